@@ -0,0 +1,62 @@
+package rehapt
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// SetDefaultBasicAuth defines the credentials of the HTTP Basic authentication sent by all the requests,
+// unless the testcase defines its own TestRequest.BasicAuth or Authorization header.
+// The variables are replaced when the request is sent, so the credentials can be created by a previous testcase.
+// It replaces the default bearer token. An empty BasicAuth removes the default credentials
+func (r *Rehapt) SetDefaultBasicAuth(auth BasicAuth) {
+	r.defaultBearerToken = ""
+	if auth == (BasicAuth{}) {
+		r.defaultBasicAuth = nil
+		return
+	}
+	r.defaultBasicAuth = &auth
+}
+
+// SetDefaultBearerToken defines the bearer token sent in the Authorization header of all the requests,
+// unless the testcase defines its own TestRequest.BearerToken, BasicAuth or Authorization header.
+// The variables are replaced when the request is sent, so "_token_" sends the token stored by a login testcase.
+// It replaces the default basic auth. An empty token removes the default credentials
+func (r *Rehapt) SetDefaultBearerToken(token string) {
+	r.defaultBasicAuth = nil
+	r.defaultBearerToken = token
+}
+
+// authorizeRequest sets the Authorization header from the credentials of the request, or the default ones
+func (r *Rehapt) authorizeRequest(request *http.Request, testRequest TestRequest) error {
+	if testRequest.BasicAuth != nil && testRequest.BearerToken != "" {
+		return fmt.Errorf("invalid testcase. Request BasicAuth and BearerToken cannot both be set")
+	}
+	basicAuth, bearerToken := r.defaultBasicAuth, r.defaultBearerToken
+	if testRequest.BasicAuth != nil {
+		basicAuth, bearerToken = testRequest.BasicAuth, ""
+	}
+	if testRequest.BearerToken != "" {
+		basicAuth, bearerToken = nil, testRequest.BearerToken
+	}
+
+	if basicAuth != nil {
+		user, err := r.replaceVars(basicAuth.User)
+		if err != nil {
+			return fmt.Errorf("error while replacing variables in basic auth user. %v", err)
+		}
+		password, err := r.replaceVars(basicAuth.Password)
+		if err != nil {
+			return fmt.Errorf("error while replacing variables in basic auth password. %v", err)
+		}
+		request.SetBasicAuth(user, password)
+	}
+	if bearerToken != "" {
+		token, err := r.replaceVars(bearerToken)
+		if err != nil {
+			return fmt.Errorf("error while replacing variables in bearer token. %v", err)
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
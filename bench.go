@@ -0,0 +1,164 @@
+package rehapt
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BenchOptions describes how a TestCase is benchmarked by Bench()
+type BenchOptions struct {
+	// N is the total number of times the testcase is executed
+	N int
+	// Concurrency is the number of testcases executed in parallel. Default is 1
+	Concurrency int
+	// Warmup is the number of times the testcase is executed before the benchmark starts.
+	// They are not measured and their responses are not checked
+	Warmup int
+}
+
+// BenchResult is the result of a benchmark.
+// The latencies are measured for each execution of the testcase, including the comparison of the response
+type BenchResult struct {
+	// N is the number of times the testcase has been executed
+	N int
+	// Errors is the number of executions which failed, because of an error or a response not matching
+	Errors int
+	// FirstError is the error of the first failed execution, nil if none failed
+	FirstError error
+	// Duration is the total duration of the benchmark
+	Duration time.Duration
+	Min      time.Duration
+	Max      time.Duration
+	Mean     time.Duration
+	P50      time.Duration
+	P95      time.Duration
+	P99      time.Duration
+}
+
+// String returns a one line summary of the result
+func (b BenchResult) String() string {
+	return fmt.Sprintf("%d requests in %v, %d errors, latency min %v mean %v p50 %v p95 %v p99 %v max %v",
+		b.N, b.Duration, b.Errors, b.Min, b.Mean, b.P50, b.P95, b.P99, b.Max)
+}
+
+// Bench executes the TestCase N times, with the given concurrency, and returns its latency percentiles.
+// Each response is still compared with the expected one, the failed executions are counted in Errors.
+// This way a functional testcase can double as a performance regression check:
+//
+//	result, err := r.Bench(testcase, BenchOptions{N: 500, Concurrency: 10})
+//	if err == nil && (result.Errors > 0 || result.P95 > 50*time.Millisecond) {
+//	    t.Errorf("%v", result)
+//	}
+//
+// Each concurrent worker uses its own Fork() of this instance, so the variables stored by
+// the testcase are not visible after the benchmark. The http.Handler must support concurrent requests.
+// An error is returned if the options are invalid or if the testcase is skipped
+func (r *Rehapt) Bench(testcase TestCase, options BenchOptions) (BenchResult, error) {
+	if options.N <= 0 {
+		return BenchResult{}, fmt.Errorf("invalid bench N %d, must be positive", options.N)
+	}
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if concurrency > options.N {
+		concurrency = options.N
+	}
+	if err := r.checkSkip(testcase); err != nil {
+		return BenchResult{}, err
+	}
+
+	r.Fork().warmup(testcase, options.Warmup)
+
+	// Each worker takes the next index until all are done
+	latencies := make([]time.Duration, options.N)
+	errs := make([]error, options.N)
+	indexes := make(chan int, options.N)
+	for i := 0; i < options.N; i++ {
+		indexes <- i
+	}
+	close(indexes)
+
+	started := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		worker := r.Fork()
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				start := time.Now()
+				errs[i] = worker.Test(testcase)
+				latencies[i] = time.Since(start)
+			}
+		}()
+	}
+	wg.Wait()
+
+	result := BenchResult{
+		N:        options.N,
+		Duration: time.Since(started),
+	}
+	for _, err := range errs {
+		if err != nil {
+			if result.FirstError == nil {
+				result.FirstError = err
+			}
+			result.Errors++
+		}
+	}
+	stats := newLatencyStats(latencies)
+	result.Min, result.Max, result.Mean = stats.Min, stats.Max, stats.Mean
+	result.P50, result.P95, result.P99 = stats.Percentile(50), stats.Percentile(95), stats.Percentile(99)
+	return result, nil
+}
+
+// latencyStats holds sorted latencies to compute their statistics
+type latencyStats struct {
+	sorted []time.Duration
+	Min    time.Duration
+	Max    time.Duration
+	Mean   time.Duration
+}
+
+// durations sorts the latencies in increasing order
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+func newLatencyStats(latencies []time.Duration) latencyStats {
+	stats := latencyStats{sorted: append([]time.Duration{}, latencies...)}
+	if len(stats.sorted) == 0 {
+		return stats
+	}
+	sort.Sort(durations(stats.sorted))
+
+	var total time.Duration
+	for _, latency := range stats.sorted {
+		total += latency
+	}
+	stats.Min = stats.sorted[0]
+	stats.Max = stats.sorted[len(stats.sorted)-1]
+	stats.Mean = total / time.Duration(len(stats.sorted))
+	return stats
+}
+
+// Percentile returns the latency below which `p` percent of the latencies are, using the nearest-rank method
+func (s latencyStats) Percentile(p float64) time.Duration {
+	if len(s.sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(s.sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(s.sorted) {
+		rank = len(s.sorted)
+	}
+	return s.sorted[rank-1]
+}
@@ -0,0 +1,42 @@
+package rehapt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"path/filepath"
+)
+
+// resolveBodyFile returns the request with the content of its BodyFile as Body, sent using RawMarshaler.
+// The variables are replaced in the content, like "_id_"
+func (r *Rehapt) resolveBodyFile(request TestRequest) (TestRequest, error) {
+	if request.BodyFile == "" {
+		return request, nil
+	}
+	if request.Body != nil {
+		return request, fmt.Errorf("invalid testcase. Request Body and BodyFile cannot both be set")
+	}
+	if request.BodyMarshaler != nil {
+		return request, fmt.Errorf("invalid testcase. Request BodyFile is sent as is, BodyMarshaler cannot be set")
+	}
+	data, err := ioutil.ReadFile(request.BodyFile)
+	if err != nil {
+		return request, fmt.Errorf("cannot read body file %v. %v", request.BodyFile, err)
+	}
+	body, err := r.replaceVars(string(data))
+	if err != nil {
+		return request, fmt.Errorf("error while replacing variables in body file %v. %v", request.BodyFile, err)
+	}
+	request.Body = body
+	request.BodyMarshaler = RawMarshaler
+	return request, nil
+}
+
+// bodyFileContentType returns the Content-Type of the BodyFile from its extension,
+// like application/json for a .json file, or an empty string if it is not known
+func bodyFileContentType(request TestRequest) string {
+	if request.BodyFile == "" {
+		return ""
+	}
+	return mime.TypeByExtension(filepath.Ext(request.BodyFile))
+}
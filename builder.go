@@ -0,0 +1,256 @@
+package rehapt
+
+import (
+	"time"
+)
+
+// TestBuilder allow to build a TestCase with chained calls, which is shorter
+// than the struct literal for small testcases. Build it with Rehapt.Get(), Rehapt.Post(), etc.
+//
+// Example:
+//
+//	r.Get("/api/user/1").
+//	    WithHeader("Authorization", "Bearer token").
+//	    ExpectCode(http.StatusOK).
+//	    ExpectBody(M{"id": "1", "name": "John"}).
+//	    Assert()
+type TestBuilder struct {
+	r        *Rehapt
+	testcase TestCase
+}
+
+// NewTest starts building a TestCase executing the given method and path.
+// The path can be a string or a ReplaceFn, as TestRequest.Path
+func (r *Rehapt) NewTest(method string, path interface{}) *TestBuilder {
+	return &TestBuilder{
+		r: r,
+		testcase: TestCase{
+			Request: TestRequest{
+				Method: method,
+				Path:   path,
+			},
+		},
+	}
+}
+
+// Get starts building a TestCase executing a GET request on the path
+func (r *Rehapt) Get(path string) *TestBuilder {
+	return r.NewTest("GET", path)
+}
+
+// Post starts building a TestCase executing a POST request on the path
+func (r *Rehapt) Post(path string) *TestBuilder {
+	return r.NewTest("POST", path)
+}
+
+// Put starts building a TestCase executing a PUT request on the path
+func (r *Rehapt) Put(path string) *TestBuilder {
+	return r.NewTest("PUT", path)
+}
+
+// Patch starts building a TestCase executing a PATCH request on the path
+func (r *Rehapt) Patch(path string) *TestBuilder {
+	return r.NewTest("PATCH", path)
+}
+
+// Delete starts building a TestCase executing a DELETE request on the path
+func (r *Rehapt) Delete(path string) *TestBuilder {
+	return r.NewTest("DELETE", path)
+}
+
+// WithHeader adds a request header
+func (b *TestBuilder) WithHeader(name string, value string) *TestBuilder {
+	if b.testcase.Request.Headers == nil {
+		b.testcase.Request.Headers = make(H)
+	}
+	b.testcase.Request.Headers[name] = append(b.testcase.Request.Headers[name], value)
+	return b
+}
+
+// WithBasicAuth defines the credentials of the HTTP Basic authentication, see TestRequest.BasicAuth
+func (b *TestBuilder) WithBasicAuth(user string, password string) *TestBuilder {
+	b.testcase.Request.BasicAuth = &BasicAuth{User: user, Password: password}
+	return b
+}
+
+// WithBearerToken defines the bearer token sent in the Authorization header, see TestRequest.BearerToken
+func (b *TestBuilder) WithBearerToken(token string) *TestBuilder {
+	b.testcase.Request.BearerToken = token
+	return b
+}
+
+// WithCookie adds a request cookie, see TestRequest.Cookies
+func (b *TestBuilder) WithCookie(name string, value string) *TestBuilder {
+	if b.testcase.Request.Cookies == nil {
+		b.testcase.Request.Cookies = make(map[string]string)
+	}
+	b.testcase.Request.Cookies[name] = value
+	return b
+}
+
+// WithBody defines the request body
+func (b *TestBuilder) WithBody(body interface{}) *TestBuilder {
+	b.testcase.Request.Body = body
+	return b
+}
+
+// WithRawBody defines the request body sent as is, see TestRequest.RawBody
+func (b *TestBuilder) WithRawBody(body interface{}) *TestBuilder {
+	b.testcase.Request.RawBody = body
+	return b
+}
+
+// WithBodyFile defines the file holding the request body, see TestRequest.BodyFile
+func (b *TestBuilder) WithBodyFile(filename string) *TestBuilder {
+	b.testcase.Request.BodyFile = filename
+	return b
+}
+
+// WithBodyMarshaler defines the function used to marshal the request body
+func (b *TestBuilder) WithBodyMarshaler(marshaler MarshalFn) *TestBuilder {
+	b.testcase.Request.BodyMarshaler = marshaler
+	return b
+}
+
+// WithTags adds tags to the testcase, see TestCase.Tags
+func (b *TestBuilder) WithTags(tags ...string) *TestBuilder {
+	b.testcase.Tags = append(b.testcase.Tags, tags...)
+	return b
+}
+
+// SkipIf defines the skip condition of the testcase, see TestCase.SkipIf
+func (b *TestBuilder) SkipIf(skip SkipFn) *TestBuilder {
+	b.testcase.SkipIf = skip
+	return b
+}
+
+// OnlyIf defines the condition to execute the testcase, see TestCase.OnlyIf
+func (b *TestBuilder) OnlyIf(condition ConditionFn) *TestBuilder {
+	b.testcase.OnlyIf = condition
+	return b
+}
+
+// Before defines the hook called before executing the request, see TestCase.Before
+func (b *TestBuilder) Before(hook HookFn) *TestBuilder {
+	b.testcase.Before = hook
+	return b
+}
+
+// After defines the hook called once the response has been checked, see TestCase.After
+func (b *TestBuilder) After(hook HookFn) *TestBuilder {
+	b.testcase.After = hook
+	return b
+}
+
+// PreCheck adds a state check executed before the request, see TestCase.PreCheck
+func (b *TestBuilder) PreCheck(checker StateChecker, expected interface{}) *TestBuilder {
+	b.testcase.PreCheck = append(b.testcase.PreCheck, StateCheck{Checker: checker, Expected: expected})
+	return b
+}
+
+// PostCheck adds a state check executed once the response has been checked, see TestCase.PostCheck
+func (b *TestBuilder) PostCheck(checker StateChecker, expected interface{}) *TestBuilder {
+	b.testcase.PostCheck = append(b.testcase.PostCheck, StateCheck{Checker: checker, Expected: expected})
+	return b
+}
+
+// ExpectOutbound adds a check of the calls made by the application, see TestCase.Outbound
+func (b *TestBuilder) ExpectOutbound(check OutboundCheck) *TestBuilder {
+	b.testcase.Outbound = append(b.testcase.Outbound, check)
+	return b
+}
+
+// ExpectEvent adds a message expected to be received by the sink, see TestCase.Events
+func (b *TestBuilder) ExpectEvent(sink EventSink, expected interface{}, within time.Duration) *TestBuilder {
+	b.testcase.Events = append(b.testcase.Events, EventCheck{Sink: sink, Expected: expected, Within: within})
+	return b
+}
+
+// ExpectCode defines the expected response code
+func (b *TestBuilder) ExpectCode(code interface{}) *TestBuilder {
+	b.testcase.Response.Code = code
+	return b
+}
+
+// ExpectProto defines the expected response protocol, see TestResponse.Proto
+func (b *TestBuilder) ExpectProto(proto interface{}) *TestBuilder {
+	b.testcase.Response.Proto = proto
+	return b
+}
+
+// ExpectHeader adds an expected response header. The other headers are ignored.
+// It replaces the headers defined by ExpectHeaders, unless they are a PartialM
+func (b *TestBuilder) ExpectHeader(name string, value interface{}) *TestBuilder {
+	headers, ok := b.testcase.Response.Headers.(PartialM)
+	if ok == false {
+		headers = PartialM{}
+	}
+	headers[name] = S{value}
+	b.testcase.Response.Headers = headers
+	return b
+}
+
+// ExpectCookie adds an expected response cookie, see TestResponse.Cookies. The other cookies are ignored
+func (b *TestBuilder) ExpectCookie(name string, cookie interface{}) *TestBuilder {
+	cookies, ok := b.testcase.Response.Cookies.(PartialM)
+	if ok == false {
+		cookies = PartialM{}
+	}
+	cookies[name] = cookie
+	b.testcase.Response.Cookies = cookies
+	return b
+}
+
+// ExpectHeaders defines all the expected response headers, see TestResponse.Headers
+func (b *TestBuilder) ExpectHeaders(headers interface{}) *TestBuilder {
+	b.testcase.Response.Headers = headers
+	return b
+}
+
+// ExpectBody defines the expected response body
+func (b *TestBuilder) ExpectBody(body interface{}) *TestBuilder {
+	b.testcase.Response.Body = body
+	return b
+}
+
+// ExpectRawBody defines the expected response body compared without decoding it, see TestResponse.RawBody
+func (b *TestBuilder) ExpectRawBody(body interface{}) *TestBuilder {
+	b.testcase.Response.RawBody = body
+	return b
+}
+
+// ExpectGolden defines the file holding the expected response body, see TestResponse.Golden
+func (b *TestBuilder) ExpectGolden(filename string) *TestBuilder {
+	b.testcase.Response.Golden = filename
+	return b
+}
+
+// WithBodyUnmarshaler defines the function used to unmarshal the response body
+func (b *TestBuilder) WithBodyUnmarshaler(unmarshaler UnmarshalFn) *TestBuilder {
+	b.testcase.Response.BodyUnmarshaler = unmarshaler
+	return b
+}
+
+// TestCase returns the built TestCase, for example to add it to a Suite
+func (b *TestBuilder) TestCase() TestCase {
+	return b.testcase
+}
+
+// Test executes the built TestCase, see Rehapt.Test
+func (b *TestBuilder) Test() error {
+	return b.r.Test(b.testcase)
+}
+
+// Assert executes the built TestCase and reports the error if not nil, see Rehapt.TestAssert
+func (b *TestBuilder) Assert() {
+	if h, ok := b.r.errorHandler.(interface{ Helper() }); ok == true {
+		h.Helper()
+	}
+	if err := b.r.Test(b.testcase); err != nil {
+		if IsSkipped(err) == true {
+			b.r.reportSkip(err)
+			return
+		}
+		b.r.reportError(err, 1)
+	}
+}
@@ -0,0 +1,145 @@
+package rehapt
+
+import (
+	"regexp"
+	"sync"
+)
+
+// Default number of entries kept by each kind of cached pattern, see SetPatternCacheSize
+const defaultPatternCacheSize = 10000
+
+// shortcutKey identifies a string scanned by one of the shortcut regexps,
+// the regexps change with SetStoreShortcutBounds and SetLoadShortcutBounds
+type shortcutKey struct {
+	re  *regexp.Regexp
+	str string
+}
+
+// patternCache keeps the compiled Regexp() patterns and the result of the shortcut scans,
+// as the same expected strings are evaluated by every testcase of a suite.
+// When a map is full it is emptied, so the cache never holds more than size entries of each kind
+type patternCache struct {
+	mutex   sync.RWMutex
+	size    int
+	regexps map[string]*regexp.Regexp
+	loads   map[shortcutKey][][]int
+	stores  map[shortcutKey]string
+}
+
+func newPatternCache(size int) *patternCache {
+	cache := &patternCache{size: size}
+	cache.clear()
+	return cache
+}
+
+// clear empties the cache, the mutex must be locked
+func (cache *patternCache) clear() {
+	cache.regexps = make(map[string]*regexp.Regexp)
+	cache.loads = make(map[shortcutKey][][]int)
+	cache.stores = make(map[shortcutKey]string)
+}
+
+// compile works like regexp.Compile but reuses the already compiled patterns
+func (cache *patternCache) compile(pattern string) (*regexp.Regexp, error) {
+	cache.mutex.RLock()
+	re, ok := cache.regexps[pattern]
+	cache.mutex.RUnlock()
+	if ok == true {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.size > 0 {
+		if len(cache.regexps) >= cache.size {
+			cache.regexps = make(map[string]*regexp.Regexp)
+		}
+		cache.regexps[pattern] = re
+	}
+	return re, nil
+}
+
+// loadMatches returns the indexes of the load shortcuts found in str, nil if there is none
+func (cache *patternCache) loadMatches(re *regexp.Regexp, str string) [][]int {
+	key := shortcutKey{re: re, str: str}
+	cache.mutex.RLock()
+	matches, ok := cache.loads[key]
+	cache.mutex.RUnlock()
+	if ok == true {
+		return matches
+	}
+
+	matches = re.FindAllStringSubmatchIndex(str, -1)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.size > 0 {
+		if len(cache.loads) >= cache.size {
+			cache.loads = make(map[shortcutKey][][]int)
+		}
+		cache.loads[key] = matches
+	}
+	return matches
+}
+
+// storeName returns the variable name if str is a store shortcut, or an empty string
+func (cache *patternCache) storeName(re *regexp.Regexp, str string) string {
+	key := shortcutKey{re: re, str: str}
+	cache.mutex.RLock()
+	name, ok := cache.stores[key]
+	cache.mutex.RUnlock()
+	if ok == true {
+		return name
+	}
+
+	// index 0 is the full match.
+	// index 1 is the first group, our variable name without the prefix and suffix
+	if elements := re.FindStringSubmatch(str); len(elements) > 1 {
+		name = elements[1]
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.size > 0 {
+		if len(cache.stores) >= cache.size {
+			cache.stores = make(map[shortcutKey]string)
+		}
+		cache.stores[key] = name
+	}
+	return name
+}
+
+// entries returns the number of cached entries
+func (cache *patternCache) entries() int {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	return len(cache.regexps) + len(cache.loads) + len(cache.stores)
+}
+
+// SetPatternCacheSize changes the number of compiled Regexp() patterns and of scanned shortcut strings
+// kept for the next testcases. The default is 10000 of each. Zero disables the cache.
+// The cache is shared with the forked instances
+func (r *Rehapt) SetPatternCacheSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	r.patterns.mutex.Lock()
+	defer r.patterns.mutex.Unlock()
+	r.patterns.size = size
+	r.patterns.clear()
+}
+
+// ClearPatternCache empties the cache of the compiled Regexp() patterns and of the scanned shortcut strings,
+// see SetPatternCacheSize
+func (r *Rehapt) ClearPatternCache() {
+	r.patterns.mutex.Lock()
+	defer r.patterns.mutex.Unlock()
+	r.patterns.clear()
+}
+
+// PatternCacheLen returns the number of entries currently held by the pattern cache, see SetPatternCacheSize
+func (r *Rehapt) PatternCacheLen() int {
+	return r.patterns.entries()
+}
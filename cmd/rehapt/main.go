@@ -0,0 +1,294 @@
+// Command rehapt runs scenario files against a running server.
+// It allows to use the rehapt scenarios outside of `go test`, for example as post-deploy smoke checks.
+//
+// Usage:
+//
+//	rehapt -url https://staging.example.com [flags] scenario.yaml [scenario.json ...]
+//
+// The variables used by the scenarios can be given with -var name=value, or through the environment:
+// each REHAPT_VAR_<name> environment variable defines the variable <name>.
+// The names only contain letters and digits, like REHAPT_VAR_apiKey, as in the scenario files.
+// They override the variables defined in the scenario files.
+//
+// Each step result is printed, and the exit code is 0 if all the steps succeeded,
+// 1 if some steps failed and 2 if the scenarios could not be run.
+// Use -junit to write a JUnit XML report, understood by most CI servers,
+// and -failures to write a JSON document per failing step, see rehapt.SetFailureExport.
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thib-ack/rehapt"
+)
+
+// Prefix of the environment variables injected as scenario variables
+const varEnvPrefix = "REHAPT_VAR_"
+
+// The variable names accepted by rehapt
+var variableNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+// Exit codes
+const (
+	exitOK     = 0
+	exitFailed = 1
+	exitError  = 2
+)
+
+// listFlag is a repeatable string flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+type options struct {
+	baseURL  string
+	tags     string
+	vars     listFlag
+	headers  listFlag
+	timeout  time.Duration
+	junit    string
+	failures string
+	files    []string
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Environ(), os.Stdout, os.Stderr))
+}
+
+// run executes the command and returns its exit code
+func run(args []string, environ []string, stdout io.Writer, stderr io.Writer) int {
+	opts := options{}
+	flags := flag.NewFlagSet("rehapt", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&opts.baseURL, "url", os.Getenv("REHAPT_URL"), "base URL of the tested server, default is $REHAPT_URL")
+	flags.StringVar(&opts.tags, "tags", os.Getenv("REHAPT_TAGS"), "comma separated tag filter, like smoke,!slow")
+	flags.Var(&opts.vars, "var", "variable `name=value`, can be repeated")
+	flags.Var(&opts.headers, "header", "default request header `'Name: value'`, can be repeated")
+	flags.DurationVar(&opts.timeout, "timeout", 30*time.Second, "timeout of each request")
+	flags.StringVar(&opts.junit, "junit", "", "write a JUnit XML report in this `file`")
+	flags.StringVar(&opts.failures, "failures", "", "write a JSON document per failing step in this `file`, one per line")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: rehapt -url URL [flags] scenario.yaml [scenario.json ...]\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	opts.files = flags.Args()
+
+	if opts.baseURL == "" || len(opts.files) == 0 {
+		flags.Usage()
+		return exitError
+	}
+
+	variables, err := parseVariables(opts.vars, environ)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return exitError
+	}
+	headers := make(http.Header)
+	for _, header := range opts.headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			fmt.Fprintf(stderr, "Error: invalid header %v, expected 'Name: value'\n", header)
+			return exitError
+		}
+		headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	handler, err := rehapt.NewRemoteHandler(opts.baseURL, &http.Client{Timeout: opts.timeout})
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return exitError
+	}
+
+	var failures io.Writer
+	if opts.failures != "" {
+		file, err := os.Create(opts.failures)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: cannot create failures file. %v\n", err)
+			return exitError
+		}
+		defer file.Close()
+		failures = file
+	}
+
+	code := exitOK
+	report := junitReport{}
+	passed, failed, skipped := 0, 0, 0
+	for _, filename := range opts.files {
+		// Each file has its own instance, so the files don't share their variables
+		r := rehapt.NewRehapt(nil, handler)
+		r.SetDefaultHeaders(headers)
+		r.SetFailureExport(failures)
+		if tags := parseTags(opts.tags); len(tags) > 0 {
+			r.SetTagFilter(tags...)
+		}
+
+		suite, err := r.LoadFile(filename)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			code = exitError
+			continue
+		}
+		// Registered after the scenario variables, so they are overridden
+		suite.BeforeAll(func(r *rehapt.Rehapt) error {
+			for _, name := range sortedKeys(variables) {
+				if err := r.SetVariable(name, variables[name]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		fmt.Fprintf(stdout, "=== %v (%v)\n", suite.Name(), filename)
+		started := time.Now()
+		results, err := suite.Execute()
+		junitSuite := junitSuite{Name: suite.Name(), Time: time.Since(started).Seconds()}
+		for _, result := range results {
+			junitCase := junitCase{Name: result.Name, ClassName: suite.Name(), Time: result.Duration.Seconds()}
+			switch {
+			case result.Err == nil:
+				passed++
+				fmt.Fprintf(stdout, "--- PASS: %v (%v)\n", result.Name, result.Duration)
+			case rehapt.IsSkipped(result.Err):
+				skipped++
+				junitSuite.Skipped++
+				junitCase.Skipped = &junitMessage{Message: result.Err.Error()}
+				fmt.Fprintf(stdout, "--- SKIP: %v\n    %v\n", result.Name, result.Err)
+			default:
+				failed++
+				junitSuite.Failures++
+				junitCase.Failure = &junitMessage{Message: "step failed", Text: result.Err.Error()}
+				fmt.Fprintf(stdout, "--- FAIL: %v (%v)\n    %v\n", result.Name, result.Duration, indent(result.Err.Error()))
+				if code == exitOK {
+					code = exitFailed
+				}
+			}
+			junitSuite.Tests++
+			junitSuite.Cases = append(junitSuite.Cases, junitCase)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			junitSuite.Errors++
+			code = exitError
+		}
+		report.Suites = append(report.Suites, junitSuite)
+	}
+
+	fmt.Fprintf(stdout, "%d passed, %d failed, %d skipped\n", passed, failed, skipped)
+
+	if opts.junit != "" {
+		if err := report.write(opts.junit); err != nil {
+			fmt.Fprintf(stderr, "Error: cannot write JUnit report. %v\n", err)
+			return exitError
+		}
+	}
+	return code
+}
+
+// parseVariables reads the variables from the environment then from the -var flags, which have priority
+func parseVariables(vars []string, environ []string) (map[string]interface{}, error) {
+	variables := make(map[string]interface{})
+	for _, env := range environ {
+		if strings.HasPrefix(env, varEnvPrefix) == false {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(env, varEnvPrefix), "=", 2)
+		if len(parts) == 2 && parts[0] != "" {
+			if variableNameRegexp.MatchString(parts[0]) == false {
+				return nil, fmt.Errorf("invalid variable name %v in environment variable %v%v, only letters and digits are allowed", parts[0], varEnvPrefix, parts[0])
+			}
+			variables[parts[0]] = parts[1]
+		}
+	}
+	for _, v := range vars {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid variable %v, expected name=value", v)
+		}
+		if variableNameRegexp.MatchString(parts[0]) == false {
+			return nil, fmt.Errorf("invalid variable name %v in -var %v, only letters and digits are allowed", parts[0], v)
+		}
+		variables[parts[0]] = parts[1]
+	}
+	return variables, nil
+}
+
+// parseTags splits the comma separated tags of the -tags flag, ignoring the spaces around them
+func parseTags(tags string) []string {
+	var parsed []string
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			parsed = append(parsed, tag)
+		}
+	}
+	return parsed
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// indent indents the lines after the first one, to align them in the output
+func indent(s string) string {
+	return strings.Replace(s, "\n", "\n    ", -1)
+}
+
+type junitReport struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     float64     `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func (report junitReport) write(filename string) error {
+	data, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append([]byte(xml.Header), append(data, '\n')...), 0644)
+}
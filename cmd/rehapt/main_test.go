@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/v1/user/john":
+			w.WriteHeader(http.StatusOK)
+			_, _ = fmt.Fprintf(w, `{"name": "John"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "rehapt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	scenario := filepath.Join(dir, "smoke.yaml")
+	content := `variables:
+  user: paul
+steps:
+  - name: get user
+    request: {method: GET, path: /user/_user_}
+    response:
+      code: 200
+      body: {name: John}
+  - name: get missing
+    request: {method: GET, path: /missing}
+    response: {code: 200}
+  - name: after missing
+    request: {method: GET, path: /user/_user_}
+    response: {code: 200, body: !any}
+`
+	if err := ioutil.WriteFile(scenario, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	junit := filepath.Join(dir, "report.xml")
+	failures := filepath.Join(dir, "failures.jsonl")
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-url", server.URL + "/v1", "-header", "Authorization: Bearer secret", "-junit", junit, "-failures", failures, scenario},
+		[]string{"REHAPT_VAR_user=john"}, &stdout, &stderr)
+	if code != exitFailed {
+		t.Errorf("Expected exit code %d, got %d. %v", exitFailed, code, stderr.String())
+	}
+	output := stdout.String()
+	for _, expected := range []string{
+		"--- PASS: get user",
+		"--- FAIL: get missing",
+		"response code does not match. Expected 200, got 404",
+		"--- SKIP: after missing\n    testcase skipped. skipped because step get missing failed",
+		"1 passed, 1 failed, 1 skipped",
+	} {
+		if strings.Contains(output, expected) == false {
+			t.Errorf("Expected output to contain '%v', got '%v'", expected, output)
+		}
+	}
+
+	report, err := ioutil.ReadFile(junit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(report), `<testsuite name="smoke" tests="3" failures="1" errors="0" skipped="1"`) == false {
+		t.Errorf("Unexpected JUnit report %v", string(report))
+	}
+
+	data, err := ioutil.ReadFile(failures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 || strings.Contains(lines[0], `"status":404`) == false {
+		t.Errorf("Unexpected failures %v", string(data))
+	}
+
+	// The -var flag overrides the environment
+	stdout.Reset()
+	code = run([]string{"-url", server.URL + "/v1", "-header", "Authorization: Bearer secret", "-var", "user=paul", scenario},
+		[]string{"REHAPT_VAR_user=john"}, &stdout, &stderr)
+	if code != exitFailed || strings.Contains(stdout.String(), "--- FAIL: get user") == false {
+		t.Errorf("Expected get user to fail, got %d. %v", code, stdout.String())
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"scenario.yaml"}, nil, &stdout, &stderr); code != exitError {
+		t.Errorf("Expected exit code %d without url, got %d", exitError, code)
+	}
+	if code := run([]string{"-url", "http://localhost", "-var", "invalid", "scenario.yaml"}, nil, &stdout, &stderr); code != exitError {
+		t.Errorf("Expected exit code %d with invalid variable, got %d", exitError, code)
+	}
+	if code := run([]string{"-url", "http://localhost", "missing.yaml"}, nil, &stdout, &stderr); code != exitError {
+		t.Errorf("Expected exit code %d with missing file, got %d", exitError, code)
+	}
+
+	// The variable names only contain letters and digits
+	stderr.Reset()
+	if code := run([]string{"-url", "http://localhost", "scenario.yaml"}, []string{"REHAPT_VAR_API_KEY=secret"}, &stdout, &stderr); code != exitError {
+		t.Errorf("Expected exit code %d with invalid variable name, got %d", exitError, code)
+	}
+	if expected := "Error: invalid variable name API_KEY in environment variable REHAPT_VAR_API_KEY, only letters and digits are allowed\n"; stderr.String() != expected {
+		t.Errorf("Expected error '%v', got '%v'", expected, stderr.String())
+	}
+	stderr.Reset()
+	if code := run([]string{"-url", "http://localhost", "-var", "api-key=secret", "scenario.yaml"}, nil, &stdout, &stderr); code != exitError {
+		t.Errorf("Expected exit code %d with invalid variable name, got %d", exitError, code)
+	}
+	if expected := "Error: invalid variable name api-key in -var api-key=secret, only letters and digits are allowed\n"; stderr.String() != expected {
+		t.Errorf("Expected error '%v', got '%v'", expected, stderr.String())
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	if tags := parseTags("smoke, api ,,"); len(tags) != 2 || tags[0] != "smoke" || tags[1] != "api" {
+		t.Errorf("Expected tags [smoke api], got %q", tags)
+	}
+	if tags := parseTags(""); len(tags) != 0 {
+		t.Errorf("Expected no tags, got %q", tags)
+	}
+}
@@ -0,0 +1,62 @@
+package rehapt
+
+import (
+	"os"
+	"regexp"
+)
+
+// ANSI escape sequences used to color the failure output
+const (
+	colorReset    = "\x1b[0m"
+	colorRed      = "\x1b[31m"
+	colorGreen    = "\x1b[32m"
+	colorBoldRed  = "\x1b[1;31m"
+	noColorEnvVar = "NO_COLOR"
+)
+
+// colorValuePattern matches a value of the error messages: an indented JSON object or array,
+// see formatValue, or a value ending at the end of line or at the ". " separating it from the next message
+const colorValuePattern = `(\[\n(?:.*\n)*?\]|\{\n(?:.*\n)*?\}|.+?)`
+
+// expectedActualRegexp matches the "Expected X, got Y" segments of the error messages
+var expectedActualRegexp = regexp.MustCompile(`(?m)([Ee]xpected) ` + colorValuePattern + `(,? (?:but )?got) ` + colorValuePattern + `(\. |$)`)
+
+// SetColorOutput enables the colors in the reported errors: the expected values are green and the actual ones red.
+// By default, the colors are enabled when the standard output is a terminal, unless the NO_COLOR
+// environment variable is set
+func (r *Rehapt) SetColorOutput(enabled bool) {
+	r.colorOutput = enabled
+}
+
+// colorOutputDetected returns true if the standard output is a terminal accepting colors
+func colorOutputDetected() bool {
+	if _, ok := os.LookupEnv(noColorEnvVar); ok == true || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// errorMessage returns the message of the error to report, colored if enabled
+func (r *Rehapt) errorMessage(err error) string {
+	if r.colorOutput == false {
+		return err.Error()
+	}
+	return colorizeMessage(err.Error())
+}
+
+// colorizeMessage colors the expected and actual values of each line of the message
+func colorizeMessage(message string) string {
+	return expectedActualRegexp.ReplaceAllString(message, "$1 "+colorGreen+"$2"+colorReset+"$3 "+colorRed+"$4"+colorReset+"$5")
+}
+
+// colorLabel colors the "Error:" label of the reported errors, if enabled
+func (r *Rehapt) colorLabel(label string) string {
+	if r.colorOutput == false {
+		return label
+	}
+	return colorBoldRed + label + colorReset
+}
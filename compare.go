@@ -1,161 +1,268 @@
 package rehapt
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
+	"time"
 )
 
 func (r *Rehapt) unsortedSliceCompare(ctx compareCtx) error {
 	if ctx.ActualKind != reflect.Slice {
-		return fmt.Errorf("different kinds. Expected slice, got %v", ctx.ActualKind)
+		return newMismatch(MismatchType, ctx.Expected, ctx.Actual, "different kinds. Expected slice, got %v%v", ctx.ActualKind, shapeHint(ctx.ActualValue))
 	}
 
 	expectedLen := ctx.ExpectedValue.Len()
 	actualLen := ctx.ActualValue.Len()
 	if expectedLen != actualLen {
-		return fmt.Errorf("different slice sizes. Expected %v, got %v. Expected %v got %v", expectedLen, actualLen, ctx.Expected, ctx.Actual)
+		return newMismatch(MismatchSize, ctx.Expected, ctx.Actual, "different slice sizes. Expected %v, got %v. Expected %v got %v", expectedLen, actualLen, r.formatValue(ctx.Expected), r.formatValue(ctx.Actual))
 	}
 
 	// Unordered comparison
-	// We build a list of all the indexes (0,1,2,...,N-1)
-	// So each time we find a matching element, we can remove its index from this list
+	// Each time we find a matching element, we mark its index as used
 	// and ignore it on next search
-	actualIndexes := make([]int, actualLen)
-	for i := range actualIndexes {
-		actualIndexes[i] = i
-	}
+	used := make([]bool, actualLen)
+	index := newUnsortedIndex(r, ctx.ActualValue)
 
-	var errs []string
+	var lines []mismatchLine
+	var mismatches []Mismatch
 
 nextExpected:
 	for i := 0; i < expectedLen; i++ {
+		if r.maxErrorsReached() == true {
+			break
+		}
 		expectedElement := ctx.ExpectedValue.Index(i)
 
+		// Only the candidates can match, they are compared first
+		candidates, indexed := index.candidates(expectedElement.Interface())
+		if indexed == true {
+			for _, idx := range candidates {
+				if used[idx] == true {
+					continue
+				}
+				if r.tryCompare(expectedElement.Interface(), ctx.ActualValue.Index(idx).Interface()) == nil {
+					used[idx] = true
+					continue nextExpected
+				}
+			}
+		}
+
 		// Now find a matching element in actual object.
 		// Once found, ignore the index.
-		for j := 0; j < len(actualIndexes); j++ {
-			idx := actualIndexes[j]
+		// Otherwise keep the closest element, the one with the fewest mismatches.
+		// For an indexed element, there is no match left and only the closest element is searched
+		closestIdx := -1
+		var closestErr *MismatchError
+		for idx := 0; idx < actualLen; idx++ {
+			if used[idx] == true {
+				continue
+			}
 			actualElement := ctx.ActualValue.Index(idx)
 
-			if err := r.compare(expectedElement.Interface(), actualElement.Interface()); err == nil {
+			err := r.tryCompare(expectedElement.Interface(), actualElement.Interface())
+			if err == nil {
 				// That's a match, ignore this index now, and continue to next expected.
-				actualIndexes = append(actualIndexes[:j], actualIndexes[j+1:]...)
+				used[idx] = true
 				continue nextExpected
 			}
+			if closestErr == nil || len(err.(*MismatchError).Mismatches) < len(closestErr.Mismatches) {
+				closestIdx = idx
+				closestErr = err.(*MismatchError)
+			}
 		}
 
 		// If we arrive here, we have an expected not matching any actual
-		errs = append(errs, fmt.Sprintf("expected element %v at index %v not found", expectedElement, i))
+		message := fmt.Sprintf("expected element %v at index %v not found", r.formatValue(expectedElement.Interface()), i)
+		// The differences with the closest element are only meaningful for the objects and arrays
+		kind := reflect.ValueOf(expectedElement.Interface()).Kind()
+		if closestErr != nil && (kind == reflect.Map || kind == reflect.Slice) {
+			lines = append(lines, mismatchLine{text: fmt.Sprintf("%v, the closest actual element is at index %d", message, closestIdx)})
+			lines = append(lines, linesAt(fmt.Sprintf("[%d]", closestIdx), closestErr)...)
+		} else {
+			lines = append(lines, mismatchLine{text: message})
+		}
+		mismatches = append(mismatches, Mismatch{Path: fmt.Sprintf("[%d]", i), Expected: expectedElement.Interface(), Kind: MismatchMissing, Message: message})
+		r.mismatchCount++
 	}
 
-	// If here we still have actual index, it means unmatched element
-	if len(actualIndexes) > 0 {
-		errs = append(errs, fmt.Sprintf("actual elements at indexes %v not found", actualIndexes))
+	// If here we still have actual index, it means unmatched element.
+	// Unless the comparison stopped, leaving unmatched elements
+	var actualIndexes []int
+	for idx := range used {
+		if used[idx] == false {
+			actualIndexes = append(actualIndexes, idx)
+		}
+	}
+	if len(actualIndexes) > 0 && r.maxErrorsReached() == false {
+		message := fmt.Sprintf("actual elements at indexes %v not found", actualIndexes)
+		lines = append(lines, mismatchLine{text: message})
+		for _, idx := range actualIndexes {
+			mismatches = append(mismatches, Mismatch{Path: fmt.Sprintf("[%d]", idx), Actual: ctx.ActualValue.Index(idx).Interface(), Kind: MismatchUnexpected, Message: message})
+			r.mismatchCount++
+		}
 	}
 
-	if len(errs) > 0 {
-		return errors.New(strings.Join(errs, "\n"))
+	if len(lines) > 0 {
+		return newMismatches(mismatches, lines)
 	}
 	return nil
 }
 
+// defaultSliceCompare compares the slices which are neither UnsortedS nor SortedS, depending on the default slice ordering
+func (r *Rehapt) defaultSliceCompare(ctx compareCtx) error {
+	if r.sliceOrdering == SliceUnordered {
+		return r.unsortedSliceCompare(ctx)
+	}
+	return r.sliceCompare(ctx)
+}
+
 func (r *Rehapt) sliceCompare(ctx compareCtx) error {
 	if ctx.ActualKind != reflect.Slice {
-		return fmt.Errorf("different kinds. Expected slice, got %v", ctx.ActualKind)
+		return newMismatch(MismatchType, ctx.Expected, ctx.Actual, "different kinds. Expected slice, got %v%v", ctx.ActualKind, shapeHint(ctx.ActualValue))
 	}
 
 	expectedLen := ctx.ExpectedValue.Len()
 	actualLen := ctx.ActualValue.Len()
 	if expectedLen != actualLen {
-		return fmt.Errorf("different slice sizes. Expected %d, got %d. Expected %v got %v", expectedLen, actualLen, ctx.Expected, ctx.Actual)
+		return newMismatch(MismatchSize, ctx.Expected, ctx.Actual, "different slice sizes. Expected %d, got %d. Expected %v got %v", expectedLen, actualLen, r.formatValue(ctx.Expected), r.formatValue(ctx.Actual))
 	}
 
-	var errs []string
-
 	// ordered comparison
-	for i := 0; i < expectedLen; i++ {
-		expectedElement := ctx.ExpectedValue.Index(i)
-		actualElement := ctx.ActualValue.Index(i)
-		if err := r.compare(expectedElement.Interface(), actualElement.Interface()); err != nil {
-			errs = append(errs, fmt.Sprintf("slice element %v does not match. %v", i, err))
+	// The decoded JSON arrays are indexed without reflection
+	expectedElements, expectedOk := interfaceSlice(ctx.Expected)
+	actualElements, actualOk := interfaceSlice(ctx.Actual)
+	lines, mismatches := r.compareElements(expectedLen, func(r *Rehapt, i int) ([]mismatchLine, []Mismatch) {
+		var expectedElement, actualElement interface{}
+		if expectedOk == true && actualOk == true {
+			expectedElement, actualElement = expectedElements[i], actualElements[i]
+		} else {
+			expectedElement, actualElement = ctx.ExpectedValue.Index(i).Interface(), ctx.ActualValue.Index(i).Interface()
 		}
-	}
+		if err := r.compare(expectedElement, actualElement); err != nil {
+			segment := fmt.Sprintf("[%d]", i)
+			return linesAt(segment, err.(*MismatchError)), mismatchesAt(segment, err.(*MismatchError))
+		}
+		return nil, nil
+	})
 
-	if len(errs) > 0 {
-		return errors.New(strings.Join(errs, "\n"))
+	if len(lines) > 0 {
+		return newMismatches(mismatches, lines)
 	}
 	return nil
 }
 
+// rawMessageCompare decodes the expected JSON, so the fixtures kept as raw JSON can be used as expected values.
+// The decoded values are compared as usual, the shortcuts like "$id$" still work
+func (r *Rehapt) rawMessageCompare(ctx compareCtx) error {
+	var expected interface{}
+	if err := json.Unmarshal(ctx.Expected.(json.RawMessage), &expected); err != nil {
+		return fmt.Errorf("invalid expected json.RawMessage. %v", err)
+	}
+	return r.compare(expected, ctx.Actual)
+}
+
 func (r *Rehapt) partialMapCompare(ctx compareCtx) error {
 	if ctx.ActualKind != reflect.Map {
-		return fmt.Errorf("different kinds. Expected map, got %v", ctx.ActualKind)
+		return newMismatch(MismatchType, ctx.Expected, ctx.Actual, "different kinds. Expected map, got %v%v", ctx.ActualKind, shapeHint(ctx.ActualValue))
 	}
 
 	// Key types have to be the same
 	if ctx.ExpectedType.Key() != ctx.ActualType.Key() {
-		return fmt.Errorf("different map key types. Expected %v, got %v", ctx.ExpectedType.Key(), ctx.ActualType.Key())
+		return newMismatch(MismatchType, ctx.Expected, ctx.Actual, "different map key types. Expected %v, got %v", ctx.ExpectedType.Key(), ctx.ActualType.Key())
 	}
 
-	var errs []string
-
 	// Partial match. Ignore the keys not listed in expected map
 	// to do this we just have to skip the map size comparison
-	keys := ctx.ExpectedValue.MapKeys()
-	for _, key := range keys {
-		expectedElement := ctx.ExpectedValue.MapIndex(key)
-		actualElement := ctx.ActualValue.MapIndex(key)
-
-		if actualElement.IsValid() == false {
-			errs = append(errs, fmt.Sprintf("expected key %v not found", key))
-			continue
+	keys := sortedMapKeys(ctx.ExpectedValue)
+	lines, mismatches := r.compareElements(len(keys), func(r *Rehapt, i int) ([]mismatchLine, []Mismatch) {
+		key := keys[i]
+		expectedElement, actualElement, found := mapEntry(ctx, key)
+
+		if found == false {
+			if isAbsent(expectedElement) == true {
+				return nil, nil
+			}
+			message := fmt.Sprintf("expected key %v not found%v", key, keySuggestion(key, ctx.ActualValue))
+			r.mismatchCount++
+			return []mismatchLine{{text: message}},
+				[]Mismatch{{Path: fmt.Sprint(key), Expected: expectedElement, Kind: MismatchMissing, Message: message}}
 		}
 
-		if err := r.compare(expectedElement.Interface(), actualElement.Interface()); err != nil {
-			errs = append(errs, fmt.Sprintf("map element [%v] does not match. %v", key, err))
+		if err := r.compare(expectedElement, actualElement); err != nil {
+			return linesAt(fmt.Sprint(key), err.(*MismatchError)), mismatchesAt(fmt.Sprint(key), err.(*MismatchError))
 		}
-	}
+		return nil, nil
+	})
 
-	if len(errs) > 0 {
-		return errors.New(strings.Join(errs, "\n"))
+	if len(lines) > 0 {
+		return newMismatches(mismatches, lines)
 	}
 	return nil
 }
 
+// defaultMapCompare compares the maps which are neither PartialM nor ExactM, depending on the default map mode
+func (r *Rehapt) defaultMapCompare(ctx compareCtx) error {
+	if r.mapMode == MapModePartial {
+		return r.partialMapCompare(ctx)
+	}
+	return r.mapCompare(ctx)
+}
+
 func (r *Rehapt) mapCompare(ctx compareCtx) error {
 	if ctx.ActualKind != reflect.Map {
-		return fmt.Errorf("different kinds. Expected map, got %v", ctx.ActualKind)
+		return newMismatch(MismatchType, ctx.Expected, ctx.Actual, "different kinds. Expected map, got %v%v", ctx.ActualKind, shapeHint(ctx.ActualValue))
 	}
 
 	// Key types have to be the same
 	if ctx.ExpectedType.Key() != ctx.ActualType.Key() {
-		return fmt.Errorf("different map key types. Expected %v, got %v", ctx.ExpectedType.Key(), ctx.ActualType.Key())
+		return newMismatch(MismatchType, ctx.Expected, ctx.Actual, "different map key types. Expected %v, got %v", ctx.ExpectedType.Key(), ctx.ActualType.Key())
 	}
 
-	if ctx.ExpectedValue.Len() != ctx.ActualValue.Len() {
-		return fmt.Errorf("different map sizes. Expected %d, got %d. Expected %v got %v", ctx.ExpectedValue.Len(), ctx.ActualValue.Len(), ctx.Expected, ctx.Actual)
+	// The keys expected to be absent are not part of the expected size
+	expectedLen := ctx.ExpectedValue.Len()
+	if expectedMap, ok := interfaceMap(ctx.Expected); ok == true {
+		for _, value := range expectedMap {
+			if isAbsent(value) == true {
+				expectedLen--
+			}
+		}
+	} else {
+		for _, key := range ctx.ExpectedValue.MapKeys() {
+			if isAbsent(ctx.ExpectedValue.MapIndex(key).Interface()) == true {
+				expectedLen--
+			}
+		}
+	}
+	if expectedLen != ctx.ActualValue.Len() {
+		return newMismatch(MismatchSize, ctx.Expected, ctx.Actual, "different map sizes. Expected %d, got %d. Expected %v got %v", expectedLen, ctx.ActualValue.Len(), r.formatValue(ctx.Expected), r.formatValue(ctx.Actual))
 	}
 
-	var errs []string
-	keys := ctx.ExpectedValue.MapKeys()
-	for _, key := range keys {
-		expectedElement := ctx.ExpectedValue.MapIndex(key)
-		actualElement := ctx.ActualValue.MapIndex(key)
+	keys := sortedMapKeys(ctx.ExpectedValue)
+	lines, mismatches := r.compareElements(len(keys), func(r *Rehapt, i int) ([]mismatchLine, []Mismatch) {
+		key := keys[i]
+		expectedElement, actualElement, found := mapEntry(ctx, key)
 
-		if actualElement.IsValid() == false {
-			errs = append(errs, fmt.Sprintf("expected key %v not found in actual %v", key, ctx.Actual))
-			continue
+		if found == false {
+			if isAbsent(expectedElement) == true {
+				return nil, nil
+			}
+			message := fmt.Sprintf("expected key %v not found in actual %v%v", key, r.formatValue(ctx.Actual), keySuggestion(key, ctx.ActualValue))
+			r.mismatchCount++
+			return []mismatchLine{{text: message}},
+				[]Mismatch{{Path: fmt.Sprint(key), Expected: expectedElement, Kind: MismatchMissing, Message: message}}
 		}
 
-		if err := r.compare(expectedElement.Interface(), actualElement.Interface()); err != nil {
-			errs = append(errs, fmt.Sprintf("map element [%v] does not match. %v", key, err))
+		if err := r.compare(expectedElement, actualElement); err != nil {
+			return linesAt(fmt.Sprint(key), err.(*MismatchError)), mismatchesAt(fmt.Sprint(key), err.(*MismatchError))
 		}
-	}
+		return nil, nil
+	})
 
-	if len(errs) > 0 {
-		return errors.New(strings.Join(errs, "\n"))
+	if len(lines) > 0 {
+		return newMismatches(mismatches, lines)
 	}
 	return nil
 }
@@ -165,34 +272,55 @@ func (r *Rehapt) stringCompare(ctx compareCtx) error {
 
 	// This might be a StoreVar shortcut
 	// even if actual value is not a string
-	if r.storeIfVariable(expectedStr, ctx.Actual) == true {
+	if r.noShortcuts == false && r.storeIfVariable(expectedStr, ctx.Actual) == true {
 		// This was a variable store operation. no comparison to do
 		return nil
 	}
 
 	if ctx.ActualKind != reflect.String {
-		return fmt.Errorf("different kinds. Expected string, got %v", ctx.ActualKind)
+		return newMismatch(MismatchType, ctx.Expected, ctx.Actual, "different kinds. Expected string, got %v", ctx.ActualKind)
 	}
 
 	actualStr := ctx.ActualValue.String()
 
 	// Make variable replacement
-	var err error
-	expectedStr, err = r.replaceVars(expectedStr)
-	if err != nil {
-		return err
+	if r.noShortcuts == false {
+		var err error
+		expectedStr, err = r.replaceVars(expectedStr)
+		if err != nil {
+			return err
+		}
 	}
 
 	// classic comparison
 	if expectedStr != actualStr {
-		return fmt.Errorf("strings does not match. Expected '%v', got '%v'", expectedStr, actualStr)
+		return newMismatch(MismatchValue, ctx.Expected, ctx.Actual, "strings does not match. Expected '%v', got '%v'", expectedStr, actualStr)
+	}
+	return nil
+}
+
+// timeCompare parses the actual string with the default time format, see SetDefaultTimeDeltaFormat,
+// and expects exactly the same instant. Use TimeDelta() to allow a difference
+func (r *Rehapt) timeCompare(ctx compareCtx) error {
+	if ctx.ActualKind != reflect.String {
+		return newMismatch(MismatchType, ctx.Expected, ctx.Actual, "different kinds. Expected string, got %v", ctx.ActualKind)
+	}
+
+	expectedTime := ctx.Expected.(time.Time)
+	actualTime, err := time.Parse(r.defaultTimeDeltaFormat, ctx.ActualValue.String())
+	if err != nil {
+		return fmt.Errorf("invalid time. %v", err)
+	}
+	if expectedTime.Equal(actualTime) == false {
+		return newMismatch(MismatchValue, ctx.Expected, ctx.Actual, "times does not match. Expected '%v', got '%v'",
+			expectedTime.Format(r.defaultTimeDeltaFormat), actualTime.Format(r.defaultTimeDeltaFormat))
 	}
 	return nil
 }
 
 func (r *Rehapt) boolCompare(ctx compareCtx) error {
 	if ctx.ActualKind != reflect.Bool {
-		return fmt.Errorf("different kinds. Expected bool, got %v", ctx.ActualKind)
+		return newMismatch(MismatchType, ctx.Expected, ctx.Actual, "different kinds. Expected bool, got %v", ctx.ActualKind)
 	}
 
 	expectedBool := ctx.ExpectedValue.Bool()
@@ -200,7 +328,7 @@ func (r *Rehapt) boolCompare(ctx compareCtx) error {
 
 	// classic comparison
 	if expectedBool != actualBool {
-		return fmt.Errorf("bools does not match. Expected %v, got %v", expectedBool, actualBool)
+		return newMismatch(MismatchValue, ctx.Expected, ctx.Actual, "bools does not match. Expected %v, got %v", expectedBool, actualBool)
 	}
 	return nil
 }
@@ -213,22 +341,22 @@ func (r *Rehapt) intCompare(ctx compareCtx) error {
 		actualInt := ctx.ActualValue.Int()
 		// classic comparison
 		if expectedInt != actualInt {
-			return fmt.Errorf("integers does not match. Expected %v, got %v", expectedInt, actualInt)
+			return newMismatch(MismatchValue, ctx.Expected, ctx.Actual, "integers does not match. Expected %v, got %v", expectedInt, actualInt)
 		}
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		actualInt := ctx.ActualValue.Uint()
 		// classic comparison
 		if uint64(expectedInt) != actualInt {
-			return fmt.Errorf("uintegers does not match. Expected %v, got %v", expectedInt, actualInt)
+			return newMismatch(MismatchValue, ctx.Expected, ctx.Actual, "uintegers does not match. Expected %v, got %v", expectedInt, actualInt)
 		}
 	case reflect.Float32, reflect.Float64:
 		actualFloat := ctx.ActualValue.Float()
 		// classic comparison
 		if float64(expectedInt) != actualFloat {
-			return fmt.Errorf("floats does not match. Expected %v, got %v", expectedInt, actualFloat)
+			return newMismatch(MismatchValue, ctx.Expected, ctx.Actual, "floats does not match. Expected %v, got %v", expectedInt, actualFloat)
 		}
 	default:
-		return fmt.Errorf("different kinds. Expected int{8,16,32,64}, uint{8,16,32,64} or float{32,64}, got %v", ctx.ActualKind)
+		return newMismatch(MismatchType, ctx.Expected, ctx.Actual, "different kinds. Expected int{8,16,32,64}, uint{8,16,32,64} or float{32,64}, got %v", ctx.ActualKind)
 	}
 
 	return nil
@@ -242,22 +370,22 @@ func (r *Rehapt) uintCompare(ctx compareCtx) error {
 		actualInt := ctx.ActualValue.Int()
 		// classic comparison
 		if int64(expectedInt) != actualInt {
-			return fmt.Errorf("integers does not match. Expected %v, got %v", expectedInt, actualInt)
+			return newMismatch(MismatchValue, ctx.Expected, ctx.Actual, "integers does not match. Expected %v, got %v", expectedInt, actualInt)
 		}
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		actualInt := ctx.ActualValue.Uint()
 		// classic comparison
 		if expectedInt != actualInt {
-			return fmt.Errorf("uintegers does not match. Expected %v, got %v", expectedInt, actualInt)
+			return newMismatch(MismatchValue, ctx.Expected, ctx.Actual, "uintegers does not match. Expected %v, got %v", expectedInt, actualInt)
 		}
 	case reflect.Float32, reflect.Float64:
 		actualFloat := ctx.ActualValue.Float()
 		// classic comparison
 		if float64(expectedInt) != actualFloat {
-			return fmt.Errorf("floats does not match. Expected %v, got %v", expectedInt, actualFloat)
+			return newMismatch(MismatchValue, ctx.Expected, ctx.Actual, "floats does not match. Expected %v, got %v", expectedInt, actualFloat)
 		}
 	default:
-		return fmt.Errorf("different kinds. Expected int{8,16,32,64}, uint{8,16,32,64} or float{32,64}, got %v", ctx.ActualKind)
+		return newMismatch(MismatchType, ctx.Expected, ctx.Actual, "different kinds. Expected int{8,16,32,64}, uint{8,16,32,64} or float{32,64}, got %v", ctx.ActualKind)
 	}
 
 	return nil
@@ -271,23 +399,100 @@ func (r *Rehapt) floatCompare(ctx compareCtx) error {
 		actualInt := ctx.ActualValue.Int()
 		// classic comparison
 		if int64(expectedFloat) != actualInt {
-			return fmt.Errorf("integers does not match. Expected %v, got %v", expectedFloat, actualInt)
+			return newMismatch(MismatchValue, ctx.Expected, ctx.Actual, "integers does not match. Expected %v, got %v", expectedFloat, actualInt)
 		}
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		actualInt := ctx.ActualValue.Uint()
 		// classic comparison
 		if uint64(expectedFloat) != actualInt {
-			return fmt.Errorf("uintegers does not match. Expected %v, got %v", expectedFloat, actualInt)
+			return newMismatch(MismatchValue, ctx.Expected, ctx.Actual, "uintegers does not match. Expected %v, got %v", expectedFloat, actualInt)
 		}
 	case reflect.Float32, reflect.Float64:
 		actualFloat := ctx.ActualValue.Float()
 		// classic comparison
 		if expectedFloat != actualFloat {
-			return fmt.Errorf("floats does not match. Expected %v, got %v", expectedFloat, actualFloat)
+			return newMismatch(MismatchValue, ctx.Expected, ctx.Actual, "floats does not match. Expected %v, got %v", expectedFloat, actualFloat)
 		}
 	default:
-		return fmt.Errorf("different kinds. Expected int{8,16,32,64}, uint{8,16,32,64} or float{32,64}, got %v", ctx.ActualKind)
+		return newMismatch(MismatchType, ctx.Expected, ctx.Actual, "different kinds. Expected int{8,16,32,64}, uint{8,16,32,64} or float{32,64}, got %v", ctx.ActualKind)
 	}
 
 	return nil
 }
+
+// sortedMapKeys returns the keys of the map sorted by their string value, so the errors are reported in a stable order
+func sortedMapKeys(m reflect.Value) []reflect.Value {
+	keys := mapKeys(m.MapKeys())
+	sort.Sort(keys)
+	return keys
+}
+
+// mapKeys sorts the map keys by their string value
+type mapKeys []reflect.Value
+
+func (k mapKeys) Len() int { return len(k) }
+func (k mapKeys) Less(i, j int) bool {
+	if k[i].Kind() == reflect.String && k[j].Kind() == reflect.String {
+		return k[i].String() < k[j].String()
+	}
+	return fmt.Sprint(k[i].Interface()) < fmt.Sprint(k[j].Interface())
+}
+func (k mapKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+
+// keySuggestion suggests the actual key closest to a missing expected key, as most of them
+// are naming convention mismatches like user_id instead of userId, or typos
+func keySuggestion(key reflect.Value, actual reflect.Value) string {
+	if key.Kind() != reflect.String {
+		return ""
+	}
+	expected := normalizeKey(key.String())
+	best := ""
+	bestDistance := len(expected)/4 + 1
+	for _, actualKey := range sortedMapKeys(actual) {
+		if actualKey.Kind() != reflect.String {
+			continue
+		}
+		if distance := levenshtein(expected, normalizeKey(actualKey.String())); distance < bestDistance {
+			best = actualKey.String()
+			bestDistance = distance
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(". Did you mean %v?", best)
+}
+
+// normalizeKey ignores the case and the separators, so userId, user_id and UserID are the same key
+func normalizeKey(key string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(key))
+}
+
+// levenshtein returns the number of single character edits needed to change a into b
+func levenshtein(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, minInt(current[j-1]+1, previous[j-1]+cost))
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
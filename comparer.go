@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"math"
 	"reflect"
-	"regexp"
 	"strings"
 	"time"
 )
@@ -16,6 +15,36 @@ func NoReplacement(s string) ReplaceFn {
 	}
 }
 
+// SkipUnlessVar skips the TestCase unless the variable is defined with a value
+// different from nil, false and the empty string.
+// It is meant to be used as TestCase.SkipIf, for example with feature flags
+func SkipUnlessVar(name string) SkipFn {
+	return func(r *Rehapt) (bool, string) {
+		value, ok := r.lookupVar(name)
+		if ok == false || value == nil || value == false || value == "" {
+			return true, fmt.Sprintf("variable %v is not set", name)
+		}
+		return false, ""
+	}
+}
+
+// VarEquals executes the TestCase only if the variable is defined and matches the expected value.
+// The expected value can be any expectation, like a simple value or Regexp().
+// It is meant to be used as TestCase.OnlyIf, for example with a value stored by a previous step
+// to run the steps matching the server behavior
+func VarEquals(name string, expected interface{}) ConditionFn {
+	return func(r *Rehapt) (bool, string) {
+		value, ok := r.lookupVar(name)
+		if ok == false {
+			return false, fmt.Sprintf("variable %v is not defined", name)
+		}
+		if err := r.tryCompare(expected, value); err != nil {
+			return false, fmt.Sprintf("variable %v does not match. %v", name, err)
+		}
+		return true, ""
+	}
+}
+
 func TimeDeltaLayout(t time.Time, delta time.Duration, layout string) CompareFn {
 	return func(r *Rehapt, ctx compareCtx) error {
 		// TimeDelta can only compare with actual string values
@@ -90,18 +119,17 @@ func Regexp(regex string) CompareFn {
 		actualStr := ctx.ActualValue.String()
 
 		// Make variable replacement
-		var err error
-		regex, err = r.replaceVars(regex)
+		pattern, err := r.replaceVars(regex)
 		if err != nil {
 			return err
 		}
 
-		re, err := regexp.Compile(regex)
+		re, err := r.patterns.compile(pattern)
 		if err != nil {
 			return err
 		}
 		if re.MatchString(actualStr) == false {
-			return fmt.Errorf("regexp '%v' does not match '%v'", regex, actualStr)
+			return fmt.Errorf("regexp '%v' does not match '%v'", pattern, actualStr)
 		}
 		return nil
 	}
@@ -125,7 +153,7 @@ func RegexpVars(regex string, vars map[int]string) CompareFn {
 
 		actualStr := ctx.ActualValue.String()
 
-		re, err := regexp.Compile(regex)
+		re, err := r.patterns.compile(regex)
 		if err != nil {
 			return err
 		}
@@ -166,6 +194,21 @@ func LoadVar(name string) CompareFn {
 	}
 }
 
+// Literal expects exactly the given string: the "$store$" and "_load_" shortcuts are not interpreted,
+// for the responses legitimately containing dollar or underscore wrapped tokens.
+// See TestResponse.NoShortcuts to disable them for the whole response
+func Literal(str string) CompareFn {
+	return func(r *Rehapt, ctx compareCtx) error {
+		if ctx.ActualKind != reflect.String {
+			return fmt.Errorf("different kinds. Expected string, got %v", ctx.ActualKind)
+		}
+		if actualStr := ctx.ActualValue.String(); actualStr != str {
+			return newMismatch(MismatchValue, str, ctx.Actual, "strings does not match. Expected '%v', got '%v'", str, actualStr)
+		}
+		return nil
+	}
+}
+
 // Any allow you to ignore completely the value
 func Any() CompareFn {
 	return func(r *Rehapt, ctx compareCtx) error {
@@ -189,7 +232,7 @@ func Or(cmp ...interface{}) CompareFn {
 	return func(r *Rehapt, ctx compareCtx) error {
 		errs := []string{}
 		for _, comparer := range cmp {
-			err := r.compare(comparer, ctx.Actual)
+			err := r.tryCompare(comparer, ctx.Actual)
 			if err != nil {
 				errs = append(errs, err.Error())
 			}
@@ -207,10 +250,83 @@ func Or(cmp ...interface{}) CompareFn {
 func Not(value interface{}) CompareFn {
 	return func(r *Rehapt, ctx compareCtx) error {
 		// Normal comparison, but error means ok and no error means error
-		err := r.compare(value, ctx.Actual)
+		err := r.tryCompare(value, ctx.Actual)
 		if err == nil {
-			return fmt.Errorf("expected not %v, got %v", value, ctx.Actual)
+			return fmt.Errorf("expected not %v, got %v", r.formatValue(value), r.formatValue(ctx.Actual))
 		}
 		return nil
 	}
 }
+
+// absentMatcher is the Matcher returned by Absent()
+type absentMatcher struct{}
+
+// Absent expects the map key to be missing. A key present with a null value does not match,
+// use Null() to expect it. In a M or ExactM, the absent keys are not counted in the expected size
+func Absent() Matcher {
+	return absentMatcher{}
+}
+
+// Match is only called when the key is present, which is a mismatch
+func (absentMatcher) Match(r *Rehapt, actual interface{}) error {
+	return newMismatch(MismatchPresent, nil, actual, "expected key to be absent, got %v", r.formatValue(actual))
+}
+
+// isAbsent returns true if the expected value is Absent()
+func isAbsent(expected interface{}) bool {
+	_, ok := expected.(absentMatcher)
+	return ok
+}
+
+// ignoreBodyMatcher is the Matcher returned by IgnoreBody()
+type ignoreBodyMatcher struct{}
+
+// IgnoreBody accepts any response body. Used as the TestResponse.Body, the body is not even decoded,
+// so the smoke tests of large responses only pay for the status and headers check.
+// Unlike Any(), which still fails if the body cannot be decoded, an invalid body is accepted.
+// The body is still decoded when it is needed elsewhere, like for a golden file, a custom BodyUnmarshaler,
+// the last response variables or the CSRF token
+func IgnoreBody() Matcher {
+	return ignoreBodyMatcher{}
+}
+
+func (ignoreBodyMatcher) Match(r *Rehapt, actual interface{}) error {
+	return nil
+}
+
+// isBodyIgnored returns true if the expected body is IgnoreBody()
+func isBodyIgnored(expected interface{}) bool {
+	_, ok := expected.(ignoreBodyMatcher)
+	return ok
+}
+
+// nullMatcher is the Matcher returned by Null()
+type nullMatcher struct{}
+
+// Null expects a null value. It works like nil, but tells explicitly that
+// the map key must be present with a null value, not absent
+func Null() Matcher {
+	return nullMatcher{}
+}
+
+func (nullMatcher) Match(r *Rehapt, actual interface{}) error {
+	if actual != nil {
+		return newMismatch(MismatchNil, nil, actual, "expected null but got %v", r.formatValue(actual))
+	}
+	return nil
+}
+
+// notNullMatcher is the Matcher returned by NotNull()
+type notNullMatcher struct{}
+
+// NotNull expects any value except null, so the map key must be present with a value
+func NotNull() Matcher {
+	return notNullMatcher{}
+}
+
+func (notNullMatcher) Match(r *Rehapt, actual interface{}) error {
+	if actual == nil {
+		return newMismatch(MismatchNil, nil, actual, "expected a value but got null")
+	}
+	return nil
+}
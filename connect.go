@@ -0,0 +1,200 @@
+package rehapt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// connectErrorStatus maps the Connect error codes to their HTTP status, as defined by the Connect protocol
+var connectErrorStatus = map[string]int{
+	"canceled":            499,
+	"unknown":             http.StatusInternalServerError,
+	"invalid_argument":    http.StatusBadRequest,
+	"deadline_exceeded":   http.StatusGatewayTimeout,
+	"not_found":           http.StatusNotFound,
+	"already_exists":      http.StatusConflict,
+	"permission_denied":   http.StatusForbidden,
+	"resource_exhausted":  http.StatusTooManyRequests,
+	"failed_precondition": http.StatusBadRequest,
+	"aborted":             http.StatusConflict,
+	"out_of_range":        http.StatusBadRequest,
+	"unimplemented":       http.StatusNotImplemented,
+	"internal":            http.StatusInternalServerError,
+	"unavailable":         http.StatusServiceUnavailable,
+	"data_loss":           http.StatusInternalServerError,
+	"unauthenticated":     http.StatusUnauthorized,
+}
+
+// ConnectRequest returns the request of a Connect protocol unary call with the JSON codec.
+// The procedure is like "acme.user.v1.UserService/GetUser"
+//
+// Example:
+//
+//	r.TestAssert(TestCase{
+//	    Request:  ConnectRequest("acme.user.v1.UserService/GetUser", M{"id": "1"}),
+//	    Response: TestResponse{Code: http.StatusOK, Body: M{"user": M{"id": "1", "name": "John"}}},
+//	})
+//	r.TestAssert(TestCase{
+//	    Request:  ConnectRequest("acme.user.v1.UserService/GetUser", M{"id": "2"}),
+//	    Response: ConnectError("not_found", "user 2 not found"),
+//	})
+func ConnectRequest(procedure string, message interface{}) TestRequest {
+	return TestRequest{
+		Method:  "POST",
+		Path:    "/" + strings.TrimPrefix(procedure, "/"),
+		Headers: H{"Content-Type": {"application/json"}, "Connect-Protocol-Version": {"1"}},
+		Body:    message,
+	}
+}
+
+// ConnectError returns the response expected for a Connect protocol error: the HTTP status
+// matching the code, and the error envelope with the code and the message. The details are ignored
+func ConnectError(code string, message interface{}) TestResponse {
+	status, ok := connectErrorStatus[code]
+	if ok == false {
+		status = connectErrorStatus["unknown"]
+	}
+	return TestResponse{
+		Code: status,
+		Body: PartialM{"code": code, "message": message},
+	}
+}
+
+// GRPCWebRequest returns the request of a gRPC-web unary call with the JSON codec.
+// The message is encoded in a gRPC-web data frame
+func GRPCWebRequest(procedure string, message interface{}) TestRequest {
+	return TestRequest{
+		Method:        "POST",
+		Path:          "/" + strings.TrimPrefix(procedure, "/"),
+		Headers:       H{"Content-Type": {"application/grpc-web+json"}, "X-Grpc-Web": {"1"}},
+		Body:          message,
+		BodyMarshaler: grpcWebMarshaler,
+	}
+}
+
+// GRPCWebResponse returns the response expected for a successful gRPC-web call:
+// a 200 OK whose frames hold the messages, like S{M{"id": "1"}}, and a zero status
+func GRPCWebResponse(messages interface{}) TestResponse {
+	return TestResponse{
+		Code:            http.StatusOK,
+		BodyUnmarshaler: GRPCWebUnmarshaler,
+		Body:            PartialM{"messages": messages, "status": 0},
+	}
+}
+
+// GRPCWebError returns the response expected for a failed gRPC-web call, with its status, like 5 for
+// NOT_FOUND, and its message. Only the status sent in the trailer frame is checked: for the
+// trailers-only responses, check the Grpc-Status header instead
+func GRPCWebError(status int, message interface{}) TestResponse {
+	return TestResponse{
+		Code:            http.StatusOK,
+		BodyUnmarshaler: GRPCWebUnmarshaler,
+		Body:            PartialM{"status": status, "message": message},
+	}
+}
+
+// grpcWebMarshaler encodes the message in JSON, within a gRPC-web data frame
+func grpcWebMarshaler(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return grpcWebFrame(0, data), nil
+}
+
+// grpcWebFrame returns the frame with its flags and its length prefix
+func grpcWebFrame(flags byte, data []byte) []byte {
+	frame := make([]byte, 5, 5+len(data))
+	frame[0] = flags
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+// GRPCWebUnmarshaler decodes the frames of a gRPC-web response with the JSON codec.
+// The result is a map with the decoded "messages", the numeric "status" and the "message" of the
+// trailer frame, and all the "trailers" with their lower case names.
+// For example a response with a message and an OK status is decoded as
+//
+//	M{"messages": S{M{"id": "1"}}, "status": 0.0, "message": "", "trailers": M{"grpc-status": "0"}}
+func GRPCWebUnmarshaler(data []byte, out interface{}) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("out should be a non-nil pointer")
+	}
+
+	messages := []interface{}{}
+	trailers := make(map[string]interface{})
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return fmt.Errorf("truncated gRPC-web frame header")
+		}
+		flags := data[0]
+		length := binary.BigEndian.Uint32(data[1:5])
+		if uint32(len(data)-5) < length {
+			return fmt.Errorf("truncated gRPC-web frame. Expected %d bytes, got %d", length, len(data)-5)
+		}
+		payload := data[5 : 5+length]
+		data = data[5+length:]
+
+		if flags&0x80 != 0 {
+			reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(append([]byte(nil), payload...), "\r\n"...))))
+			header, err := reader.ReadMIMEHeader()
+			if err != nil && len(header) == 0 {
+				return fmt.Errorf("invalid gRPC-web trailers. %v", err)
+			}
+			for name, values := range header {
+				trailers[strings.ToLower(name)] = strings.Join(values, ",")
+			}
+			continue
+		}
+		var message interface{}
+		if err := json.Unmarshal(payload, &message); err != nil {
+			return fmt.Errorf("cannot unmarshal gRPC-web message %d. %v", len(messages), err)
+		}
+		messages = append(messages, message)
+	}
+
+	result := map[string]interface{}{"messages": messages, "trailers": trailers, "status": nil, "message": ""}
+	if status, ok := trailers["grpc-status"].(string); ok == true {
+		code, err := strconv.Atoi(status)
+		if err != nil {
+			return fmt.Errorf("invalid gRPC-web status %v", status)
+		}
+		result["status"] = float64(code)
+	}
+	if message, ok := trailers["grpc-message"].(string); ok == true {
+		result["message"] = percentDecode(message)
+	}
+
+	pv := rv.Elem()
+	value := reflect.ValueOf(result)
+	if value.Type().AssignableTo(pv.Type()) == false {
+		return fmt.Errorf("out should be a pointer to interface{} or map[string]interface{}, got %T", out)
+	}
+	pv.Set(value)
+	return nil
+}
+
+// percentDecode decodes the percent encoded grpc-message. The invalid sequences are kept as is
+func percentDecode(message string) string {
+	var decoded bytes.Buffer
+	for i := 0; i < len(message); i++ {
+		if message[i] == '%' && i+2 < len(message) {
+			if value, err := strconv.ParseUint(message[i+1:i+3], 16, 8); err == nil {
+				decoded.WriteByte(byte(value))
+				i += 2
+				continue
+			}
+		}
+		decoded.WriteByte(message[i])
+	}
+	return decoded.String()
+}
@@ -0,0 +1,63 @@
+package rehapt
+
+import (
+	"net/http"
+	"reflect"
+)
+
+// actualCookies returns the cookies set by the response, by name. When a name is set several times,
+// the last cookie is kept. Each cookie is a map with the http.Cookie field names:
+// Name, Value, HttpOnly and Secure, then Path, Domain, Expires and MaxAge only if they are set.
+// Expires is formatted with the default time format, so it can be checked with TimeDelta()
+func (r *Rehapt) actualCookies(response *http.Response) map[string]interface{} {
+	cookies := make(map[string]interface{})
+	for _, cookie := range response.Cookies() {
+		actual := map[string]interface{}{
+			"Name":     cookie.Name,
+			"Value":    cookie.Value,
+			"HttpOnly": cookie.HttpOnly,
+			"Secure":   cookie.Secure,
+		}
+		if cookie.Path != "" {
+			actual["Path"] = cookie.Path
+		}
+		if cookie.Domain != "" {
+			actual["Domain"] = cookie.Domain
+		}
+		if cookie.Expires.IsZero() == false {
+			actual["Expires"] = cookie.Expires.UTC().Format(r.defaultTimeDeltaFormat)
+		}
+		if cookie.MaxAge != 0 {
+			actual["MaxAge"] = cookie.MaxAge
+		}
+		cookies[cookie.Name] = actual
+	}
+	return cookies
+}
+
+// expectedCookies returns the expected cookies as a PartialM, unless it is an ExactM, so the other cookies are ignored.
+// A cookie expected as a string is its expected value. A cookie expected as a map is a PartialM,
+// unless it is an ExactM, so only the listed fields are checked. The other types, like CompareFn, are returned as is
+func expectedCookies(expected interface{}) interface{} {
+	v := reflect.ValueOf(expected)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return expected
+	}
+	cookies := make(map[string]interface{}, v.Len())
+	for _, key := range v.MapKeys() {
+		value := v.MapIndex(key).Interface()
+		switch typed := value.(type) {
+		case string:
+			value = PartialM{"Value": typed}
+		case M:
+			value = PartialM(typed)
+		case map[string]interface{}:
+			value = PartialM(typed)
+		}
+		cookies[key.String()] = value
+	}
+	if v.Type() == reflect.TypeOf(ExactM{}) {
+		return ExactM(cookies)
+	}
+	return PartialM(cookies)
+}
@@ -0,0 +1,251 @@
+package rehapt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// HTTP methods listed in an OpenAPI path item
+var openAPIMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// Route is an endpoint of the tested API: a method and a path template.
+// The path parameters are written between braces, like "/api/user/{id}"
+type Route struct {
+	Method string
+	Path   string
+}
+
+func (route Route) String() string {
+	return route.Method + " " + route.Path
+}
+
+// match returns true if the request method and path are handled by this route
+func (route Route) match(method string, path string) bool {
+	if strings.EqualFold(route.Method, method) == false {
+		return false
+	}
+	templateSegments := strings.Split(strings.Trim(route.Path, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(templateSegments) != len(pathSegments) {
+		return false
+	}
+	for i, segment := range templateSegments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if pathSegments[i] == "" {
+				return false
+			}
+			continue
+		}
+		if segment != pathSegments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Coverage tracks which routes of the API have been exercised by the executed testcases.
+// Build it from a route list with NewCoverage() or from an OpenAPI spec with LoadOpenAPICoverage(),
+// give it to Rehapt.SetCoverage(), then check the report once the tests are done.
+//
+// Example:
+//
+//	func TestMain(m *testing.M) {
+//	    coverage, _ = rehapt.LoadOpenAPICoverage("openapi.yaml")
+//	    code := m.Run()
+//	    _ = coverage.Write(os.Stdout)
+//	    if err := coverage.Check(80); err != nil && code == 0 {
+//	        fmt.Println(err)
+//	        code = 1
+//	    }
+//	    os.Exit(code)
+//	}
+type Coverage struct {
+	mutex  sync.Mutex
+	routes []Route
+	hits   []int
+	// Requests not matching any route, "METHOD /path"
+	unknown map[string]int
+}
+
+// CoverageReport is the coverage of the routes at a given time
+type CoverageReport struct {
+	// Covered is the number of routes exercised at least once
+	Covered int
+	// Total is the number of routes
+	Total int
+	// Percent is the ratio of covered routes, between 0 and 100
+	Percent float64
+	// Missing are the routes never exercised
+	Missing []Route
+	// Unknown are the executed requests not matching any route, like "GET /api/old"
+	Unknown []string
+}
+
+// NewCoverage build a new Coverage of the given routes
+func NewCoverage(routes ...Route) *Coverage {
+	return &Coverage{
+		routes:  append([]Route{}, routes...),
+		hits:    make([]int, len(routes)),
+		unknown: make(map[string]int),
+	}
+}
+
+// LoadOpenAPICoverage build a new Coverage of the routes listed in an OpenAPI (or Swagger) spec file.
+// The file format is detected from its extension: ".yaml", ".yml" or ".json".
+// The routes are prefixed by the base path of the API, which is the "basePath" in Swagger 2
+// and the path of the first "servers" url in OpenAPI 3
+func LoadOpenAPICoverage(filename string) (*Coverage, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree interface{}
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".yaml", ".yml":
+		tree, err = parseYAML(data)
+	case ".json":
+		err = json.Unmarshal(data, &tree)
+	default:
+		return nil, fmt.Errorf("unsupported OpenAPI file extension %v", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI file %v. %v", filename, err)
+	}
+
+	routes, err := openAPIRoutes(tree)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI file %v. %v", filename, err)
+	}
+	return NewCoverage(routes...), nil
+}
+
+// openAPIRoutes lists the routes of the decoded spec, sorted by path then method
+func openAPIRoutes(tree interface{}) ([]Route, error) {
+	spec, ok := tree.(map[string]interface{})
+	if ok == false {
+		return nil, fmt.Errorf("spec must be a mapping, got %T", tree)
+	}
+	paths, ok := spec["paths"].(map[string]interface{})
+	if ok == false {
+		return nil, fmt.Errorf("paths must be a mapping, got %T", spec["paths"])
+	}
+
+	basePath := ""
+	if base, ok := spec["basePath"].(string); ok == true {
+		basePath = base
+	} else if servers, ok := spec["servers"].([]interface{}); ok == true && len(servers) > 0 {
+		if server, ok := servers[0].(map[string]interface{}); ok == true {
+			if serverURL, ok := server["url"].(string); ok == true {
+				if u, err := url.Parse(serverURL); err == nil {
+					basePath = u.Path
+				}
+			}
+		}
+	}
+	basePath = strings.TrimSuffix(basePath, "/")
+
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var routes []Route
+	for _, name := range names {
+		item, ok := paths[name].(map[string]interface{})
+		if ok == false {
+			return nil, fmt.Errorf("path %v must be a mapping, got %T", name, paths[name])
+		}
+		for _, method := range openAPIMethods {
+			if _, ok := item[method]; ok == true {
+				routes = append(routes, Route{Method: strings.ToUpper(method), Path: basePath + name})
+			}
+		}
+	}
+	return routes, nil
+}
+
+// SetCoverage allow to record the route of every executed testcase in the given Coverage.
+// Setting the coverage to nil disables the recording
+func (r *Rehapt) SetCoverage(coverage *Coverage) {
+	r.coverage = coverage
+}
+
+// record marks the routes matching the request as exercised
+func (c *Coverage) record(method string, path string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	found := false
+	for i, route := range c.routes {
+		if route.match(method, path) == true {
+			c.hits[i]++
+			found = true
+		}
+	}
+	if found == false {
+		c.unknown[method+" "+path]++
+	}
+}
+
+// Report returns the current coverage of the routes
+func (c *Coverage) Report() CoverageReport {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	report := CoverageReport{
+		Total:   len(c.routes),
+		Missing: []Route{},
+		Unknown: []string{},
+	}
+	for i, route := range c.routes {
+		if c.hits[i] > 0 {
+			report.Covered++
+		} else {
+			report.Missing = append(report.Missing, route)
+		}
+	}
+	for request := range c.unknown {
+		report.Unknown = append(report.Unknown, request)
+	}
+	sort.Strings(report.Unknown)
+	if report.Total > 0 {
+		report.Percent = float64(report.Covered) * 100 / float64(report.Total)
+	}
+	return report
+}
+
+// Check returns an error if the percentage of covered routes is below the threshold, between 0 and 100
+func (c *Coverage) Check(threshold float64) error {
+	report := c.Report()
+	if report.Percent < threshold {
+		return fmt.Errorf("endpoint coverage %.1f%% is below %.1f%%. %d routes not covered", report.Percent, threshold, len(report.Missing))
+	}
+	return nil
+}
+
+// Write writes a readable report: the coverage, then the routes not covered and the unknown requests
+func (c *Coverage) Write(w io.Writer) error {
+	report := c.Report()
+	lines := []string{fmt.Sprintf("endpoint coverage: %.1f%% (%d/%d routes)", report.Percent, report.Covered, report.Total)}
+	if len(report.Missing) > 0 {
+		lines = append(lines, "not covered:")
+		for _, route := range report.Missing {
+			lines = append(lines, "  "+route.String())
+		}
+	}
+	if len(report.Unknown) > 0 {
+		lines = append(lines, "unknown requests:")
+		for _, request := range report.Unknown {
+			lines = append(lines, "  "+request)
+		}
+	}
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
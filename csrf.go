@@ -0,0 +1,121 @@
+package rehapt
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Reserved variable name used to store the CSRF token
+const csrfTokenVar = "csrf.token"
+
+// defaultCSRFRequestHeader is the request header used to send the CSRF token if none is configured
+const defaultCSRFRequestHeader = "X-CSRF-Token"
+
+// CSRF describes where the CSRF token is found in the responses, and how it is sent back,
+// see Rehapt.SetCSRF. Exactly one of Cookie, Header or BodyPath must be set
+type CSRF struct {
+	// Cookie is the name of the response cookie holding the token
+	Cookie string
+	// Header is the name of the response header holding the token
+	Header string
+	// BodyPath is the path of the token in the decoded response body, with the map keys and slice
+	// indexes separated by dots, like "meta.csrf" or "forms.0.token"
+	BodyPath string
+	// RequestHeader is the header used to send the token, "X-CSRF-Token" if empty
+	RequestHeader string
+}
+
+// SetCSRF enables the CSRF token flow: after each response, the token is extracted as configured
+// and stored in the reserved "csrf.token" variable. Then it is sent in the RequestHeader of the
+// following requests using an unsafe method, which are all except GET, HEAD, OPTIONS and TRACE.
+// The responses without token keep the previous one. A testcase can still override the header.
+// Calling it with an empty CSRF disables the flow
+//
+// Example:
+//
+//	err := r.SetCSRF(CSRF{Cookie: "csrftoken", RequestHeader: "X-CSRFToken"})
+//	r.TestAssert(TestCase{Request: TestRequest{Method: "GET", Path: "/login"}, Response: TestResponse{Code: http.StatusOK}})
+//	// The token is sent automatically
+//	r.TestAssert(TestCase{Request: TestRequest{Method: "POST", Path: "/login", Body: M{...}}, Response: ...})
+func (r *Rehapt) SetCSRF(config CSRF) error {
+	if config == (CSRF{}) {
+		r.csrf = nil
+		return nil
+	}
+	sources := 0
+	for _, source := range []string{config.Cookie, config.Header, config.BodyPath} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("invalid CSRF configuration. Exactly one of Cookie, Header or BodyPath must be set")
+	}
+	if config.RequestHeader == "" {
+		config.RequestHeader = defaultCSRFRequestHeader
+	}
+	r.csrf = &config
+	return nil
+}
+
+// storeCSRFToken extracts the CSRF token from the response and stores it, if found
+func (r *Rehapt) storeCSRFToken(response *http.Response, body interface{}) {
+	token := ""
+	switch {
+	case r.csrf.Cookie != "":
+		for _, cookie := range response.Cookies() {
+			if cookie.Name == r.csrf.Cookie {
+				token = cookie.Value
+			}
+		}
+	case r.csrf.Header != "":
+		token = response.Header.Get(r.csrf.Header)
+	default:
+		if value, ok := lookupBodyPath(body, r.csrf.BodyPath); ok == true && value != nil {
+			token = fmt.Sprint(value)
+		}
+	}
+	if token != "" {
+		r.storeVar(csrfTokenVar, token)
+	}
+}
+
+// injectCSRFToken adds the stored CSRF token to the unsafe method request, unless it is already set
+func (r *Rehapt) injectCSRFToken(request *http.Request) {
+	switch request.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return
+	}
+	if request.Header.Get(r.csrf.RequestHeader) != "" {
+		return
+	}
+	if token, ok := r.lookupVar(csrfTokenVar); ok == true {
+		request.Header.Set(r.csrf.RequestHeader, fmt.Sprint(token))
+	}
+}
+
+// lookupBodyPath returns the value at the dot separated path in the decoded body
+func lookupBodyPath(body interface{}, path string) (interface{}, bool) {
+	value := body
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			child, ok := v[key]
+			if ok == false {
+				return nil, false
+			}
+			value = child
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, false
+			}
+			value = v[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
@@ -0,0 +1,59 @@
+package rehapt
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Host used in the exported requests when the request path has none
+const exportDefaultHost = "http://localhost"
+
+// SetCurlExport allow to write an equivalent curl command for every executed testcase,
+// one command per line. The method, path, headers and body are written with the variables
+// already replaced, which makes it easy to reproduce a failing testcase outside of the tests.
+// As the requests paths are usually relative, they are prefixed by "http://localhost".
+// Setting the writer to nil disables the export
+//
+// Example:
+//
+//	r.SetCurlExport(os.Stderr)
+//	// curl -X POST 'http://localhost/api/user' -H 'Content-Type: application/json' --data-raw '{"name":"John"}'
+func (r *Rehapt) SetCurlExport(w io.Writer) {
+	r.curlExport = w
+}
+
+// writeCurl writes the curl command executing the request with the given body
+func writeCurl(w io.Writer, request *http.Request, body []byte) error {
+	url := request.URL.String()
+	if request.URL.Host == "" {
+		url = exportDefaultHost + url
+	}
+	args := []string{"curl", "-X", request.Method, shellQuote(url)}
+
+	// Sort the headers, so the command is the same on each run
+	names := make([]string, 0, len(request.Header))
+	for name := range request.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range request.Header[name] {
+			args = append(args, "-H", shellQuote(name+": "+value))
+		}
+	}
+
+	if len(body) > 0 {
+		args = append(args, "--data-raw", shellQuote(string(body)))
+	}
+
+	_, err := fmt.Fprintln(w, strings.Join(args, " "))
+	return err
+}
+
+// shellQuote quotes the string for a POSIX shell, using single quotes
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,101 @@
+package rehapt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// SetDumpOnFailure appends the executed request and the actual response to the error of a failing testcase.
+// The request is dumped with its method, URL, headers and body, the response with its status, headers
+// and body. The JSON bodies are indented
+func (r *Rehapt) SetDumpOnFailure(enabled bool) {
+	r.dumpOnFailure = enabled
+}
+
+// SetDebugBodies logs the marshaled request body, indented if it is JSON, and the raw response body
+// of each testcase, using the ErrorHandler Logf() function when it exists or the logger, see SetLogger.
+// TestCase.Debug enables it for a single testcase
+func (r *Rehapt) SetDebugBodies(enabled bool) {
+	r.debugBodies = enabled
+}
+
+// debugBodies formats the bodies logged by SetDebugBodies
+func debugBodies(request *http.Request, requestBody []byte, response *http.Response, responseBody []byte) string {
+	var dump bytes.Buffer
+	var indented bytes.Buffer
+	if json.Indent(&indented, requestBody, "", "  ") == nil {
+		requestBody = indented.Bytes()
+	}
+	fmt.Fprintf(&dump, "Request body of %v %v:\n%s\n", request.Method, request.URL, debugBody(requestBody))
+	fmt.Fprintf(&dump, "Response body, status %v:\n%s", response.StatusCode, debugBody(responseBody))
+	return dump.String()
+}
+
+// debugBody returns the body without its trailing new lines, or "(empty)"
+func debugBody(body []byte) []byte {
+	if len(body) == 0 {
+		return []byte("(empty)")
+	}
+	return bytes.TrimRight(body, "\n")
+}
+
+// withDump appends the dump of the exchange to the error, keeping its type
+func withDump(err error, request *http.Request, requestBody []byte, response *http.Response, responseBody []byte) error {
+	dump := dumpExchange(request, requestBody, response, responseBody, nil)
+	if mismatchErr, ok := err.(*MismatchError); ok == true {
+		return &MismatchError{Mismatches: mismatchErr.Mismatches, message: mismatchErr.message + "\n" + dump}
+	}
+	return fmt.Errorf("%v\n%v", err, dump)
+}
+
+// dumpExchange writes the request and the response in a readable format.
+// The values of the redacted headers are hidden
+func dumpExchange(request *http.Request, requestBody []byte, response *http.Response, responseBody []byte, redacted []string) string {
+	var dump bytes.Buffer
+	writeRequest(&dump, request, requestBody, redacted)
+	fmt.Fprintf(&dump, "Response:\n%v %v\n", response.StatusCode, http.StatusText(response.StatusCode))
+	dumpHeaders(&dump, response.Header, redacted)
+	dumpBody(&dump, responseBody)
+	return strings.TrimSuffix(dump.String(), "\n")
+}
+
+// dumpRequest writes the request in the same format as dumpExchange, when there is no response
+func dumpRequest(request *http.Request, requestBody []byte) string {
+	var dump bytes.Buffer
+	writeRequest(&dump, request, requestBody, nil)
+	return strings.TrimSuffix(dump.String(), "\n")
+}
+
+func writeRequest(dump *bytes.Buffer, request *http.Request, requestBody []byte, redacted []string) {
+	fmt.Fprintf(dump, "Request:\n%v %v\n", request.Method, request.URL)
+	dumpHeaders(dump, request.Header, redacted)
+	dumpBody(dump, requestBody)
+}
+
+func dumpHeaders(dump *bytes.Buffer, header http.Header, redacted []string) {
+	for _, name := range sortedHeaderNames(header) {
+		for _, value := range header[name] {
+			for _, r := range redacted {
+				if http.CanonicalHeaderKey(r) == http.CanonicalHeaderKey(name) {
+					value = redactedValue
+				}
+			}
+			fmt.Fprintf(dump, "%v: %v\n", name, value)
+		}
+	}
+}
+
+// dumpBody writes the body after an empty line, indented if it is JSON
+func dumpBody(dump *bytes.Buffer, body []byte) {
+	if len(body) == 0 {
+		return
+	}
+	var indented bytes.Buffer
+	if json.Indent(&indented, body, "", "  ") == nil {
+		body = indented.Bytes()
+	}
+	fmt.Fprintf(dump, "\n%s\n", bytes.TrimRight(body, "\n"))
+}
@@ -0,0 +1,130 @@
+package rehapt
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interval between the reads of the EventSink messages, see EventCheck
+const eventPollInterval = 20 * time.Millisecond
+
+// EventSink gives access to the messages published by the application under test, like the consumer
+// of a Kafka topic, a NATS subject or an SQS queue. Messages returns all the messages received so far,
+// in order. MemorySink can be used as the target of such a consumer
+type EventSink interface {
+	Messages() ([][]byte, error)
+}
+
+// EventCheck expects a message matching Expected to be received by the Sink within the duration,
+// once the request has been executed. The messages are decoded with the unmarshaler of the Rehapt
+// instance and compared as a response body. Name is used in the error messages
+type EventCheck struct {
+	Name     string
+	Sink     EventSink
+	Expected interface{}
+	Within   time.Duration
+}
+
+// MemorySink is an EventSink keeping the published messages in memory
+//
+// Example:
+//
+//	sink := NewMemorySink()
+//	go func() {
+//	    for message := range consumer.Messages() {
+//	        sink.Publish(message.Value)
+//	    }
+//	}()
+type MemorySink struct {
+	mutex    sync.Mutex
+	messages [][]byte
+}
+
+// NewMemorySink build an empty MemorySink
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+// Publish adds a message to the sink
+func (s *MemorySink) Publish(message []byte) {
+	s.mutex.Lock()
+	s.messages = append(s.messages, append([]byte(nil), message...))
+	s.mutex.Unlock()
+}
+
+// Messages returns the published messages, in order
+func (s *MemorySink) Messages() ([][]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([][]byte(nil), s.messages...), nil
+}
+
+// eventOffsets returns the number of messages already received by each sink,
+// so only the messages published while handling the request are checked
+func (r *Rehapt) eventOffsets(checks []EventCheck) ([]int, error) {
+	offsets := make([]int, len(checks))
+	for i, check := range checks {
+		if check.Sink == nil {
+			return nil, fmt.Errorf("event %v failed. nil event sink", eventName(check, i))
+		}
+		messages, err := check.Sink.Messages()
+		if err != nil {
+			return nil, fmt.Errorf("event %v failed. %v", eventName(check, i), err)
+		}
+		offsets[i] = len(messages)
+	}
+	return offsets, nil
+}
+
+// checkEvents waits for the expected messages and returns the errors of all the missing ones
+func (r *Rehapt) checkEvents(checks []EventCheck, offsets []int) error {
+	var errs []error
+	for i, check := range checks {
+		if err := r.waitEvent(check, offsets[i]); err != nil {
+			errs = append(errs, fmt.Errorf("event %v %v", eventName(check, i), err))
+		}
+	}
+	return joinErrors(errs...)
+}
+
+// waitEvent polls the sink until a message received after offset matches the expected one
+func (r *Rehapt) waitEvent(check EventCheck, offset int) error {
+	deadline := time.Now().Add(check.Within)
+	for {
+		messages, err := check.Sink.Messages()
+		if err != nil {
+			return fmt.Errorf("failed. %v", err)
+		}
+		var errs []string
+		for i := offset; i < len(messages); i++ {
+			var message interface{}
+			if err := r.unmarshaler(messages[i], &message); err != nil {
+				errs = append(errs, fmt.Sprintf("message %d: cannot unmarshal message. %v", i, err))
+				continue
+			}
+			if err := r.call().compare(check.Expected, message); err != nil {
+				errs = append(errs, fmt.Sprintf("message %d: %v", i, err))
+				continue
+			}
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			if len(errs) == 0 {
+				return fmt.Errorf("not received within %v", check.Within)
+			}
+			return fmt.Errorf("not received within %v.\n%v", check.Within, strings.Join(errs, "\n"))
+		}
+		time.Sleep(eventPollInterval)
+	}
+}
+
+// eventName returns the name of the check, or its index
+func eventName(check EventCheck, index int) string {
+	if check.Name != "" {
+		return check.Name
+	}
+	return fmt.Sprint(index)
+}
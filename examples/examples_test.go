@@ -175,3 +175,36 @@ func TestExampleInvalidAuth(t *testing.T) {
 		},
 	})
 }
+
+func TestExampleSuite(t *testing.T) {
+	r := setupRehapt(t)
+
+	// A suite describes a flow of requests. Each step is a subtest and the remaining
+	// steps are skipped as soon as one fails, because they depend on the previous ones.
+	suite := r.NewSuite("user and cat")
+	suite.Add("get user", TestCase{
+		Request: TestRequest{
+			Method: "GET",
+			Path:   "/api/user",
+		},
+		Response: TestResponse{
+			Code: http.StatusOK,
+			Body: PartialM{
+				"pets": S{
+					PartialM{"id": "$catid$"},
+				},
+			},
+		},
+	})
+	suite.Add("get cat", TestCase{
+		Request: TestRequest{
+			Method: "GET",
+			Path:   "/api/cat/_catid_",
+		},
+		Response: TestResponse{
+			Code: http.StatusOK,
+			Body: PartialM{"name": "Pepper the cat"},
+		},
+	})
+	suite.Run(t)
+}
@@ -0,0 +1,155 @@
+package rehapt
+
+import (
+	"reflect"
+)
+
+// Extend returns the testcase merged over the base testcase, so the parts shared by many testcases,
+// like the headers, the response code or the envelope fields of the body, are defined once.
+// The fields set in the testcase override the ones of the base. The maps, like the headers, the cookies and
+// the M, PartialM or H bodies, are merged deeply: their keys are added to the base ones.
+// The tags, the state, event and outbound checks are added to the base ones
+//
+// Example:
+//
+//	base := TestCase{
+//	    Request:  TestRequest{Headers: H{"Authorization": {"Bearer _token_"}}},
+//	    Response: TestResponse{Code: http.StatusOK, Body: PartialM{"success": true}},
+//	}
+//	r.TestAssert(TestCase{
+//	    Request:  TestRequest{Method: "GET", Path: "/api/user/1"},
+//	    Response: TestResponse{Body: PartialM{"data": PartialM{"id": "1"}}},
+//	}.Extend(base))
+func (testcase TestCase) Extend(base TestCase) TestCase {
+	merged := base
+
+	if testcase.Request.Method != "" {
+		merged.Request.Method = testcase.Request.Method
+	}
+	if testcase.Request.Path != nil {
+		merged.Request.Path = testcase.Request.Path
+	}
+	if testcase.Request.Headers != nil {
+		merged.Request.Headers = mergeValues(base.Request.Headers, testcase.Request.Headers).(H)
+	}
+	merged.Request.Body = mergeValues(base.Request.Body, testcase.Request.Body)
+	if testcase.Request.BodyMarshaler != nil {
+		merged.Request.BodyMarshaler = testcase.Request.BodyMarshaler
+	}
+	if testcase.Request.RawBody != nil {
+		merged.Request.RawBody = testcase.Request.RawBody
+	}
+	if testcase.Request.BodyFile != "" {
+		merged.Request.BodyFile = testcase.Request.BodyFile
+	}
+	// The credentials of the testcase replace the ones of the base
+	if testcase.Request.BasicAuth != nil {
+		merged.Request.BasicAuth = testcase.Request.BasicAuth
+		merged.Request.BearerToken = ""
+	}
+	if testcase.Request.BearerToken != "" {
+		merged.Request.BasicAuth = nil
+		merged.Request.BearerToken = testcase.Request.BearerToken
+	}
+	if testcase.Request.Cookies != nil {
+		merged.Request.Cookies = make(map[string]string, len(base.Request.Cookies)+len(testcase.Request.Cookies))
+		for name, value := range base.Request.Cookies {
+			merged.Request.Cookies[name] = value
+		}
+		for name, value := range testcase.Request.Cookies {
+			merged.Request.Cookies[name] = value
+		}
+	}
+
+	merged.Response.Headers = mergeValues(base.Response.Headers, testcase.Response.Headers)
+	merged.Response.Cookies = mergeValues(base.Response.Cookies, testcase.Response.Cookies)
+	if testcase.Response.Code != nil {
+		merged.Response.Code = testcase.Response.Code
+	}
+	merged.Response.Body = mergeValues(base.Response.Body, testcase.Response.Body)
+	if testcase.Response.BodyUnmarshaler != nil {
+		merged.Response.BodyUnmarshaler = testcase.Response.BodyUnmarshaler
+	}
+	if testcase.Response.RawBody != nil {
+		merged.Response.RawBody = testcase.Response.RawBody
+	}
+	if testcase.Response.Golden != "" {
+		merged.Response.Golden = testcase.Response.Golden
+	}
+	if testcase.Response.NoShortcuts == true {
+		merged.Response.NoShortcuts = true
+	}
+	if testcase.Response.Proto != nil {
+		merged.Response.Proto = testcase.Response.Proto
+	}
+
+	merged.Tags = append(append([]string(nil), base.Tags...), testcase.Tags...)
+	if testcase.SkipIf != nil {
+		merged.SkipIf = testcase.SkipIf
+	}
+	if testcase.OnlyIf != nil {
+		merged.OnlyIf = testcase.OnlyIf
+	}
+	if testcase.Before != nil {
+		merged.Before = testcase.Before
+	}
+	if testcase.After != nil {
+		merged.After = testcase.After
+	}
+	if testcase.Debug == true {
+		merged.Debug = true
+	}
+	merged.PreCheck = append(append([]StateCheck(nil), base.PreCheck...), testcase.PreCheck...)
+	merged.PostCheck = append(append([]StateCheck(nil), base.PostCheck...), testcase.PostCheck...)
+	merged.Events = append(append([]EventCheck(nil), base.Events...), testcase.Events...)
+	merged.Outbound = append(append([]OutboundCheck(nil), base.Outbound...), testcase.Outbound...)
+	return merged
+}
+
+// mergeValues merges the override map over the base map, recursively, in a new map of the override type.
+// If they are not both maps with string keys, the override is returned, or the base if the override is nil
+func mergeValues(base interface{}, override interface{}) interface{} {
+	if override == nil {
+		return base
+	}
+	b := reflect.ValueOf(base)
+	o := reflect.ValueOf(override)
+	if b.Kind() != reflect.Map || o.Kind() != reflect.Map ||
+		b.Type().Key().Kind() != reflect.String || o.Type().Key().Kind() != reflect.String {
+		return override
+	}
+
+	merged := reflect.MakeMap(o.Type())
+	for _, key := range b.MapKeys() {
+		value := b.MapIndex(key)
+		if value.Kind() == reflect.Interface && value.IsNil() == false {
+			value = value.Elem()
+		}
+		// The base values which cannot be stored in the override map are dropped
+		if value.Type().AssignableTo(o.Type().Elem()) == false {
+			continue
+		}
+		merged.SetMapIndex(key.Convert(o.Type().Key()), value)
+	}
+	for _, key := range o.MapKeys() {
+		value := o.MapIndex(key)
+		// Only the nested maps are merged, any other value, even nil, overrides the base value
+		baseValue := b.MapIndex(key.Convert(b.Type().Key()))
+		if baseValue.IsValid() == true && isStringMap(baseValue) == true && isStringMap(value) == true {
+			mergedValue := reflect.ValueOf(mergeValues(baseValue.Interface(), value.Interface()))
+			if mergedValue.Type().AssignableTo(o.Type().Elem()) == true {
+				value = mergedValue
+			}
+		}
+		merged.SetMapIndex(key, value)
+	}
+	return merged.Interface()
+}
+
+// isStringMap returns true if the value is a map with string keys
+func isStringMap(v reflect.Value) bool {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	return v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String
+}
@@ -0,0 +1,125 @@
+package rehapt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// FailureReport is the JSON document written for each failing testcase, see SetFailureExport
+type FailureReport struct {
+	// Test is the name of the running test, when the ErrorHandler has a Name() method like *testing.T
+	Test       string            `json:"test,omitempty"`
+	Time       time.Time         `json:"time"`
+	Error      string            `json:"error"`
+	Request    FailureRequest    `json:"request"`
+	Response   FailureResponse   `json:"response"`
+	Mismatches []FailureMismatch `json:"mismatches,omitempty"`
+}
+
+// FailureRequest is the request executed by a failing testcase
+type FailureRequest struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Headers http.Header `json:"headers,omitempty"`
+	// Body is the JSON body, or a string when it is not JSON
+	Body interface{} `json:"body,omitempty"`
+}
+
+// FailureResponse is the actual response of a failing testcase
+type FailureResponse struct {
+	Status   int         `json:"status"`
+	Headers  http.Header `json:"headers,omitempty"`
+	Body     interface{} `json:"body,omitempty"`
+	Duration float64     `json:"durationMs"`
+}
+
+// FailureMismatch is a Mismatch of a failing testcase
+type FailureMismatch struct {
+	Path     string       `json:"path"`
+	Kind     MismatchKind `json:"kind"`
+	Expected interface{}  `json:"expected"`
+	Actual   interface{}  `json:"actual"`
+	Message  string       `json:"message"`
+}
+
+// SetFailureExport allow to write a JSON document for each testcase whose response does not match,
+// one document per line (JSON Lines). It holds the test name, the executed request, the actual response
+// and the mismatches, which allow CI tooling to aggregate the failures across runs without parsing the logs.
+// Setting the writer to nil disables the export
+//
+// Example:
+//
+//	file, _ := os.Create("failures.jsonl")
+//	defer file.Close()
+//	r.SetFailureExport(file)
+func (r *Rehapt) SetFailureExport(w io.Writer) {
+	r.failureExport = w
+}
+
+// exportFailure writes the failure report of the exchange
+func (r *Rehapt) exportFailure(err error, request *http.Request, requestBody []byte, response *http.Response, responseBody []byte, duration time.Duration) error {
+	report := FailureReport{
+		Time:  time.Now(),
+		Error: err.Error(),
+		Request: FailureRequest{
+			Method:  request.Method,
+			URL:     request.URL.String(),
+			Headers: request.Header,
+			Body:    failureBody(requestBody),
+		},
+		Response: FailureResponse{
+			Status:   response.StatusCode,
+			Headers:  response.Header,
+			Body:     failureBody(responseBody),
+			Duration: float64(duration) / float64(time.Millisecond),
+		},
+	}
+	if named, ok := r.errorHandler.(interface{ Name() string }); ok == true {
+		report.Test = named.Name()
+	}
+	if mismatchErr, ok := err.(*MismatchError); ok == true {
+		for _, mismatch := range mismatchErr.Mismatches {
+			report.Mismatches = append(report.Mismatches, FailureMismatch{
+				Path:     mismatch.Path,
+				Kind:     mismatch.Kind,
+				Expected: failureValue(mismatch.Expected),
+				Actual:   failureValue(mismatch.Actual),
+				Message:  mismatch.Message,
+			})
+		}
+	}
+
+	r.exportMutex.Lock()
+	defer r.exportMutex.Unlock()
+	encoder := json.NewEncoder(r.failureExport)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(report); err != nil {
+		return fmt.Errorf("failed to export failure. %v", err)
+	}
+	return nil
+}
+
+// failureBody keeps the JSON bodies as they are, and the others as strings
+func failureBody(body []byte) interface{} {
+	if len(body) == 0 {
+		return nil
+	}
+	var value interface{}
+	if json.Unmarshal(body, &value) == nil {
+		return json.RawMessage(body)
+	}
+	return string(body)
+}
+
+// failureValue converts the value so it can be marshaled, see formatValue
+func failureValue(value interface{}) interface{} {
+	converted := jsonFormattable(reflect.ValueOf(value))
+	if _, err := json.Marshal(converted); err != nil {
+		return fmt.Sprint(value)
+	}
+	return converted
+}
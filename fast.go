@@ -0,0 +1,78 @@
+package rehapt
+
+import "reflect"
+
+// fastMatch returns true if the actual value matches the expected one, for the common concrete types
+// of the decoded JSON: strings, numbers and bools. It avoids the reflection of the comparators
+// for the huge arrays of scalars. When it returns false, the values are compared as usual,
+// which reports the same error as without the fast path
+func (r *Rehapt) fastMatch(expected interface{}, actual interface{}) bool {
+	// The replaced comparators can match the values differently
+	if len(r.comparatorOverrides) > 0 {
+		return false
+	}
+	switch e := expected.(type) {
+	case string:
+		a, ok := actual.(string)
+		if ok == false || e != a {
+			return false
+		}
+		// A shortcut stores or loads a variable
+		return r.noShortcuts == true || (r.patterns.storeName(r.variableStoreRegexp, e) == "" && r.patterns.loadMatches(r.variableLoadRegexp, e) == nil)
+	case float64:
+		a, ok := actual.(float64)
+		return ok == true && e == a
+	case int:
+		a, ok := actual.(float64)
+		return ok == true && float64(e) == a
+	case bool:
+		a, ok := actual.(bool)
+		return ok == true && e == a
+	}
+	return false
+}
+
+// interfaceSlice returns the elements of S and of the decoded JSON arrays
+func interfaceSlice(value interface{}) ([]interface{}, bool) {
+	switch v := value.(type) {
+	case []interface{}:
+		return v, true
+	case S:
+		return v, true
+	case SortedS:
+		return v, true
+	}
+	return nil, false
+}
+
+// interfaceMap returns the entries of M, PartialM, ExactM and of the decoded JSON objects
+func interfaceMap(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case M:
+		return v, true
+	case PartialM:
+		return v, true
+	case ExactM:
+		return v, true
+	}
+	return nil, false
+}
+
+// mapEntry returns the expected and actual values of the key, and false if the actual map does not have the key.
+// The decoded JSON objects are read without reflection
+func mapEntry(ctx compareCtx, key reflect.Value) (interface{}, interface{}, bool) {
+	if expectedMap, ok := interfaceMap(ctx.Expected); ok == true {
+		if actualMap, ok := interfaceMap(ctx.Actual); ok == true {
+			actual, found := actualMap[key.String()]
+			return expectedMap[key.String()], actual, found
+		}
+	}
+	expected := ctx.ExpectedValue.MapIndex(key).Interface()
+	actual := ctx.ActualValue.MapIndex(key)
+	if actual.IsValid() == false {
+		return expected, nil, false
+	}
+	return expected, actual.Interface(), true
+}
@@ -0,0 +1,45 @@
+package rehapt
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+)
+
+// FormMarshaler encodes a url.Values, or a map like M, as an application/x-www-form-urlencoded body.
+// The request Content-Type is set accordingly, unless the testcase headers define it.
+// The map values are formatted like fmt.Sprint, and a slice value is sent as a repeated field.
+// It is used by default for the url.Values bodies
+//
+// Example:
+//
+//	r.TestAssert(TestCase{
+//	    Request:  TestRequest{Method: "POST", Path: "/login", Body: M{"user": "john", "remember": true}, BodyMarshaler: FormMarshaler},
+//	    Response: TestResponse{Code: http.StatusSeeOther},
+//	})
+func FormMarshaler(v interface{}) ([]byte, error) {
+	if values, ok := v.(url.Values); ok == true {
+		return []byte(values.Encode()), nil
+	}
+
+	m := reflect.ValueOf(v)
+	if m.Kind() != reflect.Map || m.Type().Key().Kind() != reflect.String {
+		return nil, fmt.Errorf("only url.Values or map with string keys supported")
+	}
+	values := make(url.Values, m.Len())
+	for _, key := range m.MapKeys() {
+		value := reflect.ValueOf(m.MapIndex(key).Interface())
+		if value.Kind() == reflect.Slice || value.Kind() == reflect.Array {
+			for i := 0; i < value.Len(); i++ {
+				values.Add(key.String(), fmt.Sprint(value.Index(i).Interface()))
+			}
+			continue
+		}
+		if value.IsValid() == false {
+			values.Set(key.String(), "")
+			continue
+		}
+		values.Set(key.String(), fmt.Sprint(value.Interface()))
+	}
+	return []byte(values.Encode()), nil
+}
@@ -0,0 +1,136 @@
+package rehapt
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Name of the test binary flag asking to rewrite the golden files.
+// The library does not define it, so the test package can declare its own -update flag
+const updateGoldenFlag = "update"
+
+// Environment variable asking to rewrite the golden files, when the test package has no -update flag
+const updateGoldenEnv = "REHAPT_UPDATE_GOLDEN"
+
+// SetUpdateGolden enable or disable the update mode of the golden files.
+// When enabled, the golden files of the testcases are rewritten with the actual response body
+// instead of being compared with it.
+// By default, it is enabled when the test binary is run with the -update flag, if the test package
+// defines it, or when the REHAPT_UPDATE_GOLDEN environment variable is true:
+//
+//	var update = flag.Bool("update", false, "rewrite the golden files")
+//
+//	go test ./... -update
+//	REHAPT_UPDATE_GOLDEN=1 go test ./...
+func (r *Rehapt) SetUpdateGolden(enabled bool) {
+	r.updateGolden = &enabled
+}
+
+// isUpdatingGolden returns true if the golden files must be rewritten,
+// as defined by SetUpdateGolden or else by the -update flag and the environment
+func (r *Rehapt) isUpdatingGolden() bool {
+	if r.updateGolden != nil {
+		return *r.updateGolden
+	}
+	return updateGoldenRequested()
+}
+
+// updateGoldenRequested returns true if the -update flag has been passed to the test binary,
+// or if the REHAPT_UPDATE_GOLDEN environment variable is true
+func updateGoldenRequested() bool {
+	if f := flag.Lookup(updateGoldenFlag); f != nil {
+		if getter, ok := f.Value.(flag.Getter); ok == true {
+			if enabled, ok := getter.Get().(bool); ok == true && enabled == true {
+				return true
+			}
+		}
+	}
+	enabled, err := strconv.ParseBool(os.Getenv(updateGoldenEnv))
+	return err == nil && enabled == true
+}
+
+// goldenBody returns the expected body read from the golden file of the response.
+// The expected Body, if any, overrides the golden values. It allows to use matchers
+// for the volatile fields, like an id or a date.
+// In update mode, the golden file is rewritten with the actual body data and nil is returned
+func (r *Rehapt) goldenBody(response TestResponse, data []byte, unmarshaler UnmarshalFn) (interface{}, bool, error) {
+	if r.isUpdatingGolden() == true {
+		if err := writeGoldenFile(response.Golden, data); err != nil {
+			return nil, false, fmt.Errorf("cannot update golden file %v. %v", response.Golden, err)
+		}
+		return nil, false, nil
+	}
+
+	golden, err := ioutil.ReadFile(response.Golden)
+	if err != nil {
+		if os.IsNotExist(err) == true {
+			return nil, false, fmt.Errorf("golden file %v does not exist, run the test with -update or %v=1 to create it", response.Golden, updateGoldenEnv)
+		}
+		return nil, false, fmt.Errorf("cannot read golden file %v. %v", response.Golden, err)
+	}
+
+	var expected interface{}
+	if len(golden) > 0 {
+		if err := unmarshaler(golden, &expected); err != nil {
+			return nil, false, fmt.Errorf("cannot unmarshal golden file %v. %v", response.Golden, err)
+		}
+	}
+	return overrideGolden(expected, response.Body), true, nil
+}
+
+// overrideGolden replaces the golden values by the given ones.
+// The maps are merged recursively, so only the listed fields are overridden
+func overrideGolden(golden interface{}, override interface{}) interface{} {
+	if override == nil {
+		return golden
+	}
+	goldenMap, ok := golden.(map[string]interface{})
+	if ok == false {
+		return override
+	}
+
+	var overrideMap map[string]interface{}
+	switch o := override.(type) {
+	case M:
+		overrideMap = o
+	case PartialM:
+		overrideMap = o
+	case ExactM:
+		overrideMap = o
+	case map[string]interface{}:
+		overrideMap = o
+	default:
+		return override
+	}
+
+	merged := make(M, len(goldenMap))
+	for key, value := range goldenMap {
+		merged[key] = value
+	}
+	for key, value := range overrideMap {
+		merged[key] = overrideGolden(goldenMap[key], value)
+	}
+	return merged
+}
+
+// writeGoldenFile writes the body in the golden file.
+// JSON bodies are indented to keep the file readable and its diffs small
+func writeGoldenFile(filename string, data []byte) error {
+	var indented bytes.Buffer
+	if json.Indent(&indented, data, "", "  ") == nil {
+		indented.WriteByte('\n')
+		data = indented.Bytes()
+	}
+	if dir := filepath.Dir(filename); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
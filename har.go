@@ -0,0 +1,337 @@
+package rehapt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR is an HTTP Archive, in the 1.2 format.
+// Browsers devtools can export the requests of a page as HAR, and import HAR files for inspection.
+// Use LoadHAR() and HAR.TestCases() to build testcases from a file exported by a browser,
+// and Rehapt.SetHARExport() to archive the executed testcases.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+// HARLog is the root of the archive
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+// HARCreator is the application which created the archive
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HAREntry is an archived exchange, a request and its response
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+}
+
+// HARRequest is an archived request
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+// HARResponse is an archived response
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+// HARNameValue is a header, a cookie or a query string parameter
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARPostData is the body of an archived request
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+// HARContent is the body of an archived response.
+// Binary bodies are encoded in base64
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// HARTimings is the time spent in each phase of the exchange, in milliseconds
+type HARTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// Request headers of a HAR file which are not copied in the testcases.
+// They are managed by the HTTP stack, and compressed responses could not be compared
+var harIgnoredRequestHeaders = map[string]bool{
+	"Accept-Encoding": true,
+	"Connection":      true,
+	"Content-Length":  true,
+	"Cookie":          true,
+	"Host":            true,
+}
+
+// NewHAR build a new empty HTTP Archive
+func NewHAR() *HAR {
+	return &HAR{
+		Log: HARLog{
+			Version: "1.2",
+			Creator: HARCreator{Name: "rehapt"},
+			Entries: []HAREntry{},
+		},
+	}
+}
+
+// ReadHAR decodes an HTTP Archive
+func ReadHAR(reader io.Reader) (*HAR, error) {
+	var har HAR
+	if err := json.NewDecoder(reader).Decode(&har); err != nil {
+		return nil, fmt.Errorf("invalid HAR. %v", err)
+	}
+	return &har, nil
+}
+
+// LoadHAR loads an HTTP Archive file, for example exported by a browser devtools
+func LoadHAR(filename string) (*HAR, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var har HAR
+	if err := json.Unmarshal(data, &har); err != nil {
+		return nil, fmt.Errorf("invalid HAR file %v. %v", filename, err)
+	}
+	return &har, nil
+}
+
+// Write writes the archive as indented JSON
+func (h *HAR) Write(w io.Writer) error {
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// TestCases converts each entry of the archive into a TestCase.
+// The request is copied, without the host so it is sent to the tested handler.
+// The expected response is a skeleton built from the archived one: its status code,
+// its Content-Type header and its body, decoded if it is JSON, as plain text otherwise.
+// The volatile fields of the body, like ids or dates, must then be replaced by matchers
+func (h *HAR) TestCases() ([]TestCase, error) {
+	testcases := make([]TestCase, 0, len(h.Log.Entries))
+	for i, entry := range h.Log.Entries {
+		testcase, err := entry.testCase()
+		if err != nil {
+			return nil, fmt.Errorf("invalid HAR entry %d. %v", i, err)
+		}
+		testcases = append(testcases, testcase)
+	}
+	return testcases, nil
+}
+
+func (entry HAREntry) testCase() (TestCase, error) {
+	u, err := url.Parse(entry.Request.URL)
+	if err != nil {
+		return TestCase{}, fmt.Errorf("invalid request URL. %v", err)
+	}
+
+	request := TestRequest{
+		Method: entry.Request.Method,
+		Path:   NoReplacement(u.RequestURI()),
+	}
+	for _, header := range entry.Request.Headers {
+		// HTTP/2 pseudo headers like :authority
+		if strings.HasPrefix(header.Name, ":") {
+			continue
+		}
+		name := http.CanonicalHeaderKey(header.Name)
+		if harIgnoredRequestHeaders[name] == true {
+			continue
+		}
+		if request.Headers == nil {
+			request.Headers = make(H)
+		}
+		request.Headers[name] = append(request.Headers[name], header.Value)
+	}
+	if entry.Request.PostData != nil && entry.Request.PostData.Text != "" {
+		request.Body = entry.Request.PostData.Text
+		request.BodyMarshaler = RawMarshaler
+	}
+
+	response := TestResponse{
+		Code: entry.Response.Status,
+	}
+	for _, header := range entry.Response.Headers {
+		if http.CanonicalHeaderKey(header.Name) == "Content-Type" {
+			response.Headers = PartialM{"Content-Type": S{header.Value}}
+		}
+	}
+
+	body := []byte(entry.Response.Content.Text)
+	if entry.Response.Content.Encoding == "base64" {
+		if body, err = base64.StdEncoding.DecodeString(entry.Response.Content.Text); err != nil {
+			return TestCase{}, fmt.Errorf("invalid response content. %v", err)
+		}
+	}
+	if len(body) > 0 {
+		var decoded interface{}
+		if isJSONMimeType(entry.Response.Content.MimeType) && json.Unmarshal(body, &decoded) == nil {
+			response.Body = decoded
+		} else {
+			response.Body = string(body)
+			response.BodyUnmarshaler = RawUnmarshaler
+		}
+	}
+
+	return TestCase{Request: request, Response: response}, nil
+}
+
+// SetHARExport allow to append every executed testcase, with its actual response, to the given archive.
+// Write the archive once the tests are done, it can then be inspected in a browser devtools.
+// As the requests paths are usually relative, they are prefixed by "http://localhost".
+// Setting the archive to nil disables the export
+//
+// Example:
+//
+//	har := rehapt.NewHAR()
+//	r.SetHARExport(har)
+//	// ... run the testcases
+//	err := har.Write(file)
+func (r *Rehapt) SetHARExport(har *HAR) {
+	r.harExport = har
+}
+
+// addExchange append the executed request and its response to the archive
+func (h *HAR) addExchange(started time.Time, duration time.Duration, request *http.Request, requestBody []byte,
+	response *http.Response, responseBody []byte) {
+	u := request.URL.String()
+	if request.URL.Host == "" {
+		u = exportDefaultHost + u
+	}
+	milliseconds := float64(duration) / float64(time.Millisecond)
+
+	entry := HAREntry{
+		StartedDateTime: started,
+		Time:            milliseconds,
+		Request: HARRequest{
+			Method:      request.Method,
+			URL:         u,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []HARNameValue{},
+			Headers:     harHeaders(request.Header),
+			QueryString: []HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(requestBody),
+		},
+		Response: HARResponse{
+			Status:      response.StatusCode,
+			StatusText:  http.StatusText(response.StatusCode),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []HARNameValue{},
+			Headers:     harHeaders(response.Header),
+			Content: HARContent{
+				Size:     len(responseBody),
+				MimeType: response.Header.Get("Content-Type"),
+			},
+			RedirectURL: response.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(responseBody),
+		},
+		Timings: HARTimings{Wait: milliseconds},
+	}
+
+	query := request.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range query[name] {
+			entry.Request.QueryString = append(entry.Request.QueryString, HARNameValue{Name: name, Value: value})
+		}
+	}
+
+	if len(requestBody) > 0 {
+		entry.Request.PostData = &HARPostData{
+			MimeType: request.Header.Get("Content-Type"),
+			Text:     string(requestBody),
+		}
+	}
+
+	if utf8.Valid(responseBody) {
+		entry.Response.Content.Text = string(responseBody)
+	} else {
+		entry.Response.Content.Text = base64.StdEncoding.EncodeToString(responseBody)
+		entry.Response.Content.Encoding = "base64"
+	}
+
+	h.Log.Entries = append(h.Log.Entries, entry)
+}
+
+// harHeaders converts the headers, sorted by name so the archive is the same on each run
+func harHeaders(header http.Header) []HARNameValue {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	headers := []HARNameValue{}
+	for _, name := range names {
+		for _, value := range header[name] {
+			headers = append(headers, HARNameValue{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+// isJSONMimeType returns true for "application/json" and its variants like "application/problem+json"
+func isJSONMimeType(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
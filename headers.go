@@ -0,0 +1,132 @@
+package rehapt
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// HeaderMode defines how the expected response headers are compared with the actual ones, see Rehapt.SetHeaderMode
+type HeaderMode int
+
+const (
+	// HeaderModeSubset only checks the expected headers, the other actual headers are ignored
+	HeaderModeSubset HeaderMode = iota
+	// HeaderModeExact expects exactly the listed headers
+	HeaderModeExact
+)
+
+// SetHeaderMode change how the TestResponse.Headers given as H or M are compared, independently of
+// the default map mode. By default, with HeaderModeSubset, only the expected headers are checked:
+// a response always has more headers than the ones a testcase cares about. HeaderModeExact expects
+// exactly the listed headers. The PartialM and ExactM headers are always compared as such.
+// In all the modes, a header expected with a single value can be written without its slice,
+// like M{"Content-Type": "application/json"}
+func (r *Rehapt) SetHeaderMode(mode HeaderMode) {
+	r.headerMode = mode
+}
+
+// expectedHeaders returns the expected headers as a PartialM or an ExactM depending on the header mode,
+// with the single values wrapped in a slice. The other types, like CompareFn, are returned as is
+func (r *Rehapt) expectedHeaders(expected interface{}) interface{} {
+	v := reflect.ValueOf(expected)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return expected
+	}
+	headers := make(map[string]interface{}, v.Len())
+	for _, key := range v.MapKeys() {
+		value := v.MapIndex(key).Interface()
+		if str, ok := value.(string); ok == true {
+			value = S{str}
+		}
+		headers[key.String()] = value
+	}
+	switch {
+	case v.Type() == reflect.TypeOf(ExactM{}):
+		return ExactM(headers)
+	case v.Type() == reflect.TypeOf(PartialM{}):
+		return PartialM(headers)
+	case r.headerMode == HeaderModeExact:
+		return ExactM(headers)
+	default:
+		return PartialM(headers)
+	}
+}
+
+// SetLenientHeaders makes the response headers comparison ignore the case of the header names
+// and the order of their values: H{"x-request-id": {"b", "a"}} then matches a X-Request-Id header
+// with the values "a" and "b".
+// When disabled, which is the default, the error explains the mismatches only due to the case
+// of the names or the order of the values
+func (r *Rehapt) SetLenientHeaders(enabled bool) {
+	r.lenientHeaders = enabled
+}
+
+// lenientHeaders returns the expected headers with canonical names and unsorted values,
+// and the actual headers with canonical names. The values of the actual headers having
+// the same canonical name are merged
+func lenientHeaders(expected interface{}, actual http.Header) (interface{}, http.Header) {
+	canonicalActual := make(http.Header, len(actual))
+	for name, values := range actual {
+		key := http.CanonicalHeaderKey(name)
+		canonicalActual[key] = append(canonicalActual[key], values...)
+	}
+
+	v := reflect.ValueOf(expected)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return expected, canonicalActual
+	}
+	// The unsorted values cannot be stored in H, so it becomes a M
+	canonicalExpected := reflect.ValueOf(M{})
+	if v.Type().Elem().Kind() == reflect.Interface {
+		canonicalExpected = reflect.MakeMap(v.Type())
+	}
+	for _, key := range v.MapKeys() {
+		values := unsortedValues(v.MapIndex(key).Interface())
+		canonicalExpected.SetMapIndex(reflect.ValueOf(http.CanonicalHeaderKey(key.String())).Convert(v.Type().Key()), reflect.ValueOf(values))
+	}
+	return canonicalExpected.Interface(), canonicalActual
+}
+
+// unsortedValues converts the slice of expected values to an UnsortedS, the other values are kept as is
+func unsortedValues(values interface{}) interface{} {
+	v := reflect.ValueOf(values)
+	if v.Kind() != reflect.Slice || v.Type() == reflect.TypeOf(UnsortedS{}) {
+		return values
+	}
+	unsorted := make(UnsortedS, v.Len())
+	for i := range unsorted {
+		unsorted[i] = v.Index(i).Interface()
+	}
+	return unsorted
+}
+
+// headersHint explains the header mismatches only due to the case of the names or the order of the values,
+// one line per header. It returns an empty string if there is nothing to explain
+func (r *Rehapt) headersHint(expected interface{}, actual http.Header) string {
+	v := reflect.ValueOf(expected)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return ""
+	}
+	var hints []string
+	for _, key := range sortedMapKeys(v) {
+		name := key.String()
+		actualValues, found := actual[name]
+		if found == false {
+			for actualName := range actual {
+				if strings.EqualFold(actualName, name) == true {
+					hints = append(hints, fmt.Sprintf("header %v is named %v in the response. Use the canonical name %v or SetLenientHeaders() to ignore the case",
+						name, actualName, http.CanonicalHeaderKey(name)))
+					break
+				}
+			}
+			continue
+		}
+		expectedValues := v.MapIndex(key).Interface()
+		if r.tryCompare(expectedValues, actualValues) != nil && r.tryCompare(unsortedValues(expectedValues), actualValues) == nil {
+			hints = append(hints, fmt.Sprintf("header %v has the expected values in a different order. Use UnsortedS or SetLenientHeaders() to ignore the order", name))
+		}
+	}
+	return strings.Join(hints, "\n")
+}
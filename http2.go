@@ -0,0 +1,29 @@
+//go:build go1.24
+// +build go1.24
+
+package rehapt
+
+import (
+	"net/http"
+)
+
+// NewHTTP2Client build an http.Client using only HTTP/2, to be given to NewRemoteHandler.
+// With unencrypted, the client speaks h2c, HTTP/2 without TLS, to the "http://" servers:
+// it is useful for the local servers. Otherwise HTTP/2 is negotiated with the "https://" servers
+// and the requests fail if the server does not support it.
+// Check the negotiated protocol with TestResponse.Proto
+//
+// Example:
+//
+//	handler, err := NewRemoteHandler("http://localhost:8080", NewHTTP2Client(true))
+func NewHTTP2Client(unencrypted bool) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	protocols := new(http.Protocols)
+	if unencrypted == true {
+		protocols.SetUnencryptedHTTP2(true)
+	} else {
+		protocols.SetHTTP2(true)
+	}
+	transport.Protocols = protocols
+	return &http.Client{Transport: transport}
+}
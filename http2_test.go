@@ -0,0 +1,64 @@
+//go:build go1.24
+// +build go1.24
+
+package rehapt_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/thib-ack/rehapt"
+)
+
+func TestOKHTTP2Client(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Proto", req.Proto)
+		_, _ = fmt.Fprintf(w, `{"id":"1"}`)
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	handler, err := NewRemoteHandler(server.URL, NewHTTP2Client(true))
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	r := NewRehapt(t, handler)
+	r.SetHeaderMode(HeaderModeExact)
+
+	err = r.Test(TestCase{
+		Request: TestRequest{Method: "GET", Path: "/user/1"},
+		Response: TestResponse{
+			Code:  http.StatusOK,
+			Proto: "HTTP/2.0",
+			Headers: H{
+				"X-Proto":        {"HTTP/2.0"},
+				"Content-Type":   {"text/plain; charset=utf-8"},
+				"Content-Length": {"10"},
+				"Date":           {"$date$"},
+			},
+			Body: M{"id": "1"},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The default client speaks HTTP/1.1 to the same server
+	handler, err = NewRemoteHandler(server.URL, nil)
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	r = NewRehapt(t, handler)
+	err = r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/user/1"},
+		Response: TestResponse{Code: http.StatusOK, Proto: "HTTP/2.0", Body: M{"id": "1"}},
+	})
+	if err == nil || err.Error() != "response protocol does not match. Expected HTTP/2.0, got HTTP/1.1" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package rehapt
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Reserved variable name used to store the id of the last JSON-RPC request
+const jsonRPCIDVar = "jsonrpc.id"
+
+// jsonRPCLastID is the last id generated for the JSON-RPC requests without ID
+var jsonRPCLastID int64
+
+// JSONRPC declare a JSON-RPC 2.0 request body. It is sent as
+// {"jsonrpc": "2.0", "method": Method, "params": Params, "id": ID}, params being omitted if nil.
+// When ID is nil, a unique numeric id is generated. The id is stored in the reserved "jsonrpc.id"
+// variable, so JSONRPCResult() and JSONRPCError() check the response correlates with the request
+//
+// Example:
+//
+//	r.TestAssert(TestCase{
+//	    Request:  TestRequest{Method: "POST", Path: "/rpc", Body: JSONRPC{Method: "user.get", Params: M{"id": 1}}},
+//	    Response: TestResponse{Code: http.StatusOK, Body: JSONRPCResult(M{"name": "John"})},
+//	})
+type JSONRPC struct {
+	Method string
+	Params interface{}
+	ID     interface{}
+}
+
+// jsonRPCBody returns the JSON-RPC envelope of the request and stores its id
+func (r *Rehapt) jsonRPCBody(rpc JSONRPC) (interface{}, error) {
+	if rpc.Method == "" {
+		return nil, fmt.Errorf("incomplete JSON-RPC request. Missing method")
+	}
+	id := rpc.ID
+	if id == nil {
+		id = atomic.AddInt64(&jsonRPCLastID, 1)
+	}
+	r.storeVar(jsonRPCIDVar, id)
+
+	body := M{"jsonrpc": "2.0", "method": rpc.Method, "id": id}
+	if rpc.Params != nil {
+		body["params"] = rpc.Params
+	}
+	return body, nil
+}
+
+// jsonRPCMatcher is the Matcher returned by JSONRPCResult() and JSONRPCError()
+type jsonRPCMatcher struct {
+	member   string
+	expected interface{}
+}
+
+// JSONRPCResult expects a JSON-RPC 2.0 success response with the given result,
+// and the id of the last JSONRPC request
+func JSONRPCResult(result interface{}) Matcher {
+	return jsonRPCMatcher{member: "result", expected: result}
+}
+
+// JSONRPCError expects a JSON-RPC 2.0 error response with the given code and message,
+// and the id of the last JSONRPC request. The optional error data is ignored
+func JSONRPCError(code interface{}, message interface{}) Matcher {
+	return jsonRPCMatcher{member: "error", expected: PartialM{"code": code, "message": message}}
+}
+
+func (m jsonRPCMatcher) Match(r *Rehapt, actual interface{}) error {
+	response, ok := actual.(map[string]interface{})
+	if ok == false {
+		return newMismatch(MismatchType, m.expected, actual, "expected a JSON-RPC response, got %v", r.formatValue(actual))
+	}
+	// Report the other member explicitly, the whole envelope is not interesting
+	if m.member == "result" && response["error"] != nil {
+		return newMismatch(MismatchValue, m.expected, actual, "expected a JSON-RPC result, got error %v", r.formatValue(response["error"]))
+	}
+	if m.member == "error" && response["error"] == nil {
+		return newMismatch(MismatchValue, m.expected, actual, "expected a JSON-RPC error, got result %v", r.formatValue(response["result"]))
+	}
+	return r.compare(ExactM{
+		"jsonrpc": "2.0",
+		"id":      LoadVar(jsonRPCIDVar),
+		m.member:  m.expected,
+	}, actual)
+}
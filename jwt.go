@@ -0,0 +1,89 @@
+package rehapt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// SignJWT mints a signed JSON Web Token holding the given claims, and stores it in the variable name.
+// The algorithm depends on the key type: []byte signs with HS256, *rsa.PrivateKey with RS256
+// and *ecdsa.PrivateKey, on the P-256 curve, with ES256. The claims are encoded as is,
+// so "exp", "iat" or "scope" must be set by the caller
+//
+// Example:
+//
+//	token, err := r.SignJWT("admintoken", M{"sub": "1", "role": "admin", "exp": time.Now().Add(time.Hour).Unix()}, secret)
+//	r.TestAssert(TestCase{
+//	    Request:  TestRequest{Method: "DELETE", Path: "/api/user/2", Headers: H{"Authorization": {"Bearer " + token}}},
+//	    Response: TestResponse{Code: http.StatusNoContent},
+//	})
+func (r *Rehapt) SignJWT(name string, claims map[string]interface{}, key interface{}) (string, error) {
+	if r.validVarname(name) == false {
+		return "", fmt.Errorf("invalid variable name %v", name)
+	}
+	token, err := signJWT(claims, key)
+	if err != nil {
+		return "", err
+	}
+	r.storeVar(name, token)
+	return token, nil
+}
+
+// signJWT returns the token signed with the algorithm matching the key type
+func signJWT(claims map[string]interface{}, key interface{}) (string, error) {
+	algorithm := ""
+	switch k := key.(type) {
+	case []byte:
+		algorithm = "HS256"
+	case *rsa.PrivateKey:
+		algorithm = "RS256"
+	case *ecdsa.PrivateKey:
+		if k.Curve.Params().BitSize != 256 {
+			return "", fmt.Errorf("cannot sign JWT. Only the P-256 curve is supported for ECDSA keys")
+		}
+		algorithm = "ES256"
+	default:
+		return "", fmt.Errorf("cannot sign JWT. Unsupported key type %T, only []byte, *rsa.PrivateKey or *ecdsa.PrivateKey supported", key)
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": algorithm, "typ": "JWT"})
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal JWT header. %v", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal JWT claims. %v", err)
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(unsigned))
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		_, _ = mac.Write([]byte(unsigned))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			return "", fmt.Errorf("cannot sign JWT. %v", err)
+		}
+	case *ecdsa.PrivateKey:
+		sigR, sigS, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			return "", fmt.Errorf("cannot sign JWT. %v", err)
+		}
+		// The signature is the concatenation of R and S, each padded to 32 bytes
+		signature = make([]byte, 64)
+		rBytes, sBytes := sigR.Bytes(), sigS.Bytes()
+		copy(signature[32-len(rBytes):32], rBytes)
+		copy(signature[64-len(sBytes):], sBytes)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,71 @@
+package rehapt
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ResponseSizePolicy defines what happens when a response body is larger than the limit, see Rehapt.SetMaxResponseBytes
+type ResponseSizePolicy int
+
+const (
+	// ResponseSizeFail fails the testcase, reporting the actual size of the body
+	ResponseSizeFail ResponseSizePolicy = iota
+	// ResponseSizeTruncate keeps the first bytes of the body, up to the limit, and logs a warning.
+	// The truncated body is then decoded and compared as usual
+	ResponseSizeTruncate
+)
+
+// SetMaxResponseBytes limits the size of the response bodies kept in memory, so a buggy endpoint
+// writing gigabytes does not crash the test process. The bytes above the limit are counted then discarded
+// as the handler writes them. What happens next depends on the policy, see SetResponseSizePolicy.
+// Zero, the default, means no limit
+func (r *Rehapt) SetMaxResponseBytes(n int64) {
+	r.maxResponseBytes = n
+}
+
+// SetResponseSizePolicy defines what happens when a response body is larger than SetMaxResponseBytes.
+// The default is ResponseSizeFail
+func (r *Rehapt) SetResponseSizePolicy(policy ResponseSizePolicy) {
+	r.responseSizePolicy = policy
+}
+
+// limitedWriter is an http.ResponseWriter discarding the bytes above the limit, while counting them
+type limitedWriter struct {
+	http.ResponseWriter
+	limit   int64
+	written int64
+}
+
+func (w *limitedWriter) Write(data []byte) (int, error) {
+	kept := w.limit - w.written
+	w.written += int64(len(data))
+	if kept <= 0 {
+		return len(data), nil
+	}
+	if int64(len(data)) > kept {
+		if _, err := w.ResponseWriter.Write(data[:kept]); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *limitedWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok == true {
+		flusher.Flush()
+	}
+}
+
+// checkResponseSize applies the policy when the body written by the handler exceeded the limit
+func (r *Rehapt) checkResponseSize(w *limitedWriter, request *http.Request) error {
+	if w.written <= w.limit {
+		return nil
+	}
+	if r.responseSizePolicy == ResponseSizeTruncate {
+		r.logReport(r.errorHandler, "response truncated", fmt.Sprintf("response body of %v %v truncated. Got %d bytes, the limit is %d", request.Method, request.URL, w.written, w.limit))
+		return nil
+	}
+	return fmt.Errorf("response body too large. Got %d bytes, the limit is %d", w.written, w.limit)
+}
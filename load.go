@@ -0,0 +1,227 @@
+package rehapt
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the latency histogram buckets. The last bucket holds the latencies above
+var loadHistogramBounds = []time.Duration{
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2 * time.Second,
+	5 * time.Second,
+}
+
+// WeightedTestCase is a TestCase of a load mix.
+// Its probability to be picked is its Weight divided by the sum of the weights
+type WeightedTestCase struct {
+	Weight   int
+	TestCase TestCase
+}
+
+// LoadOptions describes how the load is generated by Load()
+type LoadOptions struct {
+	// RPS is the target number of requests per second
+	RPS float64
+	// Duration is how long the load is generated
+	Duration time.Duration
+	// Users is the number of virtual users executing the requests in parallel. Default is 1.
+	// It must be high enough to reach the target RPS
+	Users int
+	// Setup is executed once by each virtual user before the load starts, for example to login.
+	// The variables it stores are then available to the testcases of this user
+	Setup []TestCase
+}
+
+// LoadResult is the result of a load test
+type LoadResult struct {
+	// Requests is the number of executed testcases
+	Requests int
+	// Errors is the number of executions which failed, because of an error or a response not matching
+	Errors int
+	// FirstError is the error of the first failed execution, nil if none failed
+	FirstError error
+	// Missed is the number of requests not sent because all the users were busy.
+	// If not zero, the target RPS has not been reached
+	Missed int
+	// Duration is the actual duration of the load test
+	Duration time.Duration
+	// Throughput is the actual number of requests per second
+	Throughput float64
+	// ErrorRate is the ratio of failed requests, between 0 and 1
+	ErrorRate float64
+	Min       time.Duration
+	Max       time.Duration
+	Mean      time.Duration
+	P50       time.Duration
+	P95       time.Duration
+	P99       time.Duration
+	// Histogram is the number of requests per latency range
+	Histogram []LoadBucket
+}
+
+// LoadBucket is a range of the latency histogram, holding the latencies up to UpperBound.
+// The UpperBound of the last bucket is zero, it holds all the latencies above the previous one
+type LoadBucket struct {
+	UpperBound time.Duration
+	Count      int
+}
+
+// String returns a one line summary of the result
+func (l LoadResult) String() string {
+	return fmt.Sprintf("%d requests in %v (%.1f req/s), %d errors (%.2f%%), %d missed, latency min %v mean %v p50 %v p95 %v p99 %v max %v",
+		l.Requests, l.Duration, l.Throughput, l.Errors, l.ErrorRate*100, l.Missed, l.Min, l.Mean, l.P50, l.P95, l.P99, l.Max)
+}
+
+// Load executes the testcases at the target rate for the given duration, and returns the throughput,
+// error rate and latencies. The testcase of each request is picked randomly according to the weights.
+// Each response is still compared with the expected one, the failed executions are counted in Errors.
+//
+// Each virtual user uses its own Fork() of this instance and first executes the Setup testcases,
+// so the load can be scripted like real users:
+//
+//	result, err := r.Load([]WeightedTestCase{
+//	    {Weight: 9, TestCase: listOrders},
+//	    {Weight: 1, TestCase: createOrder},
+//	}, LoadOptions{RPS: 100, Duration: 10 * time.Second, Users: 20, Setup: []TestCase{login}})
+//
+// The http.Handler must support concurrent requests.
+// An error is returned if the options are invalid or if the Setup of a user fails
+func (r *Rehapt) Load(testcases []WeightedTestCase, options LoadOptions) (LoadResult, error) {
+	totalWeight := 0
+	for _, testcase := range testcases {
+		if testcase.Weight <= 0 {
+			return LoadResult{}, fmt.Errorf("invalid load weight %d, must be positive", testcase.Weight)
+		}
+		totalWeight += testcase.Weight
+	}
+	if totalWeight == 0 {
+		return LoadResult{}, fmt.Errorf("no testcase to load")
+	}
+	if options.RPS <= 0 {
+		return LoadResult{}, fmt.Errorf("invalid load RPS %v, must be positive", options.RPS)
+	}
+	if options.Duration <= 0 {
+		return LoadResult{}, fmt.Errorf("invalid load duration %v, must be positive", options.Duration)
+	}
+	usersCount := options.Users
+	if usersCount <= 0 {
+		usersCount = 1
+	}
+
+	users := make([]*Rehapt, usersCount)
+	for i := range users {
+		users[i] = r.Fork()
+		for _, testcase := range options.Setup {
+			if err := users[i].Test(testcase); err != nil && IsSkipped(err) == false {
+				return LoadResult{}, fmt.Errorf("setup of user %d failed. %v", i, err)
+			}
+		}
+	}
+
+	var mutex sync.Mutex
+	var latencies []time.Duration
+	result := LoadResult{}
+
+	// The requests are dispatched to the available users at the target rate
+	requests := make(chan struct{})
+	var wg sync.WaitGroup
+	seed := time.Now().UnixNano()
+	for i, user := range users {
+		wg.Add(1)
+		go func(user *Rehapt, random *rand.Rand) {
+			defer wg.Done()
+			for range requests {
+				testcase := pickWeighted(testcases, totalWeight, random)
+				start := time.Now()
+				err := user.Test(testcase)
+				latency := time.Since(start)
+				if IsSkipped(err) == true {
+					continue
+				}
+
+				mutex.Lock()
+				latencies = append(latencies, latency)
+				if err != nil {
+					if result.FirstError == nil {
+						result.FirstError = err
+					}
+					result.Errors++
+				}
+				mutex.Unlock()
+			}
+		}(user, rand.New(rand.NewSource(seed+int64(i))))
+	}
+
+	interval := time.Duration(float64(time.Second) / options.RPS)
+	if interval <= 0 {
+		interval = 1
+	}
+	started := time.Now()
+	deadline := started.Add(options.Duration)
+	ticker := time.NewTicker(interval)
+	for now := range ticker.C {
+		if now.After(deadline) {
+			break
+		}
+		select {
+		case requests <- struct{}{}:
+		default:
+			result.Missed++
+		}
+	}
+	ticker.Stop()
+	close(requests)
+	wg.Wait()
+
+	result.Duration = time.Since(started)
+	result.Requests = len(latencies)
+	result.Throughput = float64(result.Requests) / result.Duration.Seconds()
+	if result.Requests > 0 {
+		result.ErrorRate = float64(result.Errors) / float64(result.Requests)
+	}
+	stats := newLatencyStats(latencies)
+	result.Min, result.Max, result.Mean = stats.Min, stats.Max, stats.Mean
+	result.P50, result.P95, result.P99 = stats.Percentile(50), stats.Percentile(95), stats.Percentile(99)
+	result.Histogram = loadHistogram(latencies)
+	return result, nil
+}
+
+// pickWeighted returns a random testcase according to the weights
+func pickWeighted(testcases []WeightedTestCase, totalWeight int, random *rand.Rand) TestCase {
+	n := random.Intn(totalWeight)
+	for _, testcase := range testcases {
+		if n < testcase.Weight {
+			return testcase.TestCase
+		}
+		n -= testcase.Weight
+	}
+	return testcases[len(testcases)-1].TestCase
+}
+
+// loadHistogram counts the latencies per bucket
+func loadHistogram(latencies []time.Duration) []LoadBucket {
+	histogram := make([]LoadBucket, len(loadHistogramBounds)+1)
+	for i, bound := range loadHistogramBounds {
+		histogram[i].UpperBound = bound
+	}
+	for _, latency := range latencies {
+		i := 0
+		for i < len(loadHistogramBounds) && latency > loadHistogramBounds[i] {
+			i++
+		}
+		histogram[i].Count++
+	}
+	return histogram
+}
@@ -0,0 +1,40 @@
+package rehapt
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Value written instead of the redacted header values
+const redactedValue = "[REDACTED]"
+
+// requestLogger writes a transcript of every exchange, see SetRequestLogger
+type requestLogger struct {
+	w        io.Writer
+	redacted []string
+}
+
+// SetRequestLogger allow to write every executed request and its response in a readable transcript,
+// whether the testcase succeeds or not. It is meant to keep an audit trail of the runs against a real server.
+// The values of the redactedHeaders, like Authorization or Cookie, are replaced by [REDACTED].
+// Setting the writer to nil disables the logger
+//
+// Example:
+//
+//	r.SetRequestLogger(file, "Authorization", "Set-Cookie")
+func (r *Rehapt) SetRequestLogger(w io.Writer, redactedHeaders ...string) {
+	if w == nil {
+		r.requestLogger = nil
+		return
+	}
+	r.requestLogger = &requestLogger{w: w, redacted: redactedHeaders}
+}
+
+// log writes the exchange to the transcript, preceded by its date and duration
+func (logger *requestLogger) log(started time.Time, duration time.Duration, request *http.Request, requestBody []byte, response *http.Response, responseBody []byte) error {
+	_, err := fmt.Fprintf(logger.w, "=== %v %v %v (%v)\n%v\n\n", started.Format(time.RFC3339), request.Method, request.URL, duration,
+		dumpExchange(request, requestBody, response, responseBody, logger.redacted))
+	return err
+}
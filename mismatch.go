@@ -0,0 +1,278 @@
+package rehapt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// MismatchKind describes why an actual value does not match the expected one
+type MismatchKind string
+
+const (
+	// MismatchValue means the values have the same kind but are different
+	MismatchValue MismatchKind = "value"
+	// MismatchType means the values have different kinds, like a string expected but a number received
+	MismatchType MismatchKind = "type"
+	// MismatchSize means the slices or maps have different sizes
+	MismatchSize MismatchKind = "size"
+	// MismatchMissing means an expected map key or unsorted slice element is not found
+	MismatchMissing MismatchKind = "missing"
+	// MismatchUnexpected means an actual unsorted slice element is not expected
+	MismatchUnexpected MismatchKind = "unexpected"
+	// MismatchPresent means a map key expected to be absent, see Absent(), is present
+	MismatchPresent MismatchKind = "present"
+	// MismatchNil means only one of the expected and actual values is nil
+	MismatchNil MismatchKind = "nil"
+	// MismatchComparer means a CompareFn, like Regexp() or TimeDelta(), reported an error
+	MismatchComparer MismatchKind = "comparer"
+)
+
+// Mismatch describes one difference between the expected and the actual response
+type Mismatch struct {
+	// Path locates the value in the response, like code, headers.Content-Type[0] or body.pets[0].id
+	Path string
+	// Expected is the expected value. It is the CompareFn for the MismatchComparer kind
+	Expected interface{}
+	// Actual is the received value
+	Actual interface{}
+	Kind   MismatchKind
+	// Message describes the mismatch, as it appears in the error message
+	Message string
+}
+
+// MismatchError is the error returned by Test() when the response does not match the expected one.
+// Its message is the same as the other errors, and it exposes each mismatch so they can be
+// consumed without parsing the message. Get it with errors.As() or a type assertion:
+//
+//	if mismatchErr, ok := err.(*rehapt.MismatchError); ok == true {
+//	    for _, mismatch := range mismatchErr.Mismatches {
+//	        fmt.Println(mismatch.Path, mismatch.Kind)
+//	    }
+//	}
+type MismatchError struct {
+	Mismatches []Mismatch
+	// lines are the lines of the message of a comparison, located from the compared value
+	lines   []mismatchLine
+	message string
+}
+
+// mismatchLine is a line of the error message, prefixed by its path when it is not on the compared value
+type mismatchLine struct {
+	path string
+	text string
+}
+
+func (e *MismatchError) Error() string {
+	return e.message
+}
+
+// newMismatch builds the error of a comparison reporting one mismatch, located on the compared value
+func newMismatch(kind MismatchKind, expected interface{}, actual interface{}, format string, args ...interface{}) *MismatchError {
+	message := fmt.Sprintf(format, args...)
+	return &MismatchError{
+		Mismatches: []Mismatch{{Expected: expected, Actual: actual, Kind: kind, Message: message}},
+		lines:      []mismatchLine{{text: message}},
+		message:    message,
+	}
+}
+
+// newMismatches builds the error of a comparison of nested values, like maps and slices.
+// Each line of the message starts with its path, so the nested errors have the same format at any depth:
+//
+//	pets[2].owner.id: strings does not match. Expected '1', got '2'
+func newMismatches(mismatches []Mismatch, lines []mismatchLine) *MismatchError {
+	texts := make([]string, len(lines))
+	for i, line := range lines {
+		texts[i] = line.text
+		if line.path != "" {
+			texts[i] = line.path + ": " + line.text
+		}
+	}
+	return &MismatchError{Mismatches: mismatches, lines: lines, message: strings.Join(texts, "\n")}
+}
+
+// asMismatch converts any error of a comparison to a *MismatchError.
+// The errors of the CompareFn are reported as one MismatchComparer mismatch
+func asMismatch(err error, expected interface{}, actual interface{}) *MismatchError {
+	if mismatchErr, ok := err.(*MismatchError); ok == true && mismatchErr.lines != nil {
+		return mismatchErr
+	}
+	return newMismatch(MismatchComparer, expected, actual, "%v", err)
+}
+
+// mismatchesAt returns the mismatches of the error, located under the given path segment
+func mismatchesAt(segment string, err *MismatchError) []Mismatch {
+	mismatches := make([]Mismatch, len(err.Mismatches))
+	for i, mismatch := range err.Mismatches {
+		mismatch.Path = joinMismatchPath(segment, mismatch.Path)
+		mismatches[i] = mismatch
+	}
+	return mismatches
+}
+
+// linesAt returns the message lines of the error, located under the given path segment
+func linesAt(segment string, err *MismatchError) []mismatchLine {
+	lines := make([]mismatchLine, len(err.lines))
+	for i, line := range err.lines {
+		lines[i] = mismatchLine{path: joinMismatchPath(segment, line.path), text: line.text}
+	}
+	return lines
+}
+
+// joinMismatchPath joins the path segments, using the dot notation for the map keys
+func joinMismatchPath(segment string, path string) string {
+	if path == "" || strings.HasPrefix(path, "[") {
+		return segment + path
+	}
+	if segment == "" {
+		return path
+	}
+	return segment + "." + path
+}
+
+// Default number of array elements and object keys written by the error messages, see SetMaxFormattedElements
+const defaultMaxFormattedElements = 100
+
+// formatValue formats a value for the error messages. The maps and slices are written as indented JSON,
+// which is more readable than the Go formatting for nested values and shows the strings quoted.
+// The CompareFn are written as <CompareFn>. At most defaultMaxFormattedElements elements are written
+func formatValue(value interface{}) string {
+	return formatLimitedValue(value, defaultMaxFormattedElements)
+}
+
+// formatValue works like the formatValue function, with the limit set by SetMaxFormattedElements
+func (r *Rehapt) formatValue(value interface{}) string {
+	return formatLimitedValue(value, r.maxFormattedElements)
+}
+
+// formatLimitedValue formats the value, writing at most maxElements elements of its arrays and objects.
+// Zero means no limit
+func formatLimitedValue(value interface{}, maxElements int) string {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Map && v.Kind() != reflect.Slice {
+		return fmt.Sprint(value)
+	}
+	var budget *int
+	if maxElements > 0 {
+		budget = &maxElements
+	}
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(limitedFormattable(v, budget)); err != nil {
+		return fmt.Sprint(value)
+	}
+	return strings.TrimSuffix(data.String(), "\n")
+}
+
+// Maximum length of the values previewed by shapeHint
+const previewMaxLength = 60
+
+// shapeHint previews the top-level structure of an actual array or object, so the user sees at once
+// that the response is, for example, a list instead of the expected object:
+//
+//	. Actual is a 3-element array starting with {"id":1,"name":"John"}
+func shapeHint(actual reflect.Value) string {
+	switch actual.Kind() {
+	case reflect.Slice:
+		if actual.Len() == 0 {
+			return ". Actual is an empty array"
+		}
+		return fmt.Sprintf(". Actual is a %d-element array starting with %v", actual.Len(), previewValue(actual.Index(0)))
+	case reflect.Map:
+		if actual.Len() == 0 {
+			return ". Actual is an empty object"
+		}
+		var keys []string
+		for _, key := range sortedMapKeys(actual) {
+			keys = append(keys, fmt.Sprint(key.Interface()))
+		}
+		return fmt.Sprintf(". Actual is an object with keys %v", truncate(strings.Join(keys, ", "), previewMaxLength))
+	default:
+		return ""
+	}
+}
+
+// previewValue formats the value as compact JSON, truncated to previewMaxLength
+func previewValue(v reflect.Value) string {
+	// Each element is written with at least one character
+	budget := previewMaxLength
+	data, err := json.Marshal(limitedFormattable(v, &budget))
+	if err != nil {
+		return truncate(fmt.Sprint(v.Interface()), previewMaxLength)
+	}
+	return truncate(string(data), previewMaxLength)
+}
+
+// truncate keeps the first characters of the string, followed by "..." if it is longer
+func truncate(str string, length int) string {
+	runes := []rune(str)
+	if len(runes) <= length {
+		return str
+	}
+	return string(runes[:length]) + "..."
+}
+
+// jsonFormattable converts the value so it can be marshaled to JSON whatever its map keys and CompareFn
+func jsonFormattable(v reflect.Value) interface{} {
+	return limitedFormattable(v, nil)
+}
+
+// limitedFormattable works like jsonFormattable, but stops converting the elements once the budget is spent,
+// so a huge value is not converted only to build an error message. The remaining elements are counted
+// in a last array element, or a "..." key. A nil budget means no limit
+func limitedFormattable(v reflect.Value, budget *int) interface{} {
+	if v.IsValid() == false {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() == true {
+			return nil
+		}
+		return limitedFormattable(v.Elem(), budget)
+	case reflect.Map:
+		keys := v.MapKeys()
+		// The written keys must not depend on the map order
+		if budget != nil && len(keys) > *budget {
+			keys = sortedMapKeys(v)
+		}
+		m := make(map[string]interface{}, len(keys))
+		for i, key := range keys {
+			if budget != nil && *budget <= 0 {
+				m["..."] = fmt.Sprintf("%d more keys", len(keys)-i)
+				break
+			}
+			if budget != nil {
+				*budget--
+			}
+			m[fmt.Sprint(key.Interface())] = limitedFormattable(v.MapIndex(key), budget)
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		// []byte is marshaled as base64 otherwise
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			return string(v.Bytes())
+		}
+		s := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if budget != nil && *budget <= 0 {
+				s = append(s, fmt.Sprintf("... %d more elements", v.Len()-i))
+				break
+			}
+			if budget != nil {
+				*budget--
+			}
+			s = append(s, limitedFormattable(v.Index(i), budget))
+		}
+		return s
+	case reflect.Func:
+		return "<" + v.Type().Name() + ">"
+	default:
+		return v.Interface()
+	}
+}
@@ -0,0 +1,201 @@
+package rehapt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// MockServer is an HTTP server responding with stubs, to replace the dependencies of the application
+// under test. Build it with Rehapt.NewMockServer
+type MockServer struct {
+	r      *Rehapt
+	server *httptest.Server
+	// Protects the stubs and their calls
+	mutex      sync.Mutex
+	stubs      []*Stub
+	unexpected []WebhookCall
+}
+
+// Stub describes a request expected by a MockServer and its response.
+// Build it with MockServer.On() then chain the calls
+type Stub struct {
+	method  string
+	path    interface{}
+	headers interface{}
+	body    interface{}
+	// The response
+	code          int
+	header        http.Header
+	response      interface{}
+	expectedCalls int
+	calls         int
+}
+
+// NewMockServer starts a local HTTP server responding to the requests with the stubs declared by On().
+// Give its URL() to the application under test as the base URL of a dependency.
+// A request matching no stub gets a 404 Not Found and is reported by Verify().
+// Close() must be called to stop the server
+//
+// Example:
+//
+//	payments := r.NewMockServer()
+//	defer payments.Close()
+//	payments.On("POST", "/charges").
+//	    WithBody(PartialM{"amount": 1000}).
+//	    Respond(http.StatusCreated, M{"id": "ch_1"}).
+//	    ExpectCalls(1)
+//	// ... testcases of the application configured with payments.URL()
+//	payments.VerifyAssert()
+func (r *Rehapt) NewMockServer() *MockServer {
+	mock := &MockServer{r: r}
+	mock.server = httptest.NewServer(http.HandlerFunc(mock.serve))
+	return mock
+}
+
+// URL returns the base URL of the server, like "http://127.0.0.1:41234"
+func (m *MockServer) URL() string {
+	return m.server.URL
+}
+
+// Close stops the server
+func (m *MockServer) Close() {
+	m.server.Close()
+}
+
+// On declares a stub for the requests with the method and the path. The path is compared with
+// the request URL path as a response value, so it can be a CompareFn like Regexp() or store a variable.
+// The stubs are tried in their declaration order. By default, the stub responds 200 OK without body.
+// A stub must be configured before the application sends the requests it matches
+func (m *MockServer) On(method string, path interface{}) *Stub {
+	stub := &Stub{method: method, path: path, code: http.StatusOK, header: make(http.Header), expectedCalls: -1}
+	m.mutex.Lock()
+	m.stubs = append(m.stubs, stub)
+	m.mutex.Unlock()
+	return stub
+}
+
+// WithHeaders defines the headers expected in the request, compared as the response headers
+func (s *Stub) WithHeaders(headers interface{}) *Stub {
+	s.headers = headers
+	return s
+}
+
+// WithBody defines the body expected in the request. It is decoded with the unmarshaler
+// of the Rehapt instance and compared as a response body, so PartialM or the matchers can be used
+func (s *Stub) WithBody(body interface{}) *Stub {
+	s.body = body
+	return s
+}
+
+// Respond defines the response code, and the response body encoded with the marshaler of the Rehapt
+// instance. A nil body means no body
+func (s *Stub) Respond(code int, body interface{}) *Stub {
+	s.code = code
+	s.response = body
+	return s
+}
+
+// RespondHeader adds a response header
+func (s *Stub) RespondHeader(name string, value string) *Stub {
+	s.header.Add(name, value)
+	return s
+}
+
+// ExpectCalls defines how many times the stub must be called, checked by MockServer.Verify()
+func (s *Stub) ExpectCalls(times int) *Stub {
+	s.expectedCalls = times
+	return s
+}
+
+// Verify returns an error if a stub has not been called the expected number of times,
+// or if a request matched no stub
+func (m *MockServer) Verify() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var errs []error
+	for _, stub := range m.stubs {
+		if stub.expectedCalls >= 0 && stub.calls != stub.expectedCalls {
+			errs = append(errs, fmt.Errorf("stub %v %v expected %d calls, got %d", stub.method, formatValue(stub.path), stub.expectedCalls, stub.calls))
+		}
+	}
+	for _, call := range m.unexpected {
+		errs = append(errs, fmt.Errorf("unexpected request %v %v", call.Method, call.Path))
+	}
+	return joinErrors(errs...)
+}
+
+// VerifyAssert works exactly like Verify except it reports the error if not nil
+// using the ErrorHandler Errorf() function
+func (m *MockServer) VerifyAssert() {
+	if h, ok := m.r.errorHandler.(interface{ Helper() }); ok == true {
+		h.Helper()
+	}
+	if err := m.Verify(); err != nil {
+		m.r.reportError(err, 1)
+	}
+}
+
+func (m *MockServer) serve(w http.ResponseWriter, req *http.Request) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.mutex.Lock()
+	stub := m.matchStub(req, data)
+	if stub == nil {
+		m.unexpected = append(m.unexpected, WebhookCall{Method: req.Method, Path: req.URL.RequestURI(), Header: cloneHeader(req.Header), Body: data})
+		m.mutex.Unlock()
+		http.Error(w, fmt.Sprintf("no stub matching %v %v", req.Method, req.URL.RequestURI()), http.StatusNotFound)
+		return
+	}
+	stub.calls++
+	code, header, response := stub.code, cloneHeader(stub.header), stub.response
+	m.mutex.Unlock()
+
+	var body []byte
+	if response != nil {
+		if body, err = m.r.marshaler(response); err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal the stub response body. %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(code)
+	_, _ = w.Write(body)
+}
+
+// matchStub returns the first stub matching the request, or nil. The mutex must be locked
+func (m *MockServer) matchStub(req *http.Request, data []byte) *Stub {
+	r := m.r.call()
+	var body interface{}
+	decoded := false
+	for _, stub := range m.stubs {
+		if stub.method != req.Method || r.tryCompare(stub.path, req.URL.Path) != nil {
+			continue
+		}
+		if stub.headers != nil && r.tryCompare(r.expectedHeaders(stub.headers), req.Header) != nil {
+			continue
+		}
+		if stub.body != nil {
+			if decoded == false && len(data) > 0 {
+				if err := r.unmarshaler(data, &body); err != nil {
+					continue
+				}
+				decoded = true
+			}
+			if r.tryCompare(stub.body, body) != nil {
+				continue
+			}
+		}
+		return stub
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package rehapt
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Boundary of the multipart bodies. It is fixed, so the same testcase always sends the same body
+const multipartBoundary = "rehapt-multipart-boundary-3d9f5c1a7e"
+
+// Multipart declare a multipart/form-data request body, like a file upload form.
+// It is encoded by MultipartMarshaler, which is used by default for this body, and the request
+// Content-Type is set with the boundary, unless the testcase headers define it.
+// The fields are sent first, sorted by name, then the files in order
+//
+// Example:
+//
+//	r.TestAssert(TestCase{
+//	    Request: TestRequest{Method: "POST", Path: "/api/avatars", Body: Multipart{
+//	        Fields: map[string]string{"user": "1"},
+//	        Files:  []MultipartFile{{Field: "avatar", Path: "testdata/avatar.png"}},
+//	    }},
+//	    Response: TestResponse{Code: http.StatusCreated},
+//	})
+type Multipart struct {
+	Fields map[string]string
+	Files  []MultipartFile
+}
+
+// MultipartFile is a file part of a Multipart body. Its content is Content, or read from Path if Content is nil.
+// The Filename defaults to the base name of the Path, and the ContentType to application/octet-stream
+type MultipartFile struct {
+	Field       string
+	Filename    string
+	Content     []byte
+	Path        string
+	ContentType string
+}
+
+// MultipartMarshaler encodes a Multipart body as multipart/form-data
+func MultipartMarshaler(v interface{}) ([]byte, error) {
+	var form Multipart
+	switch typed := v.(type) {
+	case Multipart:
+		form = typed
+	case *Multipart:
+		form = *typed
+	default:
+		return nil, fmt.Errorf("only Multipart supported")
+	}
+
+	var data bytes.Buffer
+	writer := multipart.NewWriter(&data)
+	if err := writer.SetBoundary(multipartBoundary); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(form.Fields))
+	for name := range form.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writer.WriteField(name, form.Fields[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, file := range form.Files {
+		if file.Field == "" {
+			return nil, fmt.Errorf("incomplete multipart file. Missing field name")
+		}
+		content := file.Content
+		if content == nil && file.Path != "" {
+			var err error
+			if content, err = ioutil.ReadFile(file.Path); err != nil {
+				return nil, fmt.Errorf("cannot read multipart file. %v", err)
+			}
+		}
+		filename := file.Filename
+		if filename == "" && file.Path != "" {
+			filename = filepath.Base(file.Path)
+		}
+		contentType := file.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, escapeQuotes(file.Field), escapeQuotes(filename)))
+		header.Set("Content-Type", contentType)
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(content); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// escapeQuotes escapes the quoted values of the Content-Disposition header, as done by mime/multipart
+func escapeQuotes(s string) string {
+	return strings.NewReplacer("\\", "\\\\", `"`, "\\\"").Replace(s)
+}
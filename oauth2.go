@@ -0,0 +1,130 @@
+package rehapt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reserved variable name used to store the OAuth2 access token
+const oauth2TokenVar = "oauth2.token"
+
+// oauth2ExpiryDelta is the time before the token expiry when it is already refreshed,
+// so a request is not sent with a token expiring in flight
+const oauth2ExpiryDelta = 10 * time.Second
+
+// oauth2Credentials fetches the access token of UseOAuth2ClientCredentials and refreshes it when expired.
+// It is shared by the forked instances
+type oauth2Credentials struct {
+	mutex        sync.Mutex
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	token        string
+	// expiry is zero when the token does not expire
+	expiry time.Time
+}
+
+// UseOAuth2ClientCredentials fetches an access token from the OAuth2 server at tokenURL
+// with the client credentials grant, and sends it in the Authorization header of all the requests,
+// like a default header. The token is refreshed before each request once it is about to expire,
+// according to the expires_in field of the token response. It is also stored in the reserved
+// "oauth2.token" variable. A testcase can still override the Authorization header.
+// The token is fetched immediately, so the error is reported before the first testcase
+//
+// Example:
+//
+//	err := r.UseOAuth2ClientCredentials("https://auth.example.com/oauth2/token", "id", "secret", []string{"users:read"})
+func (r *Rehapt) UseOAuth2ClientCredentials(tokenURL string, clientID string, clientSecret string, scopes []string) error {
+	if _, err := url.Parse(tokenURL); err != nil {
+		return fmt.Errorf("invalid OAuth2 token URL %v. %v", tokenURL, err)
+	}
+	credentials := &oauth2Credentials{
+		tokenURL:     tokenURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		scopes:       append([]string(nil), scopes...),
+	}
+	if err := r.authorizeOAuth2(credentials); err != nil {
+		return err
+	}
+	r.oauth2 = credentials
+	return nil
+}
+
+// authorizeOAuth2 refreshes the token if needed and updates the Authorization default header
+func (r *Rehapt) authorizeOAuth2(credentials *oauth2Credentials) error {
+	token, err := credentials.accessToken()
+	if err != nil {
+		return err
+	}
+	bearer := "Bearer " + token
+	if r.GetDefaultHeader("Authorization") != bearer {
+		r.SetDefaultHeader("Authorization", bearer)
+		r.storeVar(oauth2TokenVar, token)
+	}
+	return nil
+}
+
+// accessToken returns the current token, or a new one if it is expired
+func (c *oauth2Credentials) accessToken() (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.token != "" && (c.expiry.IsZero() == true || time.Now().Before(c.expiry) == true) {
+		return c.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.scopes) > 0 {
+		form.Set("scope", strings.Join(c.scopes, " "))
+	}
+	request, err := http.NewRequest("POST", c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("cannot fetch OAuth2 token. %v", err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+
+	fetched := time.Now()
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("cannot fetch OAuth2 token. %v", err)
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", fmt.Errorf("cannot fetch OAuth2 token. %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cannot fetch OAuth2 token. Response code %d, body: %v", response.StatusCode, truncate(string(data), unmarshalBodyExcerptLength))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return "", fmt.Errorf("cannot unmarshal OAuth2 token. %v", err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("cannot fetch OAuth2 token. Missing access_token in response: %v", truncate(string(data), unmarshalBodyExcerptLength))
+	}
+	if token.TokenType != "" && strings.EqualFold(token.TokenType, "bearer") == false {
+		return "", fmt.Errorf("unsupported OAuth2 token type %v, only bearer supported", token.TokenType)
+	}
+
+	c.token = token.AccessToken
+	c.expiry = time.Time{}
+	if token.ExpiresIn > 0 {
+		c.expiry = fetched.Add(time.Duration(token.ExpiresIn)*time.Second - oauth2ExpiryDelta)
+	}
+	return c.token, nil
+}
@@ -0,0 +1,47 @@
+package rehapt
+
+import (
+	"net/http"
+	"time"
+)
+
+// Observer is notified of each step of the execution of the testcases.
+// It is the place to plug metrics, logging or custom reporting.
+// Embed NopObserver to implement only some of the methods.
+// The observers are shared with the forked instances, so they must support
+// concurrent calls when the testcases run in parallel
+type Observer interface {
+	// OnTestStart is called when Test() starts, before the skip conditions are checked
+	OnTestStart(testcase TestCase)
+	// OnRequestSent is called just before the request is given to the http.Handler.
+	// The body is the marshaled request body, the request body must not be read
+	OnRequestSent(request *http.Request, body []byte)
+	// OnResponseReceived is called when the http.Handler returns, before the response is checked.
+	// The body is the response body, the response body must not be read
+	OnResponseReceived(response *http.Response, body []byte, duration time.Duration)
+	// OnTestEnd is called when Test() returns, with its error.
+	// The error is a *SkipError if the testcase has been skipped, see IsSkipped
+	OnTestEnd(testcase TestCase, err error)
+}
+
+// NopObserver is an Observer doing nothing.
+// Embed it in your observer to implement only some of the methods
+type NopObserver struct{}
+
+// OnTestStart does nothing
+func (NopObserver) OnTestStart(testcase TestCase) {}
+
+// OnRequestSent does nothing
+func (NopObserver) OnRequestSent(request *http.Request, body []byte) {}
+
+// OnResponseReceived does nothing
+func (NopObserver) OnResponseReceived(response *http.Response, body []byte, duration time.Duration) {}
+
+// OnTestEnd does nothing
+func (NopObserver) OnTestEnd(testcase TestCase, err error) {}
+
+// AddObserver register an Observer notified of each step of the execution of the testcases.
+// The observers are notified in the order they were added
+func (r *Rehapt) AddObserver(observer Observer) {
+	r.observers = append(r.observers, observer)
+}
@@ -0,0 +1,179 @@
+package rehapt
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// OutboundCall is a request sent by the application under test through an OutboundCapture
+type OutboundCall struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+}
+
+// OutboundCheck expects outbound calls to be made while handling the request, see CaptureOutbound.
+// A call matches if it has the Method, if not empty, and if its URL and decoded Body match URL and Body,
+// if not nil, compared as response values. Count is the expected number of matching calls, compared
+// as a response value, like 2 or 0. When nil, at least one call is expected
+type OutboundCheck struct {
+	Method string
+	URL    interface{}
+	Body   interface{}
+	Count  interface{}
+}
+
+// OutboundCapture is an http.RoundTripper recording the requests, see Rehapt.CaptureOutbound
+type OutboundCapture struct {
+	// Transport sends the captured requests. When nil, the requests are not sent
+	// and the response is a 200 OK without body
+	Transport http.RoundTripper
+	mutex     sync.Mutex
+	calls     []OutboundCall
+}
+
+// CaptureOutbound returns an http.RoundTripper recording the requests, to be used as the transport
+// of the http.Client of the application under test. By default the requests are not sent, so no network
+// is needed, see OutboundCapture.Transport. The calls made while handling the request of a testcase
+// are checked by its TestCase.Outbound checks. The capture is shared by the forked instances
+//
+// Example:
+//
+//	app := NewApp(&http.Client{Transport: r.CaptureOutbound()})
+//	r.TestAssert(TestCase{
+//	    Request:  TestRequest{Method: "POST", Path: "/api/orders", Body: M{"amount": 1000}},
+//	    Response: TestResponse{Code: http.StatusCreated},
+//	    Outbound: []OutboundCheck{{Method: "POST", URL: "https://payments.example.com/charges", Body: PartialM{"amount": 1000}, Count: 1}},
+//	})
+func (r *Rehapt) CaptureOutbound() *OutboundCapture {
+	if r.outbound == nil {
+		r.outbound = &OutboundCapture{}
+	}
+	return r.outbound
+}
+
+// RoundTrip records the request and sends it with the Transport, if any
+func (c *OutboundCapture) RoundTrip(request *http.Request) (*http.Response, error) {
+	var body []byte
+	if request.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.mutex.Lock()
+	c.calls = append(c.calls, OutboundCall{Method: request.Method, URL: request.URL.String(), Header: cloneHeader(request.Header), Body: body})
+	c.mutex.Unlock()
+
+	if c.Transport == nil {
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        make(http.Header),
+			Body:          ioutil.NopCloser(bytes.NewReader(nil)),
+			ContentLength: 0,
+			Request:       request,
+		}, nil
+	}
+	// The body has been consumed, give a copy to the transport
+	outgoing := *request
+	outgoing.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return c.Transport.RoundTrip(&outgoing)
+}
+
+// Calls returns all the captured calls, in order
+func (c *OutboundCapture) Calls() []OutboundCall {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]OutboundCall(nil), c.calls...)
+}
+
+// count returns the number of captured calls
+func (c *OutboundCapture) count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.calls)
+}
+
+// checkOutbound checks the calls captured since offset and returns the errors of all the failed checks
+func (r *Rehapt) checkOutbound(checks []OutboundCheck, offset int) error {
+	if len(checks) == 0 {
+		return nil
+	}
+	if r.outbound == nil {
+		return fmt.Errorf("outbound checks require CaptureOutbound()")
+	}
+	calls := r.outbound.Calls()[offset:]
+
+	var errs []error
+	for _, check := range checks {
+		name := check.Method
+		if check.URL != nil {
+			name = strings.TrimSpace(name + " " + r.formatValue(check.URL))
+		}
+		if name == "" {
+			name = "to any URL"
+		}
+		matching := 0
+		for _, call := range calls {
+			if r.matchOutbound(check, call) == true {
+				matching++
+			}
+		}
+		if check.Count == nil {
+			if matching == 0 {
+				errs = append(errs, fmt.Errorf("outbound call %v not made. Calls made: %v", name, formatOutboundCalls(calls)))
+			}
+			continue
+		}
+		if err := r.call().compare(check.Count, matching); err != nil {
+			errs = append(errs, fmt.Errorf("outbound call %v count does not match. %v", name, err))
+		}
+	}
+	return joinErrors(errs...)
+}
+
+// matchOutbound returns true if the call matches the check
+func (r *Rehapt) matchOutbound(check OutboundCheck, call OutboundCall) bool {
+	c := r.call()
+	if check.Method != "" && check.Method != call.Method {
+		return false
+	}
+	if check.URL != nil && c.tryCompare(check.URL, call.URL) != nil {
+		return false
+	}
+	if check.Body != nil {
+		var body interface{}
+		if len(call.Body) > 0 {
+			if err := c.unmarshaler(call.Body, &body); err != nil {
+				return false
+			}
+		}
+		if c.tryCompare(check.Body, body) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// formatOutboundCalls returns the method and URL of the calls
+func formatOutboundCalls(calls []OutboundCall) string {
+	if len(calls) == 0 {
+		return "none"
+	}
+	names := make([]string, len(calls))
+	for i, call := range calls {
+		names[i] = call.Method + " " + call.URL
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,82 @@
+package rehapt
+
+import (
+	"runtime"
+	"sync"
+)
+
+// SetParallelCompare compares the elements of the ordered slices and of the maps having at least threshold
+// elements using several goroutines, one per CPU. The mismatches are reported in the same order as
+// a sequential comparison. Zero, the default, disables it.
+// It is ignored when SetMaxErrors is set, as the comparison must stop after the first mismatches.
+// Note the elements storing the same variable, like "$id$", store it in any order
+func (r *Rehapt) SetParallelCompare(threshold int) {
+	r.parallelThreshold = threshold
+}
+
+// elementCompareFn compares the element at index i of a collection.
+// It must use the given instance, which is specific to the goroutine comparing the element
+type elementCompareFn func(r *Rehapt, i int) ([]mismatchLine, []Mismatch)
+
+// compareElements compares the n elements of a collection, in parallel if SetParallelCompare allows it.
+// The mismatches are returned in the order of the elements
+func (r *Rehapt) compareElements(n int, compare elementCompareFn) ([]mismatchLine, []Mismatch) {
+	var lines []mismatchLine
+	var mismatches []Mismatch
+
+	workers := runtime.GOMAXPROCS(0)
+	if r.parallelThreshold <= 0 || n < r.parallelThreshold || r.maxErrors > 0 || workers < 2 {
+		for i := 0; i < n; i++ {
+			if r.maxErrorsReached() == true {
+				break
+			}
+			elementLines, elementMismatches := compare(r, i)
+			lines = append(lines, elementLines...)
+			mismatches = append(mismatches, elementMismatches...)
+		}
+		return lines, mismatches
+	}
+
+	type result struct {
+		lines      []mismatchLine
+		mismatches []Mismatch
+	}
+	results := make([]result, n)
+	counts := make([]int, workers)
+	chunk := (n + workers - 1) / workers
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		start, end := w*chunk, (w+1)*chunk
+		if end > n {
+			end = n
+		}
+		if start >= end {
+			break
+		}
+		wg.Add(1)
+		go func(w int, start int, end int) {
+			defer wg.Done()
+			// The mismatch count and the comparators are bound to their instance.
+			// The nested collections are compared sequentially
+			worker := *r
+			worker.mismatchCount = 0
+			worker.parallelThreshold = 0
+			worker.initComparators()
+			for i := start; i < end; i++ {
+				results[i].lines, results[i].mismatches = compare(&worker, i)
+			}
+			counts[w] = worker.mismatchCount
+		}(w, start, end)
+	}
+	wg.Wait()
+
+	for _, count := range counts {
+		r.mismatchCount += count
+	}
+	for _, res := range results {
+		lines = append(lines, res.lines...)
+		mismatches = append(mismatches, res.mismatches...)
+	}
+	return lines, mismatches
+}
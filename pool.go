@@ -0,0 +1,36 @@
+package rehapt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// Capacity above which a recorder body buffer is not kept for the next testcases,
+// so a single huge response does not stay in memory
+const maxPooledBodySize = 1 << 20
+
+// recorderPool reuses the response recorders and their body buffers between the testcases.
+// Large suites would otherwise spend most of their GC time collecting them
+var recorderPool = sync.Pool{
+	New: func() interface{} {
+		return httptest.NewRecorder()
+	},
+}
+
+// getRecorder returns an empty recorder, as built by httptest.NewRecorder
+func getRecorder() *httptest.ResponseRecorder {
+	recorder := recorderPool.Get().(*httptest.ResponseRecorder)
+	body := recorder.Body
+	body.Reset()
+	*recorder = httptest.ResponseRecorder{HeaderMap: make(http.Header), Body: body, Code: http.StatusOK}
+	return recorder
+}
+
+// putRecorder gives back the recorder, once nothing references its body anymore
+func putRecorder(recorder *httptest.ResponseRecorder) {
+	if recorder.Body.Cap() > maxPooledBodySize {
+		return
+	}
+	recorderPool.Put(recorder)
+}
@@ -0,0 +1,264 @@
+package rehapt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// Schema of the Postman collections written by rehapt
+const postmanSchema = "https://schema.getpostman.com/json/collection/v2.1.0/collection.json"
+
+// Postman variable prefixed to the requests paths
+const postmanBaseURLVar = "baseUrl"
+
+// PostmanCollection is a Postman collection, in the v2.1 format.
+// It can be imported in Postman to replay the requests interactively.
+// Build it from a Suite with Suite.PostmanCollection(), or from the executed testcases
+// with Rehapt.SetPostmanExport()
+type PostmanCollection struct {
+	Info     PostmanInfo       `json:"info"`
+	Item     []PostmanItem     `json:"item"`
+	Variable []PostmanVariable `json:"variable,omitempty"`
+}
+
+// PostmanInfo describes a Postman collection
+type PostmanInfo struct {
+	Name   string `json:"name"`
+	Schema string `json:"schema"`
+}
+
+// PostmanItem is a named request of a Postman collection
+type PostmanItem struct {
+	Name    string         `json:"name"`
+	Request PostmanRequest `json:"request"`
+}
+
+// PostmanRequest is a request of a Postman collection
+type PostmanRequest struct {
+	Method string            `json:"method"`
+	Header []PostmanVariable `json:"header"`
+	URL    string            `json:"url"`
+	Body   *PostmanBody      `json:"body,omitempty"`
+}
+
+// PostmanBody is the body of a Postman request
+type PostmanBody struct {
+	Mode string `json:"mode"`
+	Raw  string `json:"raw"`
+}
+
+// PostmanVariable is a key/value pair, used for the collection variables and the requests headers
+type PostmanVariable struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// NewPostmanCollection build a new empty Postman collection.
+// The {{baseUrl}} variable, prefixed to all the requests paths, is set to "http://localhost"
+func NewPostmanCollection(name string) *PostmanCollection {
+	return &PostmanCollection{
+		Info: PostmanInfo{
+			Name:   name,
+			Schema: postmanSchema,
+		},
+		Item:     []PostmanItem{},
+		Variable: []PostmanVariable{{Key: postmanBaseURLVar, Value: exportDefaultHost}},
+	}
+}
+
+// Write writes the collection as indented JSON
+func (c *PostmanCollection) Write(w io.Writer) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// addRequest append the executed request to the collection
+func (c *PostmanCollection) addRequest(request *http.Request, body []byte) {
+	url := request.URL.String()
+	if request.URL.Host == "" {
+		url = "{{" + postmanBaseURLVar + "}}" + url
+	}
+	item := PostmanItem{
+		Name: request.Method + " " + request.URL.Path,
+		Request: PostmanRequest{
+			Method: request.Method,
+			Header: postmanHeaders(request.Header),
+			URL:    url,
+		},
+	}
+	if len(body) > 0 {
+		item.Request.Body = &PostmanBody{Mode: "raw", Raw: string(body)}
+	}
+	c.Item = append(c.Item, item)
+}
+
+// SetPostmanExport allow to append every executed testcase to the given Postman collection,
+// with the variables already replaced. Write the collection once the tests are done.
+// Setting the collection to nil disables the export
+//
+// Example:
+//
+//	collection := rehapt.NewPostmanCollection("my api")
+//	r.SetPostmanExport(collection)
+//	// ... run the testcases
+//	err := collection.Write(file)
+func (r *Rehapt) SetPostmanExport(collection *PostmanCollection) {
+	r.postmanExport = collection
+}
+
+// PostmanCollection converts the suite into a Postman collection, one request per step,
+// in execution order. The suite is not executed: the variables used in the requests, like "_id_",
+// are converted to Postman variables, like "{{id}}", so Postman can fill them.
+// The variables currently defined are added as collection variables
+func (s *Suite) PostmanCollection() (*PostmanCollection, error) {
+	steps, _, err := s.plan()
+	if err != nil {
+		return nil, err
+	}
+
+	r := s.r
+	collection := NewPostmanCollection(s.name)
+	r.stateMutex.RLock()
+	variables := make(map[string]interface{}, len(r.variables))
+	for name, value := range r.variables {
+		// Skip the reserved variables like "last.status"
+		if r.validVarname(name) == true {
+			variables[name] = value
+		}
+	}
+	r.stateMutex.RUnlock()
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if value, err := r.formatVar(name, variables[name]); err == nil {
+			collection.Variable = append(collection.Variable, PostmanVariable{Key: name, Value: value})
+		}
+	}
+
+	for _, step := range steps {
+		item, err := r.postmanItem(step.Name, step.TestCase.Request)
+		if err != nil {
+			return nil, fmt.Errorf("step %v cannot be exported. %v", step.Name, err)
+		}
+		collection.Item = append(collection.Item, item)
+	}
+	return collection, nil
+}
+
+// ExportPostman writes the suite as a Postman collection. See PostmanCollection()
+func (s *Suite) ExportPostman(w io.Writer) error {
+	collection, err := s.PostmanCollection()
+	if err != nil {
+		return err
+	}
+	return collection.Write(w)
+}
+
+// postmanItem converts the testcase request, which is not executed, into a Postman request
+func (r *Rehapt) postmanItem(name string, request TestRequest) (PostmanItem, error) {
+	p, ok := request.Path.(string)
+	if ok == false {
+		return PostmanItem{}, fmt.Errorf("invalid path type %T, only string supported", request.Path)
+	}
+
+	headers := r.cloneDefaultHeaders()
+	for k, values := range request.Headers {
+		headers.Del(k)
+		for _, value := range values {
+			headers.Add(k, r.postmanVars(value))
+		}
+	}
+
+	item := PostmanItem{
+		Name: name,
+		Request: PostmanRequest{
+			Method: request.Method,
+			Header: postmanHeaders(headers),
+			URL:    "{{" + postmanBaseURLVar + "}}" + r.postmanVars(p),
+		},
+	}
+
+	request, err := request.resolveRawBody()
+	if err != nil {
+		return PostmanItem{}, err
+	}
+	if request.Body != nil {
+		marshaler := r.marshaler
+		if request.BodyMarshaler != nil {
+			marshaler = request.BodyMarshaler
+		}
+		body, err := marshaler(r.postmanVarsDeep(request.Body))
+		if err != nil {
+			return PostmanItem{}, fmt.Errorf("failed to marshal the request body. %v", err)
+		}
+		item.Request.Body = &PostmanBody{Mode: "raw", Raw: string(body)}
+	}
+	return item, nil
+}
+
+// postmanVars converts the load shortcuts of the string into Postman variables
+func (r *Rehapt) postmanVars(str string) string {
+	return r.variableLoadRegexp.ReplaceAllString(str, "{{$1}}")
+}
+
+// postmanVarsDeep works like postmanVars on all the strings found in the maps and slices of the value.
+// The value is not modified, a copy is returned
+func (r *Rehapt) postmanVarsDeep(v interface{}) interface{} {
+	switch value := v.(type) {
+	case string:
+		return r.postmanVars(value)
+	case map[string]interface{}:
+		return r.postmanVarsDeepMap(value)
+	case M:
+		return M(r.postmanVarsDeepMap(value))
+	case []interface{}:
+		return r.postmanVarsDeepSlice(value)
+	case S:
+		return S(r.postmanVarsDeepSlice(value))
+	default:
+		return v
+	}
+}
+
+func (r *Rehapt) postmanVarsDeepMap(m map[string]interface{}) map[string]interface{} {
+	replaced := make(map[string]interface{}, len(m))
+	for key, element := range m {
+		replaced[key] = r.postmanVarsDeep(element)
+	}
+	return replaced
+}
+
+func (r *Rehapt) postmanVarsDeepSlice(sl []interface{}) []interface{} {
+	replaced := make([]interface{}, len(sl))
+	for i, element := range sl {
+		replaced[i] = r.postmanVarsDeep(element)
+	}
+	return replaced
+}
+
+// postmanHeaders converts the headers, sorted by name so the collection is the same on each run
+func postmanHeaders(header http.Header) []PostmanVariable {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	headers := []PostmanVariable{}
+	for _, name := range names {
+		for _, value := range header[name] {
+			headers = append(headers, PostmanVariable{Key: name, Value: value})
+		}
+	}
+	return headers
+}
@@ -0,0 +1,189 @@
+package rehapt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PrometheusUnmarshaler decodes a Prometheus text exposition, like the response of a /metrics endpoint.
+// The result is a map of the metric names to the list of their samples, each sample being a map
+// with its "labels", a map of strings, and its float "value". The comments and the timestamps are ignored.
+// For example
+//
+//	http_requests_total{method="GET",code="200"} 3
+//
+// is decoded as
+//
+//	M{"http_requests_total": S{M{"labels": M{"method": "GET", "code": "200"}, "value": 3.0}}}
+//
+// Use it as TestResponse.BodyUnmarshaler, with Metric() to match the samples
+func PrometheusUnmarshaler(data []byte, out interface{}) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("out should be a non-nil pointer")
+	}
+
+	metrics := make(map[string]interface{})
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan() == true; lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, labels, value, err := parsePrometheusSample(line)
+		if err != nil {
+			return fmt.Errorf("invalid Prometheus sample at line %d. %v", lineNumber, err)
+		}
+		samples, _ := metrics[name].([]interface{})
+		metrics[name] = append(samples, map[string]interface{}{"labels": labels, "value": value})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	pv := rv.Elem()
+	result := reflect.ValueOf(metrics)
+	if result.Type().AssignableTo(pv.Type()) == false {
+		return fmt.Errorf("out should be a pointer to interface{} or map[string]interface{}, got %T", out)
+	}
+	pv.Set(result)
+	return nil
+}
+
+// parsePrometheusSample parses a line like `name{label="value"} 1.5 1700000000000`
+func parsePrometheusSample(line string) (string, map[string]interface{}, float64, error) {
+	end := strings.IndexAny(line, "{ \t")
+	if end <= 0 {
+		return "", nil, 0, fmt.Errorf("missing value")
+	}
+	name := line[:end]
+	rest := line[end:]
+
+	labels := make(map[string]interface{})
+	if rest[0] == '{' {
+		rest = rest[1:]
+		for {
+			rest = strings.TrimLeft(rest, " \t,")
+			if strings.HasPrefix(rest, "}") {
+				rest = rest[1:]
+				break
+			}
+			equal := strings.Index(rest, "=\"")
+			if equal <= 0 {
+				return "", nil, 0, fmt.Errorf("invalid labels")
+			}
+			label := strings.TrimSpace(rest[:equal])
+			rest = rest[equal+2:]
+
+			var value bytes.Buffer
+			closed := false
+			for i := 0; i < len(rest); i++ {
+				c := rest[i]
+				if c == '"' {
+					rest = rest[i+1:]
+					closed = true
+					break
+				}
+				if c == '\\' && i+1 < len(rest) {
+					i++
+					c = rest[i]
+					if c == 'n' {
+						c = '\n'
+					}
+				}
+				value.WriteByte(c)
+			}
+			if closed == false {
+				return "", nil, 0, fmt.Errorf("unterminated value of label %v", label)
+			}
+			labels[label] = value.String()
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return "", nil, 0, fmt.Errorf("missing value")
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", nil, 0, fmt.Errorf("invalid value %v", fields[0])
+	}
+	return name, labels, value, nil
+}
+
+// metricMatcher is the Matcher returned by Metric()
+type metricMatcher struct {
+	labels map[string]string
+	value  interface{}
+}
+
+// Metric expects a sample of the metric decoded by PrometheusUnmarshaler, having at least the given labels
+// and the given value. The value can be a number or a CompareFn like NumberDelta, or nil to only expect
+// the sample to exist. It matches if any of the samples having the labels matches the value
+//
+// Example:
+//
+//	Body: PartialM{
+//	    "http_requests_total": Metric(map[string]string{"method": "POST", "code": "201"}, NumberDelta(1, 0)),
+//	    "process_start_time_seconds": Metric(nil, nil),
+//	}
+func Metric(labels map[string]string, value interface{}) Matcher {
+	return metricMatcher{labels: labels, value: value}
+}
+
+func (m metricMatcher) Match(r *Rehapt, actual interface{}) error {
+	samples, ok := actual.([]interface{})
+	if ok == false {
+		return newMismatch(MismatchType, m.labels, actual, "expected Prometheus samples, got %v", r.formatValue(actual))
+	}
+
+	var errs []string
+	for _, s := range samples {
+		sample, ok := s.(map[string]interface{})
+		if ok == false || m.hasLabels(sample["labels"]) == false {
+			continue
+		}
+		if m.value == nil {
+			return nil
+		}
+		err := r.tryCompare(m.value, sample["value"])
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+	if len(errs) == 0 {
+		return newMismatch(MismatchMissing, m.labels, actual, "no sample with labels %v", formatLabels(m.labels))
+	}
+	return fmt.Errorf("no sample with labels %v matches the value. %v", formatLabels(m.labels), strings.Join(errs, "\n"))
+}
+
+// hasLabels returns true if the sample labels contain the expected labels
+func (m metricMatcher) hasLabels(actual interface{}) bool {
+	labels, _ := actual.(map[string]interface{})
+	for name, value := range m.labels {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// formatLabels returns the labels as in the exposition format, sorted by name
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%v=%q", name, labels[name])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,398 @@
+package rehapt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TrafficRecorder is an http.Handler middleware recording the exchanges handled by the wrapped handler.
+// The recorded exchanges can then be written as TestCase Go code or as a YAML scenario file,
+// ready to be edited, to bootstrap a regression suite from real traffic.
+// The exchanges are kept in memory, so the recorder is meant for a staging environment.
+//
+// Example:
+//
+//	recorder := rehapt.Recorder(app)
+//	http.ListenAndServe(":8080", recorder)
+//	// ... later
+//	err := recorder.WriteYAML(file)
+type TrafficRecorder struct {
+	next      http.Handler
+	mutex     sync.Mutex
+	exchanges []recordedExchange
+}
+
+type recordedExchange struct {
+	method         string
+	uri            string
+	requestHeader  http.Header
+	requestBody    []byte
+	status         int
+	responseHeader http.Header
+	responseBody   []byte
+}
+
+// Recorder wraps the handler in a TrafficRecorder
+func Recorder(next http.Handler) *TrafficRecorder {
+	return &TrafficRecorder{next: next}
+}
+
+// recordingResponseWriter copies the response written by the handler
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+// ServeHTTP implements http.Handler. The request is given to the wrapped handler and recorded with its response
+func (rec *TrafficRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	writer := &recordingResponseWriter{ResponseWriter: w}
+	rec.next.ServeHTTP(writer, req)
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	rec.exchanges = append(rec.exchanges, recordedExchange{
+		method:         req.Method,
+		uri:            req.URL.RequestURI(),
+		requestHeader:  cloneHeader(req.Header),
+		requestBody:    body,
+		status:         writer.status,
+		responseHeader: cloneHeader(w.Header()),
+		responseBody:   writer.body.Bytes(),
+	})
+}
+
+// Reset forgets the recorded exchanges
+func (rec *TrafficRecorder) Reset() {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	rec.exchanges = nil
+}
+
+// recordedCase is a recorded exchange converted into a testcase description
+type recordedCase struct {
+	name            string
+	method          string
+	path            string
+	headers         http.Header
+	body            interface{}
+	rawBody         bool
+	code            int
+	contentType     string
+	responseBody    interface{}
+	rawResponseBody bool
+}
+
+// cases converts the recorded exchanges, in order.
+// The request headers managed by the HTTP stack are dropped, and only the Content-Type response header is expected
+func (rec *TrafficRecorder) cases() []recordedCase {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+
+	names := make(map[string]int)
+	cases := make([]recordedCase, 0, len(rec.exchanges))
+	for _, exchange := range rec.exchanges {
+		c := recordedCase{
+			method:      exchange.method,
+			path:        exchange.uri,
+			headers:     make(http.Header),
+			code:        exchange.status,
+			contentType: exchange.responseHeader.Get("Content-Type"),
+		}
+
+		// The step names must be unique
+		c.name = c.method + " " + c.path
+		names[c.name]++
+		if names[c.name] > 1 {
+			c.name = fmt.Sprintf("%v (%d)", c.name, names[c.name])
+		}
+
+		for name, values := range exchange.requestHeader {
+			if harIgnoredRequestHeaders[http.CanonicalHeaderKey(name)] == false {
+				c.headers[name] = values
+			}
+		}
+		c.body, c.rawBody = decodeRecordedBody(exchange.requestHeader.Get("Content-Type"), exchange.requestBody)
+		c.responseBody, c.rawResponseBody = decodeRecordedBody(c.contentType, exchange.responseBody)
+		cases = append(cases, c)
+	}
+	return cases
+}
+
+// decodeRecordedBody decodes the JSON bodies, and keeps the others as raw text
+func decodeRecordedBody(contentType string, data []byte) (interface{}, bool) {
+	if len(data) == 0 {
+		return nil, false
+	}
+	var decoded interface{}
+	if isJSONMimeType(contentType) && json.Unmarshal(data, &decoded) == nil {
+		return decoded, false
+	}
+	return string(data), true
+}
+
+// TestCases returns the recorded exchanges as TestCases, in order
+func (rec *TrafficRecorder) TestCases() []TestCase {
+	var testcases []TestCase
+	for _, c := range rec.cases() {
+		testcase := TestCase{
+			Request: TestRequest{
+				Method: c.method,
+				Path:   NoReplacement(c.path),
+				Body:   c.body,
+			},
+			Response: TestResponse{
+				Code: c.code,
+				Body: c.responseBody,
+			},
+		}
+		if len(c.headers) > 0 {
+			testcase.Request.Headers = H(cloneHeader(c.headers))
+		}
+		if c.rawBody == true {
+			testcase.Request.BodyMarshaler = RawMarshaler
+		}
+		if c.contentType != "" {
+			testcase.Response.Headers = PartialM{"Content-Type": S{c.contentType}}
+		}
+		if c.rawResponseBody == true {
+			testcase.Response.BodyUnmarshaler = RawUnmarshaler
+		}
+		testcases = append(testcases, testcase)
+	}
+	return testcases
+}
+
+// WriteGo writes the recorded exchanges as Go code, one r.TestAssert() call per exchange
+func (rec *TrafficRecorder) WriteGo(w io.Writer) error {
+	var code bytes.Buffer
+	for _, c := range rec.cases() {
+		fmt.Fprintf(&code, "// %v\n", c.name)
+		fmt.Fprintf(&code, "r.TestAssert(rehapt.TestCase{\nRequest: rehapt.TestRequest{\n")
+		fmt.Fprintf(&code, "Method: %q,\nPath: %q,\n", c.method, c.path)
+		if len(c.headers) > 0 {
+			fmt.Fprintf(&code, "Headers: rehapt.H{\n")
+			for _, name := range sortedHeaderNames(c.headers) {
+				fmt.Fprintf(&code, "%q: {%v},\n", name, goStrings(c.headers[name]))
+			}
+			fmt.Fprintf(&code, "},\n")
+		}
+		if c.body != nil {
+			fmt.Fprintf(&code, "Body: %v,\n", goLiteral(c.body))
+		}
+		if c.rawBody == true {
+			fmt.Fprintf(&code, "BodyMarshaler: rehapt.RawMarshaler,\n")
+		}
+		fmt.Fprintf(&code, "},\nResponse: rehapt.TestResponse{\nCode: %d,\n", c.code)
+		if c.contentType != "" {
+			fmt.Fprintf(&code, "Headers: rehapt.PartialM{%q: rehapt.S{%q}},\n", "Content-Type", c.contentType)
+		}
+		if c.responseBody != nil {
+			fmt.Fprintf(&code, "Body: %v,\n", goLiteral(c.responseBody))
+		}
+		if c.rawResponseBody == true {
+			fmt.Fprintf(&code, "BodyUnmarshaler: rehapt.RawUnmarshaler,\n")
+		}
+		fmt.Fprintf(&code, "},\n})\n\n")
+	}
+
+	formatted, err := format.Source(code.Bytes())
+	if err != nil {
+		return fmt.Errorf("cannot format the generated code. %v", err)
+	}
+	_, err = w.Write(formatted)
+	return err
+}
+
+// WriteYAML writes the recorded exchanges as a YAML scenario file, see LoadFile
+func (rec *TrafficRecorder) WriteYAML(w io.Writer) error {
+	var out bytes.Buffer
+	out.WriteString("steps:\n")
+	for _, c := range rec.cases() {
+		fmt.Fprintf(&out, "  - name: %v\n", yamlQuote(c.name))
+		fmt.Fprintf(&out, "    request:\n      method: %v\n      path: %v\n", c.method, yamlQuote(c.path))
+		if len(c.headers) > 0 {
+			out.WriteString("      headers:\n")
+			for _, name := range sortedHeaderNames(c.headers) {
+				values := c.headers[name]
+				if len(values) == 1 {
+					fmt.Fprintf(&out, "        %v: %v\n", yamlQuote(name), yamlQuote(values[0]))
+					continue
+				}
+				fmt.Fprintf(&out, "        %v:\n", yamlQuote(name))
+				for _, value := range values {
+					fmt.Fprintf(&out, "          - %v\n", yamlQuote(value))
+				}
+			}
+		}
+		writeYAMLBody(&out, c.body, c.rawBody)
+		fmt.Fprintf(&out, "    response:\n      code: %d\n", c.code)
+		if c.contentType != "" {
+			fmt.Fprintf(&out, "      headers:\n        %v: %v\n", yamlQuote("Content-Type"), yamlQuote(c.contentType))
+		}
+		writeYAMLBody(&out, c.responseBody, c.rawResponseBody)
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// writeYAMLBody writes the body or rawBody key of a request or response
+func writeYAMLBody(out *bytes.Buffer, body interface{}, raw bool) {
+	if body == nil {
+		return
+	}
+	key := "body"
+	if raw == true {
+		key = "rawBody"
+	}
+	out.WriteString("      " + key + ":")
+	writeYAMLValue(out, body, 8)
+}
+
+// writeYAMLValue writes the value after a key or a dash, in block style.
+// The nested values are indented by `indent` spaces
+func writeYAMLValue(out *bytes.Buffer, value interface{}, indent int) {
+	prefix := strings.Repeat(" ", indent)
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			out.WriteString(" {}\n")
+			return
+		}
+		out.WriteString("\n")
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			out.WriteString(prefix + yamlQuote(key) + ":")
+			writeYAMLValue(out, v[key], indent+2)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			out.WriteString(" []\n")
+			return
+		}
+		out.WriteString("\n")
+		for _, element := range v {
+			out.WriteString(prefix + "-")
+			writeYAMLValue(out, element, indent+2)
+		}
+	case string:
+		out.WriteString(" " + yamlQuote(v) + "\n")
+	case float64:
+		out.WriteString(" " + formatRecordedNumber(v) + "\n")
+	case bool:
+		out.WriteString(" " + strconv.FormatBool(v) + "\n")
+	case nil:
+		out.WriteString(" null\n")
+	default:
+		out.WriteString(fmt.Sprintf(" %v\n", v))
+	}
+}
+
+// yamlQuote writes the string as a double-quoted YAML scalar, which uses the JSON escapes
+func yamlQuote(s string) string {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(s)
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
+
+// goLiteral writes the decoded value as a Go literal, using M and S for the maps and slices
+func goLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		elements := make([]string, len(keys))
+		for i, key := range keys {
+			elements[i] = fmt.Sprintf("%q: %v,\n", key, goLiteral(v[key]))
+		}
+		return "rehapt.M{\n" + strings.Join(elements, "") + "}"
+	case []interface{}:
+		elements := make([]string, len(v))
+		for i, element := range v {
+			elements[i] = goLiteral(element) + ",\n"
+		}
+		return "rehapt.S{\n" + strings.Join(elements, "") + "}"
+	case string:
+		return strconv.Quote(v)
+	case float64:
+		return formatRecordedNumber(v)
+	case nil:
+		return "nil"
+	default:
+		return fmt.Sprintf("%#v", v)
+	}
+}
+
+// formatRecordedNumber writes the integer numbers without decimals, so they are expected as int
+func formatRecordedNumber(n float64) string {
+	if n == math.Trunc(n) && math.Abs(n) < 1e15 {
+		return strconv.FormatInt(int64(n), 10)
+	}
+	return strconv.FormatFloat(n, 'g', -1, 64)
+}
+
+func goStrings(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = strconv.Quote(value)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func sortedHeaderNames(header http.Header) []string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
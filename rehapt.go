@@ -42,22 +42,49 @@ package rehapt
 
 import (
 	"bytes"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
-	"net/http/httptest"
+	"net/url"
+	"os"
 	"path"
 	"reflect"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
 	"time"
 )
 
+// Environment variable holding the initial tag filter
+const tagFilterEnv = "REHAPT_TAGS"
+
+// The load shortcut accepts dotted names only for the reserved variables
+// like "last.status", "last.header.Location", "csrf.token" or "oauth2.token",
+// so a literal like "backup_v1.2_old" is not parsed as a variable
+const loadVarnamePattern = `(?:last|csrf|oauth2)(?:\.[a-zA-Z0-9-]+)+|[a-zA-Z0-9]+`
+
+// Interval between the requests of WaitForReady
+const readyPollInterval = 250 * time.Millisecond
+
+// Maximum length of the response body written in the unmarshal errors,
+// enough to recognize an HTML error page or a plain text message
+const unmarshalBodyExcerptLength = 200
+
+// Reserved variable names used to store the last response
+const (
+	lastStatusVar       = "last.status"
+	lastBodyVar         = "last.body"
+	lastHeaderVarPrefix = "last.header."
+)
+
 // Rehapt - REST HTTP API Test
 //
 // This is the main structure of the library.
@@ -75,6 +102,64 @@ type Rehapt struct {
 	variableNameRegexp     *regexp.Regexp
 	floatPrecision         int
 	comparators            []comparator
+	storeLastResponse      bool
+	tagFilter              []string
+	updateGolden           *bool
+	curlExport             io.Writer
+	postmanExport          *PostmanCollection
+	harExport              *HAR
+	failureExport          io.Writer
+	requestLogger          *requestLogger
+	coverage               *Coverage
+	observers              []Observer
+	eventLogger            eventLogger
+	colorOutput            bool
+	maxErrors              int
+	maxFormattedElements   int
+	parallelThreshold      int
+	failFast               bool
+	stopOnFailure          bool
+	helperAttribution      bool
+	dumpOnFailure          bool
+	debugBodies            bool
+	lenientHeaders         bool
+	headerMode             HeaderMode
+	handlerTimeout         time.Duration
+	maxResponseBytes       int64
+	responseSizePolicy     ResponseSizePolicy
+	mapMode                MapMode
+	sliceOrdering          SliceOrdering
+	requireExplicitCode    bool
+	comparatorOverrides    []comparatorOverride
+	// Shared by the forked instances, so the token is refreshed once, see UseOAuth2ClientCredentials
+	oauth2 *oauth2Credentials
+	// Where the CSRF token is read and sent, see SetCSRF
+	csrf *CSRF
+	// The default credentials, see SetDefaultBasicAuth and SetDefaultBearerToken
+	defaultBasicAuth   *BasicAuth
+	defaultBearerToken string
+	tracePropagation   bool
+	spanExporter       SpanExporter
+	// Shared by the forked instances, so the application needs a single transport, see CaptureOutbound
+	outbound *OutboundCapture
+	// Set for the testcase being executed when the tracing is enabled, see SetTracePropagation
+	span *TraceSpan
+	// Number of mismatches found in the current response, see SetMaxErrors
+	mismatchCount int
+	// Set for the response being compared, see TestResponse.NoShortcuts
+	noShortcuts bool
+	// Shared by the forked instances, so a suite cleans up the resources created by all its branches
+	resources *resourceTracker
+	// Shared by the forked instances, so the summary counts the subtests of all the instances
+	summary *summaryRecorder
+	// Shared by the forked instances, so the stats count the testcases of all the instances
+	stats *statsCounter
+	// Shared by the forked instances, see SetPatternCacheSize
+	patterns *patternCache
+	// Shared by the forked instances, which can write the same exports in parallel
+	exportMutex *sync.Mutex
+	// Protects the variables and the default headers, so Test() can be called concurrently
+	stateMutex *sync.RWMutex
 }
 
 // NewRehapt build a new Rehapt instance from the given http.Handler.
@@ -92,15 +177,101 @@ func NewRehapt(errorHandler ErrorHandler, handler http.Handler) *Rehapt {
 		variables:              make(map[string]interface{}),
 		defaultTimeDeltaFormat: time.RFC3339,
 		variableStoreRegexp:    regexp.MustCompile(`^\$([a-zA-Z0-9]+)\$$`),
-		variableLoadRegexp:     regexp.MustCompile(`_([a-zA-Z0-9]+)_`),
+		variableLoadRegexp:     regexp.MustCompile(`_(` + loadVarnamePattern + `)_`),
 		variableNameRegexp:     regexp.MustCompile(`^[a-zA-Z0-9]+$`),
 		floatPrecision:         -1,
+		maxFormattedElements:   defaultMaxFormattedElements,
 		comparators:            nil,
+		tagFilter:              parseTagFilter(os.Getenv(tagFilterEnv)),
+		colorOutput:            colorOutputDetected(),
+		exportMutex:            &sync.Mutex{},
+		stateMutex:             &sync.RWMutex{},
+		resources:              &resourceTracker{},
+		summary:                &summaryRecorder{},
+		stats:                  &statsCounter{},
+		patterns:               newPatternCache(defaultPatternCacheSize),
 	}
 	r.initComparators()
 	return r
 }
 
+// NewRehaptTB build a new Rehapt instance reporting the errors to the given test or benchmark.
+// The rehapt functions reporting the errors are marked as test helpers, so the testing package
+// attributes the failures to the line of the test calling TestAssert(), instead of the errors
+// being prefixed by the calling stack. It requires go1.9 which added Helper() to testing.TB
+//
+// Example:
+//
+//	func TestAPI(t *testing.T) {
+//	    r := NewRehaptTB(t, yourHttpServerMux)
+//	    r.TestAssert(TestCase{...})
+//	}
+func NewRehaptTB(tb testing.TB, handler http.Handler) *Rehapt {
+	r := NewRehapt(tb, handler)
+	r.helperAttribution = true
+	return r
+}
+
+// Fork build an independent copy of this Rehapt instance.
+// The copy starts with the same settings, default headers and variables, but then
+// each instance has its own: variables stored by one are not visible by the other.
+// It allow to run testcases from parallel tests which must not see the variables of each other.
+// The curl, Postman and HAR exports are shared with the forked instances.
+//
+// Example:
+//
+//	t.Run("users", func(t *testing.T) {
+//	    t.Parallel()
+//	    r := r.Fork()
+//	    r.SetErrorHandler(t)
+//	    r.TestAssert(TestCase{...})
+//	})
+func (r *Rehapt) Fork() *Rehapt {
+	r.stateMutex.RLock()
+	fork := *r
+	fork.defaultHeaders = cloneHeader(r.defaultHeaders)
+	if fork.defaultHeaders == nil {
+		fork.defaultHeaders = make(http.Header)
+	}
+	fork.variables = make(map[string]interface{}, len(r.variables))
+	for name, value := range r.variables {
+		fork.variables[name] = value
+	}
+	r.stateMutex.RUnlock()
+	fork.stateMutex = &sync.RWMutex{}
+	fork.tagFilter = append([]string(nil), r.tagFilter...)
+	fork.observers = append([]Observer(nil), r.observers...)
+	fork.comparatorOverrides = append([]comparatorOverride(nil), r.comparatorOverrides...)
+	// The comparators are bound to their instance
+	fork.initComparators()
+	return &fork
+}
+
+// Clone build an independent copy of this Rehapt instance, with the same settings, default headers,
+// marshalers and comparators. It is meant to configure a base instance once per package,
+// then derive a cheap instance for each test.
+// Unlike Fork, nothing recorded by the copy is visible by this instance: the copy has its own
+// resources to clean up, Summary and Stats. The variables are copied only if withVariables is true.
+// The curl, Postman, HAR and failure exports, the coverage and the observers are still shared
+//
+// Example:
+//
+//	func TestUsers(t *testing.T) {
+//	    r := base.Clone(false)
+//	    r.SetErrorHandler(t)
+//	    r.TestAssert(TestCase{...})
+//	}
+func (r *Rehapt) Clone(withVariables bool) *Rehapt {
+	clone := r.Fork()
+	if withVariables == false {
+		clone.variables = make(map[string]interface{})
+	}
+	clone.resources = &resourceTracker{}
+	clone.summary = &summaryRecorder{}
+	clone.stats = &statsCounter{}
+	return clone
+}
+
 // SetHttpHandler allow to change the http.Handler used to run requests
 func (r *Rehapt) SetHttpHandler(handler http.Handler) {
 	r.httpHandler = handler
@@ -127,25 +298,42 @@ func (r *Rehapt) SetErrorHandler(errorHandler ErrorHandler) {
 // GetVariable allow to retrieve a variable value from its name.
 // nil is returned if variable is not found
 func (r *Rehapt) GetVariable(name string) interface{} {
-	return r.variables[name]
+	value, _ := r.lookupVar(name)
+	return value
 }
 
 // GetVariableString allow to retrieve a variable value as a string from its name
 // empty string is returned if variable is not found
 func (r *Rehapt) GetVariableString(name string) string {
-	if value, ok := r.variables[name].(string); ok == true {
+	if value, ok := r.GetVariable(name).(string); ok == true {
 		return value
 	}
 	return ""
 }
 
+// lookupVar returns the variable value and whether it is defined
+func (r *Rehapt) lookupVar(name string) (interface{}, bool) {
+	r.stateMutex.RLock()
+	defer r.stateMutex.RUnlock()
+	value, ok := r.variables[name]
+	return value, ok
+}
+
+// storeVar defines the variable, overriding any stored value
+func (r *Rehapt) storeVar(name string, value interface{}) {
+	r.stateMutex.Lock()
+	r.variables[name] = value
+	r.stateMutex.Unlock()
+	atomic.AddInt64(&r.stats.variablesStored, 1)
+}
+
 // SetVariable allow to define manually a variable.
 // Variable names are strings, however values can be any type
 func (r *Rehapt) SetVariable(name string, value interface{}) error {
 	if r.validVarname(name) == false {
 		return fmt.Errorf("invalid variable name %v", name)
 	}
-	r.variables[name] = value
+	r.storeVar(name, value)
 	return nil
 }
 
@@ -153,19 +341,27 @@ func (r *Rehapt) SetVariable(name string, value interface{}) error {
 // These headers will be added to all requests, however each
 // TestCase can override their values
 func (r *Rehapt) SetDefaultHeaders(headers http.Header) {
+	r.stateMutex.Lock()
 	r.defaultHeaders = headers
+	r.stateMutex.Unlock()
 }
 
 // GetDefaultHeaders allow to get all default request headers.
 // These headers will be added to all requests, however each
-// TestCase can override their values
+// TestCase can override their values.
+// The returned headers must not be modified while testcases are executed concurrently,
+// use SetDefaultHeader() instead
 func (r *Rehapt) GetDefaultHeaders() http.Header {
+	r.stateMutex.RLock()
+	defer r.stateMutex.RUnlock()
 	return r.defaultHeaders
 }
 
 // GetDefaultHeader returns the default request header value from its name.
 // Default headers are added automatically to all requests
 func (r *Rehapt) GetDefaultHeader(name string) string {
+	r.stateMutex.RLock()
+	defer r.stateMutex.RUnlock()
 	return r.defaultHeaders.Get(name)
 }
 
@@ -173,14 +369,29 @@ func (r *Rehapt) GetDefaultHeader(name string) string {
 // This header will be added to all requests, however each
 // TestCase can override its value
 func (r *Rehapt) SetDefaultHeader(name string, value string) {
+	r.stateMutex.Lock()
 	r.defaultHeaders.Set(name, value)
+	r.stateMutex.Unlock()
 }
 
 // AddDefaultHeader allow to add a default request header.
 // This header will be added to all requests, however each
 // TestCase can override its value
 func (r *Rehapt) AddDefaultHeader(name string, value string) {
+	r.stateMutex.Lock()
 	r.defaultHeaders.Add(name, value)
+	r.stateMutex.Unlock()
+}
+
+// cloneDefaultHeaders returns a copy of the default headers, never nil
+func (r *Rehapt) cloneDefaultHeaders() http.Header {
+	r.stateMutex.RLock()
+	headers := cloneHeader(r.defaultHeaders)
+	r.stateMutex.RUnlock()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	return headers
 }
 
 // SetDefaultTimeDeltaFormat allow to change the default time format
@@ -223,7 +434,7 @@ func (r *Rehapt) SetLoadShortcutBounds(prefix string, suffix string) error {
 	}
 	prefixEscaped := regexp.QuoteMeta(prefix)
 	suffixEscaped := regexp.QuoteMeta(suffix)
-	re, err := regexp.Compile(prefixEscaped + `([a-zA-Z0-9]+)` + suffixEscaped)
+	re, err := regexp.Compile(prefixEscaped + `(` + loadVarnamePattern + `)` + suffixEscaped)
 	if err != nil {
 		return err
 	}
@@ -238,10 +449,256 @@ func (r *Rehapt) SetLoadShortcutFloatPrecision(precision int) {
 	r.floatPrecision = precision
 }
 
+// SetDefaultMapMode change how the maps which are neither PartialM nor ExactM, like M, are compared.
+// With MapModePartial, a plain M behaves like a PartialM, which is convenient for the suites preferring
+// a tolerant matching. ExactM can then be used to expect exactly the listed keys.
+// The default mode is MapModeExhaustive
+func (r *Rehapt) SetDefaultMapMode(mode MapMode) {
+	r.mapMode = mode
+}
+
+// SetDefaultSliceOrdering change how the slices which are neither UnsortedS nor SortedS, like S, are compared.
+// With SliceUnordered, a plain S behaves like an UnsortedS, which is convenient for the APIs
+// returning the lists in a non-deterministic order. SortedS can then be used to expect the elements in order.
+// The default ordering is SliceOrdered
+func (r *Rehapt) SetDefaultSliceOrdering(ordering SliceOrdering) {
+	r.sliceOrdering = ordering
+}
+
+// ReplaceComparator replaces the comparator used for the expected values like the given one,
+// to apply a comparison policy to all the testcases. The comparator is found as during the
+// comparisons: "" replaces the string comparator, UnsortedS{} the UnsortedS comparator and
+// S{} the comparator of the other slices. Note that each integer and float type has its own comparator.
+// The replaced comparator is given to the new one, so it can normalize the values and delegate to it.
+// An error is returned if no comparator handles the given value
+//
+// Example:
+//
+//	r.ReplaceComparator("", func(expected, actual interface{}, builtin func(expected, actual interface{}) error) error {
+//	    if str, ok := actual.(string); ok == true {
+//	        actual = strings.TrimSpace(str)
+//	    }
+//	    return builtin(expected, actual)
+//	})
+func (r *Rehapt) ReplaceComparator(expected interface{}, compare ComparatorFn) error {
+	if compare == nil {
+		return fmt.Errorf("nil comparator")
+	}
+	expectedType := reflect.TypeOf(expected)
+	if expectedType == nil {
+		return fmt.Errorf("no comparator for nil")
+	}
+	i := r.findComparator(expectedType)
+	if i < 0 {
+		return fmt.Errorf("no comparator for type %T", expected)
+	}
+	override := comparatorOverride{
+		ExpectedKind: r.comparators[i].ExpectedKind,
+		ExpectedType: r.comparators[i].ExpectedType,
+		Compare:      compare,
+	}
+	r.comparatorOverrides = append(r.comparatorOverrides, override)
+	r.overrideComparator(i, compare)
+	return nil
+}
+
+// overrideComparator replaces the comparator at the given index, keeping the replaced one as its builtin
+func (r *Rehapt) overrideComparator(i int, compare ComparatorFn) {
+	kind := r.comparators[i].ExpectedKind
+	builtin := r.comparators[i].Compare
+	r.comparators[i].Compare = func(ctx compareCtx) error {
+		return compare(ctx.Expected, ctx.Actual, func(expected interface{}, actual interface{}) error {
+			// The builtin comparator only handles its own kind, the other values are dispatched again
+			if expected == nil || actual == nil || reflect.TypeOf(expected).Kind() != kind {
+				return r.compare(expected, actual)
+			}
+			return builtin(newCompareCtx(expected, actual))
+		})
+	}
+}
+
+// SetRequireExplicitCode makes the testcases without an expected response code fail before their request
+// is executed, instead of comparing the actual code with 0. It catches the forgotten Code fields.
+// A CompareFn like Any() is still accepted as an explicit choice. Disabled by default.
+func (r *Rehapt) SetRequireExplicitCode(enabled bool) {
+	r.requireExplicitCode = enabled
+}
+
+// SetStoreLastResponse enable or disable the automatic storage of the last response
+// in reserved variables. When enabled, after each Test() the following variables are defined:
+//
+//	"last.status" the response HTTP status code (int)
+//	"last.body" the decoded response body
+//	"last.header.Name" the first value of each response header, for example "last.header.Location"
+//
+// The next testcase can then use them as any other variable, for example "/api/user/_last.header.X-Id_"
+// Disabled by default.
+func (r *Rehapt) SetStoreLastResponse(enabled bool) {
+	r.storeLastResponse = enabled
+}
+
+// SetTagFilter allow to run only the testcases matching the given tags.
+// A tag prefixed with "!" excludes the testcases having it, the others include the testcases having them.
+// For example SetTagFilter("smoke", "!slow") runs only the testcases tagged "smoke" but not tagged "slow".
+// Testcases not matching the filter are skipped. Calling it without tags removes the filter.
+// The initial filter is read from the REHAPT_TAGS environment variable, as a comma separated list,
+// so a subset of the testcases can be selected without code change:
+//
+//	REHAPT_TAGS=smoke,!slow go test ./...
+func (r *Rehapt) SetTagFilter(tags ...string) {
+	r.tagFilter = tags
+}
+
+// SetMaxErrors stops the comparison of a response once n mismatches have been found,
+// and reports that the comparison stopped. It keeps the errors readable when a large
+// response fails for a single root cause. Zero, the default, means no limit
+func (r *Rehapt) SetMaxErrors(n int) {
+	r.maxErrors = n
+}
+
+// SetMaxFormattedElements changes the number of array elements and object keys written when an error
+// message shows an expected or actual value. The others are only counted, so a failing comparison
+// of a huge body stays fast and readable. The default is 100, zero means no limit
+func (r *Rehapt) SetMaxFormattedElements(n int) {
+	r.maxFormattedElements = n
+}
+
+// SetFailFast makes the suites stop on the first failing step: all the remaining steps are skipped,
+// including the ones not depending on the failing step. It applies to the parallel branches too
+func (r *Rehapt) SetFailFast(enabled bool) {
+	r.failFast = enabled
+}
+
+// SetStopOnFailure makes TestAssert() stop the test on the first failure, using the ErrorHandler
+// Fatalf() function when it exists, like testing.T. As with Fatalf(), TestAssert() must then be called
+// from the goroutine running the test. ErrorHandlers without Fatalf() keep using Errorf()
+func (r *Rehapt) SetStopOnFailure(enabled bool) {
+	r.stopOnFailure = enabled
+}
+
 // Test is the main function of the library
 // it executes a given TestCase, i.e. do the request and
-// check if the actual response is matching the expected response
-func (r *Rehapt) Test(testcase TestCase) error {
+// check if the actual response is matching the expected response.
+// It can be called concurrently on the same instance: the variables stored by a testcase
+// are visible by the others, use Fork() to isolate them
+func (r *Rehapt) Test(testcase TestCase) (err error) {
+	for _, observer := range r.observers {
+		observer.OnTestStart(testcase)
+	}
+	defer func() {
+		for _, observer := range r.observers {
+			observer.OnTestEnd(testcase, err)
+		}
+	}()
+
+	// The comparison state is specific to this call
+	call := r.call()
+
+	if err := call.checkSkip(testcase); err != nil {
+		atomic.AddInt64(&r.stats.skipped, 1)
+		return err
+	}
+	atomic.AddInt64(&r.stats.testCases, 1)
+	r.logEvent("test started", "method", testcase.Request.Method, "path", fmt.Sprint(testcase.Request.Path))
+
+	if r.tracePropagation == true || r.spanExporter != nil {
+		if err := call.startSpan(testcase); err != nil {
+			return err
+		}
+		defer func() {
+			call.endSpan(err)
+		}()
+	}
+
+	if testcase.Before != nil {
+		if err := testcase.Before(r); err != nil {
+			return fmt.Errorf("before hook failed. %v", err)
+		}
+	}
+
+	err = r.checkStates("pre-check", testcase.PreCheck)
+	var offsets []int
+	if err == nil {
+		offsets, err = r.eventOffsets(testcase.Events)
+	}
+	outboundOffset := 0
+	if r.outbound != nil {
+		outboundOffset = r.outbound.count()
+	}
+	if err == nil {
+		err = call.test(testcase)
+		err = joinErrors(err, r.checkStates("post-check", testcase.PostCheck), r.checkEvents(testcase.Events, offsets),
+			r.checkOutbound(testcase.Outbound, outboundOffset))
+	}
+
+	// The after hook is always called, as it is usually a cleanup
+	if testcase.After != nil {
+		if afterErr := testcase.After(r); afterErr != nil {
+			err = joinErrors(err, fmt.Errorf("after hook failed. %v", afterErr))
+		}
+	}
+	return err
+}
+
+// call returns a copy of this instance sharing its variables and default headers,
+// with its own comparators and mismatch count so concurrent comparisons don't interfere
+func (r *Rehapt) call() *Rehapt {
+	r.stateMutex.RLock()
+	call := *r
+	r.stateMutex.RUnlock()
+	call.mismatchCount = 0
+	call.initComparators()
+	return &call
+}
+
+// checkSkip returns a *SkipError if the testcase must be skipped
+func (r *Rehapt) checkSkip(testcase TestCase) error {
+	if r.matchTagFilter(testcase.Tags) == false {
+		return &SkipError{Reason: fmt.Sprintf("tags %v do not match filter %v", testcase.Tags, r.tagFilter)}
+	}
+	if testcase.SkipIf != nil {
+		if skip, reason := testcase.SkipIf(r); skip == true {
+			return &SkipError{Reason: reason}
+		}
+	}
+	if testcase.OnlyIf != nil {
+		if ok, reason := testcase.OnlyIf(r); ok == false {
+			return &SkipError{Reason: fmt.Sprintf("condition not met. %v", reason)}
+		}
+	}
+	return nil
+}
+
+// matchTagFilter returns true if the tags are accepted by the tag filter.
+// They must contain none of the excluded tags and at least one of the included tags, if any
+func (r *Rehapt) matchTagFilter(tags []string) bool {
+	hasTag := func(tag string) bool {
+		for _, t := range tags {
+			if t == tag {
+				return true
+			}
+		}
+		return false
+	}
+
+	included := false
+	hasIncludes := false
+	for _, filter := range r.tagFilter {
+		if strings.HasPrefix(filter, "!") {
+			if hasTag(filter[1:]) {
+				return false
+			}
+			continue
+		}
+		hasIncludes = true
+		if hasTag(filter) {
+			included = true
+		}
+	}
+	return included == true || hasIncludes == false
+}
+
+func (r *Rehapt) test(testcase TestCase) error {
 	// If we don't have the minimum, we cannot go further.
 	if r.httpHandler == nil {
 		return fmt.Errorf("nil HTTP handler")
@@ -258,103 +715,160 @@ func (r *Rehapt) Test(testcase TestCase) error {
 	if testcase.Request.Path == "" {
 		return fmt.Errorf("incomplete testcase. Missing URL path")
 	}
+	if r.requireExplicitCode == true && isZeroCode(testcase.Response.Code) == true {
+		return fmt.Errorf("incomplete testcase. Expected response code not specified")
+	}
 
-	var body io.Reader
 	var err error
-	// If a body has been defined, then marshal it
-	if testcase.Request.Body != nil {
-		marshaler := r.marshaler
-		if testcase.Request.BodyMarshaler != nil {
-			marshaler = testcase.Request.BodyMarshaler
-		}
+	if testcase.Request, err = testcase.Request.resolveRawBody(); err != nil {
+		return err
+	}
+	if testcase.Response, err = testcase.Response.resolveRawBody(); err != nil {
+		return err
+	}
 
-		bodyData, err := marshaler(testcase.Request.Body)
-		if err != nil {
-			return fmt.Errorf("failed to marshal the testcase request body. %v", err)
-		}
-		body = bytes.NewBuffer(bodyData)
+	request, bodyData, err := r.buildRequest(testcase.Request)
+	if err != nil {
+		return err
 	}
+	r.logEvent("request built", "method", request.Method, "url", request.URL.String(), "bodySize", len(bodyData))
 
-	// Path should be either a string or a ReplaceFn
-	requestPath := ""
-	if repl, ok := testcase.Request.Path.(ReplaceFn); ok == true {
-		requestPath, err = repl(r)
-		if err != nil {
-			return fmt.Errorf("failed to replace path. %v", err)
-		}
-	} else if p, ok := testcase.Request.Path.(string); ok == true {
-		// Default to auto-replace
-		requestPath, err = r.replaceVars(p)
-		if err != nil {
-			return fmt.Errorf("error while replacing variables in path. %v", err)
+	if err := r.exportRequest(request, bodyData); err != nil {
+		return err
+	}
+
+	// Now execute the request and record its response
+	recorder := getRecorder()
+	for _, observer := range r.observers {
+		observer.OnRequestSent(request, bodyData)
+	}
+	var writer http.ResponseWriter = recorder
+	var limited *limitedWriter
+	if r.maxResponseBytes > 0 {
+		limited = &limitedWriter{ResponseWriter: recorder, limit: r.maxResponseBytes}
+		writer = limited
+	}
+	started := time.Now()
+	if err := r.serve(writer, request); err != nil {
+		// The recorder is not reused, a handler which timed out might still write to it
+		return fmt.Errorf("%v\n%v", err, dumpRequest(request, bodyData))
+	}
+	if limited != nil {
+		if err := r.checkResponseSize(limited, request); err != nil {
+			return fmt.Errorf("%v\n%v", err, dumpRequest(request, bodyData))
 		}
-	} else {
-		return fmt.Errorf("invalid path type %T, only string or rehapt.ReplaceFn supported", testcase.Request.Path)
 	}
+	// The observers might keep the body, then the recorder is not reused
+	if len(r.observers) == 0 {
+		defer putRecorder(recorder)
+	}
+	duration := time.Since(started)
+	response := recorder.Result()
+	if r.span != nil {
+		r.span.Status = response.StatusCode
+	}
+	response.Proto, response.ProtoMajor, response.ProtoMinor = responseProto(request, response.Header)
+	for _, observer := range r.observers {
+		observer.OnResponseReceived(response, recorder.Body.Bytes(), duration)
+	}
+	r.stats.exchange(len(bodyData), recorder.Body.Len(), duration)
+	if r.debugBodies == true || testcase.Debug == true {
+		r.logReport(r.errorHandler, "debug bodies", debugBodies(request, bodyData, response, recorder.Body.Bytes()))
+	}
+	r.logEvent("response received", "status", response.StatusCode, "duration", duration, "bodySize", recorder.Body.Len())
 
-	// Now start to build the HTTP request
-	request, err := http.NewRequest(testcase.Request.Method, requestPath, body)
-	if err != nil {
-		return fmt.Errorf("failed to build HTTP request. %v", err)
+	if r.coverage != nil {
+		r.coverage.record(request.Method, request.URL.Path)
 	}
 
-	// Add the default headers (if any)
-	request.Header = cloneHeader(r.defaultHeaders)
+	if r.harExport != nil {
+		r.exportMutex.Lock()
+		r.harExport.addExchange(started, duration, request, bodyData, response, recorder.Body.Bytes())
+		r.exportMutex.Unlock()
+	}
 
-	// Add the testcase defined headers. This overrides any default header previously set
-	for k, values := range testcase.Request.Headers {
-		request.Header.Del(k)
-		for _, value := range values {
-			request.Header.Add(k, value)
+	if r.requestLogger != nil {
+		r.exportMutex.Lock()
+		err := r.requestLogger.log(started, duration, request, bodyData, response, recorder.Body.Bytes())
+		r.exportMutex.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to log the request. %v", err)
 		}
 	}
 
-	// Now execute the request and record its response
-	recorder := httptest.NewRecorder()
-	r.httpHandler.ServeHTTP(recorder, request)
-	response := recorder.Result()
-
 	// And start to check result.
 	// But don't stop on first error, for example if http code doesn't match,
 	// we can still compare headers and body.
 	var codeError error
+	var protoError error
 	var headersError error
+	var cookiesError error
 	var bodyError error
+	// The mismatches are located from the response root
+	var mismatches []Mismatch
+	r.mismatchCount = 0
+	r.noShortcuts = testcase.Response.NoShortcuts
 
 	// First check HTTP response code
 	if err := r.compare(testcase.Response.Code, response.StatusCode); err != nil {
 		codeError = fmt.Errorf("response code does not match. Expected %d, got %d", testcase.Response.Code, response.StatusCode)
+		mismatches = append(mismatches, mismatchesAt("code", err.(*MismatchError))...)
+	}
+
+	if testcase.Response.Proto != nil {
+		if err := r.compare(testcase.Response.Proto, response.Proto); err != nil {
+			protoError = fmt.Errorf("response protocol does not match. Expected %v, got %v", testcase.Response.Proto, response.Proto)
+			mismatches = append(mismatches, mismatchesAt("proto", err.(*MismatchError))...)
+		}
 	}
 
 	// Check headers if requested
 	if testcase.Response.Headers != nil {
-		if err := r.compare(testcase.Response.Headers, response.Header); err != nil {
+		expectedHeaders, actualHeaders := r.expectedHeaders(testcase.Response.Headers), response.Header
+		if r.lenientHeaders == true {
+			expectedHeaders, actualHeaders = lenientHeaders(expectedHeaders, actualHeaders)
+		}
+		if err := r.compare(expectedHeaders, actualHeaders); err != nil {
 			headersError = fmt.Errorf("response headers does not match. %v", err)
+			if hint := r.headersHint(expectedHeaders, actualHeaders); hint != "" {
+				headersError = fmt.Errorf("%v\n%v", headersError, hint)
+			}
+			mismatches = append(mismatches, mismatchesAt("headers", err.(*MismatchError))...)
 		}
 	}
 
+	// Check the cookies set by the response if requested
+	if testcase.Response.Cookies != nil {
+		if err := r.compare(expectedCookies(testcase.Response.Cookies), r.actualCookies(response)); err != nil {
+			cookiesError = fmt.Errorf("response cookies does not match. %v", err)
+			mismatches = append(mismatches, mismatchesAt("cookies", err.(*MismatchError))...)
+		}
+	}
+
+	var responseBody interface{}
 	bodyError = func() error {
-		var responseBody interface{}
-		if response.Body != nil {
-			data, err := ioutil.ReadAll(response.Body)
-			defer response.Body.Close()
-			if err != nil {
-				return fmt.Errorf("cannot read response body. %v", err)
-			}
+		// Nothing reads the decoded body
+		if isBodyIgnored(testcase.Response.Body) == true && testcase.Response.Golden == "" && testcase.Response.BodyUnmarshaler == nil &&
+			r.storeLastResponse == false && (r.csrf == nil || r.csrf.BodyPath == "") {
+			return nil
+		}
 
-			if len(data) > 0 {
-				unmarshaler := r.unmarshaler
-				if testcase.Response.BodyUnmarshaler != nil {
-					unmarshaler = testcase.Response.BodyUnmarshaler
-				}
+		unmarshaler := r.unmarshaler
+		if testcase.Response.BodyUnmarshaler != nil {
+			unmarshaler = testcase.Response.BodyUnmarshaler
+		}
 
-				if err := unmarshaler(data, &responseBody); err != nil {
-					// If body is nil, then continue with nil decoded body
-					// the compare function will handle if that's expected or not
-					// but we don't want to report an unmarshal error
-					if err != io.EOF {
-						return fmt.Errorf("cannot unmarshal response body. %v", err)
-					}
+		// The body is copied with a single allocation, as the recorder is reused by the next testcases
+		// while the unmarshaler might keep the data
+		var data []byte
+		if recorder.Body.Len() > 0 {
+			data = append([]byte(nil), recorder.Body.Bytes()...)
+			if err := unmarshaler(data, &responseBody); err != nil {
+				// If body is nil, then continue with nil decoded body
+				// the compare function will handle if that's expected or not
+				// but we don't want to report an unmarshal error
+				if err != io.EOF {
+					return fmt.Errorf("cannot unmarshal response body. %v. Response code %d, body: %v", err, response.StatusCode, truncate(string(data), unmarshalBodyExcerptLength))
 				}
 			}
 		}
@@ -363,77 +877,373 @@ func (r *Rehapt) Test(testcase TestCase) error {
 		// We could have used reflect.DeepEqual but we want finer comparison,
 		// which allow ignoring some fields, storing variables, using variables, etc.
 		// This is the main purpose of this library
-		if err := r.compare(testcase.Response.Body, responseBody); err != nil {
+		expectedBody := testcase.Response.Body
+		if testcase.Response.Golden != "" {
+			golden, compare, err := r.goldenBody(testcase.Response, data, unmarshaler)
+			if err != nil || compare == false {
+				return err
+			}
+			expectedBody = golden
+		}
+		if err := r.compare(expectedBody, responseBody); err != nil {
 			return err
 		}
 
 		return nil
 	}()
 
-	// Build an error based on the 3 possible errors on code, headers and body
-	if codeError != nil || headersError != nil || bodyError != nil {
-		e := ""
-		if codeError != nil {
-			e += codeError.Error() + "\n"
+	if r.storeLastResponse == true {
+		r.storeLastResponseVariables(response, responseBody)
+	}
+	if r.csrf != nil {
+		r.storeCSRFToken(response, responseBody)
+	}
+
+	// The body error can also be about reading or unmarshaling the body
+	if mismatchErr, ok := bodyError.(*MismatchError); ok == true {
+		mismatches = append(mismatches, mismatchesAt("body", mismatchErr)...)
+	}
+
+	var limitError error
+	if r.maxErrorsReached() == true {
+		limitError = fmt.Errorf("comparison stopped after %d errors", r.mismatchCount)
+	}
+
+	// Build an error based on the possible errors on code, headers, cookies and body
+	err = joinErrors(codeError, protoError, headersError, cookiesError, bodyError, limitError)
+	if err != nil && len(mismatches) > 0 {
+		err = &MismatchError{Mismatches: mismatches, message: err.Error()}
+	}
+	if err != nil {
+		r.logEvent("comparison result", "passed", false, "mismatches", len(mismatches), "error", err.Error())
+	} else {
+		r.logEvent("comparison result", "passed", true)
+	}
+	if err != nil && r.failureExport != nil {
+		if exportErr := r.exportFailure(err, request, bodyData, response, recorder.Body.Bytes(), duration); exportErr != nil {
+			return joinErrors(err, exportErr)
+		}
+	}
+	if err != nil && r.dumpOnFailure == true {
+		err = withDump(err, request, bodyData, response, recorder.Body.Bytes())
+	}
+	return err
+}
+
+// buildRequest marshals the body, replaces the variables of the path and adds the headers.
+// The RawBody of the request must already be resolved
+func (r *Rehapt) buildRequest(testRequest TestRequest) (*http.Request, []byte, error) {
+	var body io.Reader
+	var bodyData []byte
+	var err error
+	if testRequest, err = r.resolveBodyFile(testRequest); err != nil {
+		return nil, nil, err
+	}
+	if rpc, ok := testRequest.Body.(JSONRPC); ok == true {
+		if testRequest.Body, err = r.jsonRPCBody(rpc); err != nil {
+			return nil, nil, err
+		}
+	}
+	// The Multipart and url.Values bodies have their own default marshaler
+	if testRequest.BodyMarshaler == nil {
+		switch testRequest.Body.(type) {
+		case Multipart, *Multipart:
+			testRequest.BodyMarshaler = MultipartMarshaler
+		case url.Values:
+			testRequest.BodyMarshaler = FormMarshaler
+		}
+	}
+	// If a body has been defined, then marshal it
+	contentType := ""
+	if testRequest.Body != nil {
+		marshaler := r.marshaler
+		if testRequest.BodyMarshaler != nil {
+			marshaler = testRequest.BodyMarshaler
 		}
-		if headersError != nil {
-			e += headersError.Error() + "\n"
+		contentType = marshalerContentType(marshaler)
+		if contentType == "" {
+			contentType = bodyFileContentType(testRequest)
+		}
+
+		bodyData, err = marshaler(testRequest.Body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to marshal the testcase request body. %v", err)
+		}
+		body = bytes.NewBuffer(bodyData)
+	}
+
+	// Path should be either a string or a ReplaceFn
+	requestPath := ""
+	if repl, ok := testRequest.Path.(ReplaceFn); ok == true {
+		requestPath, err = repl(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to replace path. %v", err)
 		}
-		if bodyError != nil {
-			e += bodyError.Error()
+	} else if p, ok := testRequest.Path.(string); ok == true {
+		// Default to auto-replace
+		requestPath, err = r.replaceVars(p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error while replacing variables in path. %v", err)
 		}
-		return errors.New(strings.TrimSuffix(e, "\n"))
+	} else {
+		return nil, nil, fmt.Errorf("invalid path type %T, only string or rehapt.ReplaceFn supported", testRequest.Path)
+	}
+	r.logEvent("variables replaced", "path", requestPath)
+
+	// Now start to build the HTTP request
+	request, err := http.NewRequest(testRequest.Method, requestPath, body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build HTTP request. %v", err)
+	}
+
+	// Refresh the OAuth2 token before reading the default headers
+	if r.oauth2 != nil {
+		if err := r.authorizeOAuth2(r.oauth2); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Add the default headers (if any)
+	request.Header = r.cloneDefaultHeaders()
+	// The marshaler defines the Content-Type of its bodies, like the multipart boundary
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	if err := r.authorizeRequest(request, testRequest); err != nil {
+		return nil, nil, err
+	}
+
+	// Add the testcase defined headers. This overrides any default header previously set
+	for k, values := range testRequest.Headers {
+		request.Header.Del(k)
+		for _, value := range values {
+			request.Header.Add(k, value)
+		}
+	}
+
+	// The cookies are sorted, so the header does not change between the runs
+	names := make([]string, 0, len(testRequest.Cookies))
+	for name := range testRequest.Cookies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, err := r.replaceVars(testRequest.Cookies[name])
+		if err != nil {
+			return nil, nil, fmt.Errorf("error while replacing variables in cookie %v. %v", name, err)
+		}
+		request.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+
+	if r.csrf != nil {
+		r.injectCSRFToken(request)
+	}
+	if r.span != nil {
+		r.span.Path = request.URL.Path
+		if request.Header.Get(traceParentHeader) == "" {
+			request.Header.Set(traceParentHeader, r.span.traceParent())
+		}
+	}
+
+	return request, bodyData, nil
+}
+
+// exportRequest writes the request to the curl and Postman exports, if enabled
+func (r *Rehapt) exportRequest(request *http.Request, body []byte) error {
+	r.exportMutex.Lock()
+	defer r.exportMutex.Unlock()
+	if r.curlExport != nil {
+		if err := writeCurl(r.curlExport, request, body); err != nil {
+			return fmt.Errorf("failed to export curl command. %v", err)
+		}
+	}
+	if r.postmanExport != nil {
+		r.postmanExport.addRequest(request, body)
 	}
 	return nil
 }
 
+// warmup executes the testcase n times, without its hooks and ignoring the result.
+// Each run uses its own copy, like Test(), so the shared instance is not modified
+func (r *Rehapt) warmup(testcase TestCase, n int) {
+	for i := 0; i < n; i++ {
+		_ = r.call().test(testcase)
+	}
+}
+
 // TestAssert works exactly like Test except it reports the error if not nil
-// using the ErrorHandler Errorf() function
+// using the ErrorHandler Errorf() function, or Fatalf() see SetStopOnFailure
 func (r *Rehapt) TestAssert(testcase TestCase) {
+	// Called here and not through markHelper, as Helper() marks its direct caller
+	if h, ok := r.errorHandler.(interface{ Helper() }); ok == true {
+		h.Helper()
+	}
 	if err := r.Test(testcase); err != nil {
-		// index 0 is this function calling runtime.Caller() -> we can skip it
-		// start at index 1 to get the user function calling rehapt.TestAssert()
-		//
-		// We could use only the index 2, but if somebody is using rehapt.TestAssert() inside another function
-		// then it is still good to go further and return all callers recursively until we reach the std testing library
-		var callingStack []string
-		for i := 1; i < 20; i++ {
-			pc, file, line, ok := runtime.Caller(i)
-			if !ok {
-				// End of call-stack
-				break
-			}
+		if IsSkipped(err) == true {
+			r.reportSkip(err)
+			return
+		}
+		r.reportError(err, 1)
+	}
+}
 
-			// retrieve function name from prog-counter
-			function := runtime.FuncForPC(pc)
-			if function == nil {
-				break
-			}
+// TestEventually executes the TestCase repeatedly, waiting `interval` between each try,
+// until the actual response matches the expected one or until `timeout` expires.
+// This is useful for asynchronous APIs, for example a job status which will eventually become "done".
+// If the timeout expires, the error of the last try is returned.
+// A skipped testcase is not retried, its *SkipError is returned immediately
+func (r *Rehapt) TestEventually(testcase TestCase, timeout time.Duration, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := r.Test(testcase)
+		if err == nil || IsSkipped(err) == true {
+			return err
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return fmt.Errorf("still failing after %v. %v", timeout, err)
+		}
+		time.Sleep(interval)
+	}
+}
 
-			// functionName will have form package.FuncName
-			// "github.com/thib-ack/rehapt_test.TestErrStringResponseBody"
-			functionName := function.Name()
+// TestEventuallyAssert works exactly like TestEventually except it reports the error if not nil
+// using the ErrorHandler Errorf() function
+func (r *Rehapt) TestEventuallyAssert(testcase TestCase, timeout time.Duration, interval time.Duration) {
+	if h, ok := r.errorHandler.(interface{ Helper() }); ok == true {
+		h.Helper()
+	}
+	if err := r.TestEventually(testcase, timeout, interval); err != nil {
+		if IsSkipped(err) == true {
+			r.reportSkip(err)
+			return
+		}
+		r.reportError(err, 1)
+	}
+}
 
-			// That's the std testing library
-			// which is calling the tests
-			if functionName == "testing.tRunner" {
-				// Normally we break here, when we reached the testing lib
-				break
+// WaitForReady polls the endpoint at path with GET requests until it responds with a 200 OK,
+// whatever its body, or until `timeout` expires. It is meant to be called before the testcases,
+// when the server under test boots asynchronously, for example in a container with NewRemoteHandler.
+// Use TestEventually to wait for a specific status or body
+//
+// Example:
+//
+//	if err := r.WaitForReady("/healthz", 30*time.Second); err != nil {
+//	    log.Fatal(err)
+//	}
+func (r *Rehapt) WaitForReady(path string, timeout time.Duration) error {
+	err := r.TestEventually(TestCase{
+		Request:  TestRequest{Method: "GET", Path: path},
+		Response: TestResponse{Code: http.StatusOK, BodyUnmarshaler: discardUnmarshaler},
+	}, timeout, readyPollInterval)
+	if err != nil {
+		return fmt.Errorf("%v is not ready. %v", path, err)
+	}
+	return nil
+}
+
+// discardUnmarshaler ignores the body, which is then compared as nil
+func discardUnmarshaler(data []byte, v interface{}) error {
+	return nil
+}
+
+// TestRun executes the TestCase as a subtest named `name`.
+// The testcase can then be selected with the -run flag and its result is reported individually with -v.
+// Only this subtest fails if the actual response does not match the expected one.
+// It returns true if the subtest succeeded
+func (r *Rehapt) TestRun(t *testing.T, name string, testcase TestCase) bool {
+	markHelper(t)
+	// The subtest runs in its own goroutine, so the user code calling us
+	// would not appear in its stack. Keep its location to report it
+	_, file, line, _ := runtime.Caller(1)
+	return t.Run(name, func(t *testing.T) {
+		markHelper(t)
+		err := r.Test(testcase)
+		r.summary.add(t.Name(), err)
+		if err != nil {
+			if IsSkipped(err) == true {
+				t.Skip(err.(*SkipError).Reason)
+				return
 			}
+			t.Errorf("\n%v:%d\n%v %v", path.Base(file), line, r.colorLabel("Error:"), r.errorMessage(err))
+		}
+	})
+}
+
+// reportError reports the error using the ErrorHandler Errorf() function, prefixed
+// by the calling stack. `skip` is the number of stack frames to ignore above reportError,
+// so the stack starts with the user function.
+// The optional Helper(), Name() and Fatalf() functions of the ErrorHandler are used when they exist
+func (r *Rehapt) reportError(err error, skip int) {
+	helper, hasHelper := r.errorHandler.(interface{ Helper() })
+	if hasHelper == true {
+		helper.Helper()
+	}
 
-			filename := path.Base(file)
-			callingStack = append(callingStack, fmt.Sprintf("%v:%d: %v", filename, line, functionName))
+	label := "Error:"
+	if named, ok := r.errorHandler.(interface{ Name() string }); ok == true {
+		label = fmt.Sprintf("Error in %v:", named.Name())
+	}
+	message := fmt.Sprintf("%v %v", r.colorLabel(label), r.errorMessage(err))
+	// With NewRehaptTB, the testing package already reports the line of the user function
+	if r.helperAttribution == false || hasHelper == false {
+		// One more frame, as callingStack is called from here
+		message = fmt.Sprintf("%v\n%v", strings.Join(callingStack(skip+1), "\n"), message)
+	}
+
+	fatal, hasFatal := r.errorHandler.(interface {
+		Fatalf(format string, args ...interface{})
+	})
+	if r.stopOnFailure == true && hasFatal == true {
+		fatal.Fatalf("\n" + message)
+	} else if r.errorHandler != nil {
+		// Start with a \n because testing.T Errorf() prints data and do not start on new line
+		r.errorHandler.Errorf("\n" + message)
+	} else if r.eventLogger != nil {
+		r.eventLogger.logFailure("test failed", "error", message)
+	} else {
+		fmt.Printf(message + "\n")
+	}
+}
+
+// callingStack returns the "file:line: function" of the callers, up to the std testing library.
+// `skip` is the number of stack frames to ignore above callingStack
+func callingStack(skip int) []string {
+	// index 0 is this function calling runtime.Caller() -> we can skip it
+	// as well as the `skip` rehapt functions calling us, to get the user function calling rehapt.TestAssert()
+	//
+	// We could use only the first user index, but if somebody is using rehapt.TestAssert() inside another function
+	// then it is still good to go further and return all callers recursively until we reach the std testing library
+	var callingStack []string
+	for i := 1 + skip; i < 20+skip; i++ {
+		pc, file, line, ok := runtime.Caller(i)
+		if !ok {
+			// End of call-stack
+			break
 		}
 
-		message := fmt.Sprintf("%v\nError: %v", strings.Join(callingStack, "\n"), err)
+		// retrieve function name from prog-counter
+		function := runtime.FuncForPC(pc)
+		if function == nil {
+			break
+		}
+
+		// functionName will have form package.FuncName
+		// "github.com/thib-ack/rehapt_test.TestErrStringResponseBody"
+		functionName := function.Name()
 
-		if r.errorHandler != nil {
-			// Start with a \n because testing.T Errorf() prints data and do not start on new line
-			r.errorHandler.Errorf("\n" + message)
-		} else {
-			fmt.Printf(message + "\n")
+		// That's the std testing library
+		// which is calling the tests
+		if functionName == "testing.tRunner" {
+			// Normally we break here, when we reached the testing lib
+			break
 		}
+
+		filename := path.Base(file)
+		callingStack = append(callingStack, fmt.Sprintf("%v:%d: %v", filename, line, functionName))
 	}
+	return callingStack
 }
 
 func (r *Rehapt) validVarname(name string) bool {
@@ -446,7 +1256,7 @@ func (r *Rehapt) ReplaceVars(str string) string {
 }
 
 func (r *Rehapt) replaceVars(str string) (string, error) {
-	matches := r.variableLoadRegexp.FindAllStringSubmatchIndex(str, -1)
+	matches := r.patterns.loadMatches(r.variableLoadRegexp, str)
 	if len(matches) == 0 {
 		return str, nil
 	}
@@ -469,46 +1279,16 @@ func (r *Rehapt) replaceVars(str string) (string, error) {
 
 		// remove the prefix and suffix
 		varname := str[varnameStart:varnameEnd]
-		value := ""
 
 		// Make sure variable exists, or report error
-		ivalue, ok := r.variables[varname]
+		ivalue, ok := r.lookupVar(varname)
 		if ok == false {
 			return "", fmt.Errorf("variable %v is not defined", varname)
 		}
 
-		// Try to convert value to string
-		switch ival := ivalue.(type) {
-		case string:
-			value = ival
-		case int:
-			value = strconv.FormatInt(int64(ival), 10)
-		case int8:
-			value = strconv.FormatInt(int64(ival), 10)
-		case int16:
-			value = strconv.FormatInt(int64(ival), 10)
-		case int32:
-			value = strconv.FormatInt(int64(ival), 10)
-		case int64:
-			value = strconv.FormatInt(ival, 10)
-		case uint:
-			value = strconv.FormatUint(uint64(ival), 10)
-		case uint8:
-			value = strconv.FormatUint(uint64(ival), 10)
-		case uint16:
-			value = strconv.FormatUint(uint64(ival), 10)
-		case uint32:
-			value = strconv.FormatUint(uint64(ival), 10)
-		case uint64:
-			value = strconv.FormatUint(ival, 10)
-		case float32:
-			value = strconv.FormatFloat(float64(ival), 'f', r.floatPrecision, 32)
-		case float64:
-			value = strconv.FormatFloat(ival, 'f', r.floatPrecision, 64)
-		case bool:
-			value = strconv.FormatBool(ival)
-		default:
-			return "", fmt.Errorf("variable %v of type %T cannot be using inside string", varname, ivalue)
+		value, err := r.formatVar(varname, ivalue)
+		if err != nil {
+			return "", err
 		}
 
 		replaced = append(replaced, str[offset:prefix]...)
@@ -524,19 +1304,164 @@ func (r *Rehapt) replaceVars(str string) (string, error) {
 	return string(replaced), nil
 }
 
+// formatVar converts the variable value to a string, so it can be used inside another string
+func (r *Rehapt) formatVar(varname string, ivalue interface{}) (string, error) {
+	value := ""
+	switch ival := ivalue.(type) {
+	case string:
+		value = ival
+	case int:
+		value = strconv.FormatInt(int64(ival), 10)
+	case int8:
+		value = strconv.FormatInt(int64(ival), 10)
+	case int16:
+		value = strconv.FormatInt(int64(ival), 10)
+	case int32:
+		value = strconv.FormatInt(int64(ival), 10)
+	case int64:
+		value = strconv.FormatInt(ival, 10)
+	case uint:
+		value = strconv.FormatUint(uint64(ival), 10)
+	case uint8:
+		value = strconv.FormatUint(uint64(ival), 10)
+	case uint16:
+		value = strconv.FormatUint(uint64(ival), 10)
+	case uint32:
+		value = strconv.FormatUint(uint64(ival), 10)
+	case uint64:
+		value = strconv.FormatUint(ival, 10)
+	case float32:
+		value = strconv.FormatFloat(float64(ival), 'f', r.floatPrecision, 32)
+	case float64:
+		value = strconv.FormatFloat(ival, 'f', r.floatPrecision, 64)
+	case bool:
+		value = strconv.FormatBool(ival)
+	default:
+		return "", fmt.Errorf("variable %v of type %T cannot be using inside string", varname, ivalue)
+	}
+	return value, nil
+}
+
+// ReplaceVarsDeep works like ReplaceVars, but walks the maps and slices of the value, like M, S
+// or a map[string]string, and replaces the variables in all the strings found.
+// It is meant to prepare the structured request bodies. The value is not modified, a copy of the
+// same type is returned. An error is returned if a variable is not defined
+//
+// Example:
+//
+//	body, err := r.ReplaceVarsDeep(M{"owner": "_userid_", "tags": S{"_tag_"}})
+func (r *Rehapt) ReplaceVarsDeep(v interface{}) (interface{}, error) {
+	return r.replaceVarsDeep(v)
+}
+
+// replaceVarsDeep walks the maps and slices of the value and replaces the variables in all the strings found.
+// The value is not modified, a copy is returned
+func (r *Rehapt) replaceVarsDeep(v interface{}) (interface{}, error) {
+	if str, ok := v.(string); ok == true {
+		return r.replaceVars(str)
+	}
+
+	value := reflect.ValueOf(v)
+	switch {
+	case value.Kind() == reflect.Map && value.IsNil() == false:
+		replaced := reflect.MakeMap(value.Type())
+		for _, key := range value.MapKeys() {
+			element, err := r.replaceVarsDeepValue(value.MapIndex(key), value.Type().Elem())
+			if err != nil {
+				return nil, err
+			}
+			replaced.SetMapIndex(key, element)
+		}
+		return replaced.Interface(), nil
+	case value.Kind() == reflect.Slice && value.IsNil() == false && value.Type().Elem().Kind() != reflect.Uint8:
+		// The []byte are raw data, not a list of values
+		replaced := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+		for i := 0; i < value.Len(); i++ {
+			element, err := r.replaceVarsDeepValue(value.Index(i), value.Type().Elem())
+			if err != nil {
+				return nil, err
+			}
+			replaced.Index(i).Set(element)
+		}
+		return replaced.Interface(), nil
+	default:
+		return v, nil
+	}
+}
+
+// replaceVarsDeepValue replaces the variables of a map or slice element, returned as a value of the element type
+func (r *Rehapt) replaceVarsDeepValue(element reflect.Value, elementType reflect.Type) (reflect.Value, error) {
+	if element.Kind() == reflect.Interface && element.IsNil() == true {
+		return reflect.Zero(elementType), nil
+	}
+	replaced, err := r.replaceVarsDeep(element.Interface())
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	// The replaced value has the dynamic type of the element, converted back for the interface{} elements
+	return reflect.ValueOf(replaced).Convert(elementType), nil
+}
+
+// replaceRequestVars replaces the variables in the request parts not handled by Test()
+func replaceRequestVars(r *Rehapt, testcase TestCase) (TestCase, error) {
+	if testcase.Request.Headers != nil {
+		headers := make(H, len(testcase.Request.Headers))
+		for name, values := range testcase.Request.Headers {
+			replaced := make([]string, len(values))
+			for i, value := range values {
+				var err error
+				if replaced[i], err = r.replaceVars(value); err != nil {
+					return testcase, fmt.Errorf("error while replacing variables in header %v. %v", name, err)
+				}
+			}
+			headers[name] = replaced
+		}
+		testcase.Request.Headers = headers
+	}
+
+	request, err := testcase.Request.resolveRawBody()
+	if err != nil {
+		return testcase, err
+	}
+	testcase.Request = request
+	if testcase.Request.Body != nil {
+		body, err := r.replaceVarsDeep(testcase.Request.Body)
+		if err != nil {
+			return testcase, fmt.Errorf("error while replacing variables in body. %v", err)
+		}
+		testcase.Request.Body = body
+	}
+	return testcase, nil
+}
+
 func (r *Rehapt) storeIfVariable(expected string, actual interface{}) bool {
-	elements := r.variableStoreRegexp.FindStringSubmatch(expected)
-	if len(elements) > 1 {
-		// index 0 is the full match.
-		// index 1 is the first group, our variable name without the '_' prefix and suffix
-		varname := elements[1]
+	varname := r.patterns.storeName(r.variableStoreRegexp, expected)
+	if varname != "" {
 		// We override any stored value
-		r.variables[varname] = actual
+		r.storeVar(varname, actual)
 		return true
 	}
 	return false
 }
 
+func (r *Rehapt) storeLastResponseVariables(response *http.Response, body interface{}) {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+
+	// Remove the headers of the previous response, they might not be present in this one
+	for name := range r.variables {
+		if strings.HasPrefix(name, lastHeaderVarPrefix) {
+			delete(r.variables, name)
+		}
+	}
+
+	r.variables[lastStatusVar] = response.StatusCode
+	r.variables[lastBodyVar] = body
+	for name := range response.Header {
+		r.variables[lastHeaderVarPrefix+name] = response.Header.Get(name)
+	}
+}
+
 func (r *Rehapt) initComparators() {
 	// Fill the list of supported comparators
 	// Note the list order do matter because
@@ -549,9 +1474,19 @@ func (r *Rehapt) initComparators() {
 		},
 		{
 			ExpectedKind: reflect.Slice,
-			ExpectedType: nil,
+			ExpectedType: reflect.TypeOf(SortedS{}),
 			Compare:      r.sliceCompare,
 		},
+		{
+			ExpectedKind: reflect.Slice,
+			ExpectedType: reflect.TypeOf(json.RawMessage{}),
+			Compare:      r.rawMessageCompare,
+		},
+		{
+			ExpectedKind: reflect.Slice,
+			ExpectedType: nil,
+			Compare:      r.defaultSliceCompare,
+		},
 		{
 			ExpectedKind: reflect.Map,
 			ExpectedType: reflect.TypeOf(PartialM{}),
@@ -559,9 +1494,14 @@ func (r *Rehapt) initComparators() {
 		},
 		{
 			ExpectedKind: reflect.Map,
-			ExpectedType: nil,
+			ExpectedType: reflect.TypeOf(ExactM{}),
 			Compare:      r.mapCompare,
 		},
+		{
+			ExpectedKind: reflect.Map,
+			ExpectedType: nil,
+			Compare:      r.defaultMapCompare,
+		},
 		{
 			ExpectedKind: reflect.String,
 			ExpectedType: nil,
@@ -632,26 +1572,43 @@ func (r *Rehapt) initComparators() {
 			ExpectedType: nil,
 			Compare:      r.floatCompare,
 		},
+		{
+			ExpectedKind: reflect.Struct,
+			ExpectedType: reflect.TypeOf(time.Time{}),
+			Compare:      r.timeCompare,
+		},
 	}
-}
 
-func (r *Rehapt) compare(expected interface{}, actual interface{}) error {
-	// This is perfectly valid
-	if expected == nil && actual == nil {
-		return nil
-	}
-	// but this is not. We cannot go further in these 2 cases as there are nothing to compare
-	if expected == nil {
-		return fmt.Errorf("expected is nil but got %v", actual)
+	// The comparators replaced by ReplaceComparator are bound to this instance too
+	for _, override := range r.comparatorOverrides {
+		for i, comparator := range r.comparators {
+			if comparator.ExpectedKind == override.ExpectedKind && comparator.ExpectedType == override.ExpectedType {
+				r.overrideComparator(i, override.Compare)
+				break
+			}
+		}
 	}
-	if actual == nil {
-		return fmt.Errorf("expected %v but got nil", expected)
+}
+
+// findComparator returns the index of the first comparator handling the expected type, or -1.
+// Either the Kind *and* the Type have to match (for example Kind==String and Type==Regexp)
+// or only the Kind as a generic fallback (for example Kind==String)
+func (r *Rehapt) findComparator(expectedType reflect.Type) int {
+	for i, comparator := range r.comparators {
+		if comparator.ExpectedKind == expectedType.Kind() {
+			if comparator.ExpectedType == expectedType || comparator.ExpectedType == nil {
+				return i
+			}
+		}
 	}
+	return -1
+}
 
+// newCompareCtx describes the compared values, which must not be nil
+func newCompareCtx(expected interface{}, actual interface{}) compareCtx {
 	expectedType := reflect.TypeOf(expected)
 	actualType := reflect.TypeOf(actual)
-
-	ctx := compareCtx{
+	return compareCtx{
 		Expected:      expected,
 		ExpectedKind:  expectedType.Kind(),
 		ExpectedType:  expectedType,
@@ -661,6 +1618,116 @@ func (r *Rehapt) compare(expected interface{}, actual interface{}) error {
 		ActualType:    actualType,
 		ActualValue:   reflect.ValueOf(actual),
 	}
+}
+
+// Compare compares any actual value with an expected value, like a response body, so the expectations
+// like PartialM, UnsortedS, Regexp() or the variables can assert values not coming from an HTTP response,
+// for example a message queue payload. The actual value is expected as decoded by json.Unmarshal into
+// an interface{}: maps, slices, strings, float64, bool and nil.
+// It returns a *MismatchError if the values do not match, or another error for an invalid expectation.
+// It can be called concurrently, the variables stored are visible by the testcases of this instance
+//
+// Example:
+//
+//	var payload interface{}
+//	_ = json.Unmarshal(message, &payload)
+//	err := r.Compare(PartialM{"event": "user.created", "id": "$id$"}, payload)
+func (r *Rehapt) Compare(expected interface{}, actual interface{}) error {
+	return r.call().compare(expected, actual)
+}
+
+// Compare compares any actual value with an expected value using the default settings,
+// see Rehapt.Compare. The variables stored by the expected value are lost
+func Compare(expected interface{}, actual interface{}) error {
+	return NewRehapt(nil, nil).Compare(expected, actual)
+}
+
+// compare returns a *MismatchError if the actual value does not match the expected one
+func (r *Rehapt) compare(expected interface{}, actual interface{}) error {
+	atomic.AddInt64(&r.stats.comparisons, 1)
+	if r.fastMatch(expected, actual) == true {
+		return nil
+	}
+	expected = unwrapExpected(expected)
+	// A Matcher decides itself if a nil actual value matches
+	if _, ok := expected.(Matcher); ok == false {
+		// This is perfectly valid
+		if expected == nil && actual == nil {
+			return nil
+		}
+		// but this is not. We cannot go further in these 2 cases as there are nothing to compare
+		if expected == nil {
+			r.mismatchCount++
+			return newMismatch(MismatchNil, expected, actual, "expected is nil but got %v", r.formatValue(actual))
+		}
+		if actual == nil {
+			r.mismatchCount++
+			return newMismatch(MismatchNil, expected, actual, "expected %v but got nil", r.formatValue(expected))
+		}
+	}
+
+	// The CompareFn and some comparators report other errors, like an invalid variable
+	count := r.mismatchCount
+	if err := r.compareValues(expected, actual); err != nil {
+		mismatchErr := asMismatch(err, expected, actual)
+		// The nested comparisons already counted their mismatches
+		if r.mismatchCount == count {
+			r.mismatchCount += len(mismatchErr.Mismatches)
+		}
+		return mismatchErr
+	}
+	return nil
+}
+
+// unwrapExpected returns the value to compare in place of the expected one.
+// A pointer is compared as the value it points to, and a nil pointer as nil.
+// A driver.Valuer, like the sql.NullString fields of the generated DTOs, is compared as its value.
+// A Matcher is kept as is
+func unwrapExpected(expected interface{}) interface{} {
+	for {
+		v := reflect.ValueOf(expected)
+		if v.Kind() == reflect.Ptr && v.IsNil() == true {
+			return nil
+		}
+		if _, ok := expected.(Matcher); ok == true {
+			return expected
+		}
+		if valuer, ok := expected.(driver.Valuer); ok == true {
+			value, err := valuer.Value()
+			if err != nil {
+				return expected
+			}
+			expected = value
+			continue
+		}
+		if v.Kind() != reflect.Ptr {
+			return expected
+		}
+		expected = v.Elem().Interface()
+	}
+}
+
+// tryCompare works like compare, except its mismatches do not count toward SetMaxErrors.
+// It is meant for the comparisons where a mismatch is not an error, like the alternatives of Or()
+func (r *Rehapt) tryCompare(expected interface{}, actual interface{}) error {
+	count := r.mismatchCount
+	defer func() {
+		r.mismatchCount = count
+	}()
+	return r.compare(expected, actual)
+}
+
+// maxErrorsReached returns true once SetMaxErrors mismatches have been found in the current response
+func (r *Rehapt) maxErrorsReached() bool {
+	return r.maxErrors > 0 && r.mismatchCount >= r.maxErrors
+}
+
+func (r *Rehapt) compareValues(expected interface{}, actual interface{}) error {
+	if matcher, ok := expected.(Matcher); ok == true {
+		return matcher.Match(r, actual)
+	}
+
+	ctx := newCompareCtx(expected, actual)
 
 	// If expected is a CompareFn function, then call it
 	if cmp, ok := expected.(CompareFn); ok == true { //expectedType.Kind() == reflect.Func && expectedType.String() == "rehapt.CompareFn" {
@@ -669,16 +1736,112 @@ func (r *Rehapt) compare(expected interface{}, actual interface{}) error {
 
 	// Now find a matching comparator and let it do the job.
 	// We iterate through our defined comparators and stop on the first matching one.
-	// Either the Kind *and* the Type have to match (for example Kind==String and Type==Regexp)
-	// or only the Kind as a generic fallback (for example Kind==String)
-	for _, comparator := range r.comparators {
-		if comparator.ExpectedKind == ctx.ExpectedKind {
-			if comparator.ExpectedType == expectedType || comparator.ExpectedType == nil {
-				return comparator.Compare(ctx)
-			}
+	if i := r.findComparator(ctx.ExpectedType); i >= 0 {
+		return r.comparators[i].Compare(ctx)
+	}
+	return newMismatch(MismatchType, expected, actual, "unhandled type %T%v", expected, unhandledTypeHint(ctx.ExpectedType))
+}
+
+// isZeroCode returns true if the expected response code is not set, or set to 0
+func isZeroCode(code interface{}) bool {
+	v := reflect.ValueOf(code)
+	switch v.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	default:
+		return false
+	}
+}
+
+// unhandledTypeHint suggests what to use instead of an expected type which cannot be compared
+func unhandledTypeHint(t reflect.Type) string {
+	switch {
+	case t.Kind() == reflect.Struct:
+		return ". Structs are not supported, use M or PartialM with the JSON field names instead"
+	case t.Kind() == reflect.Array:
+		return ". Arrays are not supported, use S, SortedS or UnsortedS instead"
+	case t.Kind() == reflect.Complex64 || t.Kind() == reflect.Complex128:
+		return ". Complex numbers are not supported, use a float or NumberDelta() instead"
+	case t.Kind() == reflect.Func:
+		return ". Functions are not supported, use a CompareFn like Regexp() or Any() instead"
+	default:
+		return ""
+	}
+}
+
+// reportSkip reports a skipped testcase using the ErrorHandler Logf() function when it exists.
+// We don't use Skip() here because it would stop the whole test, not only this testcase
+func (r *Rehapt) reportSkip(err error) {
+	if logger, ok := r.errorHandler.(interface {
+		Logf(format string, args ...interface{})
+	}); ok == true {
+		logger.Logf("%v", err)
+	} else if r.eventLogger != nil {
+		r.eventLogger.logEvent("test skipped", "reason", err.(*SkipError).Reason)
+	} else {
+		fmt.Printf("%v\n", err)
+	}
+}
+
+// eventLogger logs the lifecycle events of the testcases as a message followed by key-value pairs.
+// It is implemented with log/slog, see SetLogger, which is only available since go1.21
+type eventLogger interface {
+	// logEvent logs the event at the configured level
+	logEvent(message string, args ...interface{})
+	// logFailure logs the event at the error level
+	logFailure(message string, args ...interface{})
+}
+
+// logEvent logs a lifecycle event of the testcase, if a logger is set
+func (r *Rehapt) logEvent(message string, args ...interface{}) {
+	if r.eventLogger != nil {
+		r.eventLogger.logEvent(message, args...)
+	}
+}
+
+// parseTagFilter parse a comma separated list of tags, ignoring the empty ones
+func parseTagFilter(str string) []string {
+	var tags []string
+	for _, tag := range strings.Split(str, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// markHelper calls the Helper() method of the given testing object if it exists.
+// testing.T gained this method in go1.9, so we cannot call it directly
+func markHelper(t interface{}) {
+	if h, ok := t.(interface{ Helper() }); ok == true {
+		h.Helper()
+	}
+}
+
+// joinErrors merge all the non-nil errors in a single one, one error per line.
+// It returns nil if all the errors are nil
+func joinErrors(errs ...error) error {
+	var nonNil []error
+	var messages []string
+	for _, err := range errs {
+		if err != nil {
+			nonNil = append(nonNil, err)
+			messages = append(messages, err.Error())
 		}
 	}
-	return fmt.Errorf("unhandled type %T", expected)
+	switch len(nonNil) {
+	case 0:
+		return nil
+	case 1:
+		// Keep the original error, the caller might check its type
+		return nonNil[0]
+	default:
+		return errors.New(strings.Join(messages, "\n"))
+	}
 }
 
 func cloneHeader(header http.Header) http.Header {
@@ -1,16 +1,42 @@
 package rehapt_test
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	. "github.com/thib-ack/rehapt"
 )
 
+// The usual golden files flag, which the library must not define itself
+var update = flag.Bool("update", false, "rewrite the golden files")
+
 type testContext struct {
 	r      *Rehapt
 	server *http.ServeMux
@@ -2028,262 +2054,4454 @@ func TestOKRegexpVarsOnlyFullMatch(t *testing.T) {
 	}
 }
 
-// And now invalid cases
-
-func TestErrNilMarshaler(t *testing.T) {
+func TestOKStoreLastResponse(t *testing.T) {
 	c := setupTest(t)
+	c.r.SetStoreLastResponse(true)
 
-	c.r.SetMarshaler(nil)
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Location", "/api/user/55")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"id": "55"}`)
+	})
+	c.server.HandleFunc("/api/user/55", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"id": "55", "name": "John"}`)
+	})
 
 	err := c.r.Test(TestCase{
 		Request: TestRequest{
-			Method: "GET",
-			Path:   "/api/test",
-			Body:   nil,
+			Method: "POST",
+			Path:   "/api/user",
 		},
 		Response: TestResponse{
-			Code: http.StatusOK,
-			Body: nil,
+			Code: http.StatusCreated,
+			Body: M{"id": "55"},
 		},
 	})
-
-	if e := ExpectError(err, `nil marshaler`); e != "" {
+	if e := ExpectNil(err); e != "" {
 		t.Error(e)
 	}
-}
-
-func TestErrNilUnmarshaler(t *testing.T) {
-	c := setupTest(t)
 
-	c.r.SetUnmarshaler(nil)
+	if c.r.GetVariable("last.status") != http.StatusCreated {
+		t.Errorf("Expected last.status %v, got %v", http.StatusCreated, c.r.GetVariable("last.status"))
+	}
 
-	err := c.r.Test(TestCase{
+	err = c.r.Test(TestCase{
 		Request: TestRequest{
 			Method: "GET",
-			Path:   "/api/test",
-			Body:   nil,
+			Path:   "_last.header.Location_",
 		},
 		Response: TestResponse{
 			Code: http.StatusOK,
-			Body: nil,
+			Body: M{"id": "_last.status_", "name": "John"},
 		},
 	})
-
-	if e := ExpectError(err, `nil unmarshaler`); e != "" {
+	if e := ExpectError(err, `id: strings does not match. Expected '201', got '55'`); e != "" {
 		t.Error(e)
 	}
-}
-
-func TestErrNilHTTPHandler(t *testing.T) {
-	c := setupTest(t)
 
-	c.r.SetHttpHandler(nil)
+	// Headers of the previous response are not kept
+	if v := c.r.GetVariable("last.header.Location"); v != nil {
+		t.Errorf("Expected no last.header.Location, got %v", v)
+	}
 
-	err := c.r.Test(TestCase{
+	// The same response is expected again
+	err = c.r.Test(TestCase{
 		Request: TestRequest{
 			Method: "GET",
-			Path:   "/api/test",
-			Body:   nil,
+			Path:   "/api/user/55",
 		},
 		Response: TestResponse{
-			Code: http.StatusOK,
-			Body: nil,
+			Code: LoadVar("last.status"),
+			Body: LoadVar("last.body"),
 		},
 	})
-
-	if e := ExpectError(err, `nil HTTP handler`); e != "" {
+	if e := ExpectNil(err); e != "" {
 		t.Error(e)
 	}
 }
 
-func TestErrNilErrorHandler(t *testing.T) {
-	server := http.NewServeMux()
-
-	c := &testContext{
-		r:      NewRehapt(nil, server),
-		server: server,
-	}
+func TestOKDottedLiteralNotVariable(t *testing.T) {
+	c := setupTest(t)
 
-	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+	c.server.HandleFunc("/api/backup", func(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusOK)
-		_, _ = fmt.Fprintf(w, `"ok"`)
+		_, _ = fmt.Fprintf(w, `{"f": "backup_v1.2_old", "g": "_x.y_"}`)
 	})
 
-	// The reported error on stdout here is expected
-	c.r.TestAssert(TestCase{
+	// Only the reserved variables like "last.status" have dotted names,
+	// the other dotted strings are compared as literals
+	err := c.r.Test(TestCase{
 		Request: TestRequest{
 			Method: "GET",
-			Path:   "/api/test",
-			Body:   nil,
+			Path:   "/api/backup",
 		},
 		Response: TestResponse{
 			Code: http.StatusOK,
-			Body: "KO",
+			Body: M{"f": "backup_v1.2_old", "g": "_x.y_"},
 		},
 	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKSuite(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/login", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"token": "abc"}`)
+	})
+	c.server.HandleFunc("/api/cart/abc", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"items": 2}`)
+	})
 
-	// No easy way to check stdout, but at least we make sure the TestAssert() function
-	// does not crash when errorHandler is nil
+	suite := c.r.NewSuite("checkout flow")
+	suite.Add("login", TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/login"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"token": "$token$"}},
+	})
+	suite.Add("cart", TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/cart/_token_"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"items": 2}},
+	})
+
+	if suite.Name() != "checkout flow" || len(suite.Steps()) != 2 {
+		t.Errorf("Unexpected suite %v with %d steps", suite.Name(), len(suite.Steps()))
+	}
+	if suite.Run(t) == false {
+		t.Error("Expected suite to succeed")
+	}
 }
 
-func TestErrMissingHTTPMethod(t *testing.T) {
+func TestOKTestCaseHooks(t *testing.T) {
 	c := setupTest(t)
 
+	c.server.HandleFunc("/api/user/55", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	var calls []string
 	err := c.r.Test(TestCase{
-		Request: TestRequest{
-			Method: "",
-			Path:   "/api/test",
-			Body:   nil,
+		Before: func(r *Rehapt) error {
+			calls = append(calls, "before")
+			return r.SetVariable("id", "55")
 		},
-		Response: TestResponse{
-			Code: http.StatusOK,
-			Body: nil,
+		After: func(r *Rehapt) error {
+			calls = append(calls, "after")
+			return nil
 		},
+		Request:  TestRequest{Method: "GET", Path: "/api/user/_id_"},
+		Response: TestResponse{Code: http.StatusOK},
 	})
-
-	if e := ExpectError(err, `incomplete testcase. Missing HTTP method`); e != "" {
+	if e := ExpectNil(err); e != "" {
 		t.Error(e)
 	}
+	if fmt.Sprint(calls) != "[before after]" {
+		t.Errorf("Unexpected hook calls %v", calls)
+	}
 }
 
-func TestErrInvalidHTTPMethod(t *testing.T) {
+func TestOKSuiteHooks(t *testing.T) {
 	c := setupTest(t)
 
-	err := c.r.Test(TestCase{
-		Request: TestRequest{
-			Method: "NOT CORRECT",
-			Path:   "/api/test",
-			Body:   nil,
-		},
-		Response: TestResponse{
-			Code: http.StatusOK,
-			Body: nil,
-		},
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
 	})
 
-	if e := ExpectError(err, `failed to build HTTP request. net/http: invalid method "NOT CORRECT"`); e != "" {
+	var calls []string
+	hook := func(name string) HookFn {
+		return func(r *Rehapt) error {
+			calls = append(calls, name)
+			return nil
+		}
+	}
+
+	suite := c.r.NewSuite("hooks")
+	suite.BeforeAll(hook("beforeAll"))
+	suite.AfterAll(hook("afterAll"))
+	suite.BeforeEach(hook("beforeEach"))
+	suite.AfterEach(hook("afterEach"))
+	suite.Add("first", TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	suite.Add("second", TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+
+	if e := ExpectNil(suite.Test()); e != "" {
 		t.Error(e)
 	}
+	if fmt.Sprint(calls) != "[beforeAll beforeEach afterEach beforeEach afterEach afterAll]" {
+		t.Errorf("Unexpected hook calls %v", calls)
+	}
 }
 
-func TestErrMissingURLPath(t *testing.T) {
+func TestOKTestEventually(t *testing.T) {
 	c := setupTest(t)
 
-	err := c.r.Test(TestCase{
-		Request: TestRequest{
-			Method: "GET",
-			Path:   "",
-			Body:   nil,
-		},
-		Response: TestResponse{
-			Code: http.StatusOK,
-			Body: nil,
-		},
+	calls := 0
+	c.server.HandleFunc("/api/job", func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+		if calls < 3 {
+			_, _ = fmt.Fprintf(w, `{"status": "running"}`)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"status": "done"}`)
 	})
 
-	if e := ExpectError(err, `incomplete testcase. Missing URL path`); e != "" {
+	err := c.r.TestEventually(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/job"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"status": "done"}},
+	}, time.Second, time.Millisecond)
+	if e := ExpectNil(err); e != "" {
 		t.Error(e)
 	}
+	if calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", calls)
+	}
 }
 
-func TestErrMarshalRequestBody(t *testing.T) {
+func TestOKTestEventuallySkipped(t *testing.T) {
 	c := setupTest(t)
 
-	err := c.r.Test(TestCase{
-		Request: TestRequest{
-			Method: "GET",
-			Path:   "/api/test",
-			Body:   M{"n": json.Number(`invalid`)}, // This is refused by json.Marshal
-		},
-		Response: TestResponse{
-			Code: http.StatusOK,
-			Body: nil,
-		},
-	})
+	testcase := TestCase{
+		SkipIf:   SkipUnlessVar("premium"),
+		Request:  TestRequest{Method: "GET", Path: "/api/premium"},
+		Response: TestResponse{Code: http.StatusOK},
+	}
 
-	if e := ExpectError(err, `failed to marshal the testcase request body. json: invalid number literal "invalid"`); e != "" {
+	// A skipped testcase is not retried until the timeout
+	started := time.Now()
+	err := c.r.TestEventually(testcase, 10*time.Second, 10*time.Millisecond)
+	if e := ExpectError(err, `testcase skipped. variable premium is not set`); e != "" {
 		t.Error(e)
 	}
+	if IsSkipped(err) == false {
+		t.Error("Expected a skip error")
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Expected the skip to be returned immediately, took %v", elapsed)
+	}
+
+	// and it is not a failure
+	tt := &testingT{}
+	c.r.SetErrorHandler(tt)
+	c.r.TestEventuallyAssert(testcase, 10*time.Second, 10*time.Millisecond)
+	if tt.called == true {
+		t.Error("Expected Errorf not to be called")
+	}
 }
 
-func TestErrResponseCode(t *testing.T) {
+func TestOKTestRun(t *testing.T) {
 	c := setupTest(t)
 
 	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
-		w.WriteHeader(http.StatusUnauthorized)
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `"ok"`)
 	})
 
-	err := c.r.Test(TestCase{
-		Request: TestRequest{
-			Method: "GET",
-			Path:   "/api/test",
-			Body:   nil,
-		},
-		Response: TestResponse{
-			Code: http.StatusOK,
-			Body: nil,
-		},
+	ok := c.r.TestRun(t, "get test", TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusOK, Body: "ok"},
 	})
-
-	if e := ExpectError(err, `response code does not match. Expected 200, got 401`); e != "" {
-		t.Error(e)
+	if ok == false {
+		t.Error("Expected subtest to succeed")
 	}
 }
 
-func TestErrTestAssertCallFailFunction(t *testing.T) {
-	c := setupTest(t)
+type logT struct {
+	messageT
+	logs []string
+}
 
-	tt := &testingT{}
-	c.r.SetErrorHandler(tt)
+func (t *logT) Logf(format string, args ...interface{}) {
+	t.logs = append(t.logs, fmt.Sprintf(format, args...))
+}
+
+func TestOKRunSummary(t *testing.T) {
+	c := setupTest(t)
 
 	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = fmt.Fprintf(w, `"ok"`)
 	})
+	testcase := TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusOK, Body: "ok"},
+	}
+	skipped := testcase
+	skipped.SkipIf = func(r *Rehapt) (bool, string) { return true, "not ready" }
 
-	c.r.TestAssert(TestCase{
-		Request: TestRequest{
-			Method: "GET",
-			Path:   "/api/test",
-			Body:   nil,
-		},
-		Response: TestResponse{
-			Code: http.StatusOK,
-			Body: "not ok",
-		},
-	})
+	c.r.TestRun(t, "get test", testcase)
+	c.r.TestRun(t, "skipped test", skipped)
+	suite := c.r.NewSuite("suite")
+	suite.Add("first", testcase)
+	suite.Add("second", skipped)
+	suite.Run(t)
 
-	if tt.called == false {
-		t.Errorf("Fail function should have been called")
+	summary := c.r.Summary()
+	if summary.Passed != 2 || summary.Failed != 0 || summary.Skipped != 2 || len(summary.Failures) != 0 {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+
+	handler := &logT{}
+	c.r.SetErrorHandler(handler)
+	c.r.ReportSummary()
+	if len(handler.logs) != 1 || handler.logs[0] != "\n2 passed, 0 failed, 2 skipped" {
+		t.Errorf("Unexpected logs %q", handler.logs)
+	}
+
+	summary = RunSummary{Passed: 1, Failed: 2, Failures: []RunFailure{
+		{Name: "TestUsers/get_user", Reason: "response code does not match. Expected 200, got 404"},
+		{Name: "TestUsers/delete_user", Reason: "response code does not match. Expected 204, got 500"},
+	}}
+	expected := "1 passed, 2 failed, 0 skipped\n" +
+		"FAIL TestUsers/get_user: response code does not match. Expected 200, got 404\n" +
+		"FAIL TestUsers/delete_user: response code does not match. Expected 204, got 500"
+	if summary.String() != expected {
+		t.Errorf("Expected summary %q, got %q", expected, summary.String())
 	}
 }
 
-func TestErrResponseBodyType(t *testing.T) {
+func TestOKStats(t *testing.T) {
 	c := setupTest(t)
 
-	c.server.HandleFunc("/api/string", func(w http.ResponseWriter, req *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = fmt.Fprintf(w, `"ok"`)
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"id": "1", "tags": ["a"]}`)
 	})
-	c.server.HandleFunc("/api/int", func(w http.ResponseWriter, req *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = fmt.Fprintf(w, `1`)
+
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/user", Body: M{"name": "John"}},
+		Response: TestResponse{Code: http.StatusCreated, Body: M{"id": "$id$", "tags": S{"a"}}},
 	})
-	c.server.HandleFunc("/api/float", func(w http.ResponseWriter, req *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = fmt.Fprintf(w, `1.0`)
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	// The forks share the stats
+	_ = c.r.Fork().Test(TestCase{
+		SkipIf:   func(r *Rehapt) (bool, string) { return true, "not ready" },
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK},
 	})
-	c.server.HandleFunc("/api/bool", func(w http.ResponseWriter, req *http.Request) {
+
+	stats := c.r.Stats()
+	if stats.ServerTime <= 0 {
+		t.Errorf("Expected a server time, got %v", stats.ServerTime)
+	}
+	stats.ServerTime = 0
+	// code, body, id, tags and tags[0]
+	expected := Stats{TestCases: 1, Skipped: 1, Comparisons: 5, VariablesStored: 1, BytesSent: 15, BytesReceived: 26}
+	if stats != expected {
+		t.Errorf("Expected stats %+v, got %+v", expected, stats)
+	}
+	if actual := expected.String(); actual != "1 testcases executed, 1 skipped, 5 comparisons, 1 variables stored, 15 bytes sent, 26 bytes received, 0s server time" {
+		t.Errorf("Unexpected stats string %q", actual)
+	}
+}
+
+func TestOKClone(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusOK)
-		_, _ = fmt.Fprintf(w, `true`)
+		_, _ = fmt.Fprintf(w, `{"id": "1", "token": %q}`, req.Header.Get("Authorization"))
 	})
-	c.server.HandleFunc("/api/map", func(w http.ResponseWriter, req *http.Request) {
+
+	c.r.SetDefaultHeader("Authorization", "base")
+	_ = c.r.SetVariable("name", "John")
+
+	clone := c.r.Clone(false)
+	clone.SetDefaultHeader("Authorization", "clone")
+	err := clone.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"id": "$id$", "token": "clone"}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	if clone.GetVariable("name") != nil || clone.GetVariable("id") != "1" {
+		t.Errorf("Expected only the stored variables in the clone, got %v and %v", clone.GetVariable("name"), clone.GetVariable("id"))
+	}
+	if c.r.GetVariable("id") != nil || c.r.GetDefaultHeader("Authorization") != "base" {
+		t.Errorf("Expected the base instance unchanged, got %v and %v", c.r.GetVariable("id"), c.r.GetDefaultHeader("Authorization"))
+	}
+	if clone.Stats().TestCases != 1 || c.r.Stats().TestCases != 0 {
+		t.Errorf("Expected independent stats, got %v and %v", clone.Stats().TestCases, c.r.Stats().TestCases)
+	}
+
+	if withVariables := c.r.Clone(true); withVariables.GetVariable("name") != "John" {
+		t.Errorf("Expected the variables in the clone, got %v", withVariables.GetVariable("name"))
+	}
+}
+
+func TestOKExtend(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user/1", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" || req.Header.Get("X-Request-Id") != "42" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		_, _ = fmt.Fprintf(w, `{"msg": "ok"}`)
+		_, _ = fmt.Fprintf(w, `{"success": true, "data": {"id": "1", "name": "John", "manager": null}, "version": 2}`)
 	})
-	c.server.HandleFunc("/api/slice", func(w http.ResponseWriter, req *http.Request) {
+
+	base := TestCase{
+		Tags:    []string{"api"},
+		Request: TestRequest{Method: "GET", Headers: H{"Authorization": {"Bearer token"}}},
+		Response: TestResponse{
+			Code:    http.StatusOK,
+			Headers: PartialM{"Content-Type": S{"application/json"}},
+			Body:    PartialM{"success": true, "data": PartialM{"id": Any()}, "version": 1},
+		},
+	}
+	testcase := TestCase{
+		Tags:     []string{"users"},
+		Request:  TestRequest{Path: "/api/user/1", Headers: H{"X-Request-Id": {"42"}}},
+		Response: TestResponse{Body: PartialM{"data": PartialM{"name": "John", "manager": nil}, "version": 2}},
+	}.Extend(base)
+
+	if strings.Join(testcase.Tags, ",") != "api,users" {
+		t.Errorf("Expected merged tags, got %v", testcase.Tags)
+	}
+	if e := ExpectNil(c.r.Test(testcase)); e != "" {
+		t.Error(e)
+	}
+
+	// The base is not modified
+	testcase = TestCase{Request: TestRequest{Path: "/api/user/1"}}.Extend(base)
+	if e := ExpectError(c.r.Test(testcase), "response code does not match. Expected 200, got 401\n"+
+		"response headers does not match. expected key Content-Type not found\n"+
+		"expected {\n  \"data\": {\n    \"id\": \"<CompareFn>\"\n  },\n  \"success\": true,\n  \"version\": 1\n} but got nil"); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKOnlyIf(t *testing.T) {
+	c := setupTest(t)
+
+	var calls []string
+	c.server.HandleFunc("/api/", func(w http.ResponseWriter, req *http.Request) {
+		calls = append(calls, req.URL.Path)
 		w.WriteHeader(http.StatusOK)
-		_, _ = fmt.Fprintf(w, `["ok"]`)
+		_, _ = fmt.Fprintf(w, `{"accountType": "premium", "credits": 10}`)
+	})
+
+	step := func(path string) TestCase {
+		return TestCase{
+			Request:  TestRequest{Method: "GET", Path: path},
+			Response: TestResponse{Code: http.StatusOK, Body: Any()},
+		}
+	}
+
+	suite := c.r.NewSuite("account")
+	suite.Add("get account", TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/account"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"accountType": "$accountType$", "credits": "$credits$"}},
+	})
+	premium := step("/api/premium")
+	premium.OnlyIf = VarEquals("accountType", "premium")
+	suite.Add("premium features", premium)
+	basic := step("/api/basic")
+	basic.OnlyIf = VarEquals("accountType", Regexp("^basic"))
+	suite.Add("basic features", basic)
+	credits := step("/api/credits")
+	credits.OnlyIf = VarEquals("credits", 10)
+	suite.Add("use credits", credits)
+
+	if e := ExpectNil(suite.Test()); e != "" {
+		t.Error(e)
+	}
+	if fmt.Sprint(calls) != "[/api/account /api/premium /api/credits]" {
+		t.Errorf("Unexpected calls %v", calls)
+	}
+
+	err := c.r.Test(TestCase{
+		OnlyIf:   VarEquals("unknown", "value"),
+		Request:  TestRequest{Method: "GET", Path: "/api/unknown"},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	if e := ExpectError(err, "testcase skipped. condition not met. variable unknown is not defined"); e != "" {
+		t.Error(e)
+	}
+
+	// The same condition in a scenario file
+	dir, err := ioutil.TempDir("", "rehapt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "account.yaml")
+	content := `steps:
+  - request: {method: GET, path: /api/account}
+    response: {code: 200, body: {accountType: !storevar accountType, credits: !any}}
+  - request: {method: GET, path: /api/scenario/premium}
+    response: {code: 200, body: !any}
+    onlyIf: {accountType: premium}
+  - request: {method: GET, path: /api/scenario/basic}
+    response: {code: 200, body: !any}
+    onlyIf: {accountType: !regexp '^basic'}
+`
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	calls = nil
+	if c.r.RunFile(t, filename) == false {
+		t.Error("Expected scenario to succeed")
+	}
+	if fmt.Sprint(calls) != "[/api/account /api/scenario/premium]" {
+		t.Errorf("Unexpected calls %v", calls)
+	}
+}
+
+func TestOKTestTable(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user/", func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"path": "%v", "role": "%v", "lang": "%v"}`, req.URL.Path, body["role"], req.Header.Get("Accept-Language"))
+	})
+
+	ok := c.r.TestTable(t, []map[string]interface{}{
+		{"name": "admin", "id": 1, "role": "admin"},
+		{"id": 2, "role": "guest"},
+	}, TestCase{
+		Request: TestRequest{
+			Method:  "PUT",
+			Path:    "/api/user/_id_",
+			Headers: H{"Accept-Language": {"_role_"}},
+			Body:    M{"role": "_role_"},
+		},
+		Response: TestResponse{
+			Code: http.StatusOK,
+			Body: M{"path": "/api/user/_id_", "role": "_role_", "lang": "_role_"},
+		},
+	})
+	if ok == false {
+		t.Error("Expected all rows to succeed")
+	}
+	if c.r.GetVariable("role") != nil {
+		t.Errorf("Expected rows variables to be isolated, got %v", c.r.GetVariable("role"))
+	}
+}
+
+func TestOKSkipIf(t *testing.T) {
+	c := setupTest(t)
+
+	called := 0
+	c.server.HandleFunc("/api/premium", func(w http.ResponseWriter, req *http.Request) {
+		called++
+		w.WriteHeader(http.StatusOK)
+	})
+
+	testcase := TestCase{
+		SkipIf:   SkipUnlessVar("premium"),
+		Request:  TestRequest{Method: "GET", Path: "/api/premium"},
+		Response: TestResponse{Code: http.StatusOK},
+	}
+
+	err := c.r.Test(testcase)
+	if e := ExpectError(err, `testcase skipped. variable premium is not set`); e != "" {
+		t.Error(e)
+	}
+	if IsSkipped(err) == false {
+		t.Error("Expected a skip error")
+	}
+
+	// A skipped testcase is not a failure
+	tt := &testingT{}
+	c.r.SetErrorHandler(tt)
+	c.r.TestAssert(testcase)
+	if tt.called == true {
+		t.Error("Expected Errorf not to be called")
+	}
+	if called != 0 {
+		t.Errorf("Expected no call, got %d", called)
+	}
+
+	_ = c.r.SetVariable("premium", true)
+	if e := ExpectNil(c.r.Test(testcase)); e != "" {
+		t.Error(e)
+	}
+	if called != 1 {
+		t.Errorf("Expected 1 call, got %d", called)
+	}
+}
+
+func TestOKTagFilter(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	c.r.SetTagFilter("smoke", "!slow")
+
+	tests := []struct {
+		Tags    []string
+		Skipped bool
+	}{
+		{Tags: nil, Skipped: true},
+		{Tags: []string{"smoke"}, Skipped: false},
+		{Tags: []string{"smoke", "slow"}, Skipped: true},
+		{Tags: []string{"regression"}, Skipped: true},
+	}
+
+	for _, test := range tests {
+		err := c.r.Test(TestCase{
+			Tags:     test.Tags,
+			Request:  TestRequest{Method: "GET", Path: "/api/test"},
+			Response: TestResponse{Code: http.StatusOK},
+		})
+		if IsSkipped(err) != test.Skipped {
+			t.Errorf("Tags %v: expected skipped %v, got error %v", test.Tags, test.Skipped, err)
+		}
+	}
+
+	// Only exclusions
+	c.r.SetTagFilter("!slow")
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	err = c.r.Test(TestCase{
+		Tags:     []string{"slow"},
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	if e := ExpectError(err, `testcase skipped. tags [slow] do not match filter [!slow]`); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKSuiteDependencies(t *testing.T) {
+	c := setupTest(t)
+
+	var calls []string
+	c.server.HandleFunc("/api/", func(w http.ResponseWriter, req *http.Request) {
+		calls = append(calls, req.URL.Path)
+		if req.URL.Path == "/api/user" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	step := func(path string) TestCase {
+		return TestCase{
+			Request:  TestRequest{Method: "GET", Path: path},
+			Response: TestResponse{Code: http.StatusOK},
+		}
+	}
+
+	suite := c.r.NewSuite("dependencies")
+	// Declared before its dependency, it will be executed after it
+	suite.Add("get product", step("/api/product/get")).DependsOn("create product")
+	suite.Add("create user", step("/api/user")).DependsOn()
+	suite.Add("get user", step("/api/user/get")).DependsOn("create user")
+	suite.Add("create product", step("/api/product")).DependsOn()
+
+	err := suite.Test()
+	if e := ExpectError(err, `step create user failed. response code does not match. Expected 200, got 500`); e != "" {
+		t.Error(e)
+	}
+	if fmt.Sprint(calls) != "[/api/user /api/product /api/product/get]" {
+		t.Errorf("Unexpected calls %v", calls)
+	}
+}
+
+func TestOKStoreResource(t *testing.T) {
+	c := setupTest(t)
+
+	var deleted []string
+	nextID := 0
+	c.server.HandleFunc("/api/users", func(w http.ResponseWriter, req *http.Request) {
+		nextID++
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"id": "%d"}`, nextID)
+	})
+	c.server.HandleFunc("/api/users/", func(w http.ResponseWriter, req *http.Request) {
+		id := strings.TrimPrefix(req.URL.Path, "/api/users/")
+		if req.Method != "DELETE" || req.Header.Get("Authorization") != "token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		deleted = append(deleted, id)
+		if id == "3" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	c.r.SetDefaultHeader("Authorization", "token")
+
+	create := TestCase{
+		Request: TestRequest{Method: "POST", Path: "/api/users"},
+		Response: TestResponse{
+			Code: http.StatusCreated,
+			Body: M{"id": StoreResource("user", "id", "DELETE /api/users/_id_")},
+		},
+	}
+	suite := c.r.NewSuite("users")
+	suite.Add("create first", create)
+	suite.Add("create second", create)
+	if e := ExpectNil(suite.Test()); e != "" {
+		t.Error(e)
+	}
+	if fmt.Sprint(deleted) != "[2 1]" {
+		t.Errorf("Expected resources 2 then 1 to be deleted, got %v", deleted)
+	}
+
+	// The failed cleanups are reported, the other ones are still executed
+	deleted = nil
+	c.r.TestAssert(create)
+	c.r.TestAssert(create)
+	err := c.r.Cleanup()
+	if e := ExpectError(err, "cleanup of user (DELETE /api/users/3) failed. response code 500"); e != "" {
+		t.Error(e)
+	}
+	if fmt.Sprint(deleted) != "[4 3]" {
+		t.Errorf("Expected resources 4 then 3 to be deleted, got %v", deleted)
+	}
+	if e := ExpectNil(c.r.Cleanup()); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.TrackResource("user", "/api/users/1")
+	if e := ExpectError(err, "invalid cleanup request '/api/users/1' for resource user, expected 'METHOD path'"); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKSuiteWarmup(t *testing.T) {
+	c := setupTest(t)
+
+	// The cache needs 3 calls to be warm
+	calls := 0
+	c.server.HandleFunc("/api/cached", func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		if calls <= 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	testcase := TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/cached"},
+		Response: TestResponse{Code: http.StatusOK},
+	}
+	suite := c.r.NewSuite("warmup")
+	suite.Warmup(testcase, 3)
+	suite.Add("get cached", testcase)
+	if e := ExpectNil(suite.Test()); e != "" {
+		t.Error(e)
+	}
+	if calls != 4 {
+		t.Errorf("Expected 4 calls, got %d", calls)
+	}
+
+	calls = 0
+	result, err := c.r.Bench(testcase, BenchOptions{N: 5, Warmup: 3})
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	if calls != 8 || result.N != 5 || result.Errors != 0 {
+		t.Errorf("Expected 8 calls and no error, got %d calls and %v", calls, result)
+	}
+}
+
+func TestOKFork(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"id": "%v"}`, req.Header.Get("X-Id"))
+	})
+
+	_ = c.r.SetVariable("name", "John")
+	c.r.SetDefaultHeader("X-Id", "1")
+
+	fork := c.r.Fork()
+	fork.SetDefaultHeader("X-Id", "2")
+	err := fork.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"id": "$id$"}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	if fork.GetVariable("name") != "John" || fork.GetVariable("id") != "2" {
+		t.Errorf("Expected fork to have name and id variables, got %v and %v", fork.GetVariable("name"), fork.GetVariable("id"))
+	}
+	if c.r.GetVariable("id") != nil || c.r.GetDefaultHeader("X-Id") != "1" {
+		t.Errorf("Expected parent to be unchanged, got id %v and header %v", c.r.GetVariable("id"), c.r.GetDefaultHeader("X-Id"))
+	}
+}
+
+func TestOKSuiteRunParallel(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/", func(w http.ResponseWriter, req *http.Request) {
+		// The created resource id is its kind
+		kind := strings.Split(req.URL.Path, "/")[2]
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"id": "%v"}`, kind)
+	})
+
+	step := func(path string, id interface{}) TestCase {
+		return TestCase{
+			Request:  TestRequest{Method: "GET", Path: path},
+			Response: TestResponse{Code: http.StatusOK, Body: M{"id": id}},
+		}
+	}
+
+	afterAll := 0
+	suite := c.r.NewSuite("parallel")
+	suite.BeforeAll(func(r *Rehapt) error {
+		return r.SetVariable("version", "v1")
+	})
+	suite.AfterAll(func(r *Rehapt) error {
+		afterAll++
+		return nil
+	})
+	// Both branches store the same variable, each one sees its own value
+	suite.Add("create user", step("/api/user/_version_", "$id$")).DependsOn()
+	suite.Add("get user", step("/api/_id_", "user"))
+	suite.Add("create product", step("/api/product/_version_", "$id$")).DependsOn()
+	suite.Add("get product", step("/api/_id_", "product"))
+
+	if suite.RunParallel(t) == false {
+		t.Error("Expected parallel suite to succeed")
+	}
+	if afterAll != 1 {
+		t.Errorf("Expected after all hook to be called once, got %d", afterAll)
+	}
+	if c.r.GetVariable("id") != nil {
+		t.Errorf("Expected branches variables to be isolated, got %v", c.r.GetVariable("id"))
+	}
+}
+
+func TestOKRunFileYAML(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		if req.Header.Get("Authorization") != "Bearer secret # not a comment" || len(req.Header["X-Roles"]) != 2 {
+			t.Errorf("Unexpected headers %v", req.Header)
+		}
+		if body["name"] != "John" || body["age"] != 51.0 || body["bio"] != "Hello,\nI am John\n" {
+			t.Errorf("Unexpected body %v", body)
+		}
+		w.Header().Set("Location", "/api/user/55")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"id": "55", "name": "John", "roles": ["admin", "user"], "createdAt": "now", "score": 10.2,
+			"pets": [{"name": "Pepper", "type": "cat"}, {"name": "Rex", "type": "dog"}]}`)
+	})
+	c.server.HandleFunc("/api/user/55", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"id": "55", "name": "John", "age": 51}`)
+	})
+	c.server.HandleFunc("/api/echo", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.Copy(w, req.Body)
+	})
+
+	suite, err := c.r.LoadFile("testdata/users.yaml")
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	if suite.Name() != "users" || len(suite.Steps()) != 3 {
+		t.Errorf("Unexpected suite %v with %d steps", suite.Name(), len(suite.Steps()))
+	}
+
+	if c.r.RunFile(t, "testdata/users.yaml") == false {
+		t.Error("Expected scenario to succeed")
+	}
+}
+
+func TestOKRunFileJSON(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/order", func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		if req.Header.Get("X-Product") != "book" || body["product"] != "book" || body["quantity"] != 2.0 {
+			t.Errorf("Unexpected request %v %v", req.Header, body)
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"id": 12, "product": "book", "quantity": 2, "createdAt": "now", "items": ["pen", "book"]}`)
+	})
+	c.server.HandleFunc("/api/order/12", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"id": 12, "product": "book"}`)
+	})
+
+	if c.r.RunFile(t, "testdata/orders.json") == false {
+		t.Error("Expected scenario to succeed")
+	}
+}
+
+func TestOKVCRRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rehapt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cassette := filepath.Join(dir, "cassettes", "payment.json")
+
+	// The third-party API called by our application
+	calls := 0
+	thirdParty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("X-Payment", "ok")
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"paid": %s}`, body)
+	}))
+	defer thirdParty.Close()
+
+	run := func(vcr *VCR) {
+		client := &http.Client{Transport: vcr}
+		app := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			response, err := client.Post(thirdParty.URL+"/pay", "application/json", strings.NewReader(`10`))
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer response.Body.Close()
+			w.Header().Set("X-Payment", response.Header.Get("X-Payment"))
+			_, _ = io.Copy(w, response.Body)
+		})
+
+		r := NewRehapt(t, app)
+		r.TestAssert(TestCase{
+			Request: TestRequest{Method: "POST", Path: "/api/checkout"},
+			Response: TestResponse{
+				Code:    http.StatusOK,
+				Headers: PartialM{"X-Payment": S{"ok"}},
+				Body:    M{"paid": 10},
+			},
+		})
+	}
+
+	// First run, the calls are recorded
+	vcr, err := NewVCR(cassette, nil)
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	if vcr.Recording() == false {
+		t.Error("Expected VCR to record")
+	}
+	run(vcr)
+	if e := ExpectNil(vcr.Stop()); e != "" {
+		t.Error(e)
+	}
+	if calls != 1 || len(vcr.Cassette().Interactions) != 1 {
+		t.Errorf("Expected 1 recorded call, got %d calls and %d interactions", calls, len(vcr.Cassette().Interactions))
+	}
+
+	// Second run, the calls are replayed
+	vcr, err = NewVCR(cassette, nil)
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	if vcr.Recording() == true {
+		t.Error("Expected VCR to replay")
+	}
+	run(vcr)
+	if calls != 1 {
+		t.Errorf("Expected no new call, got %d calls", calls)
+	}
+
+	// The recorded call has already been replayed
+	_, err = vcr.RoundTrip(httptest.NewRequest("POST", thirdParty.URL+"/pay", strings.NewReader(`10`)))
+	if err == nil || strings.HasPrefix(err.Error(), "no recorded call found in cassette") == false {
+		t.Errorf("Expected no recorded call error, got %v", err)
+	}
+}
+
+func TestOKGolden(t *testing.T) {
+	c := setupTest(t)
+
+	dir, err := ioutil.TempDir("", "rehapt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	golden := filepath.Join(dir, "golden", "user_get.golden.json")
+
+	id := 0
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		id++
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"id": %d, "name": "John", "pets": [{"name": "Pepper", "type": "cat"}]}`, id)
+	})
+
+	testcase := TestCase{
+		Request: TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{
+			Code:   http.StatusOK,
+			Golden: golden,
+			// The id changes on each call
+			Body: M{"id": StoreVar("id")},
+		},
+	}
+
+	// Write the golden file
+	c.r.SetUpdateGolden(true)
+	if e := ExpectNil(c.r.Test(testcase)); e != "" {
+		t.Error(e)
+	}
+	data, err := ioutil.ReadFile(golden)
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	if strings.Contains(string(data), "\n  \"name\": \"John\"") == false {
+		t.Errorf("Expected indented golden file, got %v", string(data))
+	}
+
+	// And compare with it
+	c.r.SetUpdateGolden(false)
+	if e := ExpectNil(c.r.Test(testcase)); e != "" {
+		t.Error(e)
+	}
+	if c.r.GetVariable("id") != 2.0 {
+		t.Errorf("Expected id variable to be 2, got %v", c.r.GetVariable("id"))
+	}
+}
+
+func TestOKGoldenUpdateFlag(t *testing.T) {
+	c := setupTest(t)
+
+	dir, err := ioutil.TempDir("", "rehapt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"name": "John"}`)
+	})
+	testcase := func(golden string) TestCase {
+		return TestCase{
+			Request:  TestRequest{Method: "GET", Path: "/api/user"},
+			Response: TestResponse{Code: http.StatusOK, Golden: filepath.Join(dir, golden)},
+		}
+	}
+
+	// The -update flag of the test package is read when the golden file is compared
+	_ = flag.Set("update", "true")
+	err = c.r.Test(testcase("flag.golden.json"))
+	_ = flag.Set("update", "false")
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	if *update == true {
+		t.Errorf("Expected the update flag to be reset")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "flag.golden.json")); err != nil {
+		t.Errorf("Expected golden file written with the -update flag, got %v", err)
+	}
+
+	// or the environment variable
+	_ = os.Setenv("REHAPT_UPDATE_GOLDEN", "1")
+	err = c.r.Test(testcase("env.golden.json"))
+	_ = os.Unsetenv("REHAPT_UPDATE_GOLDEN")
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "env.golden.json")); err != nil {
+		t.Errorf("Expected golden file written with the environment variable, got %v", err)
+	}
+
+	// SetUpdateGolden overrides both
+	_ = os.Setenv("REHAPT_UPDATE_GOLDEN", "1")
+	c.r.SetUpdateGolden(false)
+	err = c.r.Test(testcase("disabled.golden.json"))
+	_ = os.Unsetenv("REHAPT_UPDATE_GOLDEN")
+	if e := ExpectError(err, fmt.Sprintf("golden file %v does not exist, run the test with -update or REHAPT_UPDATE_GOLDEN=1 to create it", filepath.Join(dir, "disabled.golden.json"))); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKCurlExport(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user/1", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	var export bytes.Buffer
+	c.r.SetCurlExport(&export)
+	c.r.SetDefaultHeader("Authorization", "Bearer token")
+	_ = c.r.SetVariable("id", 1)
+
+	err := c.r.Test(TestCase{
+		Request: TestRequest{
+			Method:  "PUT",
+			Path:    "/api/user/_id_",
+			Headers: H{"Content-Type": {"application/json"}},
+			Body:    M{"name": "John's"},
+		},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	expected := `curl -X PUT 'http://localhost/api/user/1' -H 'Authorization: Bearer token' -H 'Content-Type: application/json' --data-raw '{"name":"John'\''s"}'` + "\n"
+	if export.String() != expected {
+		t.Errorf("Expected '%v', got '%v'", expected, export.String())
+	}
+}
+
+func TestOKPostmanExport(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"id": "1"}`)
+	})
+	c.server.HandleFunc("/api/user/1", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	_ = c.r.SetVariable("name", "John")
+	suite := c.r.NewSuite("users")
+	suite.Add("create", TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/user", Body: M{"name": "_name_"}},
+		Response: TestResponse{Code: http.StatusCreated, Body: M{"id": "$id$"}},
+	})
+	suite.Add("get", TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user/_id_", Headers: H{"Accept": {"application/json"}}},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+
+	// The suite is exported without being executed
+	var export bytes.Buffer
+	if e := ExpectNil(suite.ExportPostman(&export)); e != "" {
+		t.Fatal(e)
+	}
+	var collection PostmanCollection
+	if e := ExpectNil(json.Unmarshal([]byte(export.String()), &collection)); e != "" {
+		t.Fatal(e)
+	}
+	if collection.Info.Name != "users" || len(collection.Item) != 2 {
+		t.Fatalf("Unexpected collection %v", export.String())
+	}
+	if collection.Item[0].Request.Body == nil || collection.Item[0].Request.Body.Raw != `{"name":"{{name}}"}` {
+		t.Errorf("Expected body with Postman variable, got %v", collection.Item[0].Request.Body)
+	}
+	if collection.Item[1].Request.URL != "{{baseUrl}}/api/user/{{id}}" {
+		t.Errorf("Expected URL with Postman variables, got %v", collection.Item[1].Request.URL)
+	}
+	if len(collection.Item[1].Request.Header) != 1 || collection.Item[1].Request.Header[0].Key != "Accept" {
+		t.Errorf("Expected Accept header, got %v", collection.Item[1].Request.Header)
+	}
+	if len(collection.Variable) != 2 || collection.Variable[1] != (PostmanVariable{Key: "name", Value: "John"}) {
+		t.Errorf("Expected baseUrl and name variables, got %v", collection.Variable)
+	}
+
+	// The executed testcases are exported with their variables replaced
+	executed := NewPostmanCollection("executed")
+	c.r.SetPostmanExport(executed)
+	if e := ExpectNil(suite.Test()); e != "" {
+		t.Fatal(e)
+	}
+	if len(executed.Item) != 2 || executed.Item[1].Request.URL != "{{baseUrl}}/api/user/1" {
+		t.Errorf("Expected 2 executed requests, got %v", executed.Item)
+	}
+}
+
+func TestOKHAR(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Type") != "application/json" || req.Header.Get("Accept-Encoding") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"id": "1", "name": "John"}`)
+	})
+	c.server.HandleFunc("/api/user/1", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("fields") != "name" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, "John")
+	})
+
+	har, err := LoadHAR("testdata/users.har")
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	testcases, err := har.TestCases()
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	if len(testcases) != 2 {
+		t.Fatalf("Expected 2 testcases, got %d", len(testcases))
+	}
+
+	exported := NewHAR()
+	c.r.SetHARExport(exported)
+	for _, testcase := range testcases {
+		if e := ExpectNil(c.r.Test(testcase)); e != "" {
+			t.Error(e)
+		}
+	}
+
+	// The exported archive can be imported back
+	var data bytes.Buffer
+	if e := ExpectNil(exported.Write(&data)); e != "" {
+		t.Fatal(e)
+	}
+	har, err = ReadHAR(strings.NewReader(data.String()))
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	if len(har.Log.Entries) != 2 || har.Log.Entries[1].Request.URL != "http://localhost/api/user/1?fields=name" {
+		t.Fatalf("Unexpected exported HAR %v", data.String())
+	}
+	testcases, err = har.TestCases()
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	c.r.SetHARExport(nil)
+	for _, testcase := range testcases {
+		if e := ExpectNil(c.r.Test(testcase)); e != "" {
+			t.Error(e)
+		}
+	}
+}
+
+func TestOKBench(t *testing.T) {
+	c := setupTest(t)
+
+	var mutex sync.Mutex
+	calls := 0
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		calls++
+		call := calls
+		mutex.Unlock()
+		w.WriteHeader(http.StatusOK)
+		// One response out of ten does not match
+		if call%10 == 0 {
+			_, _ = fmt.Fprintf(w, `{"name": "Paul"}`)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"name": "John"}`)
+	})
+
+	result, err := c.r.Bench(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"name": "John"}},
+	}, BenchOptions{N: 100, Concurrency: 10})
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	if calls != 100 || result.N != 100 || result.Errors != 10 || result.FirstError == nil {
+		t.Errorf("Expected 100 calls and 10 errors, got %d calls and %v", calls, result)
+	}
+	if result.Min > result.P50 || result.P50 > result.P95 || result.P95 > result.P99 || result.P99 > result.Max {
+		t.Errorf("Expected ordered latencies, got %v", result)
+	}
+
+	_, err = c.r.Bench(TestCase{}, BenchOptions{})
+	if e := ExpectError(err, "invalid bench N 0, must be positive"); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKLoad(t *testing.T) {
+	c := setupTest(t)
+
+	var mutex sync.Mutex
+	logins := 0
+	calls := map[string]int{}
+	c.server.HandleFunc("/api/login", func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		logins++
+		mutex.Unlock()
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"token": "secret"}`)
+	})
+	c.server.HandleFunc("/api/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("token") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mutex.Lock()
+		calls[req.URL.Path]++
+		mutex.Unlock()
+		w.WriteHeader(http.StatusOK)
+	})
+
+	step := func(path string) TestCase {
+		return TestCase{
+			Request:  TestRequest{Method: "GET", Path: path},
+			Response: TestResponse{Code: http.StatusOK},
+		}
+	}
+	login := TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/login"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"token": "$token$"}},
+	}
+
+	result, err := c.r.Load([]WeightedTestCase{
+		{Weight: 3, TestCase: step("/api/orders?token=_token_")},
+		{Weight: 1, TestCase: step("/api/order?token=_token_")},
+	}, LoadOptions{RPS: 500, Duration: 200 * time.Millisecond, Users: 4, Setup: []TestCase{login}})
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+
+	if logins != 4 {
+		t.Errorf("Expected 4 logins, got %d", logins)
+	}
+	if result.Requests == 0 || result.Errors != 0 || result.ErrorRate != 0 {
+		t.Errorf("Expected requests without error, got %v. %v", result, result.FirstError)
+	}
+	if calls["/api/orders"]+calls["/api/order"] != result.Requests || calls["/api/orders"] < calls["/api/order"] {
+		t.Errorf("Expected weighted calls, got %v", calls)
+	}
+	count := 0
+	for _, bucket := range result.Histogram {
+		count += bucket.Count
+	}
+	if count != result.Requests {
+		t.Errorf("Expected %d requests in histogram, got %d", result.Requests, count)
+	}
+
+	_, err = c.r.Load([]WeightedTestCase{{Weight: 1, TestCase: login}}, LoadOptions{Duration: time.Second})
+	if e := ExpectError(err, "invalid load RPS 0, must be positive"); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKCoverage(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	coverage, err := LoadOpenAPICoverage("testdata/openapi.yaml")
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	c.r.SetCoverage(coverage)
+
+	for _, request := range []TestRequest{
+		{Method: "GET", Path: "/api/user"},
+		{Method: "GET", Path: "/api/user/12"},
+		{Method: "GET", Path: "/api/user/13"},
+		{Method: "GET", Path: "/api/old"},
+	} {
+		c.r.TestAssert(TestCase{Request: request, Response: TestResponse{Code: http.StatusOK}})
+	}
+
+	report := coverage.Report()
+	if report.Covered != 2 || report.Total != 4 || report.Percent != 50 {
+		t.Errorf("Expected 2/4 routes covered, got %v", report)
+	}
+	if fmt.Sprint(report.Missing) != "[POST /api/user DELETE /api/user/{id}]" || fmt.Sprint(report.Unknown) != "[GET /api/old]" {
+		t.Errorf("Unexpected missing and unknown routes %v %v", report.Missing, report.Unknown)
+	}
+	if e := ExpectNil(coverage.Check(50)); e != "" {
+		t.Error(e)
+	}
+	if e := ExpectError(coverage.Check(80), "endpoint coverage 50.0% is below 80.0%. 2 routes not covered"); e != "" {
+		t.Error(e)
+	}
+
+	var output bytes.Buffer
+	_ = coverage.Write(&output)
+	expected := "endpoint coverage: 50.0% (2/4 routes)\nnot covered:\n  POST /api/user\n  DELETE /api/user/{id}\nunknown requests:\n  GET /api/old\n"
+	if output.String() != expected {
+		t.Errorf("Expected '%v', got '%v'", expected, output.String())
+	}
+
+	// A route list can be given instead of a spec
+	coverage = NewCoverage(Route{Method: "GET", Path: "/api/user/{id}"})
+	c.r.SetCoverage(coverage)
+	c.r.TestAssert(TestCase{Request: TestRequest{Method: "GET", Path: "/api/user/"}, Response: TestResponse{Code: http.StatusOK}})
+	if report := coverage.Report(); report.Covered != 0 {
+		t.Errorf("Expected empty parameter not to match, got %v", report)
+	}
+}
+
+func TestOKRemoteHandler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("X-Path", req.URL.RequestURI())
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"received": %s}`, body)
+	}))
+	defer server.Close()
+
+	handler, err := NewRemoteHandler(server.URL+"/v1/", nil)
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	r := NewRehapt(t, handler)
+
+	suite := r.NewSuite("remote")
+	suite.Add("create", TestCase{
+		Request: TestRequest{Method: "POST", Path: "/user?admin=true", Body: M{"name": "John"}},
+		Response: TestResponse{
+			Code:    http.StatusCreated,
+			Proto:   "HTTP/1.1",
+			Headers: ExactM{"X-Path": S{"/v1/user?admin=true"}, "Content-Length": S{"$len$"}, "Content-Type": S{"$type$"}, "Date": S{"$date$"}},
+			Body:    M{"received": M{"name": "John"}},
+		},
+	})
+	suite.Add("get", TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/user"},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	suite.Add("delete", TestCase{
+		Request:  TestRequest{Method: "DELETE", Path: "/user"},
+		Response: TestResponse{Code: http.StatusCreated, Body: Any()},
+	})
+
+	results, err := suite.Execute()
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	if len(results) != 3 || results[0].Err != nil || results[1].Err == nil || IsSkipped(results[2].Err) == false {
+		t.Errorf("Expected passed, failed and skipped steps, got %v", results)
+	}
+
+	if _, err := NewRemoteHandler("/v1", nil); err == nil {
+		t.Error("Expected error for base URL without host")
+	}
+}
+
+func TestOKBuilder(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var body map[string]interface{}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		if req.Header.Get("X-Custom") != "value" || body["name"] != "John" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", "/api/user/1")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"id": "1", "name": "John"}`)
+	})
+
+	c.r.Post("/api/user").
+		WithHeader("X-Custom", "value").
+		WithBody(M{"name": "John"}).
+		ExpectCode(http.StatusCreated).
+		ExpectHeader("Location", "/api/user/1").
+		ExpectBody(M{"id": "$id$", "name": "John"}).
+		Assert()
+
+	if c.r.GetVariable("id") != "1" {
+		t.Errorf("Expected id variable to be 1, got %v", c.r.GetVariable("id"))
+	}
+
+	testcase := c.r.Get("/api/user/_id_").WithTags("smoke").ExpectCode(http.StatusOK).TestCase()
+	if testcase.Request.Method != "GET" || testcase.Request.Path != "/api/user/_id_" || len(testcase.Tags) != 1 {
+		t.Errorf("Unexpected testcase %v", testcase)
+	}
+
+	err := c.r.Delete("/api/user").ExpectCode(http.StatusOK).Test()
+	if e := ExpectError(err, "response code does not match. Expected 200, got 400"); e != "" {
+		t.Error(e)
+	}
+
+	tt := &testingT{}
+	c.r.SetErrorHandler(tt)
+	c.r.Put("/api/user").ExpectCode(http.StatusOK).Assert()
+	if tt.called == false {
+		t.Error("Expected error to be reported")
+	}
+}
+
+// recordingObserver records the calls of the Observer methods
+type recordingObserver struct {
+	NopObserver
+	events []string
+}
+
+func (o *recordingObserver) OnTestStart(testcase TestCase) {
+	o.events = append(o.events, "start "+testcase.Request.Method)
+}
+
+func (o *recordingObserver) OnRequestSent(request *http.Request, body []byte) {
+	o.events = append(o.events, fmt.Sprintf("request %v %s", request.URL.Path, body))
+}
+
+func (o *recordingObserver) OnResponseReceived(response *http.Response, body []byte, duration time.Duration) {
+	o.events = append(o.events, fmt.Sprintf("response %d %s", response.StatusCode, body))
+}
+
+func (o *recordingObserver) OnTestEnd(testcase TestCase, err error) {
+	o.events = append(o.events, fmt.Sprintf("end %v", err))
+}
+
+func TestOKObserver(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"id":"1"}`)
+	})
+
+	observer := &recordingObserver{}
+	c.r.AddObserver(observer)
+	// Only some methods implemented
+	c.r.AddObserver(NopObserver{})
+
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/user", Body: M{"name": "John"}},
+		Response: TestResponse{Code: http.StatusCreated, Body: M{"id": "1"}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	_ = c.r.Test(TestCase{
+		Tags:     []string{"slow"},
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	c.r.SetTagFilter("!slow")
+	_ = c.r.Test(TestCase{
+		Tags:     []string{"slow"},
+		Request:  TestRequest{Method: "DELETE", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+
+	expected := []string{
+		"start POST",
+		`request /api/user {"name":"John"}`,
+		`response 201 {"id":"1"}`,
+		"end <nil>",
+		"start GET",
+		"request /api/user ",
+		`response 201 {"id":"1"}`,
+		"end response code does not match. Expected 200, got 201\nexpected is nil but got {\n  \"id\": \"1\"\n}",
+		"start DELETE",
+		"end testcase skipped. tags [slow] do not match filter [!slow]",
+	}
+	if strings.Join(observer.events, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected events %q, got %q", expected, observer.events)
+	}
+}
+
+func TestOKRecorder(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"id": 1, "name": %q, "tags": ["a", "b"], "admin": false, "meta": {}}`, body["name"])
+	})
+	c.server.HandleFunc("/api/user/1", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = fmt.Fprintf(w, "John \"Doe\"\n")
+	})
+
+	// Record real traffic
+	recorder := Recorder(c.server)
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	resp, err := http.Post(server.URL+"/api/user", "application/json", strings.NewReader(`{"name": "John"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	resp, err = http.Get(server.URL + "/api/user/1?fields=name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	testcases := recorder.TestCases()
+	if len(testcases) != 2 {
+		t.Fatalf("Expected 2 testcases, got %d", len(testcases))
+	}
+	for _, testcase := range testcases {
+		if e := ExpectNil(c.r.Test(testcase)); e != "" {
+			t.Error(e)
+		}
+	}
+
+	// The YAML scenario can be loaded and run
+	var yaml bytes.Buffer
+	if e := ExpectNil(recorder.WriteYAML(&yaml)); e != "" {
+		t.Fatal(e)
+	}
+	dir, err := ioutil.TempDir("", "rehapt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "recorded.yaml")
+	if err := ioutil.WriteFile(filename, []byte(yaml.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	suite, err := c.r.LoadFile(filename)
+	if e := ExpectNil(err); e != "" {
+		t.Fatalf("%v\n%v", e, yaml.String())
+	}
+	if e := ExpectNil(suite.Test()); e != "" {
+		t.Error(e)
+	}
+
+	// The Go code uses the literals
+	var code bytes.Buffer
+	if e := ExpectNil(recorder.WriteGo(&code)); e != "" {
+		t.Fatal(e)
+	}
+	for _, expected := range []string{
+		`Path:   "/api/user/1?fields=name",`,
+		`"tags": rehapt.S{`,
+		`"id":    1,`,
+		`Body:            "John \"Doe\"\n",`,
+		`BodyUnmarshaler: rehapt.RawUnmarshaler,`,
+	} {
+		if strings.Contains(code.String(), expected) == false {
+			t.Errorf("Expected generated code to contain %v, got\n%v", expected, code.String())
+		}
+	}
+
+	recorder.Reset()
+	if len(recorder.TestCases()) != 0 {
+		t.Error("Expected no testcase after Reset")
+	}
+}
+
+// small helper to capture the reported error messages
+type messageT struct {
+	messages []string
+}
+
+func (t *messageT) Errorf(format string, args ...interface{}) {
+	t.messages = append(t.messages, fmt.Sprintf(format, args...))
+}
+
+func TestOKColorOutput(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"name": "John", "tags": ["a"]}`)
+	})
+	testcase := TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: PartialM{"name": "Paul", "tags": S{"a", "b"}}},
+	}
+
+	mt := &messageT{}
+	c.r.SetErrorHandler(mt)
+	c.r.SetColorOutput(false)
+	c.r.TestAssert(testcase)
+	c.r.SetColorOutput(true)
+	c.r.TestAssert(testcase)
+	if len(mt.messages) != 2 {
+		t.Fatalf("Expected 2 reported errors, got %d", len(mt.messages))
+	}
+
+	if strings.Contains(mt.messages[0], "\x1b[") == true {
+		t.Errorf("Expected uncolored message, got %q", mt.messages[0])
+	}
+	for _, expected := range []string{
+		"\x1b[1;31mError:\x1b[0m",
+		"Expected \x1b[32m'Paul'\x1b[0m, got \x1b[31m'John'\x1b[0m",
+		"Expected \x1b[32m2\x1b[0m, got \x1b[31m1\x1b[0m. Expected \x1b[32m[\n  \"a\",\n  \"b\"\n]\x1b[0m got \x1b[31m[\n  \"a\"\n]\x1b[0m",
+	} {
+		if strings.Contains(mt.messages[1], expected) == false {
+			t.Errorf("Expected colored message to contain %q, got %q", expected, mt.messages[1])
+		}
+	}
+}
+
+func TestOKSuiteFailFast(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/ok", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	c.server.HandleFunc("/api/error", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	ok := TestCase{Request: TestRequest{Method: "GET", Path: "/api/ok"}, Response: TestResponse{Code: http.StatusOK}}
+	failing := TestCase{Request: TestRequest{Method: "GET", Path: "/api/error"}, Response: TestResponse{Code: http.StatusOK}}
+	suite := c.r.NewSuite("independent")
+	suite.Add("first", ok).DependsOn()
+	suite.Add("failing", failing).DependsOn()
+	suite.Add("independent", ok).DependsOn()
+
+	// By default only the dependent steps are skipped
+	results, err := suite.Execute()
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	if results[2].Err != nil {
+		t.Errorf("Expected independent step to succeed, got %v", results[2].Err)
+	}
+
+	c.r.SetFailFast(true)
+	results, err = suite.Execute()
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	if results[0].Err != nil || results[1].Err == nil || IsSkipped(results[1].Err) == true {
+		t.Errorf("Unexpected results %v", results)
+	}
+	if e := ExpectError(results[2].Err, "testcase skipped. skipped because step failing failed and fail fast is enabled"); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKRequestLogger(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"name":"John"}`)
+	})
+
+	var transcript bytes.Buffer
+	c.r.SetRequestLogger(&transcript, "authorization", "Set-Cookie")
+	c.r.SetDefaultHeader("Authorization", "Bearer secret")
+	c.r.SetDefaultHeader("Accept", "application/json")
+	testcase := TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"name": "John"}},
+	}
+	// Both the successes and the failures are logged
+	c.r.TestAssert(testcase)
+	testcase.Response.Code = http.StatusCreated
+	if err := c.r.Test(testcase); err == nil {
+		t.Error("Expected an error")
+	}
+
+	log := transcript.String()
+	if strings.Count(log, "=== ") != 2 || strings.Count(log, " GET /api/user (") != 2 {
+		t.Errorf("Expected 2 exchanges, got %v", log)
+	}
+	for _, expected := range []string{
+		"Request:\nGET /api/user\nAccept: application/json\nAuthorization: [REDACTED]\nResponse:\n200 OK\nSet-Cookie: [REDACTED]\n\n{\n  \"name\": \"John\"\n}\n\n",
+	} {
+		if strings.Contains(log, expected) == false {
+			t.Errorf("Expected transcript to contain %q, got %q", expected, log)
+		}
+	}
+	if strings.Contains(log, "secret") == true {
+		t.Errorf("Expected the secrets to be redacted, got %v", log)
+	}
+
+	c.r.SetRequestLogger(nil)
+	c.r.TestAssert(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"name": "John"}},
+	})
+	if transcript.String() != log {
+		t.Error("Expected nothing to be logged once disabled")
+	}
+}
+
+func TestOKPointerResponseBody(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"name": "John", "age": 20, "manager": null}`)
+	})
+
+	name := "John"
+	age := 20
+	var manager *M
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: &M{"name": &name, "age": &age, "manager": manager}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	name = "Paul"
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"name": &name, "age": Any(), "manager": nil}},
+	})
+	if e := ExpectError(err, "name: strings does not match. Expected 'Paul', got 'John'"); e != "" {
+		t.Error(e)
+	}
+
+	// The sql.Null* fields are compared as their value, or nil when not valid
+	err = c.r.Test(TestCase{
+		Request: TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{
+			"name":    &sql.NullString{String: "John", Valid: true},
+			"age":     sql.NullInt64{Int64: 20, Valid: true},
+			"manager": sql.NullString{},
+		}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKHeaderMode(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Custom", "value")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	testcase := TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusOK, Headers: M{"X-Custom": "value"}},
+	}
+	if e := ExpectNil(c.r.Test(testcase)); e != "" {
+		t.Error(e)
+	}
+	// The default map mode does not change the headers comparison
+	c.r.SetDefaultMapMode(MapModePartial)
+	c.r.SetHeaderMode(HeaderModeExact)
+	if e := ExpectError(c.r.Test(testcase), `response headers does not match. different map sizes. Expected 1, got 2. Expected {
+  "X-Custom": [
+    "value"
+  ]
+} got {
+  "Content-Type": [
+    "application/json"
+  ],
+  "X-Custom": [
+    "value"
+  ]
+}`); e != "" {
+		t.Error(e)
+	}
+	testcase.Response.Headers = PartialM{"X-Custom": "value"}
+	if e := ExpectNil(c.r.Test(testcase)); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKDefaultMapMode(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"id": "1", "name": "John", "owner": {"id": "2", "name": "Paul"}}`)
+	})
+
+	testcase := TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"id": "1", "owner": M{"id": "2"}}},
+	}
+	if e := ExpectError(c.r.Test(testcase), `different map sizes. Expected 2, got 3. Expected {
+  "id": "1",
+  "owner": {
+    "id": "2"
+  }
+} got {
+  "id": "1",
+  "name": "John",
+  "owner": {
+    "id": "2",
+    "name": "Paul"
+  }
+}`); e != "" {
+		t.Error(e)
+	}
+
+	c.r.SetDefaultMapMode(MapModePartial)
+	if e := ExpectNil(c.r.Test(testcase)); e != "" {
+		t.Error(e)
+	}
+
+	testcase.Response.Body = M{"id": "1", "owner": ExactM{"id": "2"}}
+	if e := ExpectError(c.r.Test(testcase), `owner: different map sizes. Expected 1, got 2. Expected {
+  "id": "2"
+} got {
+  "id": "2",
+  "name": "Paul"
+}`); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKDefaultSliceOrdering(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"tags": ["b", "a"], "steps": [1, 2]}`)
+	})
+
+	testcase := TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"tags": S{"a", "b"}, "steps": S{1, 2}}},
+	}
+	if e := ExpectError(c.r.Test(testcase), "tags[0]: strings does not match. Expected 'a', got 'b'\n"+
+		"tags[1]: strings does not match. Expected 'b', got 'a'"); e != "" {
+		t.Error(e)
+	}
+
+	c.r.SetDefaultSliceOrdering(SliceUnordered)
+	if e := ExpectNil(c.r.Test(testcase)); e != "" {
+		t.Error(e)
+	}
+
+	testcase.Response.Body = M{"tags": S{"a", "b"}, "steps": SortedS{2, 1}}
+	if e := ExpectError(c.r.Test(testcase), "steps[0]: floats does not match. Expected 2, got 1\n"+
+		"steps[1]: floats does not match. Expected 1, got 2"); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKConcurrentTest(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user/", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"id": %q, "token": %q, "roles": ["admin", "user"]}`,
+			strings.TrimPrefix(req.URL.Path, "/api/user/"), req.Header.Get("Authorization"))
+	})
+
+	c.r.SetDefaultHeader("Authorization", "token")
+	c.r.SetMaxErrors(2)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 20)
+	mismatches := make([]error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.r.AddDefaultHeader(fmt.Sprintf("X-Worker-%d", i), "1")
+			_ = c.r.SetVariable(fmt.Sprintf("in%d", i), fmt.Sprint(i))
+			errs[i] = c.r.Test(TestCase{
+				Request:  TestRequest{Method: "GET", Path: fmt.Sprintf("/api/user/_in%d_", i)},
+				Response: TestResponse{Code: http.StatusOK, Body: M{"id": fmt.Sprintf("$out%d$", i), "token": "token", "roles": UnsortedS{"user", "admin"}}},
+			})
+			// Each call counts its own mismatches
+			mismatches[i] = c.r.Test(TestCase{
+				Request:  TestRequest{Method: "GET", Path: "/api/user/x"},
+				Response: TestResponse{Code: http.StatusOK, Body: M{"id": "y", "token": "z", "roles": S{"a", "b"}}},
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 20; i++ {
+		if e := ExpectNil(errs[i]); e != "" {
+			t.Error(e)
+		}
+		if actual := c.r.GetVariableString(fmt.Sprintf("out%d", i)); actual != fmt.Sprint(i) {
+			t.Errorf("Expected variable out%d to be %v, got %v", i, i, actual)
+		}
+		if mismatches[i] == nil || strings.HasSuffix(mismatches[i].Error(), "comparison stopped after 2 errors") == false {
+			t.Errorf("Expected the comparison to stop after 2 errors, got %v", mismatches[i])
+		}
+	}
+}
+
+// recordingTester records the paths of the testcases executed through the Tester interface
+type recordingTester struct {
+	Tester
+	paths []interface{}
+}
+
+func (tester *recordingTester) Test(testcase TestCase) error {
+	tester.paths = append(tester.paths, testcase.Request.Path)
+	return tester.Tester.Test(testcase)
+}
+
+// createUser is a helper accepting any Tester
+func createUser(tester Tester, name string) error {
+	if err := tester.SetVariable("name", name); err != nil {
+		return err
+	}
+	return tester.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/user", Body: M{"name": "_name_"}},
+		Response: TestResponse{Code: http.StatusCreated, Body: M{"id": "$id$"}},
+	})
+}
+
+func TestOKTester(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"id": "1"}`)
+	})
+
+	tester := &recordingTester{Tester: c.r}
+	if e := ExpectNil(createUser(tester, "John")); e != "" {
+		t.Error(e)
+	}
+	if tester.GetVariableString("id") != "1" || len(tester.paths) != 1 || tester.paths[0] != "/api/user" {
+		t.Errorf("Expected the testcase to be recorded and executed, got %v and %v", tester.paths, tester.GetVariable("id"))
+	}
+}
+
+func TestOKReplaceComparator(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"id": "1 ", "name": "  John", "score": 0.30000000000000004}`)
+	})
+
+	err := c.r.ReplaceComparator("", func(expected, actual interface{}, builtin func(expected, actual interface{}) error) error {
+		if str, ok := actual.(string); ok == true {
+			actual = strings.TrimSpace(str)
+		}
+		return builtin(expected, actual)
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	err = c.r.ReplaceComparator(0.0, func(expected, actual interface{}, builtin func(expected, actual interface{}) error) error {
+		if a, ok := actual.(float64); ok == true && math.Abs(a-expected.(float64)) < 1e-9 {
+			return nil
+		}
+		return builtin(expected, actual)
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	if err := c.r.ReplaceComparator(struct{}{}, nil); err == nil {
+		t.Errorf("Expected an error for a nil comparator")
+	}
+	if err := c.r.ReplaceComparator(struct{}{}, func(expected, actual interface{}, builtin func(expected, actual interface{}) error) error { return nil }); err == nil {
+		t.Errorf("Expected an error for a type without comparator")
+	}
+
+	// The variables are still handled by the replaced comparator, and the forks keep the replacement
+	err = c.r.Fork().Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"id": "$id$", "name": "John", "score": 0.3}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"id": "1", "name": "Jack", "score": 0.3}},
+	})
+	if e := ExpectError(err, "name: strings does not match. Expected 'Jack', got 'John'"); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKRawMessageResponseBody(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"id": "1", "name": "John", "roles": ["admin"]}`)
+	})
+
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: json.RawMessage(`{"id": "$id$", "name": "John", "roles": ["admin"]}`)},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	if id := c.r.GetVariable("id"); id != "1" {
+		t.Errorf("Expected variable id to be 1, got %v", id)
+	}
+
+	// Nested in the other expectations too
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: PartialM{"roles": json.RawMessage(`["user"]`)}},
+	})
+	if e := ExpectError(err, "roles[0]: strings does not match. Expected 'user', got 'admin'"); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: json.RawMessage(`{"id": `)},
+	})
+	if e := ExpectError(err, "invalid expected json.RawMessage. unexpected end of JSON input"); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKTimeExpectedValue(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/event", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"start": "2020-04-11T22:10:30.123+02:00", "end": "2020-04-11T21:00:00Z"}`)
+	})
+
+	// The same instant matches, even in another location
+	err := c.r.Test(TestCase{
+		Request: TestRequest{Method: "GET", Path: "/api/event"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{
+			"start": time.Date(2020, time.April, 11, 20, 10, 30, 123*int(time.Millisecond), time.UTC),
+			"end":   time.Date(2020, time.April, 11, 21, 0, 0, 0, time.UTC),
+		}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.Test(TestCase{
+		Request: TestRequest{Method: "GET", Path: "/api/event"},
+		Response: TestResponse{Code: http.StatusOK, Body: PartialM{
+			"end": time.Date(2020, time.April, 11, 21, 0, 1, 0, time.UTC),
+		}},
+	})
+	if e := ExpectError(err, "end: times does not match. Expected '2020-04-11T21:00:01Z', got '2020-04-11T21:00:00Z'"); e != "" {
+		t.Error(e)
+	}
+}
+
+// amount is a custom expectation matching the "12.50 EUR" strings
+type amount struct {
+	cents    int64
+	currency string
+}
+
+func (a amount) Match(r *Rehapt, actual interface{}) error {
+	str, ok := actual.(string)
+	if ok == false {
+		return fmt.Errorf("expected an amount string, got %T", actual)
+	}
+	var units, cents int64
+	var currency string
+	if _, err := fmt.Sscanf(str, "%d.%d %s", &units, &cents, &currency); err != nil {
+		return fmt.Errorf("invalid amount %q. %v", str, err)
+	}
+	if units*100+cents != a.cents || currency != a.currency {
+		return fmt.Errorf("amounts does not match. Expected %d.%02d %v, got %v", a.cents/100, a.cents%100, a.currency, str)
+	}
+	return nil
+}
+
+// optionalAmount also matches a null amount
+type optionalAmount struct {
+	amount
+}
+
+func (a *optionalAmount) Match(r *Rehapt, actual interface{}) error {
+	if actual == nil {
+		return nil
+	}
+	return a.amount.Match(r, actual)
+}
+
+func TestOKMatcher(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/order", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"total": "12.50 EUR", "discount": null, "tax": "2.10 EUR"}`)
+	})
+
+	err := c.r.Test(TestCase{
+		Request: TestRequest{Method: "GET", Path: "/api/order"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{
+			"total":    amount{cents: 1250, currency: "EUR"},
+			"discount": &optionalAmount{amount{cents: 100, currency: "EUR"}},
+			"tax":      &optionalAmount{amount{cents: 210, currency: "EUR"}},
+		}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.Test(TestCase{
+		Request: TestRequest{Method: "GET", Path: "/api/order"},
+		Response: TestResponse{Code: http.StatusOK, Body: PartialM{
+			"total":    amount{cents: 1200, currency: "EUR"},
+			"discount": amount{cents: 100, currency: "EUR"},
+		}},
+	})
+	if e := ExpectError(err, "discount: expected an amount string, got <nil>\ntotal: amounts does not match. Expected 12.00 EUR, got 12.50 EUR"); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKAbsentNullNotNull(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"id": "1", "manager": null}`)
+	})
+
+	err := c.r.Test(TestCase{
+		Request: TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{
+			"id":       NotNull(),
+			"manager":  Null(),
+			"password": Absent(),
+		}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.Test(TestCase{
+		Request: TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: PartialM{
+			"id":      Null(),
+			"manager": Absent(),
+		}},
+	})
+	if e := ExpectError(err, "id: expected null but got 1\nmanager: expected key to be absent, got <nil>"); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.Test(TestCase{
+		Request: TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: PartialM{
+			"manager":  NotNull(),
+			"password": Null(),
+		}},
+	})
+	if e := ExpectError(err, "manager: expected a value but got null\nexpected key password not found"); e != "" {
+		t.Error(e)
+	}
+	if mismatchErr, ok := err.(*MismatchError); ok == false || mismatchErr.Mismatches[1].Kind != MismatchMissing {
+		t.Errorf("Expected a missing key mismatch, got %#v", err)
+	}
+}
+
+// fullT is an ErrorHandler with the optional functions of testing.T
+type fullT struct {
+	messageT
+	fatals  []string
+	helpers int
+}
+
+func (t *fullT) Fatalf(format string, args ...interface{}) {
+	t.fatals = append(t.fatals, fmt.Sprintf(format, args...))
+}
+
+func (t *fullT) Helper() {
+	t.helpers++
+}
+
+func (t *fullT) Name() string {
+	return "TestUsers/get_user"
+}
+
+func TestOKRichErrorHandler(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"name": "John"}`)
+	})
+	testcase := TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"name": "Paul"}},
+	}
+
+	ft := &fullT{}
+	c.r.SetErrorHandler(ft)
+	c.r.SetColorOutput(false)
+	c.r.TestAssert(testcase)
+	c.r.SetStopOnFailure(true)
+	c.r.TestAssert(testcase)
+
+	if len(ft.messages) != 1 || len(ft.fatals) != 1 {
+		t.Fatalf("Expected 1 error and 1 fatal error, got %v and %v", ft.messages, ft.fatals)
+	}
+	for _, message := range []string{ft.messages[0], ft.fatals[0]} {
+		if strings.HasSuffix(message, "\nError in TestUsers/get_user: name: strings does not match. Expected 'Paul', got 'John'") == false {
+			t.Errorf("Expected the test name in the error, got %q", message)
+		}
+	}
+	if ft.helpers == 0 {
+		t.Errorf("Expected Helper() to be called")
+	}
+
+	// Without Fatalf(), Errorf() is still used
+	mt := &messageT{}
+	c.r.SetErrorHandler(mt)
+	c.r.TestAssert(testcase)
+	if len(mt.messages) != 1 || strings.Contains(mt.messages[0], "\nError: name: strings does not match") == false {
+		t.Errorf("Expected the error to be reported with Errorf(), got %v", mt.messages)
+	}
+}
+
+// recordTB records the errors instead of reporting them to the embedded testing.TB
+type recordTB struct {
+	testing.TB
+	messages []string
+}
+
+func (tb *recordTB) Errorf(format string, args ...interface{}) {
+	tb.messages = append(tb.messages, fmt.Sprintf(format, args...))
+}
+
+func TestOKNewRehaptTB(t *testing.T) {
+	server := http.NewServeMux()
+	server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"name": "John"}`)
+	})
+
+	tb := &recordTB{TB: t}
+	r := NewRehaptTB(tb, server)
+	r.SetColorOutput(false)
+	r.TestAssert(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"name": "Paul"}},
+	})
+
+	// The testing package reports the line, there is no calling stack
+	expected := "\nError in TestOKNewRehaptTB: name: strings does not match. Expected 'Paul', got 'John'"
+	if len(tb.messages) != 1 || tb.messages[0] != expected {
+		t.Errorf("Expected error %q, got %q", expected, tb.messages)
+	}
+}
+
+func TestOKRawBody(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/echo", func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, "echo: %s", body)
+	})
+
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/echo", RawBody: "plain text"},
+		Response: TestResponse{Code: http.StatusOK, RawBody: "echo: plain text"},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/echo", RawBody: []byte("bytes")},
+		Response: TestResponse{Code: http.StatusOK, RawBody: Regexp(`^echo: (.+)$`)},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKCompare(t *testing.T) {
+	c := setupTest(t)
+
+	var payload interface{}
+	if err := json.Unmarshal([]byte(`{"event": "user.created", "id": "42", "tags": ["b", "a"], "at": 1}`), &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.r.Compare(PartialM{"event": "user.created", "id": "$id$", "tags": UnsortedS{"a", "b"}}, payload)
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	if id := c.r.GetVariable("id"); id != "42" {
+		t.Errorf("Expected variable id to be 42, got %v", id)
+	}
+
+	err = c.r.Compare(PartialM{"event": Regexp(`^user\.`), "id": "_id_"}, payload)
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	err = Compare(PartialM{"event": "user.deleted"}, payload)
+	if e := ExpectError(err, "event: strings does not match. Expected 'user.deleted', got 'user.created'"); e != "" {
+		t.Error(e)
+	}
+	if _, ok := err.(*MismatchError); ok == false {
+		t.Errorf("Expected a *MismatchError, got %T", err)
+	}
+}
+
+func TestOKReplaceVarsDeep(t *testing.T) {
+	c := setupTest(t)
+	_ = c.r.SetVariable("userid", "42")
+	_ = c.r.SetVariable("tag", "admin")
+
+	body, err := c.r.ReplaceVarsDeep(M{
+		"owner":  "user _userid_",
+		"tags":   S{"_tag_", 1, nil},
+		"labels": map[string]string{"team": "_tag_"},
+		"nested": PartialM{"ids": []string{"_userid_"}},
+		"raw":    []byte("_userid_"),
+		"count":  2,
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	expected := M{
+		"owner":  "user 42",
+		"tags":   S{"admin", 1, nil},
+		"labels": map[string]string{"team": "admin"},
+		"nested": PartialM{"ids": []string{"42"}},
+		"raw":    []byte("_userid_"),
+		"count":  2,
+	}
+	if reflect.DeepEqual(body, expected) == false {
+		t.Errorf("Expected %#v, got %#v", expected, body)
+	}
+
+	_, err = c.r.ReplaceVarsDeep(S{M{"id": "_unknown_"}})
+	if e := ExpectError(err, "variable unknown is not defined"); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKNoShortcuts(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/template", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Template", "_name_")
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"price": "$price$", "greeting": "Hello _name_", "id": "1"}`)
+	})
+
+	err := c.r.Test(TestCase{
+		Request: TestRequest{Method: "GET", Path: "/api/template"},
+		Response: TestResponse{
+			Code:        http.StatusOK,
+			Headers:     M{"X-Template": "_name_"},
+			Body:        M{"price": "$price$", "greeting": "Hello _name_", "id": "1"},
+			NoShortcuts: true,
+		},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	if price := c.r.GetVariable("price"); price != nil {
+		t.Errorf("Expected no variable stored, got %v", price)
+	}
+
+	// Only the Literal values are compared literally
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/template"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"price": Literal("$price$"), "greeting": Literal("Hello _name_"), "id": "$id$"}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	if price, id := c.r.GetVariable("price"), c.r.GetVariable("id"); price != nil || id != "1" {
+		t.Errorf("Expected only the id variable stored, got %v and %v", price, id)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/template"},
+		Response: TestResponse{Code: http.StatusOK, Body: PartialM{"price": Literal("$cost$")}},
+	})
+	if e := ExpectError(err, "price: strings does not match. Expected '$cost$', got '$price$'"); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKDebugBodies(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"id":"1"}`)
+	})
+	testcase := TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/user", Body: M{"name": "John"}},
+		Response: TestResponse{Code: http.StatusCreated, Body: M{"id": "1"}},
+	}
+
+	lt := &logT{}
+	c.r.SetErrorHandler(lt)
+	c.r.TestAssert(testcase)
+	if len(lt.logs) != 0 {
+		t.Errorf("Expected no debug log, got %v", lt.logs)
+	}
+
+	// Enabled for a single testcase
+	testcase.Debug = true
+	c.r.TestAssert(testcase)
+	expected := "\nRequest body of POST /api/user:\n{\n  \"name\": \"John\"\n}\nResponse body, status 201:\n{\"id\":\"1\"}"
+	if len(lt.logs) != 1 || lt.logs[0] != expected {
+		t.Errorf("Expected debug log %q, got %q", expected, lt.logs)
+	}
+
+	// Enabled for all the testcases
+	testcase.Debug = false
+	c.r.SetDebugBodies(true)
+	c.r.TestAssert(testcase)
+	if len(lt.logs) != 2 || lt.logs[1] != expected {
+		t.Errorf("Expected debug log %q, got %q", expected, lt.logs)
+	}
+	if len(lt.messages) != 0 {
+		t.Errorf("Expected no error, got %v", lt.messages)
+	}
+}
+
+func TestOKStream(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/events", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher := w.(http.Flusher)
+		for i, event := range []string{"created", "updated", "deleted"} {
+			_, _ = fmt.Fprintf(w, `{"event":"%v","id":"%d"}`, event, i+1)
+			flusher.Flush()
+		}
+		// Keep the connection open until the client is gone
+		<-req.Context().Done()
+	})
+
+	err := c.r.TestStream(StreamTestCase{
+		Request:   TestRequest{Method: "GET", Path: "/api/events"},
+		Response:  TestResponse{Code: http.StatusOK, Headers: H{"Content-Type": {"application/x-ndjson"}}},
+		Chunks:    S{M{"event": "created", "id": "$firstid$"}, M{"event": "updated", "id": "2"}},
+		MaxChunks: 2,
+		Duration:  5 * time.Second,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if id := c.r.GetVariableString("firstid"); id != "1" {
+		t.Errorf("Expected stored id 1, got %v", id)
+	}
+
+	// Collected until the duration expires
+	err = c.r.TestStream(StreamTestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/events"},
+		Response: TestResponse{Code: http.StatusOK},
+		Chunks:   S{M{"event": "created", "id": "_firstid_"}, M{"event": "updated", "id": "2"}, M{"event": "deleted", "id": "3"}},
+		Duration: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = c.r.TestStream(StreamTestCase{
+		Request:   TestRequest{Method: "GET", Path: "/api/events"},
+		Response:  TestResponse{Code: http.StatusOK},
+		Chunks:    S{M{"event": "created", "id": "1"}, M{"event": "created", "id": "2"}},
+		MaxChunks: 2,
+	})
+	if err == nil || err.Error() != "response chunks does not match. [1].event: strings does not match. Expected 'created', got 'updated'" {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	err = c.r.TestStream(StreamTestCase{
+		Request:   TestRequest{Method: "GET", Path: "/api/events"},
+		Response:  TestResponse{Code: http.StatusOK},
+		MaxChunks: -1,
+	})
+	if err == nil || err.Error() != "invalid testcase. MaxChunks and Duration cannot be negative" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestOKJSONRPC(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/rpc", func(w http.ResponseWriter, req *http.Request) {
+		var request map[string]interface{}
+		_ = json.NewDecoder(req.Body).Decode(&request)
+		id, _ := json.Marshal(request["id"])
+		switch request["method"] {
+		case "user.get":
+			params, _ := json.Marshal(request["params"])
+			_, _ = fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"result":{"params":%s}}`, id, params)
+		case "user.stale":
+			_, _ = fmt.Fprintf(w, `{"jsonrpc":"2.0","id":999,"result":{}}`)
+		default:
+			_, _ = fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"error":{"code":-32601,"message":"Method not found","data":"%v"}}`, id, request["method"])
+		}
+	})
+
+	c.r.TestAssert(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/rpc", Body: JSONRPC{Method: "user.get", Params: M{"id": 1}}},
+		Response: TestResponse{Code: http.StatusOK, Body: JSONRPCResult(M{"params": M{"id": 1}})},
+	})
+	c.r.TestAssert(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/rpc", Body: JSONRPC{Method: "user.get", ID: "req-1"}},
+		Response: TestResponse{Code: http.StatusOK, Body: JSONRPCResult(M{"params": nil})},
+	})
+	if id := c.r.GetVariable("jsonrpc.id"); id != "req-1" {
+		t.Errorf("Expected stored id req-1, got %v", id)
+	}
+	c.r.TestAssert(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/rpc", Body: JSONRPC{Method: "user.delete"}},
+		Response: TestResponse{Code: http.StatusOK, Body: JSONRPCError(-32601, "Method not found")},
+	})
+
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/rpc", Body: JSONRPC{Method: "user.stale"}},
+		Response: TestResponse{Code: http.StatusOK, Body: JSONRPCResult(M{})},
+	})
+	if err == nil || strings.HasPrefix(err.Error(), "id: floats does not match. Expected ") == false || strings.HasSuffix(err.Error(), ", got 999") == false {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/rpc", Body: JSONRPC{Method: "user.delete"}},
+		Response: TestResponse{Code: http.StatusOK, Body: JSONRPCResult(M{})},
+	})
+	if err == nil || strings.HasPrefix(err.Error(), "expected a JSON-RPC result, got error {") == false {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/rpc", Body: JSONRPC{}},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	if err == nil || err.Error() != "incomplete JSON-RPC request. Missing method" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestOKOAuth2ClientCredentials(t *testing.T) {
+	var mutex sync.Mutex
+	fetched := 0
+	expiresIn := 3600
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id, secret, _ := req.BasicAuth()
+		if id != "client" || secret != "s3cret" || req.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = fmt.Fprintf(w, `{"error":"invalid_client"}`)
+			return
+		}
+		mutex.Lock()
+		fetched++
+		token := fmt.Sprintf("token%d-%v", fetched, req.FormValue("scope"))
+		mutex.Unlock()
+		_, _ = fmt.Fprintf(w, `{"access_token":"%v","token_type":"Bearer","expires_in":%d}`, token, expiresIn)
+	}))
+	defer auth.Close()
+
+	c := setupTest(t)
+	c.server.HandleFunc("/api/me", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"authorization":"%v"}`, req.Header.Get("Authorization"))
+	})
+
+	err := c.r.UseOAuth2ClientCredentials(auth.URL, "client", "s3cret", []string{"users:read", "users:write"})
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	testcase := TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/me"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"authorization": "Bearer token1-users:read users:write"}},
+	}
+	c.r.TestAssert(testcase)
+	c.r.TestAssert(testcase)
+	if token := c.r.GetVariable("oauth2.token"); token != "token1-users:read users:write" {
+		t.Errorf("Expected stored token, got %v", token)
+	}
+
+	// Expiring within the expiry delta, the token is fetched before each request
+	expiresIn = 5
+	c.r = NewRehapt(t, c.server)
+	if e := ExpectNil(c.r.UseOAuth2ClientCredentials(auth.URL, "client", "s3cret", nil)); e != "" {
+		t.Fatal(e)
+	}
+	c.r.TestAssert(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/me"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"authorization": "Bearer token3-"}},
+	})
+	if fetched != 3 {
+		t.Errorf("Expected 3 tokens fetched, got %d", fetched)
+	}
+
+	err = c.r.UseOAuth2ClientCredentials(auth.URL, "client", "wrong", nil)
+	if err == nil || err.Error() != `cannot fetch OAuth2 token. Response code 401, body: {"error":"invalid_client"}` {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestOKSignJWT(t *testing.T) {
+	c := setupTest(t)
+	secret := []byte("s3cret")
+
+	c.server.HandleFunc("/api/admin", func(w http.ResponseWriter, req *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "), ".")
+		if len(parts) != 3 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mac := hmac.New(sha256.New, secret)
+		_, _ = mac.Write([]byte(parts[0] + "." + parts[1]))
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		if hmac.Equal(signature, mac.Sum(nil)) == false {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		header, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		_, _ = fmt.Fprintf(w, `{"header":%s,"claims":%s}`, header, claims)
+	})
+
+	token, err := c.r.SignJWT("admintoken", M{"sub": "1", "role": "admin"}, secret)
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	if c.r.GetVariable("admintoken") != token {
+		t.Errorf("Expected token stored in variable, got %v", c.r.GetVariable("admintoken"))
+	}
+	c.r.TestAssert(TestCase{
+		Request: TestRequest{Method: "GET", Path: "/api/admin", Headers: H{"Authorization": {"Bearer " + token}}},
+		Response: TestResponse{Code: http.StatusOK, Body: M{
+			"header": M{"alg": "HS256", "typ": "JWT"},
+			"claims": M{"sub": "1", "role": "admin"},
+		}},
+	})
+
+	// Asymmetric keys
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	for _, key := range []interface{}{rsaKey, ecKey} {
+		token, err := c.r.SignJWT("token", M{"sub": "2"}, key)
+		if e := ExpectNil(err); e != "" {
+			t.Fatal(e)
+		}
+		parts := strings.Split(token, ".")
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		valid := false
+		if key == rsaKey {
+			valid = rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], signature) == nil
+		} else {
+			valid = len(signature) == 64 && ecdsa.Verify(&ecKey.PublicKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]))
+		}
+		if valid == false {
+			t.Errorf("Invalid signature for key %T", key)
+		}
+	}
+
+	if _, err := c.r.SignJWT("token", M{}, "secret"); err == nil || err.Error() != "cannot sign JWT. Unsupported key type string, only []byte, *rsa.PrivateKey or *ecdsa.PrivateKey supported" {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if _, err := c.r.SignJWT("my-token", M{}, secret); err == nil || err.Error() != "invalid variable name my-token" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestOKCSRF(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/form", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			_, _ = fmt.Fprintf(w, `{"token":"%v","default":"%v"}`, req.Header.Get("X-CSRFToken"), req.Header.Get("X-CSRF-Token"))
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "csrftoken", Value: "fromcookie"})
+		w.Header().Set("X-Next-Token", "fromheader")
+		_, _ = fmt.Fprintf(w, `{"forms":[{"csrf":"frombody"}],"token":"%v"}`, req.Header.Get("X-CSRFToken"))
+	})
+
+	get := TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/form"},
+		Response: TestResponse{Code: http.StatusOK, Body: PartialM{"token": ""}},
+	}
+	post := func(token string, defaultToken string) TestCase {
+		return TestCase{
+			Request:  TestRequest{Method: "POST", Path: "/form"},
+			Response: TestResponse{Code: http.StatusOK, Body: M{"token": token, "default": defaultToken}},
+		}
+	}
+
+	// No token before the flow is enabled
+	c.r.TestAssert(get)
+	c.r.TestAssert(post("", ""))
+
+	if e := ExpectNil(c.r.SetCSRF(CSRF{Cookie: "csrftoken", RequestHeader: "X-CSRFToken"})); e != "" {
+		t.Fatal(e)
+	}
+	c.r.TestAssert(get)
+	c.r.TestAssert(post("fromcookie", ""))
+	if token := c.r.GetVariable("csrf.token"); token != "fromcookie" {
+		t.Errorf("Expected stored token, got %v", token)
+	}
+
+	_ = c.r.SetCSRF(CSRF{Header: "X-Next-Token", RequestHeader: "X-CSRFToken"})
+	c.r.TestAssert(get)
+	c.r.TestAssert(post("fromheader", ""))
+
+	_ = c.r.SetCSRF(CSRF{BodyPath: "forms.0.csrf"})
+	c.r.TestAssert(get)
+	c.r.TestAssert(post("", "frombody"))
+
+	// Overridden by the testcase
+	override := post("", "mine")
+	override.Request.Headers = H{"X-CSRF-Token": {"mine"}}
+	c.r.TestAssert(override)
+
+	_ = c.r.SetCSRF(CSRF{})
+	c.r.TestAssert(post("", ""))
+
+	if err := c.r.SetCSRF(CSRF{Cookie: "csrftoken", Header: "X-Next-Token"}); err == nil || err.Error() != "invalid CSRF configuration. Exactly one of Cookie, Header or BodyPath must be set" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestOKPrometheusMetrics(t *testing.T) {
+	c := setupTest(t)
+
+	requests := 0
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusCreated)
+	})
+	c.server.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprintf(w, "# HELP http_requests_total The number of requests.\n")
+		_, _ = fmt.Fprintf(w, "# TYPE http_requests_total counter\n")
+		_, _ = fmt.Fprintf(w, "http_requests_total{method=\"POST\",code=\"201\"} %d 1700000000000\n", requests)
+		_, _ = fmt.Fprintf(w, "http_requests_total{method=\"GET\",code=\"200\"} 12\n")
+		_, _ = fmt.Fprintf(w, "build_info{version=\"1.0 \\\"beta\\\"\",path=\"C:\\\\app\"} 1\n")
+		_, _ = fmt.Fprintf(w, "\nprocess_start_time_seconds 1.7e+09\n")
+	})
+
+	metrics := TestCase{
+		Request: TestRequest{Method: "GET", Path: "/metrics"},
+		Response: TestResponse{
+			Code:            http.StatusOK,
+			BodyUnmarshaler: PrometheusUnmarshaler,
+			Body: PartialM{
+				"http_requests_total":        Metric(map[string]string{"method": "POST"}, StoreVar("before")),
+				"build_info":                 Metric(map[string]string{"version": `1.0 "beta"`, "path": `C:\app`}, 1),
+				"process_start_time_seconds": Metric(nil, nil),
+			},
+		},
+	}
+	c.r.TestAssert(metrics)
+	c.r.TestAssert(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusCreated},
+	})
+
+	// The counter has been incremented as a side effect
+	before := c.r.GetVariable("before").(float64)
+	metrics.Response.Body = PartialM{"http_requests_total": Metric(map[string]string{"method": "POST", "code": "201"}, NumberDelta(before+1, 0))}
+	c.r.TestAssert(metrics)
+
+	metrics.Response.Body = PartialM{"http_requests_total": Metric(map[string]string{"method": "DELETE"}, nil)}
+	err := c.r.Test(metrics)
+	if err == nil || err.Error() != `http_requests_total: no sample with labels {method="DELETE"}` {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	metrics.Response.Body = PartialM{"http_requests_total": Metric(map[string]string{"code": "200"}, 10)}
+	err = c.r.Test(metrics)
+	if err == nil || strings.HasPrefix(err.Error(), `http_requests_total: no sample with labels {code="200"} matches the value. `) == false {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	var decoded interface{}
+	if err := PrometheusUnmarshaler([]byte("up{job=\"api} 1\n"), &decoded); err == nil || err.Error() != "invalid Prometheus sample at line 1. unterminated value of label job" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestOKWaitForReady(t *testing.T) {
+	c := setupTest(t)
+
+	var mutex sync.Mutex
+	polled := 0
+	c.server.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		polled++
+		if polled < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = fmt.Fprintf(w, "ok")
+	})
+	c.server.HandleFunc("/down", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	if e := ExpectNil(c.r.WaitForReady("/healthz", 5*time.Second)); e != "" {
+		t.Error(e)
+	}
+	if polled != 3 {
+		t.Errorf("Expected 3 polls, got %d", polled)
+	}
+
+	err := c.r.WaitForReady("/down", 100*time.Millisecond)
+	if err == nil || err.Error() != "/down is not ready. still failing after 100ms. response code does not match. Expected 200, got 503" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestOKWebhookCatcher(t *testing.T) {
+	c := setupTest(t)
+
+	hooks := c.r.NewWebhookCatcher()
+	defer hooks.Close()
+
+	c.server.HandleFunc("/api/subscriptions", func(w http.ResponseWriter, req *http.Request) {
+		var subscription map[string]string
+		_ = json.NewDecoder(req.Body).Decode(&subscription)
+		// The webhook is sent asynchronously
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			for _, event := range []string{"created", "activated"} {
+				body := strings.NewReader(fmt.Sprintf(`{"event":"subscription.%v","id":"42"}`, event))
+				response, err := http.Post(subscription["url"], "application/json", body)
+				if err == nil {
+					response.Body.Close()
+				}
+			}
+		}()
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	c.r.TestAssert(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/subscriptions", Body: M{"url": hooks.URL() + "/events"}},
+		Response: TestResponse{Code: http.StatusAccepted},
+	})
+	hooks.ExpectCallAssert(PartialM{"event": "subscription.activated", "id": "$subid$"}, 5*time.Second)
+	hooks.ExpectCallAssert(M{"event": "subscription.created", "id": "_subid_"}, 5*time.Second)
+	if id := c.r.GetVariable("subid"); id != "42" {
+		t.Errorf("Expected stored id 42, got %v", id)
+	}
+
+	calls := hooks.Calls()
+	if len(calls) != 2 || calls[0].Method != "POST" || calls[0].Path != "/events" || calls[0].Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Unexpected calls %v", calls)
+	}
+
+	// Each call is matched only once
+	err := hooks.ExpectCall(PartialM{"event": "subscription.created"}, 50*time.Millisecond)
+	if err == nil || err.Error() != "no new webhook call received within 50ms" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestOKMockServer(t *testing.T) {
+	c := setupTest(t)
+
+	payments := c.r.NewMockServer()
+	defer payments.Close()
+	payments.On("POST", "/charges").
+		WithHeaders(H{"Authorization": {"Bearer key"}}).
+		WithBody(PartialM{"amount": 1000}).
+		Respond(http.StatusCreated, M{"id": "ch_1"}).
+		RespondHeader("Content-Type", "application/json").
+		ExpectCalls(1)
+	payments.On("GET", Regexp(`^/charges/(.+)$`)).
+		Respond(http.StatusOK, M{"status": "paid"})
+	refunds := payments.On("POST", "/refunds").ExpectCalls(1)
+
+	// The application under test calls its payment provider
+	c.server.HandleFunc("/api/orders", func(w http.ResponseWriter, req *http.Request) {
+		request, _ := http.NewRequest("POST", payments.URL()+"/charges", strings.NewReader(`{"amount":1000,"currency":"EUR"}`))
+		request.Header.Set("Authorization", "Bearer key")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer response.Body.Close()
+		charge, _ := ioutil.ReadAll(response.Body)
+		w.WriteHeader(response.StatusCode)
+		_, _ = fmt.Fprintf(w, `{"charge":%s,"type":"%v"}`, charge, response.Header.Get("Content-Type"))
+	})
+	c.server.HandleFunc("/api/orders/1", func(w http.ResponseWriter, req *http.Request) {
+		response, err := http.Get(payments.URL() + "/charges/ch_1")
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer response.Body.Close()
+		charge, _ := ioutil.ReadAll(response.Body)
+		_, _ = fmt.Fprintf(w, `{"charge":%s}`, charge)
+	})
+
+	c.r.TestAssert(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/orders"},
+		Response: TestResponse{Code: http.StatusCreated, Body: M{"charge": M{"id": "ch_1"}, "type": "application/json"}},
+	})
+	c.r.TestAssert(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/orders/1"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"charge": M{"status": "paid"}}},
+	})
+
+	// The refund is never called, and this request matches no stub
+	response, err := http.Post(payments.URL()+"/charges", "application/json", strings.NewReader(`{"amount":5}`))
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for unmatched request, got %d", response.StatusCode)
+	}
+	err = payments.Verify()
+	if err == nil || err.Error() != "stub POST /refunds expected 1 calls, got 0\nunexpected request POST /charges" {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// Once called, the stub is verified
+	refunds.Respond(http.StatusNoContent, nil)
+	response, err = http.Post(payments.URL()+"/refunds", "application/json", nil)
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected 204 for refund, got %d", response.StatusCode)
+	}
+	err = payments.Verify()
+	if err == nil || err.Error() != "unexpected request POST /charges" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+// memoryDriver is a database/sql driver for a users table, whose queries all select the user by id
+type memoryDriver struct {
+	mutex sync.Mutex
+	users map[string]string
+}
+
+var memoryDB = &memoryDriver{users: make(map[string]string)}
+var registerMemoryDB sync.Once
+
+func (d *memoryDriver) Open(name string) (driver.Conn, error)     { return d, nil }
+func (d *memoryDriver) Prepare(query string) (driver.Stmt, error) { return d, nil }
+func (d *memoryDriver) Close() error                              { return nil }
+func (d *memoryDriver) Begin() (driver.Tx, error)                 { return nil, fmt.Errorf("not supported") }
+func (d *memoryDriver) NumInput() int                             { return 1 }
+func (d *memoryDriver) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("not supported")
+}
+func (d *memoryDriver) Query(args []driver.Value) (driver.Rows, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	rows := &memoryRows{}
+	if name, ok := d.users[fmt.Sprint(args[0])]; ok == true {
+		rows.values = append(rows.values, []driver.Value{args[0], []byte(name)})
+	}
+	return rows, nil
+}
+
+type memoryRows struct {
+	values [][]driver.Value
+}
+
+func (rows *memoryRows) Columns() []string { return []string{"id", "name"} }
+func (rows *memoryRows) Close() error      { return nil }
+func (rows *memoryRows) Next(dest []driver.Value) error {
+	if len(rows.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, rows.values[0])
+	rows.values = rows.values[1:]
+	return nil
+}
+
+func TestOKStateCheck(t *testing.T) {
+	registerMemoryDB.Do(func() {
+		sql.Register("rehapt-memory", memoryDB)
+	})
+	memoryDB.users = make(map[string]string)
+	db, err := sql.Open("rehapt-memory", "")
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	defer db.Close()
+
+	c := setupTest(t)
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		var user map[string]string
+		_ = json.NewDecoder(req.Body).Decode(&user)
+		memoryDB.mutex.Lock()
+		memoryDB.users["7"] = user["name"]
+		memoryDB.mutex.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"id":"7"}`)
+	})
+
+	userRow := SQLQuery(db, "SELECT id, name FROM users WHERE id = ?", "_userid_")
+	c.r.TestAssert(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/user", Body: M{"name": "John"}},
+		Response: TestResponse{Code: http.StatusCreated, Body: M{"id": "$userid$"}},
+		// The user id is not known yet
+		PreCheck:  []StateCheck{{Checker: SQLQuery(db, "SELECT id, name FROM users WHERE id = ?", "7"), Expected: S{}}},
+		PostCheck: []StateCheck{{Name: "user persisted", Checker: userRow, Expected: S{M{"id": "7", "name": "John"}}}},
+	})
+
+	err = c.r.Post("/api/user").
+		WithBody(M{"name": "Jane"}).
+		ExpectCode(http.StatusCreated).
+		ExpectBody(M{"id": "7"}).
+		PreCheck(userRow, S{M{"id": "7", "name": "John"}}).
+		PostCheck(userRow, S{M{"id": "7", "name": "John"}}).
+		Test()
+	if err == nil || err.Error() != "post-check 0 does not match. [0].name: strings does not match. Expected 'John', got 'Jane'" {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// The request is not executed when a pre-check fails
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/user", Body: M{"name": "Jim"}},
+		Response: TestResponse{Code: http.StatusCreated},
+		PreCheck: []StateCheck{{Name: "no user", Checker: userRow, Expected: S{}}},
+	})
+	if err == nil || strings.HasPrefix(err.Error(), "pre-check no user does not match. ") == false {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if name := memoryDB.users["7"]; name != "Jane" {
+		t.Errorf("Expected request not executed, got user %v", name)
+	}
+}
+
+func TestOKEventSink(t *testing.T) {
+	c := setupTest(t)
+
+	sink := NewMemorySink()
+	sink.Publish([]byte(`{"type":"user.created","id":"0"}`))
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		// The message is published asynchronously
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			sink.Publish([]byte(`{"type":"audit"}`))
+			sink.Publish([]byte(`{"type":"user.created","id":"1"}`))
+		}()
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	c.r.TestAssert(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusCreated},
+		Events:   []EventCheck{{Name: "user created", Sink: sink, Expected: M{"type": "user.created", "id": "$userid$"}, Within: 5 * time.Second}},
+	})
+	if id := c.r.GetVariable("userid"); id != "1" {
+		t.Errorf("Expected stored id 1, got %v", id)
+	}
+
+	// The messages published before the request are ignored
+	err := c.r.Get("/api/user").
+		ExpectCode(http.StatusCreated).
+		ExpectEvent(sink, M{"type": "user.deleted"}, 100*time.Millisecond).
+		Test()
+	if err == nil || strings.HasPrefix(err.Error(), "event 0 not received within 100ms.\nmessage 3: type: strings does not match.") == false {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// A webhook catcher is a sink too
+	hooks := c.r.NewWebhookCatcher()
+	defer hooks.Close()
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusCreated},
+		Events:   []EventCheck{{Sink: hooks, Expected: Any(), Within: 10 * time.Millisecond}},
+	})
+	if err == nil || err.Error() != "event 0 not received within 10ms" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+type recordingExporter struct {
+	mutex sync.Mutex
+	spans []TraceSpan
+}
+
+func (e *recordingExporter) ExportSpan(span TraceSpan) {
+	e.mutex.Lock()
+	e.spans = append(e.spans, span)
+	e.mutex.Unlock()
+}
+
+func TestOKTracing(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user/1", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"traceparent":"%v"}`, req.Header.Get("traceparent"))
+	})
+
+	testcase := TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user/_id_"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"traceparent": Regexp(`^00-([0-9a-f]{32})-[0-9a-f]{16}-01$`)}},
+	}
+	_ = c.r.SetVariable("id", "1")
+
+	// Disabled by default
+	testcase.Response.Body = M{"traceparent": ""}
+	c.r.TestAssert(testcase)
+
+	c.r.SetTracePropagation(true)
+	testcase.Response.Body = M{"traceparent": RegexpVars(`^00-([0-9a-f]{32})-[0-9a-f]{16}-01$`, map[int]string{1: "sent"})}
+	c.r.TestAssert(testcase)
+	if c.r.GetVariable("sent") != c.r.GetVariable("trace.id") {
+		t.Errorf("Expected trace id %v sent, got %v", c.r.GetVariable("trace.id"), c.r.GetVariable("sent"))
+	}
+
+	exporter := &recordingExporter{}
+	c.r.SetTracePropagation(false)
+	c.r.SetSpanExporter(exporter)
+	failing := testcase
+	failing.Response = TestResponse{Code: http.StatusCreated, Body: M{"traceparent": "wrong"}}
+	_ = c.r.Test(failing)
+	testcase.Request.Headers = H{"traceparent": {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}}
+	testcase.Response.Body = M{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+	c.r.TestAssert(testcase)
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %v", exporter.spans)
+	}
+	span := exporter.spans[0]
+	if span.Name != "GET /api/user/1" || span.Status != http.StatusOK || span.Passed == true || span.Mismatches != 2 || span.Err == nil ||
+		len(span.TraceID) != 32 || len(span.SpanID) != 16 || span.End.Before(span.Start) == true {
+		t.Errorf("Unexpected failed span %+v", span)
+	}
+	if span := exporter.spans[1]; span.Passed == false || span.Mismatches != 0 || span.Err != nil {
+		t.Errorf("Unexpected passed span %+v", span)
+	}
+}
+
+func TestOKCaptureOutbound(t *testing.T) {
+	c := setupTest(t)
+
+	client := &http.Client{Transport: c.r.CaptureOutbound()}
+	c.server.HandleFunc("/api/orders", func(w http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 2; i++ {
+			response, err := client.Post("https://payments.example.com/charges", "application/json", strings.NewReader(fmt.Sprintf(`{"amount":1000,"attempt":%d}`, i)))
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			response.Body.Close()
+		}
+		response, err := client.Get("https://audit.example.com/log?order=1")
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		response.Body.Close()
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	c.r.Post("/api/orders").
+		ExpectCode(http.StatusCreated).
+		ExpectOutbound(OutboundCheck{Method: "POST", URL: "https://payments.example.com/charges", Body: PartialM{"amount": 1000}, Count: 2}).
+		ExpectOutbound(OutboundCheck{URL: Regexp(`^https://audit\.example\.com/`)}).
+		ExpectOutbound(OutboundCheck{Method: "DELETE", Count: 0}).
+		Assert()
+	if calls := c.r.CaptureOutbound().Calls(); len(calls) != 3 || string(calls[1].Body) != `{"amount":1000,"attempt":1}` {
+		t.Errorf("Unexpected calls %v", calls)
+	}
+
+	// Only the calls of the testcase are checked
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/orders"},
+		Response: TestResponse{Code: http.StatusCreated},
+		Outbound: []OutboundCheck{
+			{Method: "POST", Body: PartialM{"attempt": 0}, Count: 2},
+			{Method: "PUT", URL: "https://payments.example.com/charges"},
+		},
+	})
+	if err == nil || err.Error() != "outbound call POST count does not match. integers does not match. Expected 2, got 1\n"+
+		"outbound call PUT https://payments.example.com/charges not made. Calls made: POST https://payments.example.com/charges, POST https://payments.example.com/charges, GET https://audit.example.com/log?order=1" {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// The calls can be sent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer server.Close()
+	c.r.CaptureOutbound().Transport = http.DefaultTransport
+	response, err := client.Get(server.URL)
+	if e := ExpectNil(err); e != "" {
+		t.Fatal(e)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusTeapot {
+		t.Errorf("Expected forwarded call, got %d", response.StatusCode)
+	}
+}
+
+func TestOKConnectAndGRPCWeb(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/acme.user.v1.UserService/GetUser", func(w http.ResponseWriter, req *http.Request) {
+		var request map[string]string
+		if req.Header.Get("Content-Type") == "application/grpc-web+json" {
+			data, _ := ioutil.ReadAll(req.Body)
+			_ = json.Unmarshal(data[5:], &request)
+			w.Header().Set("Content-Type", "application/grpc-web+json")
+			if request["id"] != "1" {
+				trailer := []byte("grpc-status: 5\r\ngrpc-message: user%20" + request["id"] + "%20not found\r\n")
+				_, _ = w.Write(append([]byte{0x80, 0, 0, 0, byte(len(trailer))}, trailer...))
+				return
+			}
+			message := []byte(`{"user":{"id":"1"}}`)
+			_, _ = w.Write(append([]byte{0, 0, 0, 0, byte(len(message))}, message...))
+			trailer := []byte("grpc-status: 0\r\n")
+			_, _ = w.Write(append([]byte{0x80, 0, 0, 0, byte(len(trailer))}, trailer...))
+			return
+		}
+
+		_ = json.NewDecoder(req.Body).Decode(&request)
+		if req.Header.Get("Connect-Protocol-Version") != "1" || request["id"] != "1" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = fmt.Fprintf(w, `{"code":"not_found","message":"user %v not found","details":[]}`, request["id"])
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"user":{"id":"1"}}`)
+	})
+
+	c.r.TestAssert(TestCase{
+		Request:  ConnectRequest("acme.user.v1.UserService/GetUser", M{"id": "1"}),
+		Response: TestResponse{Code: http.StatusOK, Body: M{"user": M{"id": "1"}}},
+	})
+	c.r.TestAssert(TestCase{
+		Request:  ConnectRequest("acme.user.v1.UserService/GetUser", M{"id": "2"}),
+		Response: ConnectError("not_found", "user 2 not found"),
+	})
+
+	c.r.TestAssert(TestCase{
+		Request:  GRPCWebRequest("acme.user.v1.UserService/GetUser", M{"id": "1"}),
+		Response: GRPCWebResponse(S{M{"user": M{"id": "$userid$"}}}),
+	})
+	if id := c.r.GetVariable("userid"); id != "1" {
+		t.Errorf("Expected stored id 1, got %v", id)
+	}
+	c.r.TestAssert(TestCase{
+		Request:  GRPCWebRequest("acme.user.v1.UserService/GetUser", M{"id": "2"}),
+		Response: GRPCWebError(5, "user 2 not found"),
+	})
+
+	err := c.r.Test(TestCase{
+		Request:  GRPCWebRequest("acme.user.v1.UserService/GetUser", M{"id": "2"}),
+		Response: GRPCWebResponse(S{M{"user": M{"id": "2"}}}),
+	})
+	if err == nil || strings.Contains(err.Error(), "status: ") == false {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	var decoded interface{}
+	if err := GRPCWebUnmarshaler([]byte{0, 0, 0, 0, 9, '{'}, &decoded); err == nil || err.Error() != "truncated gRPC-web frame. Expected 9 bytes, got 1" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestOKReusedRecorder(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/full", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Custom", "full")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"name":"john","age":51}`)
+	})
+	c.server.HandleFunc("/api/empty", func(w http.ResponseWriter, req *http.Request) {
+	})
+
+	// The second testcase must not see anything from the first response
+	for i := 0; i < 3; i++ {
+		e := c.r.Test(TestCase{
+			Request:  TestRequest{Method: "GET", Path: "/api/full"},
+			Response: TestResponse{Code: http.StatusCreated, Headers: H{"X-Custom": {"full"}}, Body: M{"name": "john", "age": 51}},
+		})
+		if e != nil {
+			t.Error(e)
+		}
+		e = c.r.Test(TestCase{
+			Request:  TestRequest{Method: "GET", Path: "/api/empty"},
+			Response: TestResponse{Code: http.StatusOK, Headers: H{}, Body: nil},
+		})
+		if e != nil {
+			t.Error(e)
+		}
+	}
+}
+
+func TestOKPatternCache(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"stats": "%v - high - end", "id": "%v"}`, req.URL.Query().Get("value"), req.URL.Query().Get("value"))
+	})
+
+	// The same expectation is reused, the variable is loaded again by each testcase
+	stats := Regexp(`^_value_ - .* - end$`)
+	for _, value := range []string{"150", "250"} {
+		if err := c.r.SetVariable("value", value); err != nil {
+			t.Fatal(err)
+		}
+		err := c.r.Test(TestCase{
+			Request:  TestRequest{Method: "GET", Path: "/api/test?value=_value_"},
+			Response: TestResponse{Code: http.StatusOK, Body: M{"stats": stats, "id": "$id$"}},
+		})
+		if e := ExpectNil(err); e != "" {
+			t.Error(e)
+		}
+		if id := c.r.GetVariable("id"); id != value {
+			t.Errorf("Expected id %v, got %v", value, id)
+		}
+	}
+	if c.r.PatternCacheLen() == 0 {
+		t.Errorf("Expected cached patterns")
+	}
+
+	c.r.ClearPatternCache()
+	if n := c.r.PatternCacheLen(); n != 0 {
+		t.Errorf("Expected empty cache, got %d entries", n)
+	}
+
+	c.r.SetPatternCacheSize(0)
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test?value=_value_"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"stats": stats, "id": "_id_"}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	if n := c.r.PatternCacheLen(); n != 0 {
+		t.Errorf("Expected disabled cache, got %d entries", n)
+	}
+}
+
+func TestOKUnsortedLargeSlice(t *testing.T) {
+	n := 2000
+	expected := UnsortedS{}
+	var actual []interface{}
+	for i := 0; i < n; i++ {
+		expected = append(expected, M{"id": "$lastid$", "name": fmt.Sprintf("user%d", i), "age": i % 50})
+		actual = append(actual, map[string]interface{}{"id": fmt.Sprint(i), "name": fmt.Sprintf("user%d", n-1-i), "age": float64((n - 1 - i) % 50)})
+	}
+	if e := ExpectNil(Compare(expected, actual)); e != "" {
+		t.Error(e)
+	}
+
+	// The literals match the numbers of any type
+	if e := ExpectNil(Compare(UnsortedS{3, uint(2), "1", true}, []interface{}{true, 2.0, "1", int64(3)})); e != "" {
+		t.Error(e)
+	}
+
+	expected[10] = M{"id": "$lastid$", "name": "unknown", "age": 10}
+	err := Compare(expected, actual)
+	if err == nil || err.Error() != "expected element {\n  \"age\": 10,\n  \"id\": \"$lastid$\",\n  \"name\": \"unknown\"\n} at index 10 not found, the closest actual element is at index 39\n[39].name: strings does not match. Expected 'unknown', got 'user1960'\nactual elements at indexes [1989] not found" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestOKParallelCompare(t *testing.T) {
+	n := 5000
+	expected := S{}
+	actual := map[string]interface{}{}
+	var elements []interface{}
+	for i := 0; i < n; i++ {
+		expected = append(expected, M{"id": float64(i), "tags": S{"a", "b"}})
+		elements = append(elements, map[string]interface{}{"id": float64(i), "tags": []interface{}{"a", "b"}})
+	}
+	actual["elements"] = elements
+	actual["first"] = "john"
+
+	r := NewRehapt(nil, nil)
+	r.SetParallelCompare(100)
+	if e := ExpectNil(r.Compare(M{"elements": expected, "first": "$first$"}, actual)); e != "" {
+		t.Error(e)
+	}
+	if first := r.GetVariable("first"); first != "john" {
+		t.Errorf("Expected john, got %v", first)
+	}
+
+	// The mismatches are reported in the same order as a sequential comparison
+	expected[10] = M{"id": 11.0, "tags": S{"a", "b"}}
+	expected[4000] = M{"id": 4000.0, "tags": S{"a", "c"}}
+	expected[4999] = M{"id": 4999.0}
+	sequential := NewRehapt(nil, nil).Compare(M{"elements": expected}, M{"elements": elements})
+	parallel := r.Compare(M{"elements": expected}, M{"elements": elements})
+	if sequential == nil || parallel == nil || sequential.Error() != parallel.Error() {
+		t.Errorf("Unexpected errors %v and %v", sequential, parallel)
+	}
+	if mismatches := parallel.(*MismatchError).Mismatches; len(mismatches) != 3 || mismatches[0].Path != "elements[10].id" || mismatches[1].Path != "elements[4000].tags[1]" {
+		t.Errorf("Unexpected mismatches %v", mismatches)
+	}
+}
+
+func BenchmarkCompareNumbers(b *testing.B) {
+	expected := S{}
+	var actual []interface{}
+	for i := 0; i < 10000; i++ {
+		expected = append(expected, i)
+		actual = append(actual, float64(i))
+	}
+	r := NewRehapt(b, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := r.Compare(expected, actual); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompareObjects(b *testing.B) {
+	expected := S{}
+	var actual []interface{}
+	for i := 0; i < 1000; i++ {
+		expected = append(expected, M{"id": fmt.Sprint(i), "name": "John", "age": 51.0, "admin": false, "tags": S{"a", "b"}})
+		actual = append(actual, map[string]interface{}{"id": fmt.Sprint(i), "name": "John", "age": 51.0, "admin": false, "tags": []interface{}{"a", "b"}})
+	}
+	r := NewRehapt(b, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := r.Compare(expected, actual); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestOKIgnoreBody(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/export", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		// The body is not decoded, even if it is not valid JSON
+		_, _ = fmt.Fprintf(w, `{"items": [1, 2, 3...`)
+	})
+
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/export"},
+		Response: TestResponse{Code: http.StatusOK, Body: IgnoreBody()},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	// Any() still requires a valid body
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/export"},
+		Response: TestResponse{Code: http.StatusOK, Body: Any()},
+	})
+	if err == nil || strings.HasPrefix(err.Error(), "cannot unmarshal response body.") == false {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/export"},
+		Response: TestResponse{Code: http.StatusCreated, Body: IgnoreBody()},
+	})
+	if e := ExpectError(err, "response code does not match. Expected 201, got 200"); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKRequestCookies(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/me", func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"cookie": req.Header.Get("Cookie")})
+	})
+
+	if err := c.r.SetVariable("session", "abc123"); err != nil {
+		t.Fatal(err)
+	}
+	err := c.r.Test(TestCase{
+		Request: TestRequest{
+			Method:  "GET",
+			Path:    "/api/me",
+			Headers: H{"Cookie": {"theme=dark"}},
+			Cookies: map[string]string{"session": "_session_", "lang": "fr"},
+		},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"cookie": "theme=dark; lang=fr; session=abc123"}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	base := TestCase{Request: TestRequest{Cookies: map[string]string{"session": "_session_"}}}
+	testcase := c.r.Get("/api/me").WithCookie("lang", "en").ExpectCode(http.StatusOK).ExpectBody(M{"cookie": "lang=en; session=abc123"}).TestCase()
+	err = c.r.Test(testcase.Extend(base))
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/me", Cookies: map[string]string{"session": "_unknown_"}},
+		Response: TestResponse{Code: http.StatusOK, Body: Any()},
+	})
+	if e := ExpectError(err, "error while replacing variables in cookie session. variable unknown is not defined"); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKResponseCookies(t *testing.T) {
+	c := setupTest(t)
+
+	expires := time.Now().Add(time.Hour)
+	c.server.HandleFunc("/api/login", func(w http.ResponseWriter, req *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc123", Path: "/", Expires: expires, HttpOnly: true, Secure: true})
+		http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark"})
+		w.WriteHeader(http.StatusOK)
+	})
+
+	err := c.r.Test(TestCase{
+		Request: TestRequest{Method: "POST", Path: "/api/login"},
+		Response: TestResponse{
+			Code: http.StatusOK,
+			Cookies: M{
+				"session": M{"Value": "$session$", "Path": "/", "HttpOnly": true, "Secure": true, "Expires": TimeDelta(expires, time.Second)},
+				"theme":   "dark",
+			},
+		},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	if session := c.r.GetVariable("session"); session != "abc123" {
+		t.Errorf("Expected abc123, got %v", session)
+	}
+
+	err = c.r.Post("/api/login").ExpectCode(http.StatusOK).ExpectCookie("theme", M{"Value": "dark", "Domain": Absent()}).Test()
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/login"},
+		Response: TestResponse{Code: http.StatusOK, Cookies: M{"theme": "light", "lang": Any()}},
+	})
+	if e := ExpectError(err, "response cookies does not match. expected key lang not found\ntheme.Value: strings does not match. Expected 'light', got 'dark'"); e != "" {
+		t.Error(e)
+	}
+	if mismatchErr, ok := err.(*MismatchError); ok == false || len(mismatchErr.Mismatches) != 2 || mismatchErr.Mismatches[1].Path != "cookies.theme.Value" {
+		t.Errorf("Unexpected error %#v", err)
+	}
+}
+
+func TestOKMultipart(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/upload", func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseMultipartForm(1 << 20); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		files := map[string]interface{}{}
+		for field, headers := range req.MultipartForm.File {
+			file, _ := headers[0].Open()
+			content, _ := ioutil.ReadAll(file)
+			_ = file.Close()
+			files[field] = map[string]interface{}{"filename": headers[0].Filename, "type": headers[0].Header.Get("Content-Type"), "content": string(content)}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"fields": req.MultipartForm.Value, "files": files})
+	})
+
+	// The multipart Content-Type overrides the default one
+	c.r.SetDefaultHeader("Content-Type", "application/json")
+	err := c.r.Test(TestCase{
+		Request: TestRequest{
+			Method: "POST",
+			Path:   "/api/upload",
+			Body: Multipart{
+				Fields: map[string]string{"user": "1", "title": "Hello"},
+				Files: []MultipartFile{
+					{Field: "avatar", Filename: "avatar.png", Content: []byte("PNG"), ContentType: "image/png"},
+					{Field: "notes", Path: "testdata/upload.txt"},
+				},
+			},
+		},
+		Response: TestResponse{
+			Code: http.StatusOK,
+			Body: M{
+				"fields": M{"user": S{"1"}, "title": S{"Hello"}},
+				"files": M{
+					"avatar": M{"filename": "avatar.png", "type": "image/png", "content": "PNG"},
+					"notes":  M{"filename": "upload.txt", "type": "application/octet-stream", "content": "hello from a file\n"},
+				},
+			},
+		},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/upload", Body: Multipart{Files: []MultipartFile{{Field: "notes", Path: "testdata/missing.txt"}}}},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	if err == nil || strings.HasPrefix(err.Error(), "failed to marshal the testcase request body. cannot read multipart file.") == false {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestOKFormMarshaler(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/login", func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"type": req.Header.Get("Content-Type"), "form": req.PostForm})
+	})
+
+	err := c.r.Test(TestCase{
+		Request: TestRequest{
+			Method:        "POST",
+			Path:          "/login",
+			Body:          M{"user": "john doe", "remember": true, "roles": S{"admin", "dev"}},
+			BodyMarshaler: FormMarshaler,
+		},
+		Response: TestResponse{
+			Code: http.StatusOK,
+			Body: M{"type": "application/x-www-form-urlencoded", "form": M{"user": S{"john doe"}, "remember": S{"true"}, "roles": S{"admin", "dev"}}},
+		},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	// The url.Values are encoded as a form by default
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/login", Body: url.Values{"user": {"john"}}},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"type": "application/x-www-form-urlencoded", "form": M{"user": S{"john"}}}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	if _, err := FormMarshaler("user=john"); err == nil || err.Error() != "only url.Values or map with string keys supported" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestOKBasicAuth(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/admin", func(w http.ResponseWriter, req *http.Request) {
+		user, password, ok := req.BasicAuth()
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": ok, "user": user, "password": password})
+	})
+
+	if err := c.r.SetVariable("password", "s3cr3t"); err != nil {
+		t.Fatal(err)
+	}
+	c.r.SetDefaultBasicAuth(BasicAuth{User: "admin", Password: "_password_"})
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/admin"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"ok": true, "user": "admin", "password": "s3cr3t"}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	// The testcase credentials override the default ones
+	err = c.r.Get("/api/admin").WithBasicAuth("john", "doe").ExpectCode(http.StatusOK).ExpectBody(M{"ok": true, "user": "john", "password": "doe"}).Test()
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	c.r.SetDefaultBasicAuth(BasicAuth{})
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/admin"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"ok": false, "user": "", "password": ""}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/admin", BasicAuth: &BasicAuth{User: "admin", Password: "_unknown_"}},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	if e := ExpectError(err, "error while replacing variables in basic auth password. variable unknown is not defined"); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKBearerToken(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/login", func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"token": "abc123"})
+	})
+	c.server.HandleFunc("/api/me", func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"authorization": req.Header.Get("Authorization")})
+	})
+
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/login"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"token": "$token$"}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	// The token stored by the login is sent by the following requests
+	c.r.SetDefaultBearerToken("_token_")
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/me"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"authorization": "Bearer abc123"}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	// The testcase credentials override the default ones
+	err = c.r.Get("/api/me").WithBearerToken("other").ExpectCode(http.StatusOK).ExpectBody(M{"authorization": "Bearer other"}).Test()
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	err = c.r.Get("/api/me").WithBasicAuth("john", "doe").ExpectCode(http.StatusOK).ExpectBody(M{"authorization": "Basic am9objpkb2U="}).Test()
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	// The default basic auth replaces the default token
+	c.r.SetDefaultBasicAuth(BasicAuth{User: "john", Password: "doe"})
+	err = c.r.Get("/api/me").ExpectCode(http.StatusOK).ExpectBody(M{"authorization": "Basic am9objpkb2U="}).Test()
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+	c.r.SetDefaultBearerToken("")
+	err = c.r.Get("/api/me").ExpectCode(http.StatusOK).ExpectBody(M{"authorization": ""}).Test()
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/me", BearerToken: "_unknown_"},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	if e := ExpectError(err, "error while replacing variables in bearer token. variable unknown is not defined"); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/me", BearerToken: "abc", BasicAuth: &BasicAuth{User: "john"}},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	if e := ExpectError(err, "invalid testcase. Request BasicAuth and BearerToken cannot both be set"); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestOKBodyFile(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/orders", func(w http.ResponseWriter, req *http.Request) {
+		var order interface{}
+		_ = json.NewDecoder(req.Body).Decode(&order)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"contentType": req.Header.Get("Content-Type"), "order": order})
+	})
+
+	if err := c.r.SetVariable("customer", "john"); err != nil {
+		t.Fatal(err)
+	}
+	err := c.r.Test(TestCase{
+		Request: TestRequest{Method: "POST", Path: "/api/orders", BodyFile: "testdata/new_order.json"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{
+			"contentType": "application/json",
+			"order": M{
+				"customer": "john",
+				"items":    S{M{"sku": "A-1", "quantity": 2}, M{"sku": "B-7", "quantity": 1}},
+			},
+		}},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	// The testcase headers define the Content-Type
+	err = c.r.Post("/api/orders").WithBodyFile("testdata/new_order.json").WithHeader("Content-Type", "text/plain").
+		ExpectCode(http.StatusOK).ExpectBody(PartialM{"contentType": "text/plain"}).Test()
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/orders", BodyFile: "testdata/unknown.json"},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	if e := ExpectError(err, "cannot read body file testdata/unknown.json. open testdata/unknown.json: no such file or directory"); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/orders", BodyFile: "testdata/new_order.json", Body: M{}},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	if e := ExpectError(err, "invalid testcase. Request Body and BodyFile cannot both be set"); e != "" {
+		t.Error(e)
+	}
+
+	// The variables are replaced before sending the request
+	err = setupTest(t).r.Test(TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/orders", BodyFile: "testdata/new_order.json"},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	if e := ExpectError(err, "error while replacing variables in body file testdata/new_order.json. variable customer is not defined"); e != "" {
+		t.Error(e)
+	}
+}
+
+// And now invalid cases
+
+func TestErrSuiteStopOnFailure(t *testing.T) {
+	c := setupTest(t)
+
+	called := 0
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		called++
+		w.WriteHeader(http.StatusBadRequest)
+	})
+
+	suite := c.r.NewSuite("flow")
+	suite.Add("first", TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	suite.Add("second", TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusBadRequest},
+	})
+
+	err := suite.Test()
+	if e := ExpectError(err, `step first failed. response code does not match. Expected 200, got 400`); e != "" {
+		t.Error(e)
+	}
+	if called != 1 {
+		t.Errorf("Expected second step to be skipped, handler called %d times", called)
+	}
+}
+
+func TestErrHandlerTimeout(t *testing.T) {
+	c := setupTest(t)
+
+	release := make(chan struct{})
+	defer close(release)
+	c.server.HandleFunc("/api/blocked", func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	})
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	c.r.SetHandlerTimeout(50 * time.Millisecond)
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/blocked"},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	if err == nil || strings.HasPrefix(err.Error(), "handler did not return within 50ms for GET /api/blocked. Goroutines:\ngoroutine ") == false {
+		t.Errorf("Unexpected error %v", err)
+	} else if strings.Contains(err.Error(), "TestErrHandlerTimeout.func1") == false {
+		t.Errorf("Expected the blocked handler in the goroutines, got %v", err)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrHandlerPanic(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/panic", func(w http.ResponseWriter, req *http.Request) {
+		panic("boom")
+	})
+
+	testcase := TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/panic", Body: M{"name": "John"}},
+		Response: TestResponse{Code: http.StatusOK},
+	}
+	// Also recovered when the handler runs in the watchdog goroutine
+	for _, timeout := range []time.Duration{0, time.Second} {
+		c.r.SetHandlerTimeout(timeout)
+		err := c.r.Test(testcase)
+		if err == nil || strings.HasPrefix(err.Error(), "handler panicked for POST /api/panic. boom\ngoroutine ") == false {
+			t.Errorf("Unexpected error %v", err)
+			continue
+		}
+		if strings.Contains(err.Error(), "TestErrHandlerPanic.func1") == false {
+			t.Errorf("Expected the handler in the stack, got %v", err)
+		}
+		if strings.HasSuffix(err.Error(), "\nRequest:\nPOST /api/panic\n\n{\n  \"name\": \"John\"\n}") == false {
+			t.Errorf("Expected the request dump, got %v", err)
+		}
+	}
+}
+
+func TestErrMismatchError(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/pets", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"pets": [{"id": 1, "name": "Rex"}, {"id": 2}], "tags": ["a", "b"], "owner": "john"}`)
+	})
+
+	err := c.r.Test(TestCase{
+		Request: TestRequest{Method: "GET", Path: "/api/pets"},
+		Response: TestResponse{
+			Code:    http.StatusCreated,
+			Headers: PartialM{"Content-Type": S{"application/json"}},
+			Body: PartialM{
+				"pets":  S{M{"id": 10, "name": "Rex"}, PartialM{"id": 2, "age": Any()}},
+				"tags":  UnsortedS{"a", "c"},
+				"owner": Regexp(`^[A-Z]`),
+			},
+		},
+	})
+	mismatchErr, ok := err.(*MismatchError)
+	if ok == false {
+		t.Fatalf("Expected a *MismatchError, got %T %v", err, err)
+	}
+
+	var mismatches []string
+	for _, mismatch := range mismatchErr.Mismatches {
+		mismatches = append(mismatches, fmt.Sprintf("%v %v %v", mismatch.Path, mismatch.Kind, mismatch.Actual))
+	}
+	// The map keys are not ordered
+	sort.Strings(mismatches)
+	expected := "body.owner comparer john\n" +
+		"body.pets[0].id value 1\n" +
+		"body.pets[1].age missing <nil>\n" +
+		"body.tags[1] missing <nil>\n" +
+		"body.tags[1] unexpected b\n" +
+		"code value 200\n" +
+		"headers.Content-Type[0] value text/plain"
+	if actual := strings.Join(mismatches, "\n"); actual != expected {
+		t.Errorf("Expected mismatches\n%v\ngot\n%v", expected, actual)
+	}
+	// The expected element not found in the UnsortedS is the element itself
+	for _, mismatch := range mismatchErr.Mismatches {
+		if mismatch.Path == "body.tags[1]" && mismatch.Kind == MismatchMissing {
+			if value, ok := mismatch.Expected.(string); ok == false || value != "c" {
+				t.Errorf("Expected missing element \"c\", got %T %v", mismatch.Expected, mismatch.Expected)
+			}
+		}
+	}
+	// The message is unchanged
+	if strings.HasPrefix(err.Error(), "response code does not match. Expected 201, got 200\nresponse headers does not match.") == false {
+		t.Errorf("Unexpected error message %v", err)
+	}
+	// and the nested errors start with their path
+	if strings.Contains(err.Error(), "\npets[0].id: floats does not match. Expected 10, got 1\n") == false {
+		t.Errorf("Expected nested error with its path, got %v", err)
+	}
+}
+
+func TestErrMaxErrors(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/numbers", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `[1, 2, 3, 4, 5, 6]`)
+	})
+	testcase := TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/numbers"},
+		Response: TestResponse{Code: http.StatusOK, Body: S{0, 0, 0, 0, 0, Or(0, 6)}},
+	}
+
+	err := c.r.Test(testcase)
+	if mismatchErr, ok := err.(*MismatchError); ok == false || len(mismatchErr.Mismatches) != 5 {
+		t.Errorf("Expected 5 mismatches, got %v", err)
+	}
+
+	c.r.SetMaxErrors(2)
+	err = c.r.Test(testcase)
+	if e := ExpectError(err, "[0]: floats does not match. Expected 0, got 1\n"+
+		"[1]: floats does not match. Expected 0, got 2\n"+
+		"comparison stopped after 2 errors"); e != "" {
+		t.Error(e)
+	}
+
+	// The failing alternatives of Or() do not count
+	testcase.Response.Body = S{Or(0, 1), Or(0, 2), Or(0, 3), 4, 5, 6}
+	if e := ExpectNil(c.r.Test(testcase)); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrDumpOnFailure(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"id":"1","name":"John"}`)
+	})
+
+	c.r.SetDumpOnFailure(true)
+	c.r.SetDefaultHeader("Authorization", "token")
+	testcase := TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/user?notify=1", Body: M{"name": "John"}},
+		Response: TestResponse{Code: http.StatusCreated, Body: M{"id": "1", "name": "Paul"}},
+	}
+	err := c.r.Test(testcase)
+	if e := ExpectError(err, "name: strings does not match. Expected 'Paul', got 'John'\n"+
+		"Request:\n"+
+		"POST /api/user?notify=1\n"+
+		"Authorization: token\n"+
+		"\n"+
+		"{\n  \"name\": \"John\"\n}\n"+
+		"Response:\n"+
+		"201 Created\n"+
+		"Content-Type: application/json\n"+
+		"\n"+
+		"{\n  \"id\": \"1\",\n  \"name\": \"John\"\n}"); e != "" {
+		t.Error(e)
+	}
+	if _, ok := err.(*MismatchError); ok == false {
+		t.Errorf("Expected a *MismatchError, got %T", err)
+	}
+
+	// Nothing is dumped on success
+	testcase.Response.Body = M{"id": "1", "name": "John"}
+	if e := ExpectNil(c.r.Test(testcase)); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrFailureExport(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"id": 1, "name": "John"}`)
+	})
+
+	var export bytes.Buffer
+	c.r.SetFailureExport(&export)
+	testcase := TestCase{
+		Request:  TestRequest{Method: "POST", Path: "/api/user", Body: M{"name": "John"}},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"id": Any(), "name": "Paul"}},
+	}
+	// Only the failures are exported
+	if e := ExpectError(c.r.Test(testcase), "name: strings does not match. Expected 'Paul', got 'John'"); e != "" {
+		t.Error(e)
+	}
+	testcase.Response.Body = M{"id": 1, "name": "John"}
+	if e := ExpectNil(c.r.Test(testcase)); e != "" {
+		t.Error(e)
+	}
+
+	lines := strings.Split(strings.TrimSpace(export.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 failure, got %v", export.String())
+	}
+	var report FailureReport
+	if err := json.Unmarshal([]byte(lines[0]), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Test != "TestErrFailureExport" || report.Request.Method != "POST" || report.Request.URL != "/api/user" || report.Response.Status != 200 {
+		t.Errorf("Unexpected report %v", lines[0])
+	}
+	if body := fmt.Sprint(report.Request.Body, report.Response.Body); body != "map[name:John] map[id:1 name:John]" {
+		t.Errorf("Unexpected bodies %v", body)
+	}
+	if len(report.Mismatches) != 1 || report.Mismatches[0].Path != "body.name" || report.Mismatches[0].Expected != "Paul" || report.Mismatches[0].Actual != "John" {
+		t.Errorf("Unexpected mismatches %v", report.Mismatches)
+	}
+}
+
+func TestErrNilMarshaler(t *testing.T) {
+	c := setupTest(t)
+
+	c.r.SetMarshaler(nil)
+
+	err := c.r.Test(TestCase{
+		Request: TestRequest{
+			Method: "GET",
+			Path:   "/api/test",
+			Body:   nil,
+		},
+		Response: TestResponse{
+			Code: http.StatusOK,
+			Body: nil,
+		},
+	})
+
+	if e := ExpectError(err, `nil marshaler`); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrNilUnmarshaler(t *testing.T) {
+	c := setupTest(t)
+
+	c.r.SetUnmarshaler(nil)
+
+	err := c.r.Test(TestCase{
+		Request: TestRequest{
+			Method: "GET",
+			Path:   "/api/test",
+			Body:   nil,
+		},
+		Response: TestResponse{
+			Code: http.StatusOK,
+			Body: nil,
+		},
+	})
+
+	if e := ExpectError(err, `nil unmarshaler`); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrNilHTTPHandler(t *testing.T) {
+	c := setupTest(t)
+
+	c.r.SetHttpHandler(nil)
+
+	err := c.r.Test(TestCase{
+		Request: TestRequest{
+			Method: "GET",
+			Path:   "/api/test",
+			Body:   nil,
+		},
+		Response: TestResponse{
+			Code: http.StatusOK,
+			Body: nil,
+		},
+	})
+
+	if e := ExpectError(err, `nil HTTP handler`); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrNilErrorHandler(t *testing.T) {
+	server := http.NewServeMux()
+
+	c := &testContext{
+		r:      NewRehapt(nil, server),
+		server: server,
+	}
+
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `"ok"`)
+	})
+
+	// The reported error on stdout here is expected
+	c.r.TestAssert(TestCase{
+		Request: TestRequest{
+			Method: "GET",
+			Path:   "/api/test",
+			Body:   nil,
+		},
+		Response: TestResponse{
+			Code: http.StatusOK,
+			Body: "KO",
+		},
+	})
+
+	// No easy way to check stdout, but at least we make sure the TestAssert() function
+	// does not crash when errorHandler is nil
+}
+
+func TestErrMissingHTTPMethod(t *testing.T) {
+	c := setupTest(t)
+
+	err := c.r.Test(TestCase{
+		Request: TestRequest{
+			Method: "",
+			Path:   "/api/test",
+			Body:   nil,
+		},
+		Response: TestResponse{
+			Code: http.StatusOK,
+			Body: nil,
+		},
+	})
+
+	if e := ExpectError(err, `incomplete testcase. Missing HTTP method`); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrInvalidHTTPMethod(t *testing.T) {
+	c := setupTest(t)
+
+	err := c.r.Test(TestCase{
+		Request: TestRequest{
+			Method: "NOT CORRECT",
+			Path:   "/api/test",
+			Body:   nil,
+		},
+		Response: TestResponse{
+			Code: http.StatusOK,
+			Body: nil,
+		},
+	})
+
+	if e := ExpectError(err, `failed to build HTTP request. net/http: invalid method "NOT CORRECT"`); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrMissingURLPath(t *testing.T) {
+	c := setupTest(t)
+
+	err := c.r.Test(TestCase{
+		Request: TestRequest{
+			Method: "GET",
+			Path:   "",
+			Body:   nil,
+		},
+		Response: TestResponse{
+			Code: http.StatusOK,
+			Body: nil,
+		},
+	})
+
+	if e := ExpectError(err, `incomplete testcase. Missing URL path`); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrMarshalRequestBody(t *testing.T) {
+	c := setupTest(t)
+
+	err := c.r.Test(TestCase{
+		Request: TestRequest{
+			Method: "GET",
+			Path:   "/api/test",
+			Body:   M{"n": json.Number(`invalid`)}, // This is refused by json.Marshal
+		},
+		Response: TestResponse{
+			Code: http.StatusOK,
+			Body: nil,
+		},
+	})
+
+	if e := ExpectError(err, `failed to marshal the testcase request body. json: invalid number literal "invalid"`); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrResponseCode(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	err := c.r.Test(TestCase{
+		Request: TestRequest{
+			Method: "GET",
+			Path:   "/api/test",
+			Body:   nil,
+		},
+		Response: TestResponse{
+			Code: http.StatusOK,
+			Body: nil,
+		},
+	})
+
+	if e := ExpectError(err, `response code does not match. Expected 200, got 401`); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrTestAssertCallFailFunction(t *testing.T) {
+	c := setupTest(t)
+
+	tt := &testingT{}
+	c.r.SetErrorHandler(tt)
+
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `"ok"`)
+	})
+
+	c.r.TestAssert(TestCase{
+		Request: TestRequest{
+			Method: "GET",
+			Path:   "/api/test",
+			Body:   nil,
+		},
+		Response: TestResponse{
+			Code: http.StatusOK,
+			Body: "not ok",
+		},
+	})
+
+	if tt.called == false {
+		t.Errorf("Fail function should have been called")
+	}
+}
+
+func TestErrResponseBodyType(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/string", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `"ok"`)
+	})
+	c.server.HandleFunc("/api/int", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `1`)
+	})
+	c.server.HandleFunc("/api/float", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `1.0`)
+	})
+	c.server.HandleFunc("/api/bool", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `true`)
+	})
+	c.server.HandleFunc("/api/map", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"msg": "ok"}`)
+	})
+	c.server.HandleFunc("/api/slice", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `["ok"]`)
 	})
 
 	tests := []struct {
@@ -2328,21 +6546,24 @@ func TestErrResponseBodyType(t *testing.T) {
 		{Path: "int", Body: M{}, Error: "different kinds. Expected map, got float64"},
 		{Path: "float", Body: M{}, Error: "different kinds. Expected map, got float64"},
 		{Path: "bool", Body: M{}, Error: "different kinds. Expected map, got bool"},
-		{Path: "slice", Body: M{}, Error: "different kinds. Expected map, got slice"},
+		{Path: "slice", Body: M{}, Error: `different kinds. Expected map, got slice. Actual is a 1-element array starting with "ok"`},
 		// Slice
 		{Path: "string", Body: S{}, Error: "different kinds. Expected slice, got string"},
 		{Path: "int", Body: S{}, Error: "different kinds. Expected slice, got float64"},
 		{Path: "float", Body: S{}, Error: "different kinds. Expected slice, got float64"},
 		{Path: "bool", Body: S{}, Error: "different kinds. Expected slice, got bool"},
-		{Path: "map", Body: S{}, Error: "different kinds. Expected slice, got map"},
+		{Path: "map", Body: S{}, Error: "different kinds. Expected slice, got map. Actual is an object with keys msg"},
 		// Struct
-		{Path: "string", Body: struct{}{}, Error: "unhandled type struct {}"},
-		{Path: "int", Body: struct{}{}, Error: "unhandled type struct {}"},
-		{Path: "float", Body: struct{}{}, Error: "unhandled type struct {}"},
-		{Path: "bool", Body: struct{}{}, Error: "unhandled type struct {}"},
-		{Path: "slice", Body: struct{}{}, Error: "unhandled type struct {}"},
+		{Path: "string", Body: struct{}{}, Error: "unhandled type struct {}. Structs are not supported, use M or PartialM with the JSON field names instead"},
+		{Path: "int", Body: struct{}{}, Error: "unhandled type struct {}. Structs are not supported, use M or PartialM with the JSON field names instead"},
+		{Path: "float", Body: struct{}{}, Error: "unhandled type struct {}. Structs are not supported, use M or PartialM with the JSON field names instead"},
+		{Path: "bool", Body: struct{}{}, Error: "unhandled type struct {}. Structs are not supported, use M or PartialM with the JSON field names instead"},
+		{Path: "slice", Body: struct{}{}, Error: "unhandled type struct {}. Structs are not supported, use M or PartialM with the JSON field names instead"},
 		// Unhandled
-		{Path: "string", Body: complex(1, 2), Error: "unhandled type complex128"},
+		{Path: "string", Body: complex(1, 2), Error: "unhandled type complex128. Complex numbers are not supported, use a float or NumberDelta() instead"},
+		{Path: "slice", Body: [1]int{1}, Error: "unhandled type [1]int. Arrays are not supported, use S, SortedS or UnsortedS instead"},
+		{Path: "bool", Body: time.Time{}, Error: "different kinds. Expected string, got bool"},
+		{Path: "string", Body: make(chan int), Error: "unhandled type chan int"},
 	}
 
 	for _, test := range tests {
@@ -2364,6 +6585,47 @@ func TestErrResponseBodyType(t *testing.T) {
 	}
 }
 
+func TestErrResponseBodyShape(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/users", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `[{"id": 1, "name": "John", "description": "A very long description which is truncated"}, {"id": 2}]`)
+	})
+	c.server.HandleFunc("/api/pets", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"items": [], "total": 0}`)
+	})
+	c.server.HandleFunc("/api/empty", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `[]`)
+	})
+
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/users"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"id": 1}},
+	})
+	if e := ExpectError(err, `different kinds. Expected map, got slice. Actual is a 2-element array starting with {"description":"A very long description which is truncated",...`); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/pets"},
+		Response: TestResponse{Code: http.StatusOK, Body: UnsortedS{}},
+	})
+	if e := ExpectError(err, "different kinds. Expected slice, got map. Actual is an object with keys items, total"); e != "" {
+		t.Error(e)
+	}
+
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/empty"},
+		Response: TestResponse{Code: http.StatusOK, Body: PartialM{}},
+	})
+	if e := ExpectError(err, "different kinds. Expected map, got slice. Actual is an empty array"); e != "" {
+		t.Error(e)
+	}
+}
+
 func TestErrStringResponseBody(t *testing.T) {
 	c := setupTest(t)
 
@@ -2639,7 +6901,27 @@ func TestErrUnmarshalResponseBody(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, `cannot unmarshal response body. invalid character 'i' looking for beginning of value`); e != "" {
+	if e := ExpectError(err, `cannot unmarshal response body. invalid character 'i' looking for beginning of value. Response code 200, body: {"error": invalid...`); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrUnmarshalResponseBodyErrorPage(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = fmt.Fprintf(w, "<html><body>%v</body></html>", strings.Repeat("Internal Server Error. ", 10))
+	})
+
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusOK, Body: Any()},
+	})
+
+	if e := ExpectError(err, "response code does not match. Expected 200, got 500\n"+
+		"cannot unmarshal response body. invalid character '<' looking for beginning of value. Response code 500, body: <html><body>"+
+		strings.Repeat("Internal Server Error. ", 8)+"Inte..."); e != "" {
 		t.Error(e)
 	}
 }
@@ -2667,7 +6949,75 @@ func TestErrResponseHeader(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, `response headers does not match. map element [X-Custom] does not match. slice element 0 does not match. strings does not match. Expected 'custom value 123', got 'not right value'`); e != "" {
+	if e := ExpectError(err, `response headers does not match. X-Custom[0]: strings does not match. Expected 'custom value 123', got 'not right value'`); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrResponseHeaderCanonicalization(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Custom", "value")
+		w.Header().Add("X-Values", "b")
+		w.Header().Add("X-Values", "a")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	testcase := TestCase{
+		Request: TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{
+			Code:    http.StatusOK,
+			Headers: PartialM{"X-custom": S{"value"}, "X-Values": S{"a", "b"}},
+		},
+	}
+	err := c.r.Test(testcase)
+	if e := ExpectError(err, "response headers does not match. X-Values[0]: strings does not match. Expected 'a', got 'b'\n"+
+		"X-Values[1]: strings does not match. Expected 'b', got 'a'\n"+
+		"expected key X-custom not found. Did you mean X-Custom?\n"+
+		"header X-Values has the expected values in a different order. Use UnsortedS or SetLenientHeaders() to ignore the order\n"+
+		"header X-custom is named X-Custom in the response. Use the canonical name X-Custom or SetLenientHeaders() to ignore the case"); e != "" {
+		t.Error(e)
+	}
+
+	c.r.SetLenientHeaders(true)
+	if e := ExpectNil(c.r.Test(testcase)); e != "" {
+		t.Error(e)
+	}
+	testcase.Response.Headers = H{"x-values": {"b", "a"}, "x-custom": {"value"}}
+	if e := ExpectNil(c.r.Test(testcase)); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrRequireExplicitCode(t *testing.T) {
+	c := setupTest(t)
+
+	calls := 0
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+	})
+	c.r.SetRequireExplicitCode(true)
+
+	for _, code := range []interface{}{nil, 0, uint(0)} {
+		err := c.r.Test(TestCase{
+			Request:  TestRequest{Method: "GET", Path: "/api/test"},
+			Response: TestResponse{Code: code},
+		})
+		if e := ExpectError(err, "incomplete testcase. Expected response code not specified"); e != "" {
+			t.Error(e)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("Expected no request, got %d", calls)
+	}
+
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: Any()},
+	})
+	if e := ExpectNil(err); e != "" {
 		t.Error(e)
 	}
 }
@@ -2762,7 +7112,12 @@ func TestErrSliceDifferentSize(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, `different slice sizes. Expected 1, got 2. Expected [A] got [A B]`); e != "" {
+	if e := ExpectError(err, `different slice sizes. Expected 1, got 2. Expected [
+  "A"
+] got [
+  "A",
+  "B"
+]`); e != "" {
 		t.Error(e)
 	}
 }
@@ -2787,7 +7142,7 @@ func TestErrSliceElementDoesNotMatch(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, `slice element 1 does not match. strings does not match. Expected 'C', got 'B'`); e != "" {
+	if e := ExpectError(err, `[1]: strings does not match. Expected 'C', got 'B'`); e != "" {
 		t.Error(e)
 	}
 }
@@ -2837,11 +7192,45 @@ func TestErrMapDifferentSize(t *testing.T) {
 		},
 	})
 
-	// as printed order of map is unknown, we have to expect any of the two possibilities
-	e1 := ExpectError(err, `different map sizes. Expected 2, got 1. Expected map[foo:bar key:value] got map[key:value]`)
-	e2 := ExpectError(err, `different map sizes. Expected 2, got 1. Expected map[key:value foo:bar] got map[key:value]`)
-	if !(e1 == "" || e2 == "") {
-		t.Error(e1)
+	if e := ExpectError(err, `different map sizes. Expected 2, got 1. Expected {
+  "foo": "bar",
+  "key": "value"
+} got {
+  "key": "value"
+}`); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrMapDifferentSizeNested(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"id": "1"}`)
+	})
+
+	err := c.r.Test(TestCase{
+		Request: TestRequest{
+			Method: "GET",
+			Path:   "/api/test",
+		},
+		Response: TestResponse{
+			Code: http.StatusOK,
+			Body: M{"id": Any(), "tags": S{1, "1"}},
+		},
+	})
+
+	if e := ExpectError(err, `different map sizes. Expected 2, got 1. Expected {
+  "id": "<CompareFn>",
+  "tags": [
+    1,
+    "1"
+  ]
+} got {
+  "id": "1"
+}`); e != "" {
+		t.Error(e)
 	}
 }
 
@@ -2865,7 +7254,31 @@ func TestErrMapKeyNotFound(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, `expected key foo not found in actual map[key:value]`); e != "" {
+	if e := ExpectError(err, `expected key foo not found in actual {
+  "key": "value"
+}`); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrMapKeyNotFoundSuggestion(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"userId": 1, "firstName": "John", "adress": "street", "id": 2}`)
+	})
+
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusOK, Body: PartialM{"user_id": 1, "FirstName": "John", "address": "street", "ID": 2, "lastName": "Doe"}},
+	})
+
+	if e := ExpectError(err, "expected key FirstName not found. Did you mean firstName?\n"+
+		"expected key ID not found. Did you mean id?\n"+
+		"expected key address not found. Did you mean adress?\n"+
+		"expected key lastName not found\n"+
+		"expected key user_id not found. Did you mean userId?"); e != "" {
 		t.Error(e)
 	}
 }
@@ -2890,7 +7303,7 @@ func TestErrMapElementDoesNotMatch(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, `map element [key] does not match. strings does not match. Expected 'bar', got 'value'`); e != "" {
+	if e := ExpectError(err, `key: strings does not match. Expected 'bar', got 'value'`); e != "" {
 		t.Error(e)
 	}
 }
@@ -3113,7 +7526,7 @@ func TestErrStoreVarInvalidVarname(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, `map element [stats] does not match. invalid variable name my var`); e != "" {
+	if e := ExpectError(err, `stats: invalid variable name my var`); e != "" {
 		t.Error(e)
 	}
 }
@@ -3178,7 +7591,7 @@ func TestErrLoadVarShortcutUnknownVariable(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, `map element [status] does not match. variable unknownvar is not defined`); e != "" {
+	if e := ExpectError(err, `status: variable unknownvar is not defined`); e != "" {
 		t.Error(e)
 	}
 }
@@ -3237,7 +7650,7 @@ func TestErrLoadVarShortcutInvalidVariableType(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, `map element [status] does not match. variable var of type rehapt.M cannot be using inside string`); e != "" {
+	if e := ExpectError(err, `status: variable var of type rehapt.M cannot be using inside string`); e != "" {
 		t.Error(e)
 	}
 }
@@ -3262,7 +7675,12 @@ func TestErrUnsortedSliceDifferentSize(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, `different slice sizes. Expected 1, got 2. Expected [A] got [A B]`); e != "" {
+	if e := ExpectError(err, `different slice sizes. Expected 1, got 2. Expected [
+  "A"
+] got [
+  "A",
+  "B"
+]`); e != "" {
 		t.Error(e)
 	}
 }
@@ -3293,6 +7711,30 @@ actual elements at indexes [0] not found`); e != "" {
 	}
 }
 
+func TestErrUnsortedSliceClosestElement(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `[{"id": 1, "name": "John", "age": 30}, {"id": 2, "name": "Paul", "age": 40}]`)
+	})
+
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusOK, Body: UnsortedS{M{"id": 2, "name": "Paul", "age": 41}, M{"id": 1, "name": "John", "age": 30}}},
+	})
+
+	if e := ExpectError(err, `expected element {
+  "age": 41,
+  "id": 2,
+  "name": "Paul"
+} at index 0 not found, the closest actual element is at index 1
+[1].age: floats does not match. Expected 41, got 40
+actual elements at indexes [1] not found`); e != "" {
+		t.Error(e)
+	}
+}
+
 func TestErrPartialMapKeyNotFound(t *testing.T) {
 	c := setupTest(t)
 
@@ -3338,7 +7780,7 @@ func TestErrPartialMapElementDoesNotMatch(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, `map element [key] does not match. strings does not match. Expected 'bar', got 'value'`); e != "" {
+	if e := ExpectError(err, `key: strings does not match. Expected 'bar', got 'value'`); e != "" {
 		t.Error(e)
 	}
 }
@@ -3365,7 +7807,7 @@ func TestErrRegexpFailParsing(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, "map element [stats] does not match. error parsing regexp: missing closing ): `^[0-9](3 - .* - end$`"); e != "" {
+	if e := ExpectError(err, "stats: error parsing regexp: missing closing ): `^[0-9](3 - .* - end$`"); e != "" {
 		t.Error(e)
 	}
 }
@@ -3392,7 +7834,7 @@ func TestErrRegexpNotString(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, `map element [stats] does not match. different kinds. Expected string, got float64`); e != "" {
+	if e := ExpectError(err, `stats: different kinds. Expected string, got float64`); e != "" {
 		t.Error(e)
 	}
 }
@@ -3419,7 +7861,7 @@ func TestErrRegexpReplaceUnknownVariable(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, `map element [stats] does not match. variable who is not defined`); e != "" {
+	if e := ExpectError(err, `stats: variable who is not defined`); e != "" {
 		t.Error(e)
 	}
 }
@@ -3446,7 +7888,7 @@ func TestErrRegexpDoesNotMatch(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, `map element [stats] does not match. regexp '^[a-z]{3} - .* - end$' does not match '150 - high - end'`); e != "" {
+	if e := ExpectError(err, `stats: regexp '^[a-z]{3} - .* - end$' does not match '150 - high - end'`); e != "" {
 		t.Error(e)
 	}
 }
@@ -3498,7 +7940,7 @@ func TestErrRegexpVarsFailParsing(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, "map element [stats] does not match. error parsing regexp: missing closing ): `^[0-9](3 - .* - end$`"); e != "" {
+	if e := ExpectError(err, "stats: error parsing regexp: missing closing ): `^[0-9](3 - .* - end$`"); e != "" {
 		t.Error(e)
 	}
 }
@@ -3525,7 +7967,7 @@ func TestErrRegexpVarsDoesNotMatch(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, `map element [stats] does not match. regexp '^[a-z]{3} - (.*) - end$' does not match '150 - high - end'`); e != "" {
+	if e := ExpectError(err, `stats: regexp '^[a-z]{3} - (.*) - end$' does not match '150 - high - end'`); e != "" {
 		t.Error(e)
 	}
 }
@@ -3552,7 +7994,7 @@ func TestErrRegexpVarsDoesInvalidVarname(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, `map element [stats] does not match. invalid variable name v 1`); e != "" {
+	if e := ExpectError(err, `stats: invalid variable name v 1`); e != "" {
 		t.Error(e)
 	}
 }
@@ -3579,7 +8021,7 @@ func TestErrRegexpVarsOverflowIndexIgnored(t *testing.T) {
 		},
 	})
 
-	if e := ExpectError(err, `map element [stats] does not match. expected variable index 2 overflow regexp group count of 2`); e != "" {
+	if e := ExpectError(err, `stats: expected variable index 2 overflow regexp group count of 2`); e != "" {
 		t.Error(e)
 	}
 }
@@ -3817,8 +8259,328 @@ func TestErrMultipleErrors(t *testing.T) {
 	})
 
 	if e := ExpectError(err, `response code does not match. Expected 200, got 400
-response headers does not match. map element [X-Custom] does not match. slice element 0 does not match. strings does not match. Expected 'custom value 123', got 'not right value'
-different map sizes. Expected 0, got 1. Expected map[] got map[key:value]`); e != "" {
+response headers does not match. X-Custom[0]: strings does not match. Expected 'custom value 123', got 'not right value'
+different map sizes. Expected 0, got 1. Expected {} got {
+  "key": "value"
+}`); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrTestCaseHooks(t *testing.T) {
+	c := setupTest(t)
+
+	called := false
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusOK)
+	})
+
+	err := c.r.Test(TestCase{
+		Before:   func(r *Rehapt) error { return fmt.Errorf("no database") },
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+	if e := ExpectError(err, `before hook failed. no database`); e != "" {
+		t.Error(e)
+	}
+	if called == true {
+		t.Error("Expected request not to be executed")
+	}
+
+	err = c.r.Test(TestCase{
+		After:    func(r *Rehapt) error { return fmt.Errorf("cannot delete") },
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusCreated},
+	})
+	if e := ExpectError(err, `response code does not match. Expected 201, got 200
+after hook failed. cannot delete`); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrSuiteHooks(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	afterAllCalled := false
+	suite := c.r.NewSuite("hooks")
+	suite.BeforeEach(func(r *Rehapt) error { return fmt.Errorf("cannot seed") })
+	suite.AfterAll(func(r *Rehapt) error {
+		afterAllCalled = true
+		return nil
+	})
+	suite.Add("first", TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+
+	if e := ExpectError(suite.Test(), `step first failed. before each hook failed. cannot seed`); e != "" {
+		t.Error(e)
+	}
+	if afterAllCalled == false {
+		t.Error("Expected after all hook to be called")
+	}
+}
+
+func TestErrTestEventuallyTimeout(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/job", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"status": "running"}`)
+	})
+
+	err := c.r.TestEventually(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/job"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"status": "done"}},
+	}, 20*time.Millisecond, 5*time.Millisecond)
+	if e := ExpectError(err, `still failing after 20ms. status: strings does not match. Expected 'done', got 'running'`); e != "" {
+		t.Error(e)
+	}
+
+	tt := &testingT{}
+	c.r.SetErrorHandler(tt)
+	c.r.TestEventuallyAssert(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/job"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"status": "done"}},
+	}, 0, time.Millisecond)
+	if tt.called == false {
+		t.Error("Expected Errorf to be called")
+	}
+}
+
+func TestErrSuiteDependencies(t *testing.T) {
+	c := setupTest(t)
+
+	suite := c.r.NewSuite("unknown")
+	suite.Add("first", TestCase{}).DependsOn("zero")
+	if e := ExpectError(suite.Test(), `step first depends on unknown step zero`); e != "" {
+		t.Error(e)
+	}
+
+	suite = c.r.NewSuite("cycle")
+	suite.Add("first", TestCase{}).DependsOn("second")
+	suite.Add("second", TestCase{}).DependsOn("first")
+	if e := ExpectError(suite.Test(), `dependency cycle between steps first, second`); e != "" {
+		t.Error(e)
+	}
+
+	suite = c.r.NewSuite("duplicated")
+	suite.Add("first", TestCase{})
+	suite.Add("first", TestCase{})
+	if e := ExpectError(suite.Test(), `duplicated step name first`); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrLoadFile(t *testing.T) {
+	c := setupTest(t)
+
+	dir, err := ioutil.TempDir("", "rehapt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		Content string
+		Error   string
+	}{
+		{
+			Content: "steps:\n  - request: {method: GET, path: /}\n    response: {code: 200, bdy: 1}",
+			Error:   "response has unknown keys bdy, supported keys are code, headers, body, rawBody",
+		},
+		{
+			Content: "steps:\n  - request: {method: GET, path: /}\n    response: {code: !regex '^2'}",
+			Error:   "unknown tag step step 1 response code !regex",
+		},
+		{
+			Content: "steps:\n  - request: {method: GET, path: /}\n    response:\n      body: 1",
+			Error:   "step step 1 response code is missing",
+		},
+		{
+			Content: "steps:\n  - request: {method: GET, path: /\n",
+			Error:   "yaml line 2: unexpected end of flow collection, missing '}'",
+		},
+		{
+			Content: "name: a\nname: b",
+			Error:   "yaml line 2: duplicated key name",
+		},
+		{
+			Content: "steps: {",
+			Error:   "yaml line 1: unexpected end of flow mapping",
+		},
+		{
+			Content: "steps: {a: 1,",
+			Error:   "yaml line 1: unexpected end of flow mapping",
+		},
+		{
+			Content: "steps: {a: 1, ",
+			Error:   "yaml line 1: unexpected end of flow mapping",
+		},
+	}
+
+	for _, test := range tests {
+		filename := filepath.Join(dir, "scenario.yaml")
+		if err := ioutil.WriteFile(filename, []byte(test.Content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := c.r.LoadFile(filename)
+		if err == nil || strings.HasSuffix(err.Error(), test.Error) == false {
+			t.Errorf("Expected error ending with '%v', got '%v'", test.Error, err)
+		}
+	}
+
+	if _, err := c.r.LoadFile("testdata/users.txt"); err == nil {
+		t.Error("Expected error for unknown file")
+	}
+}
+
+func TestErrGolden(t *testing.T) {
+	c := setupTest(t)
+
+	dir, err := ioutil.TempDir("", "rehapt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c.server.HandleFunc("/api/user", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"id": 1, "name": "John"}`)
+	})
+
+	missing := filepath.Join(dir, "missing.golden.json")
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Golden: missing},
+	})
+	if e := ExpectError(err, fmt.Sprintf("golden file %v does not exist, run the test with -update or REHAPT_UPDATE_GOLDEN=1 to create it", missing)); e != "" {
+		t.Error(e)
+	}
+
+	golden := filepath.Join(dir, "user.golden.json")
+	if err := ioutil.WriteFile(golden, []byte(`{"id": 1, "name": "Paul"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user"},
+		Response: TestResponse{Code: http.StatusOK, Golden: golden},
+	})
+	if e := ExpectError(err, "name: strings does not match. Expected 'Paul', got 'John'"); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestErrRawBodyConflict(t *testing.T) {
+	c := setupTest(t)
+
+	tests := []struct {
+		Request  TestRequest
+		Response TestResponse
+		Error    string
+	}{
+		{
+			Request: TestRequest{Method: "POST", Path: "/api/echo", Body: M{}, RawBody: "text"},
+			Error:   "invalid testcase. Request Body and RawBody cannot both be set",
+		},
+		{
+			Request: TestRequest{Method: "POST", Path: "/api/echo", BodyMarshaler: RawMarshaler, RawBody: "text"},
+			Error:   "invalid testcase. Request RawBody is sent as is, BodyMarshaler cannot be set",
+		},
+		{
+			Request:  TestRequest{Method: "POST", Path: "/api/echo"},
+			Response: TestResponse{Body: "text", RawBody: "text"},
+			Error:    "invalid testcase. Response Body and RawBody cannot both be set",
+		},
+		{
+			Request:  TestRequest{Method: "POST", Path: "/api/echo"},
+			Response: TestResponse{BodyUnmarshaler: RawUnmarshaler, RawBody: "text"},
+			Error:    "invalid testcase. Response RawBody is compared as is, BodyUnmarshaler cannot be set",
+		},
+	}
+	for _, test := range tests {
+		err := c.r.Test(TestCase{Request: test.Request, Response: test.Response})
+		if e := ExpectError(err, test.Error); e != "" {
+			t.Error(e)
+		}
+	}
+}
+
+func TestErrMaxFormattedElements(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/test", func(w http.ResponseWriter, req *http.Request) {
+		ids := make([]int, 1000)
+		for i := range ids {
+			ids[i] = i
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"ids": ids})
+	})
+
+	testcase := TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/test"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"ids": S{1, 2}}},
+	}
+	err := c.r.Test(testcase)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if strings.Contains(err.Error(), "\"... 900 more elements\"") == false || strings.Contains(err.Error(), "  999") == true {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	c.r.SetMaxFormattedElements(3)
+	err = c.r.Test(testcase)
+	if err == nil || strings.Contains(err.Error(), "Expected [\n  1,\n  2\n] got [\n  0,\n  1,\n  2,\n  \"... 997 more elements\"\n]") == false {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	c.r.SetMaxFormattedElements(0)
+	err = c.r.Test(testcase)
+	if err == nil || strings.Contains(err.Error(), "  999\n]") == false || strings.Contains(err.Error(), "more elements") == true {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestErrMaxResponseBytes(t *testing.T) {
+	c := setupTest(t)
+
+	c.server.HandleFunc("/api/export", func(w http.ResponseWriter, req *http.Request) {
+		line := strings.Repeat("x", 1023) + "\n"
+		for i := 0; i < 10; i++ {
+			_, _ = fmt.Fprint(w, line)
+		}
+	})
+
+	c.r.SetMaxResponseBytes(4096)
+	err := c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/export"},
+		Response: TestResponse{Code: http.StatusOK, RawBody: Any()},
+	})
+	if err == nil || strings.HasPrefix(err.Error(), "response body too large. Got 10240 bytes, the limit is 4096\n") == false {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	c.r.SetResponseSizePolicy(ResponseSizeTruncate)
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/export"},
+		Response: TestResponse{Code: http.StatusOK, RawBody: strings.Repeat(strings.Repeat("x", 1023)+"\n", 4)},
+	})
+	if e := ExpectNil(err); e != "" {
+		t.Error(e)
+	}
+
+	c.r.SetMaxResponseBytes(0)
+	err = c.r.Test(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/export"},
+		Response: TestResponse{Code: http.StatusOK, RawBody: strings.Repeat(strings.Repeat("x", 1023)+"\n", 10)},
+	})
+	if e := ExpectNil(err); e != "" {
 		t.Error(e)
 	}
 }
@@ -0,0 +1,99 @@
+package rehapt
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ProtoHeader is the response header used by the handler returned by NewRemoteHandler to report
+// the protocol negotiated with the server, like "HTTP/2.0". It is removed from the response headers
+// and compared with TestResponse.Proto. A custom forwarding handler can set it too
+const ProtoHeader = "X-Rehapt-Proto"
+
+// remoteHandler forwards the requests to a running server
+type remoteHandler struct {
+	base   *url.URL
+	client *http.Client
+}
+
+// NewRemoteHandler build an http.Handler forwarding the requests to the server at baseURL.
+// It allow to run the testcases against a deployed server instead of an in-process handler.
+// The request path is appended to the base URL path, so "http://host/v1" and "/user"
+// gives "http://host/v1/user". If client is nil, http.DefaultClient is used.
+// When the server cannot be reached, the response is a 502 Bad Gateway with the error as body.
+// The protocol negotiated with the server can be checked with TestResponse.Proto, see NewHTTP2Client
+// to force HTTP/2
+func NewRemoteHandler(baseURL string, client *http.Client) (http.Handler, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL %v. %v", baseURL, err)
+	}
+	if base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("invalid base URL %v. Missing scheme or host", baseURL)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &remoteHandler{base: base, client: client}, nil
+}
+
+func (h *remoteHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	target := *h.base
+	target.Path = strings.TrimSuffix(h.base.Path, "/") + req.URL.Path
+	target.RawPath = ""
+	target.RawQuery = req.URL.RawQuery
+
+	outgoing, err := http.NewRequest(req.Method, target.String(), req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	outgoing.Header = cloneHeader(req.Header)
+	outgoing.ContentLength = req.ContentLength
+	// A streamed response stops when the testcase cancels the request
+	outgoing = outgoing.WithContext(req.Context())
+
+	response, err := h.client.Do(outgoing)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+
+	for name, values := range response.Header {
+		w.Header()[name] = append([]string{}, values...)
+	}
+	w.Header().Set(ProtoHeader, response.Proto)
+	w.WriteHeader(response.StatusCode)
+	flusher, ok := w.(http.Flusher)
+	if ok == false {
+		_, _ = io.Copy(w, response.Body)
+		return
+	}
+	// Forward the data as it is received, so the streamed responses can be tested
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := response.Body.Read(buffer)
+		if n > 0 {
+			_, _ = w.Write(buffer[:n])
+			flusher.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// responseProto returns the protocol of the response, reported by the ProtoHeader if any,
+// otherwise the one of the request. The ProtoHeader is removed from the headers
+func responseProto(request *http.Request, header http.Header) (string, int, int) {
+	proto := header.Get(ProtoHeader)
+	header.Del(ProtoHeader)
+	if major, minor, ok := http.ParseHTTPVersion(proto); ok == true {
+		return proto, major, minor
+	}
+	return request.Proto, request.ProtoMajor, request.ProtoMinor
+}
@@ -0,0 +1,105 @@
+package rehapt
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// resourceTracker holds the resources created by the testcases, waiting for their cleanup.
+// It is shared by the forked instances
+type resourceTracker struct {
+	mutex     sync.Mutex
+	resources []trackedResource
+}
+
+type trackedResource struct {
+	kind   string
+	method string
+	path   string
+}
+
+func (resource trackedResource) String() string {
+	return fmt.Sprintf("%v (%v %v)", resource.kind, resource.method, resource.path)
+}
+
+// StoreResource works like StoreVar, and also tracks the resource identified by the stored value
+// so it is deleted by Cleanup(). The cleanup request is described as "METHOD path",
+// its variables are replaced when the value is stored. For example:
+//
+//	Response: TestResponse{
+//	    Code: http.StatusCreated,
+//	    Body: M{"id": StoreResource("user", "id", "DELETE /api/users/_id_")},
+//	}
+func StoreResource(kind string, name string, cleanup string) CompareFn {
+	return func(r *Rehapt, ctx compareCtx) error {
+		if err := r.SetVariable(name, ctx.Actual); err != nil {
+			return err
+		}
+		return r.TrackResource(kind, cleanup)
+	}
+}
+
+// TrackResource registers a resource deleted by Cleanup(), for the resources not created
+// through StoreResource, like in a hook. The cleanup request is described as "METHOD path",
+// its variables are replaced immediately
+func (r *Rehapt) TrackResource(kind string, cleanup string) error {
+	parts := strings.SplitN(strings.TrimSpace(cleanup), " ", 2)
+	if len(parts) != 2 || parts[0] == "" || strings.TrimSpace(parts[1]) == "" {
+		return fmt.Errorf("invalid cleanup request '%v' for resource %v, expected 'METHOD path'", cleanup, kind)
+	}
+	path, err := r.replaceVars(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return fmt.Errorf("error while replacing variables in cleanup request of resource %v. %v", kind, err)
+	}
+
+	r.resources.mutex.Lock()
+	defer r.resources.mutex.Unlock()
+	r.resources.resources = append(r.resources.resources, trackedResource{kind: kind, method: parts[0], path: path})
+	return nil
+}
+
+// Cleanup deletes the tracked resources, the last created first, and forgets them.
+// A cleanup request succeeds if its response code is 2xx, or 404 when the testcases already deleted the resource.
+// All the cleanup requests are executed, and the returned error lists the ones which failed.
+// The suites call it once their steps and AfterAll hooks are done, otherwise call it at the end of your test:
+//
+//	defer r.Cleanup()
+func (r *Rehapt) Cleanup() error {
+	r.resources.mutex.Lock()
+	resources := r.resources.resources
+	r.resources.resources = nil
+	r.resources.mutex.Unlock()
+
+	var errs []error
+	for i := len(resources) - 1; i >= 0; i-- {
+		if err := r.cleanupResource(resources[i]); err != nil {
+			errs = append(errs, fmt.Errorf("cleanup of %v failed. %v", resources[i], err))
+		}
+	}
+	return joinErrors(errs...)
+}
+
+// cleanupResource executes the cleanup request with the default headers.
+// It is not a testcase: the observers and exports are not involved
+func (r *Rehapt) cleanupResource(resource trackedResource) error {
+	if r.httpHandler == nil {
+		return fmt.Errorf("nil HTTP handler")
+	}
+	request, err := http.NewRequest(resource.method, resource.path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to build HTTP request. %v", err)
+	}
+	request.Header = r.cloneDefaultHeaders()
+
+	recorder := httptest.NewRecorder()
+	if err := r.serve(recorder, request); err != nil {
+		return err
+	}
+	if code := recorder.Code; (code < 200 || code > 299) && code != http.StatusNotFound {
+		return fmt.Errorf("response code %d", code)
+	}
+	return nil
+}
@@ -0,0 +1,570 @@
+package rehapt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Scenario files allow to describe a Suite without writing Go code.
+// They can be written in YAML or JSON, both formats describe the same structure.
+// The JSON schema of this structure is available in the scenario.schema.json file.
+// A YAML scenario file looks like:
+//
+//	name: users
+//	# Variables defined before the first step
+//	variables:
+//	  userName: John
+//	steps:
+//	  - name: create user
+//	    tags: [smoke]
+//	    request:
+//	      method: POST
+//	      path: /api/user
+//	      headers:
+//	        X-Custom: value
+//	      body:
+//	        name: _userName_
+//	    response:
+//	      code: 201
+//	      headers:
+//	        Location: !regexp '^/api/user/[0-9]+$'
+//	      body:
+//	        id: !storevar userId
+//	        name: _userName_
+//	        createdAt: !any
+//	        roles: !unsorted [admin, user]
+//	  - name: get user
+//	    dependsOn: [create user]
+//	    request:
+//	      method: GET
+//	      path: /api/user/_userId_
+//	    response:
+//	      code: 200
+//	      body: !partial
+//	        name: John
+//
+// Each step accepts the keys:
+//
+//	name           the step name, default is "step N"
+//	tags           list of tags, see TestCase.Tags
+//	dependsOn      list of step names, see SuiteStep.DependsOn
+//	skipUnlessVar  variable name, see SkipUnlessVar
+//	onlyIf         mapping of variable names to their expected values, see VarEquals
+//	request        method, path, headers, body, rawBody
+//	response       code, headers, body, rawBody
+//
+// The variables are replaced in the request path, headers, body and rawBody just before executing the step.
+// `rawBody` is sent or compared as plain text instead of JSON.
+// The response headers are compared partially: only the listed headers are checked.
+// A missing response body means no body is expected, use `!any` to ignore it.
+//
+// The expected values support the following tags:
+//
+//	!any                       Any()
+//	!regexp '^[0-9]+$'         Regexp()
+//	!storevar name             StoreVar()
+//	!loadvar name              LoadVar()
+//	!partial {...}             PartialM
+//	!unsorted [...]            UnsortedS
+//	!not value                 Not()
+//	!and [...]                 And()
+//	!or [...]                  Or()
+//	!numberdelta [10, 0.5]     NumberDelta()
+//
+// In JSON, a tag is written as an object with a single key, the tag name.
+// For example {"!regexp": "^[0-9]+$"} or {"!any": null}.
+// The same structure is also accepted in YAML.
+
+// RunFile loads the scenario file and runs it as a Suite, see LoadFile and Suite.Run.
+// It returns true if all the steps succeeded
+func (r *Rehapt) RunFile(t *testing.T, filename string) bool {
+	markHelper(t)
+	suite, err := r.LoadFile(filename)
+	if err != nil {
+		t.Errorf("\nError: %v", err)
+		return false
+	}
+	return suite.Run(t)
+}
+
+// LoadFile loads a scenario file and returns the Suite it describes.
+// The file format is detected from its extension: ".yaml", ".yml" or ".json".
+// The suite name defaults to the file name without extension
+func (r *Rehapt) LoadFile(filename string) (*Suite, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree interface{}
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".yaml", ".yml":
+		tree, err = parseYAML(data)
+	case ".json":
+		err = json.Unmarshal(data, &tree)
+	default:
+		return nil, fmt.Errorf("unsupported scenario file extension %v", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid scenario file %v. %v", filename, err)
+	}
+
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	suite, err := r.loadScenario(name, tree)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scenario file %v. %v", filename, err)
+	}
+	return suite, nil
+}
+
+// loadScenario builds a Suite from the decoded scenario
+func (r *Rehapt) loadScenario(name string, tree interface{}) (*Suite, error) {
+	var steps interface{}
+	var variables map[string]interface{}
+
+	switch scenario := tree.(type) {
+	case []interface{}:
+		// Only a list of steps
+		steps = scenario
+	case map[string]interface{}:
+		if err := checkScenarioKeys("scenario", scenario, "name", "variables", "steps"); err != nil {
+			return nil, err
+		}
+		if n, ok := scenario["name"]; ok == true {
+			if name, ok = n.(string); ok == false {
+				return nil, fmt.Errorf("scenario name must be a string, got %T", n)
+			}
+		}
+		if v, ok := scenario["variables"]; ok == true && v != nil {
+			if variables, ok = v.(map[string]interface{}); ok == false {
+				return nil, fmt.Errorf("scenario variables must be a mapping, got %T", v)
+			}
+		}
+		steps = scenario["steps"]
+	default:
+		return nil, fmt.Errorf("scenario must be a mapping or a list of steps, got %T", tree)
+	}
+
+	stepList, ok := steps.([]interface{})
+	if ok == false {
+		return nil, fmt.Errorf("scenario steps must be a list, got %T", steps)
+	}
+
+	suite := r.NewSuite(name)
+	if len(variables) > 0 {
+		suite.BeforeAll(func(r *Rehapt) error {
+			// Sorted to report errors consistently
+			names := make([]string, 0, len(variables))
+			for name := range variables {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if err := r.SetVariable(name, variables[name]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	for i, s := range stepList {
+		if err := loadScenarioStep(suite, i, s); err != nil {
+			return nil, err
+		}
+	}
+	return suite, nil
+}
+
+func loadScenarioStep(suite *Suite, index int, tree interface{}) error {
+	step, ok := tree.(map[string]interface{})
+	if ok == false {
+		return fmt.Errorf("step %d must be a mapping, got %T", index+1, tree)
+	}
+
+	name := fmt.Sprintf("step %d", index+1)
+	if n, ok := step["name"]; ok == true {
+		if name, ok = n.(string); ok == false {
+			return fmt.Errorf("step %d name must be a string, got %T", index+1, n)
+		}
+	}
+	where := fmt.Sprintf("step %v", name)
+
+	if err := checkScenarioKeys(where, step, "name", "tags", "dependsOn", "skipUnlessVar", "onlyIf", "request", "response"); err != nil {
+		return err
+	}
+
+	testcase := TestCase{}
+	var err error
+	if testcase.Tags, err = scenarioStrings(where+" tags", step["tags"]); err != nil {
+		return err
+	}
+	if v, ok := step["skipUnlessVar"]; ok == true {
+		varname, ok := v.(string)
+		if ok == false {
+			return fmt.Errorf("%v skipUnlessVar must be a string, got %T", where, v)
+		}
+		testcase.SkipIf = SkipUnlessVar(varname)
+	}
+	if v, ok := step["onlyIf"]; ok == true {
+		if testcase.OnlyIf, err = loadScenarioCondition(where+" onlyIf", v); err != nil {
+			return err
+		}
+	}
+	if testcase.Request, err = loadScenarioRequest(where, step["request"]); err != nil {
+		return err
+	}
+	if testcase.Response, err = loadScenarioResponse(where, step["response"]); err != nil {
+		return err
+	}
+
+	s := suite.Add(name, testcase)
+	if v, ok := step["dependsOn"]; ok == true {
+		dependencies, err := scenarioStrings(where+" dependsOn", v)
+		if err != nil {
+			return err
+		}
+		s.DependsOn(dependencies...)
+	}
+	s.prepare = replaceRequestVars
+	return nil
+}
+
+// loadScenarioCondition builds a condition met when all the listed variables match their expected value
+func loadScenarioCondition(where string, tree interface{}) (ConditionFn, error) {
+	variables, ok := tree.(map[string]interface{})
+	if ok == false {
+		return nil, fmt.Errorf("%v must be a mapping, got %T", where, tree)
+	}
+
+	// Sorted to report errors consistently
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	conditions := make([]ConditionFn, len(names))
+	for i, name := range names {
+		expected, err := scenarioExpectation(where+" "+name, variables[name])
+		if err != nil {
+			return nil, err
+		}
+		conditions[i] = VarEquals(name, expected)
+	}
+
+	return func(r *Rehapt) (bool, string) {
+		for _, condition := range conditions {
+			if ok, reason := condition(r); ok == false {
+				return false, reason
+			}
+		}
+		return true, ""
+	}, nil
+}
+
+func loadScenarioRequest(where string, tree interface{}) (TestRequest, error) {
+	where += " request"
+	request, ok := tree.(map[string]interface{})
+	if ok == false {
+		return TestRequest{}, fmt.Errorf("%v must be a mapping, got %T", where, tree)
+	}
+	if err := checkScenarioKeys(where, request, "method", "path", "headers", "body", "rawBody"); err != nil {
+		return TestRequest{}, err
+	}
+
+	req := TestRequest{}
+	var err error
+	if req.Method, err = scenarioString(where+" method", request["method"]); err != nil {
+		return TestRequest{}, err
+	}
+	// The path is kept as a string, its variables are replaced by Test()
+	if req.Path, err = scenarioString(where+" path", request["path"]); err != nil {
+		return TestRequest{}, err
+	}
+
+	if h, ok := request["headers"]; ok == true && h != nil {
+		headers, ok := h.(map[string]interface{})
+		if ok == false {
+			return TestRequest{}, fmt.Errorf("%v headers must be a mapping, got %T", where, h)
+		}
+		req.Headers = make(H, len(headers))
+		for name, value := range headers {
+			if str, ok := value.(string); ok == true {
+				req.Headers[name] = []string{str}
+				continue
+			}
+			values, err := scenarioStrings(where+" header "+name, value)
+			if err != nil {
+				return TestRequest{}, err
+			}
+			req.Headers[name] = values
+		}
+	}
+
+	body, hasBody := request["body"]
+	rawBody, hasRawBody := request["rawBody"]
+	switch {
+	case hasBody == true && hasRawBody == true:
+		return TestRequest{}, fmt.Errorf("%v cannot have both body and rawBody", where)
+	case hasRawBody == true:
+		str, ok := rawBody.(string)
+		if ok == false {
+			return TestRequest{}, fmt.Errorf("%v rawBody must be a string, got %T", where, rawBody)
+		}
+		req.RawBody = str
+	case hasBody == true:
+		req.Body = body
+	}
+	return req, nil
+}
+
+func loadScenarioResponse(where string, tree interface{}) (TestResponse, error) {
+	where += " response"
+	response, ok := tree.(map[string]interface{})
+	if ok == false {
+		return TestResponse{}, fmt.Errorf("%v must be a mapping, got %T", where, tree)
+	}
+	if err := checkScenarioKeys(where, response, "code", "headers", "body", "rawBody"); err != nil {
+		return TestResponse{}, err
+	}
+
+	resp := TestResponse{}
+	var err error
+	code, ok := response["code"]
+	if ok == false {
+		return TestResponse{}, fmt.Errorf("%v code is missing", where)
+	}
+	if resp.Code, err = scenarioExpectation(where+" code", code); err != nil {
+		return TestResponse{}, err
+	}
+
+	if h, ok := response["headers"]; ok == true && h != nil {
+		headers, ok := h.(map[string]interface{})
+		if ok == false {
+			return TestResponse{}, fmt.Errorf("%v headers must be a mapping, got %T", where, h)
+		}
+		expected := make(PartialM, len(headers))
+		for name, value := range headers {
+			e, err := scenarioExpectation(where+" header "+name, value)
+			if err != nil {
+				return TestResponse{}, err
+			}
+			// Headers are lists of values, allow to describe only one value
+			if _, isSlice := e.(S); isSlice == false {
+				if _, isUnsorted := e.(UnsortedS); isUnsorted == false {
+					e = S{e}
+				}
+			}
+			expected[name] = e
+		}
+		resp.Headers = expected
+	}
+
+	body, hasBody := response["body"]
+	rawBody, hasRawBody := response["rawBody"]
+	switch {
+	case hasBody == true && hasRawBody == true:
+		return TestResponse{}, fmt.Errorf("%v cannot have both body and rawBody", where)
+	case hasRawBody == true:
+		if resp.RawBody, err = scenarioExpectation(where+" rawBody", rawBody); err != nil {
+			return TestResponse{}, err
+		}
+	case hasBody == true:
+		if resp.Body, err = scenarioExpectation(where+" body", body); err != nil {
+			return TestResponse{}, err
+		}
+	}
+	return resp, nil
+}
+
+// scenarioExpectation converts a decoded value into an expected value,
+// maps becoming M, lists becoming S and tags becoming their matching CompareFn
+func scenarioExpectation(where string, tree interface{}) (interface{}, error) {
+	switch value := tree.(type) {
+	case map[string]interface{}:
+		if tag, arg, ok := scenarioTag(value); ok == true {
+			return scenarioMatcher(where, tag, arg)
+		}
+		expected := make(M, len(value))
+		for key, element := range value {
+			e, err := scenarioExpectation(where+"."+key, element)
+			if err != nil {
+				return nil, err
+			}
+			expected[key] = e
+		}
+		return expected, nil
+	case []interface{}:
+		return scenarioExpectations(where, value)
+	default:
+		return tree, nil
+	}
+}
+
+func scenarioExpectations(where string, list []interface{}) (S, error) {
+	expected := make(S, len(list))
+	for i, element := range list {
+		e, err := scenarioExpectation(fmt.Sprintf("%v[%d]", where, i), element)
+		if err != nil {
+			return nil, err
+		}
+		expected[i] = e
+	}
+	return expected, nil
+}
+
+// scenarioTag returns the tag and its argument if the map is a tagged value
+func scenarioTag(m map[string]interface{}) (string, interface{}, bool) {
+	if len(m) != 1 {
+		return "", nil, false
+	}
+	for key, value := range m {
+		if strings.HasPrefix(key, "!") {
+			return key, value, true
+		}
+	}
+	return "", nil, false
+}
+
+func scenarioMatcher(where string, tag string, arg interface{}) (interface{}, error) {
+	where += " " + tag
+	switch tag {
+	case "!any":
+		return Any(), nil
+	case "!regexp":
+		regex, err := scenarioString(where, arg)
+		if err != nil {
+			return nil, err
+		}
+		return Regexp(regex), nil
+	case "!storevar":
+		name, err := scenarioString(where, arg)
+		if err != nil {
+			return nil, err
+		}
+		return StoreVar(name), nil
+	case "!loadvar":
+		name, err := scenarioString(where, arg)
+		if err != nil {
+			return nil, err
+		}
+		return LoadVar(name), nil
+	case "!partial":
+		m, ok := arg.(map[string]interface{})
+		if ok == false {
+			return nil, fmt.Errorf("%v expects a mapping, got %T", where, arg)
+		}
+		expected, err := scenarioExpectation(where, m)
+		if err != nil {
+			return nil, err
+		}
+		if e, ok := expected.(M); ok == true {
+			return PartialM(e), nil
+		}
+		return nil, fmt.Errorf("%v expects a mapping, got a tag", where)
+	case "!unsorted":
+		list, ok := arg.([]interface{})
+		if ok == false {
+			return nil, fmt.Errorf("%v expects a list, got %T", where, arg)
+		}
+		expected, err := scenarioExpectations(where, list)
+		if err != nil {
+			return nil, err
+		}
+		return UnsortedS(expected), nil
+	case "!not":
+		expected, err := scenarioExpectation(where, arg)
+		if err != nil {
+			return nil, err
+		}
+		return Not(expected), nil
+	case "!and", "!or":
+		list, ok := arg.([]interface{})
+		if ok == false {
+			return nil, fmt.Errorf("%v expects a list, got %T", where, arg)
+		}
+		expected, err := scenarioExpectations(where, list)
+		if err != nil {
+			return nil, err
+		}
+		if tag == "!and" {
+			return And(expected...), nil
+		}
+		return Or(expected...), nil
+	case "!numberdelta":
+		list, ok := arg.([]interface{})
+		if ok == false || len(list) != 2 {
+			return nil, fmt.Errorf("%v expects a list [value, delta]", where)
+		}
+		value, ok1 := scenarioNumber(list[0])
+		delta, ok2 := scenarioNumber(list[1])
+		if ok1 == false || ok2 == false {
+			return nil, fmt.Errorf("%v expects numbers, got %v", where, list)
+		}
+		return NumberDelta(value, delta), nil
+	default:
+		return nil, fmt.Errorf("unknown tag %v", where)
+	}
+}
+
+// checkScenarioKeys reports the unknown keys, which are most probably typos
+func checkScenarioKeys(where string, m map[string]interface{}, known ...string) error {
+	var unknown []string
+nextKey:
+	for key := range m {
+		for _, k := range known {
+			if key == k {
+				continue nextKey
+			}
+		}
+		unknown = append(unknown, key)
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%v has unknown keys %v, supported keys are %v", where, strings.Join(unknown, ", "), strings.Join(known, ", "))
+	}
+	return nil
+}
+
+func scenarioString(where string, v interface{}) (string, error) {
+	str, ok := v.(string)
+	if ok == false {
+		return "", fmt.Errorf("%v must be a string, got %T", where, v)
+	}
+	return str, nil
+}
+
+func scenarioStrings(where string, v interface{}) ([]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if ok == false {
+		return nil, fmt.Errorf("%v must be a list of strings, got %T", where, v)
+	}
+	strs := make([]string, len(list))
+	for i, element := range list {
+		str, ok := element.(string)
+		if ok == false {
+			return nil, fmt.Errorf("%v must be a list of strings, got %T", where, element)
+		}
+		strs[i] = str
+	}
+	return strs, nil
+}
+
+func scenarioNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
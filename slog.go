@@ -0,0 +1,41 @@
+//go:build go1.21
+// +build go1.21
+
+package rehapt
+
+import (
+	"context"
+	"log/slog"
+)
+
+// slogLogger logs the lifecycle events with a *slog.Logger, see SetLogger
+type slogLogger struct {
+	logger *slog.Logger
+	level  slog.Level
+}
+
+// SetLogger allow to log the lifecycle events of each testcase with log/slog: test started, variables replaced,
+// request built, response received and comparison result. The events are logged at the given level,
+// with their details as attributes like method, url, status, duration or error.
+// When no ErrorHandler is set, the errors reported by TestAssert() are logged at the error level
+// instead of being printed on stdout.
+// Setting the logger to nil disables the logging
+//
+// Example:
+//
+//	r.SetLogger(slog.New(slog.NewJSONHandler(os.Stderr, nil)), slog.LevelInfo)
+func (r *Rehapt) SetLogger(logger *slog.Logger, level slog.Level) {
+	if logger == nil {
+		r.eventLogger = nil
+		return
+	}
+	r.eventLogger = &slogLogger{logger: logger, level: level}
+}
+
+func (l *slogLogger) logEvent(message string, args ...interface{}) {
+	l.logger.Log(context.Background(), l.level, message, args...)
+}
+
+func (l *slogLogger) logFailure(message string, args ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelError, message, args...)
+}
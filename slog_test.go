@@ -0,0 +1,82 @@
+//go:build go1.21
+// +build go1.21
+
+package rehapt_test
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	. "github.com/thib-ack/rehapt"
+)
+
+func TestOKLogger(t *testing.T) {
+	server := http.NewServeMux()
+	server.HandleFunc("/api/user/1", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"id":"1"}`)
+	})
+
+	// No ErrorHandler, the reported errors are logged too
+	r := NewRehapt(nil, server)
+	var output bytes.Buffer
+	r.SetLogger(slog.New(slog.NewTextHandler(&output, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			// Remove the changing values
+			if a.Key == slog.TimeKey || a.Key == "duration" {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})), slog.LevelDebug)
+
+	r.SetVariable("id", "1")
+	r.TestAssert(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user/_id_"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"id": "1"}},
+	})
+	r.TestAssert(TestCase{
+		Request:  TestRequest{Method: "GET", Path: "/api/user/1"},
+		Response: TestResponse{Code: http.StatusOK, Body: M{"id": "2"}},
+	})
+	r.TestAssert(TestCase{
+		SkipIf:   func(r *Rehapt) (bool, string) { return true, "not ready" },
+		Request:  TestRequest{Method: "GET", Path: "/api/user/1"},
+		Response: TestResponse{Code: http.StatusOK},
+	})
+
+	expected := []string{
+		`level=DEBUG msg="test started" method=GET path=/api/user/_id_`,
+		`level=DEBUG msg="variables replaced" path=/api/user/1`,
+		`level=DEBUG msg="request built" method=GET url=/api/user/1 bodySize=0`,
+		`level=DEBUG msg="response received" status=200 bodySize=10`,
+		`level=DEBUG msg="comparison result" passed=true`,
+		`level=DEBUG msg="test started" method=GET path=/api/user/1`,
+		`level=DEBUG msg="variables replaced" path=/api/user/1`,
+		`level=DEBUG msg="request built" method=GET url=/api/user/1 bodySize=0`,
+		`level=DEBUG msg="response received" status=200 bodySize=10`,
+		`level=DEBUG msg="comparison result" passed=false mismatches=1 error="id: strings does not match. Expected '2', got '1'"`,
+		`level=DEBUG msg="test skipped" reason="not ready"`,
+	}
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	// The failure is logged with its calling stack
+	var failure string
+	for i, line := range lines {
+		if strings.HasPrefix(line, "level=ERROR") {
+			failure = line
+			lines = append(lines[:i], lines[i+1:]...)
+			break
+		}
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected events:\n%v\ngot:\n%v", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+	if strings.HasPrefix(failure, `level=ERROR msg="test failed" error="slog_test.go:`) == false ||
+		strings.HasSuffix(failure, `Error: id: strings does not match. Expected '2', got '1'"`) == false {
+		t.Errorf("Unexpected failure log %q", failure)
+	}
+}
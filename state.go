@@ -0,0 +1,116 @@
+package rehapt
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// StateChecker reads the state of a system outside of the HTTP responses, like a database,
+// so the persisted side effects of a testcase can be checked. See SQLQuery
+type StateChecker interface {
+	State(r *Rehapt) (interface{}, error)
+}
+
+// StateCheck compares the state read by the Checker with Expected, as a response body:
+// PartialM, UnsortedS or the matchers can be used, and the variables can be stored or loaded.
+// Name is used in the error messages
+type StateCheck struct {
+	Name     string
+	Checker  StateChecker
+	Expected interface{}
+}
+
+// checkStates executes the checks and returns the errors of all the failed ones
+func (r *Rehapt) checkStates(stage string, checks []StateCheck) error {
+	var errs []error
+	for i, check := range checks {
+		name := check.Name
+		if name == "" {
+			name = fmt.Sprint(i)
+		}
+		if check.Checker == nil {
+			errs = append(errs, fmt.Errorf("%v %v failed. nil state checker", stage, name))
+			continue
+		}
+		actual, err := check.Checker.State(r)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v %v failed. %v", stage, name, err))
+			continue
+		}
+		if err := r.call().compare(check.Expected, actual); err != nil {
+			errs = append(errs, fmt.Errorf("%v %v does not match. %v", stage, name, err))
+		}
+	}
+	return joinErrors(errs...)
+}
+
+// sqlChecker is the StateChecker returned by SQLQuery
+type sqlChecker struct {
+	db    *sql.DB
+	query string
+	args  []interface{}
+}
+
+// SQLQuery returns a StateChecker executing the query on the database. The state is the list of rows,
+// each row being a map of the column names to their values, with []byte values converted to string.
+// The variables of the string arguments are replaced, like "_userid_"
+//
+// Example:
+//
+//	PostCheck: []StateCheck{{
+//	    Name:     "user persisted",
+//	    Checker:  SQLQuery(db, "SELECT name, active FROM users WHERE id = ?", "_userid_"),
+//	    Expected: S{M{"name": "John", "active": true}},
+//	}},
+func SQLQuery(db *sql.DB, query string, args ...interface{}) StateChecker {
+	return sqlChecker{db: db, query: query, args: args}
+}
+
+func (c sqlChecker) State(r *Rehapt) (interface{}, error) {
+	args := make([]interface{}, len(c.args))
+	for i, arg := range c.args {
+		args[i] = arg
+		if str, ok := arg.(string); ok == true {
+			replaced, err := r.replaceVars(str)
+			if err != nil {
+				return nil, fmt.Errorf("error while replacing variables in query argument %d. %v", i, err)
+			}
+			args[i] = replaced
+		}
+	}
+
+	rows, err := c.db.Query(c.query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query failed. %v", err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("query failed. %v", err)
+	}
+
+	result := []interface{}{}
+	for rows.Next() == true {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, fmt.Errorf("cannot read row. %v", err)
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			if data, ok := values[i].([]byte); ok == true {
+				row[column] = string(data)
+			} else {
+				row[column] = values[i]
+			}
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read rows. %v", err)
+	}
+	return result, nil
+}
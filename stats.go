@@ -0,0 +1,70 @@
+package rehapt
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Stats counts what the testcases of a Rehapt instance and its forks did.
+// Comparing them between runs allow to detect the silently skipped testcases and to monitor the growth of the suites
+type Stats struct {
+	// TestCases is the number of executed testcases, the skipped ones excluded
+	TestCases int64
+	Skipped   int64
+	// Comparisons is the number of compared values, including the nested ones like the map elements
+	Comparisons     int64
+	VariablesStored int64
+	// BytesSent is the size of the request bodies, BytesReceived the size of the response bodies
+	BytesSent     int64
+	BytesReceived int64
+	// ServerTime is the time spent in the http.Handler
+	ServerTime time.Duration
+}
+
+// String formats the stats on one line
+func (s Stats) String() string {
+	return fmt.Sprintf("%d testcases executed, %d skipped, %d comparisons, %d variables stored, %d bytes sent, %d bytes received, %v server time",
+		s.TestCases, s.Skipped, s.Comparisons, s.VariablesStored, s.BytesSent, s.BytesReceived, s.ServerTime)
+}
+
+// statsCounter holds the Stats, updated atomically as the forks can run in parallel
+type statsCounter struct {
+	testCases       int64
+	skipped         int64
+	comparisons     int64
+	variablesStored int64
+	bytesSent       int64
+	bytesReceived   int64
+	serverTime      int64
+}
+
+// exchange counts an executed request and its response
+func (counter *statsCounter) exchange(sent int, received int, duration time.Duration) {
+	atomic.AddInt64(&counter.bytesSent, int64(sent))
+	atomic.AddInt64(&counter.bytesReceived, int64(received))
+	atomic.AddInt64(&counter.serverTime, int64(duration))
+}
+
+// Stats returns the counters of the testcases executed by this instance and its forks
+func (r *Rehapt) Stats() Stats {
+	return Stats{
+		TestCases:       atomic.LoadInt64(&r.stats.testCases),
+		Skipped:         atomic.LoadInt64(&r.stats.skipped),
+		Comparisons:     atomic.LoadInt64(&r.stats.comparisons),
+		VariablesStored: atomic.LoadInt64(&r.stats.variablesStored),
+		BytesSent:       atomic.LoadInt64(&r.stats.bytesSent),
+		BytesReceived:   atomic.LoadInt64(&r.stats.bytesReceived),
+		ServerTime:      time.Duration(atomic.LoadInt64(&r.stats.serverTime)),
+	}
+}
+
+// ReportStats reports the Stats using the ErrorHandler Logf() function when it exists, see ReportSummary
+//
+// Example:
+//
+//	defer r.ReportStats()
+func (r *Rehapt) ReportStats() {
+	markHelper(r.errorHandler)
+	r.logReport(r.errorHandler, "run stats", r.Stats().String())
+}
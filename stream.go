@@ -0,0 +1,260 @@
+package rehapt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StreamTestCase describes a request whose response is streamed, like a long-poll or a chunked endpoint.
+// The connection is kept open while the chunks are collected, until MaxChunks chunks are received,
+// Duration expires or the handler returns. Then the request context is cancelled
+type StreamTestCase struct {
+	Request TestRequest
+	// Response holds the expected code, protocol and headers. Its Body is ignored, see Chunks
+	Response TestResponse
+	// Chunks is the expected list of chunks, like S{M{"event": "created"}, M{"event": "deleted"}}.
+	// Each chunk is decoded by the response BodyUnmarshaler, or the default unmarshaler if nil
+	Chunks interface{}
+	// MaxChunks stops the collection once this number of chunks is received, zero means no limit
+	MaxChunks int
+	// Duration stops the collection once expired, zero means no limit
+	Duration time.Duration
+}
+
+// TestStream executes the StreamTestCase and checks the collected chunks.
+// A chunk is the data written by the handler between two calls to Flush(), so the handler
+// must implement the streaming as for a real client. Use NewRemoteHandler to test a running server.
+// Without MaxChunks and Duration, the chunks are collected until the handler returns
+//
+// Example:
+//
+//	err := r.TestStream(StreamTestCase{
+//	    Request:   TestRequest{Method: "GET", Path: "/api/events"},
+//	    Response:  TestResponse{Code: http.StatusOK},
+//	    Chunks:    S{M{"event": "created", "id": "$id$"}, M{"event": "deleted", "id": "_id_"}},
+//	    MaxChunks: 2,
+//	    Duration:  5 * time.Second,
+//	})
+func (r *Rehapt) TestStream(testcase StreamTestCase) error {
+	// The comparison state is specific to this call
+	r = r.call()
+
+	if r.httpHandler == nil {
+		return fmt.Errorf("nil HTTP handler")
+	}
+	if testcase.Request.Method == "" {
+		return fmt.Errorf("incomplete testcase. Missing HTTP method")
+	}
+	if testcase.Request.Path == "" {
+		return fmt.Errorf("incomplete testcase. Missing URL path")
+	}
+	if testcase.MaxChunks < 0 || testcase.Duration < 0 {
+		return fmt.Errorf("invalid testcase. MaxChunks and Duration cannot be negative")
+	}
+	atomic.AddInt64(&r.stats.testCases, 1)
+
+	requestTestCase, err := testcase.Request.resolveRawBody()
+	if err != nil {
+		return err
+	}
+	request, bodyData, err := r.buildRequest(requestTestCase)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+	request = request.WithContext(ctx)
+
+	recorder := newStreamRecorder()
+	started := time.Now()
+	var serveErr error
+	go func() {
+		defer recorder.finish()
+		serveErr = r.serveRecovered(recorder, request)
+	}()
+	chunks, finished := recorder.collect(testcase.MaxChunks, testcase.Duration)
+	// Let the handler know the client is gone
+	cancel()
+	r.stats.exchange(len(bodyData), recorder.size(), time.Since(started))
+	// The handler error can only be read once it returned
+	if finished == true && serveErr != nil {
+		return fmt.Errorf("%v\n%v", serveErr, dumpRequest(request, bodyData))
+	}
+
+	unmarshaler := r.unmarshaler
+	if testcase.Response.BodyUnmarshaler != nil {
+		unmarshaler = testcase.Response.BodyUnmarshaler
+	}
+	if unmarshaler == nil {
+		return fmt.Errorf("nil unmarshaler")
+	}
+	decoded := make([]interface{}, len(chunks))
+	for i, chunk := range chunks {
+		if err := unmarshaler(chunk, &decoded[i]); err != nil {
+			return fmt.Errorf("cannot unmarshal response chunk %d. %v. Chunk: %v", i, err, truncate(string(chunk), unmarshalBodyExcerptLength))
+		}
+	}
+
+	code, header := recorder.status()
+	proto, _, _ := responseProto(request, header)
+	var codeError, protoError, headersError, chunksError error
+	if err := r.compare(testcase.Response.Code, code); err != nil {
+		codeError = fmt.Errorf("response code does not match. Expected %d, got %d", testcase.Response.Code, code)
+	}
+	if testcase.Response.Proto != nil {
+		if err := r.compare(testcase.Response.Proto, proto); err != nil {
+			protoError = fmt.Errorf("response protocol does not match. Expected %v, got %v", testcase.Response.Proto, proto)
+		}
+	}
+	if testcase.Response.Headers != nil {
+		if err := r.compare(r.expectedHeaders(testcase.Response.Headers), header); err != nil {
+			headersError = fmt.Errorf("response headers does not match. %v", err)
+		}
+	}
+	if err := r.compare(testcase.Chunks, decoded); err != nil {
+		chunksError = fmt.Errorf("response chunks does not match. %v", err)
+	}
+	return joinErrors(codeError, protoError, headersError, chunksError)
+}
+
+// TestStreamAssert works exactly like TestStream except it reports the error if not nil
+// using the ErrorHandler Errorf() function
+func (r *Rehapt) TestStreamAssert(testcase StreamTestCase) {
+	if h, ok := r.errorHandler.(interface{ Helper() }); ok == true {
+		h.Helper()
+	}
+	if err := r.TestStream(testcase); err != nil {
+		r.reportError(err, 1)
+	}
+}
+
+// streamRecorder is an http.ResponseWriter keeping the flushed chunks, which can be read
+// while the handler is still running. The handler is never blocked by the reader
+type streamRecorder struct {
+	mutex       sync.Mutex
+	header      http.Header
+	code        int
+	wroteHeader bool
+	written     http.Header
+	current     bytes.Buffer
+	chunks      [][]byte
+	total       int
+	notify      chan struct{}
+	done        chan struct{}
+}
+
+func newStreamRecorder() *streamRecorder {
+	return &streamRecorder{
+		header: make(http.Header),
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+func (rec *streamRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *streamRecorder) WriteHeader(code int) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	rec.writeHeader(code)
+}
+
+// writeHeader keeps the code and a copy of the headers, the mutex must be locked
+func (rec *streamRecorder) writeHeader(code int) {
+	if rec.wroteHeader == true {
+		return
+	}
+	rec.wroteHeader = true
+	rec.code = code
+	rec.written = cloneHeader(rec.header)
+}
+
+func (rec *streamRecorder) Write(data []byte) (int, error) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	rec.writeHeader(http.StatusOK)
+	rec.total += len(data)
+	return rec.current.Write(data)
+}
+
+// Flush ends the current chunk
+func (rec *streamRecorder) Flush() {
+	rec.mutex.Lock()
+	rec.writeHeader(http.StatusOK)
+	if rec.current.Len() > 0 {
+		rec.chunks = append(rec.chunks, append([]byte(nil), rec.current.Bytes()...))
+		rec.current.Reset()
+	}
+	rec.mutex.Unlock()
+
+	select {
+	case rec.notify <- struct{}{}:
+	default:
+	}
+}
+
+// finish ends the last chunk once the handler returned
+func (rec *streamRecorder) finish() {
+	rec.Flush()
+	close(rec.done)
+}
+
+// collect waits for the chunks until maxChunks are received, the duration expires or the handler returns.
+// Zero means no limit. It returns at most maxChunks chunks, and true if the handler returned
+func (rec *streamRecorder) collect(maxChunks int, duration time.Duration) ([][]byte, bool) {
+	var expired <-chan time.Time
+	if duration > 0 {
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	finished := false
+collecting:
+	for {
+		rec.mutex.Lock()
+		count := len(rec.chunks)
+		rec.mutex.Unlock()
+		if maxChunks > 0 && count >= maxChunks {
+			break
+		}
+
+		select {
+		case <-rec.notify:
+		case <-rec.done:
+			finished = true
+			break collecting
+		case <-expired:
+			break collecting
+		}
+	}
+
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	chunks := rec.chunks
+	if maxChunks > 0 && len(chunks) > maxChunks {
+		chunks = chunks[:maxChunks]
+	}
+	return append([][]byte(nil), chunks...), finished
+}
+
+// status returns the response code and headers, the code is 0 if the handler did not respond yet
+func (rec *streamRecorder) status() (int, http.Header) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	return rec.code, cloneHeader(rec.written)
+}
+
+// size returns the number of bytes written so far
+func (rec *streamRecorder) size() int {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	return rec.total
+}
@@ -0,0 +1,483 @@
+package rehapt
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Suite is an ordered list of named steps, each one being a TestCase.
+// All the steps share the same Rehapt instance, and so the same variables,
+// which allow to describe a complete flow where each step uses the values
+// stored by the previous ones.
+// Steps are executed in order and when a step fails, the remaining ones are skipped
+// as they most probably depend on it. See SuiteStep.DependsOn to declare other dependencies.
+//
+// Example:
+//
+//	suite := r.NewSuite("checkout flow")
+//	suite.Add("login", TestCase{...})
+//	suite.Add("add to cart", TestCase{...})
+//	suite.Add("checkout", TestCase{...})
+//	suite.Run(t)
+type Suite struct {
+	name       string
+	r          *Rehapt
+	steps      []*SuiteStep
+	beforeAll  []HookFn
+	afterAll   []HookFn
+	beforeEach []HookFn
+	afterEach  []HookFn
+	warmups    []suiteWarmup
+}
+
+// suiteWarmup is a TestCase executed several times before the steps
+type suiteWarmup struct {
+	testcase TestCase
+	n        int
+}
+
+// SuiteStep is a named TestCase within a Suite
+type SuiteStep struct {
+	Name     string
+	TestCase TestCase
+
+	// nil means the step depends on the previous one
+	dependsOn []string
+	// prepare allow to update the testcase just before its execution,
+	// for example to replace variables in parts which are not replaced by Test()
+	prepare func(r *Rehapt, testcase TestCase) (TestCase, error)
+}
+
+// DependsOn declares the steps which must succeed before this one is executed.
+// By default a step depends on the previous one, which makes the suite a simple ordered flow.
+// Declaring the dependencies explicitly allow independent branches: a failing step only skips
+// the steps depending on it (directly or not), the other ones are still executed.
+// Calling it without names makes the step independent.
+// The steps are executed in the order they were added, unless a dependency forces a step to run later
+func (step *SuiteStep) DependsOn(names ...string) *SuiteStep {
+	step.dependsOn = append([]string{}, names...)
+	return step
+}
+
+// NewSuite build a new empty Suite using this Rehapt instance to execute its steps
+func (r *Rehapt) NewSuite(name string) *Suite {
+	return &Suite{
+		name: name,
+		r:    r,
+	}
+}
+
+// Name returns the name of the suite
+func (s *Suite) Name() string {
+	return s.name
+}
+
+// Steps returns the list of steps of the suite, in order of execution
+func (s *Suite) Steps() []*SuiteStep {
+	return s.steps
+}
+
+// Add append a new step at the end of the suite.
+// The added step is returned so it can be further customized
+func (s *Suite) Add(name string, testcase TestCase) *SuiteStep {
+	step := &SuiteStep{
+		Name:     name,
+		TestCase: testcase,
+	}
+	s.steps = append(s.steps, step)
+	return step
+}
+
+// BeforeAll register a hook called once before the first step.
+// If it fails, none of the steps are executed
+func (s *Suite) BeforeAll(hook HookFn) {
+	s.beforeAll = append(s.beforeAll, hook)
+}
+
+// AfterAll register a hook called once after the last step, even if some steps failed
+func (s *Suite) AfterAll(hook HookFn) {
+	s.afterAll = append(s.afterAll, hook)
+}
+
+// BeforeEach register a hook called before each step.
+// If it fails, the step is not executed and is considered as failed
+func (s *Suite) BeforeEach(hook HookFn) {
+	s.beforeEach = append(s.beforeEach, hook)
+}
+
+// AfterEach register a hook called after each step, even if the step failed
+func (s *Suite) AfterEach(hook HookFn) {
+	s.afterEach = append(s.afterEach, hook)
+}
+
+// StepResult is the result of the execution of a suite step.
+// Err is nil if the step succeeded, and a *SkipError if it has been skipped (see IsSkipped)
+type StepResult struct {
+	Name     string
+	Err      error
+	Duration time.Duration
+}
+
+// Warmup register a TestCase executed n times before the first step, once the BeforeAll hooks are called.
+// The warm-up responses are not checked, which makes it useful for the endpoints depending
+// on a cache or for example to populate a connection pool. The hooks of the testcase are not called
+func (s *Suite) Warmup(testcase TestCase, n int) {
+	s.warmups = append(s.warmups, suiteWarmup{testcase: testcase, n: n})
+}
+
+// Test executes all the steps in order. When a step fails, the steps depending on it are not executed.
+// The returned error describes which steps failed and why
+func (s *Suite) Test() error {
+	results, err := s.Execute()
+	var errs []error
+	for _, result := range results {
+		if result.Err != nil && IsSkipped(result.Err) == false {
+			errs = append(errs, fmt.Errorf("step %v failed. %v", result.Name, result.Err))
+		}
+	}
+	return joinErrors(append(errs, err)...)
+}
+
+// Execute works like Test, except it returns the result of each step, in execution order.
+// It is meant to build custom reports. The returned error is about the suite itself,
+// like an invalid dependency, a failing BeforeAll or AfterAll hook or a failed cleanup, not about its steps
+func (s *Suite) Execute() (results []StepResult, err error) {
+	steps, dependencies, err := s.plan()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.runHooks(s.r, "before all", s.beforeAll); err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = joinErrors(err, s.runHooks(s.r, "after all", s.afterAll), s.cleanup())
+	}()
+	s.runWarmups(s.r)
+
+	failed := make(map[*SuiteStep]bool)
+	abort := &suiteAbort{}
+	for _, step := range steps {
+		if blocking := failedDependency(step, dependencies, failed); blocking != nil {
+			failed[step] = true
+			reason := fmt.Sprintf("skipped because step %v failed", blocking.Name)
+			results = append(results, StepResult{Name: step.Name, Err: &SkipError{Reason: reason}})
+			continue
+		}
+		if reason := abort.reason(); reason != "" {
+			results = append(results, StepResult{Name: step.Name, Err: &SkipError{Reason: reason}})
+			continue
+		}
+		started := time.Now()
+		err := s.runStep(s.r, step)
+		if err != nil && IsSkipped(err) == false {
+			failed[step] = true
+			abort.stepFailed(s.r, step)
+		}
+		results = append(results, StepResult{Name: step.Name, Err: err, Duration: time.Since(started)})
+	}
+	return results, nil
+}
+
+// Run executes all the steps in order, each one as a subtest of a subtest named after the suite.
+// This allow to filter the steps using the -run flag and to see the result of each step with -v.
+// When a step fails, the steps depending on it are skipped.
+// Once the AfterAll hooks are called, the resources tracked by StoreResource are deleted, see Rehapt.Cleanup.
+// The RunSummary of the steps is logged at the end, listing the failing steps.
+// It returns true if all the steps succeeded
+func (s *Suite) Run(t *testing.T) bool {
+	markHelper(t)
+	return t.Run(s.name, func(t *testing.T) {
+		steps, dependencies, err := s.plan()
+		if err != nil {
+			t.Errorf("\nError: %v", err)
+			return
+		}
+
+		if err := s.runHooks(s.r, "before all", s.beforeAll); err != nil {
+			t.Errorf("\nError: %v", err)
+			return
+		}
+		defer func() {
+			if err := s.runHooks(s.r, "after all", s.afterAll); err != nil {
+				t.Errorf("\nError: %v", err)
+			}
+			if err := s.cleanup(); err != nil {
+				t.Errorf("\nError: %v", err)
+			}
+		}()
+		s.runWarmups(s.r)
+
+		summary := &summaryRecorder{parent: s.r.summary}
+		s.runSubtests(t, s.r, steps, dependencies, &suiteAbort{}, summary)
+		s.r.logReport(t, "run summary", summary.get().String())
+	})
+}
+
+// RunParallel works like Run, except the independent branches of the suite are executed in parallel.
+// A branch is a group of steps linked by their dependencies, see SuiteStep.DependsOn.
+// Each branch runs as a parallel subtest named after its first step, using its own fork
+// of the Rehapt instance: the variables stored in a branch are not visible by the other branches.
+// The BeforeAll hooks are called before forking, so the variables they define are visible by all the branches.
+// It returns true if all the steps succeeded
+func (s *Suite) RunParallel(t *testing.T) bool {
+	markHelper(t)
+	afterAll := false
+	summary := &summaryRecorder{parent: s.r.summary}
+	ok := t.Run(s.name, func(t *testing.T) {
+		steps, dependencies, err := s.plan()
+		if err != nil {
+			t.Errorf("\nError: %v", err)
+			return
+		}
+
+		if err := s.runHooks(s.r, "before all", s.beforeAll); err != nil {
+			t.Errorf("\nError: %v", err)
+			return
+		}
+		// The parallel subtests only start once this function returns,
+		// so the after all hooks are called once t.Run() returns
+		afterAll = true
+		s.runWarmups(s.r)
+
+		abort := &suiteAbort{}
+		for _, branch := range branches(steps, dependencies) {
+			branch := branch
+			r := s.r.Fork()
+			t.Run(branch[0].Name, func(t *testing.T) {
+				t.Parallel()
+				s.runSubtests(t, r, branch, dependencies, abort, summary)
+			})
+		}
+	})
+
+	if afterAll == true {
+		if err := s.runHooks(s.r, "after all", s.afterAll); err != nil {
+			t.Errorf("\nError: %v", err)
+			ok = false
+		}
+		if err := s.cleanup(); err != nil {
+			t.Errorf("\nError: %v", err)
+			ok = false
+		}
+		s.r.logReport(t, "run summary", summary.get().String())
+	}
+	return ok
+}
+
+// runSubtests executes the steps in order, each one as a subtest.
+// When a step fails, the steps depending on it are skipped, or all the steps in fail fast mode.
+// The result of each step is recorded in the summary
+func (s *Suite) runSubtests(t *testing.T, r *Rehapt, steps []*SuiteStep, dependencies map[*SuiteStep][]*SuiteStep, abort *suiteAbort, summary *summaryRecorder) {
+	failed := make(map[*SuiteStep]bool)
+	for _, step := range steps {
+		step := step
+		t.Run(step.Name, func(t *testing.T) {
+			if blocking := failedDependency(step, dependencies, failed); blocking != nil {
+				failed[step] = true
+				reason := fmt.Sprintf("skipped because step %v failed", blocking.Name)
+				summary.add(t.Name(), &SkipError{Reason: reason})
+				t.Skip(reason)
+				return
+			}
+			if reason := abort.reason(); reason != "" {
+				summary.add(t.Name(), &SkipError{Reason: reason})
+				t.Skip(reason)
+				return
+			}
+			err := s.runStep(r, step)
+			summary.add(t.Name(), err)
+			if err != nil {
+				if IsSkipped(err) == true {
+					t.Skip(err.(*SkipError).Reason)
+					return
+				}
+				failed[step] = true
+				abort.stepFailed(r, step)
+				t.Errorf("\n%v %v", r.colorLabel("Error:"), r.errorMessage(err))
+			}
+		})
+	}
+}
+
+// suiteAbort remembers the first failing step of a suite in fail fast mode, see Rehapt.SetFailFast.
+// It is shared by the parallel branches
+type suiteAbort struct {
+	mutex  sync.Mutex
+	failed *SuiteStep
+}
+
+// stepFailed aborts the suite if the fail fast mode is enabled
+func (abort *suiteAbort) stepFailed(r *Rehapt, step *SuiteStep) {
+	if r.failFast == false {
+		return
+	}
+	abort.mutex.Lock()
+	defer abort.mutex.Unlock()
+	if abort.failed == nil {
+		abort.failed = step
+	}
+}
+
+// reason returns why the remaining steps are skipped, or an empty string if the suite is not aborted
+func (abort *suiteAbort) reason() string {
+	abort.mutex.Lock()
+	defer abort.mutex.Unlock()
+	if abort.failed == nil {
+		return ""
+	}
+	return fmt.Sprintf("skipped because step %v failed and fail fast is enabled", abort.failed.Name)
+}
+
+// plan resolves the dependencies of each step and returns the steps in execution order.
+// The order is the insertion order, except when a step has to wait for its dependencies
+func (s *Suite) plan() ([]*SuiteStep, map[*SuiteStep][]*SuiteStep, error) {
+	byName := make(map[string]*SuiteStep, len(s.steps))
+	for _, step := range s.steps {
+		if _, exists := byName[step.Name]; exists == true {
+			return nil, nil, fmt.Errorf("duplicated step name %v", step.Name)
+		}
+		byName[step.Name] = step
+	}
+
+	dependencies := make(map[*SuiteStep][]*SuiteStep, len(s.steps))
+	for i, step := range s.steps {
+		if step.dependsOn == nil {
+			// Implicit dependency on the previous step
+			if i > 0 {
+				dependencies[step] = []*SuiteStep{s.steps[i-1]}
+			}
+			continue
+		}
+		for _, name := range step.dependsOn {
+			dependency, ok := byName[name]
+			if ok == false {
+				return nil, nil, fmt.Errorf("step %v depends on unknown step %v", step.Name, name)
+			}
+			dependencies[step] = append(dependencies[step], dependency)
+		}
+	}
+
+	// Simple topological sort which keeps the insertion order as much as possible.
+	// At each round, take the first remaining step having all its dependencies planned
+	ordered := make([]*SuiteStep, 0, len(s.steps))
+	planned := make(map[*SuiteStep]bool, len(s.steps))
+	remaining := append([]*SuiteStep{}, s.steps...)
+	for len(remaining) > 0 {
+		next := -1
+	nextStep:
+		for i, step := range remaining {
+			for _, dependency := range dependencies[step] {
+				if planned[dependency] == false {
+					continue nextStep
+				}
+			}
+			next = i
+			break
+		}
+		if next == -1 {
+			var names []string
+			for _, step := range remaining {
+				names = append(names, step.Name)
+			}
+			return nil, nil, fmt.Errorf("dependency cycle between steps %v", strings.Join(names, ", "))
+		}
+		planned[remaining[next]] = true
+		ordered = append(ordered, remaining[next])
+		remaining = append(remaining[:next], remaining[next+1:]...)
+	}
+	return ordered, dependencies, nil
+}
+
+// branches splits the ordered steps in groups of steps linked by their dependencies.
+// The steps keep their order within each branch, and the branches are ordered by their first step
+func branches(steps []*SuiteStep, dependencies map[*SuiteStep][]*SuiteStep) [][]*SuiteStep {
+	// Union-find, each step points to another step of its branch, the root identifies the branch
+	parent := make(map[*SuiteStep]*SuiteStep, len(steps))
+	root := func(step *SuiteStep) *SuiteStep {
+		for parent[step] != step {
+			step = parent[step]
+		}
+		return step
+	}
+	for _, step := range steps {
+		parent[step] = step
+	}
+	for _, step := range steps {
+		for _, dependency := range dependencies[step] {
+			parent[root(step)] = root(dependency)
+		}
+	}
+
+	var result [][]*SuiteStep
+	index := make(map[*SuiteStep]int)
+	for _, step := range steps {
+		r := root(step)
+		i, ok := index[r]
+		if ok == false {
+			i = len(result)
+			index[r] = i
+			result = append(result, nil)
+		}
+		result[i] = append(result[i], step)
+	}
+	return result
+}
+
+// failedDependency returns the first dependency of the step which failed, or nil
+func failedDependency(step *SuiteStep, dependencies map[*SuiteStep][]*SuiteStep, failed map[*SuiteStep]bool) *SuiteStep {
+	for _, dependency := range dependencies[step] {
+		if failed[dependency] == true {
+			return dependency
+		}
+	}
+	return nil
+}
+
+// runStep executes the step using the given Rehapt instance, surrounded by the BeforeEach and AfterEach hooks
+func (s *Suite) runStep(r *Rehapt, step *SuiteStep) error {
+	// A skipped step does not need its hooks
+	if err := r.checkSkip(step.TestCase); err != nil {
+		return err
+	}
+	if err := s.runHooks(r, "before each", s.beforeEach); err != nil {
+		return err
+	}
+	testcase := step.TestCase
+	if step.prepare != nil {
+		var err error
+		if testcase, err = step.prepare(r, testcase); err != nil {
+			return joinErrors(err, s.runHooks(r, "after each", s.afterEach))
+		}
+	}
+	err := r.Test(testcase)
+	return joinErrors(err, s.runHooks(r, "after each", s.afterEach))
+}
+
+// runWarmups executes the warm-up testcases, ignoring their result
+func (s *Suite) runWarmups(r *Rehapt) {
+	for _, warmup := range s.warmups {
+		r.warmup(warmup.testcase, warmup.n)
+	}
+}
+
+// cleanup deletes the resources tracked during the run, see Rehapt.Cleanup
+func (s *Suite) cleanup() error {
+	if err := s.r.Cleanup(); err != nil {
+		return fmt.Errorf("resources cleanup failed.\n%v", err)
+	}
+	return nil
+}
+
+// runHooks calls all the hooks in order and stops on the first error
+func (s *Suite) runHooks(r *Rehapt, kind string, hooks []HookFn) error {
+	for _, hook := range hooks {
+		if err := hook(r); err != nil {
+			return fmt.Errorf("%v hook failed. %v", kind, err)
+		}
+	}
+	return nil
+}
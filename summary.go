@@ -0,0 +1,108 @@
+package rehapt
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// RunSummary counts the results of the testcases executed as subtests by TestRun, TestTable and the suites
+type RunSummary struct {
+	Passed  int
+	Failed  int
+	Skipped int
+	// Failures lists the failing testcases, in execution order
+	Failures []RunFailure
+}
+
+// RunFailure is a failing testcase of a RunSummary
+type RunFailure struct {
+	// Name is the full name of the subtest, like TestUsers/get_user
+	Name string
+	// Reason is the first line of the error
+	Reason string
+}
+
+// String formats the summary as the counts followed by one line per failing testcase:
+//
+//	2 passed, 1 failed, 1 skipped
+//	FAIL TestUsers/get_user: response code does not match. Expected 200, got 404
+func (s RunSummary) String() string {
+	lines := []string{fmt.Sprintf("%d passed, %d failed, %d skipped", s.Passed, s.Failed, s.Skipped)}
+	for _, failure := range s.Failures {
+		lines = append(lines, fmt.Sprintf("FAIL %v: %v", failure.Name, failure.Reason))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// summaryRecorder records the results of the subtests. It forwards them to its parent, if any,
+// so a suite keeps its own summary while the Rehapt instance counts all the subtests
+type summaryRecorder struct {
+	mutex   sync.Mutex
+	summary RunSummary
+	parent  *summaryRecorder
+}
+
+// add records the result of a subtest. The error is a *SkipError if the subtest has been skipped
+func (rec *summaryRecorder) add(name string, err error) {
+	rec.mutex.Lock()
+	switch {
+	case err == nil:
+		rec.summary.Passed++
+	case IsSkipped(err) == true:
+		rec.summary.Skipped++
+	default:
+		rec.summary.Failed++
+		reason := strings.SplitN(err.Error(), "\n", 2)[0]
+		rec.summary.Failures = append(rec.summary.Failures, RunFailure{Name: name, Reason: reason})
+	}
+	rec.mutex.Unlock()
+
+	if rec.parent != nil {
+		rec.parent.add(name, err)
+	}
+}
+
+// get returns a copy of the summary
+func (rec *summaryRecorder) get() RunSummary {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	summary := rec.summary
+	summary.Failures = append([]RunFailure{}, rec.summary.Failures...)
+	return summary
+}
+
+// Summary returns the results of the testcases executed as subtests by TestRun, TestTable and the suites
+// of this instance and its forks
+func (r *Rehapt) Summary() RunSummary {
+	return r.summary.get()
+}
+
+// ReportSummary reports the Summary using the ErrorHandler Logf() function when it exists.
+// Call it once all the testcases are executed, so a long `go test -v` output doesn't have to be
+// scrolled to find all the failures. The suites report their own summary at the end of Run and RunParallel
+//
+// Example:
+//
+//	defer r.ReportSummary()
+//	r.TestRun(t, "get user", TestCase{...})
+//	r.TestRun(t, "delete user", TestCase{...})
+func (r *Rehapt) ReportSummary() {
+	markHelper(r.errorHandler)
+	r.logReport(r.errorHandler, "run summary", r.Summary().String())
+}
+
+// logReport writes the report using the Logf() function of the given object when it exists.
+// Otherwise it is logged as the given event, or printed on stdout
+func (r *Rehapt) logReport(handler interface{}, event string, report string) {
+	markHelper(handler)
+	if logger, ok := handler.(interface {
+		Logf(format string, args ...interface{})
+	}); ok == true {
+		logger.Logf("\n%v", report)
+	} else if r.eventLogger != nil {
+		r.eventLogger.logEvent(event, "report", report)
+	} else {
+		fmt.Printf("%v\n", report)
+	}
+}
@@ -0,0 +1,82 @@
+package rehapt
+
+import (
+	"fmt"
+	"path"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+// Row key used as subtest name by TestTable
+const tableRowNameKey = "name"
+
+// TestTable executes the template TestCase once per row, each time as a subtest.
+// The values of the row are defined as variables, so the template can use them
+// in the request path, headers and body as well as in the expected response:
+//
+//	r.TestTable(t, []map[string]interface{}{
+//	    {"name": "admin", "id": 1, "role": "admin"},
+//	    {"name": "guest", "id": 2, "role": "guest"},
+//	}, TestCase{
+//	    Request:  TestRequest{Method: "GET", Path: "/api/user/_id_"},
+//	    Response: TestResponse{Code: http.StatusOK, Body: PartialM{"role": "_role_"}},
+//	})
+//
+// The subtest is named after the "name" value of the row if it is a string, "row N" otherwise.
+// Each row uses its own Fork() of this instance, so the rows don't share their variables.
+// It returns true if all the rows succeeded
+func (r *Rehapt) TestTable(t *testing.T, rows []map[string]interface{}, template TestCase) bool {
+	markHelper(t)
+	// The subtests run in their own goroutine, so the user code calling us
+	// would not appear in their stack. Keep its location to report it
+	_, file, line, _ := runtime.Caller(1)
+
+	succeeded := true
+	for i, row := range rows {
+		row := row
+		name, ok := row[tableRowNameKey].(string)
+		if ok == false {
+			name = fmt.Sprintf("row %d", i+1)
+		}
+
+		succeeded = t.Run(name, func(t *testing.T) {
+			markHelper(t)
+			err := r.Fork().testRow(row, template)
+			r.summary.add(t.Name(), err)
+			if err != nil {
+				if IsSkipped(err) == true {
+					t.Skip(err.(*SkipError).Reason)
+					return
+				}
+				t.Errorf("\n%v:%d\n%v %v", path.Base(file), line, r.colorLabel("Error:"), r.errorMessage(err))
+			}
+		}) && succeeded
+	}
+	return succeeded
+}
+
+// testRow defines the row variables then executes the template
+func (r *Rehapt) testRow(row map[string]interface{}, template TestCase) error {
+	if err := r.checkSkip(template); err != nil {
+		return err
+	}
+
+	// Sorted to report errors consistently
+	names := make([]string, 0, len(row))
+	for name := range row {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := r.SetVariable(name, row[name]); err != nil {
+			return err
+		}
+	}
+
+	testcase, err := replaceRequestVars(r, template)
+	if err != nil {
+		return err
+	}
+	return r.Test(testcase)
+}
@@ -0,0 +1,110 @@
+package rehapt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Reserved variable name used to store the trace id of the last testcase
+const traceIDVar = "trace.id"
+
+// traceParentHeader is the W3C Trace Context request header
+const traceParentHeader = "traceparent"
+
+// TraceSpan describes the execution of a TestCase, see SetSpanExporter
+type TraceSpan struct {
+	// TraceID and SpanID are hex encoded, as in the traceparent header
+	TraceID string
+	SpanID  string
+	// Name is "METHOD path"
+	Name   string
+	Method string
+	// Path is the request path once its variables have been replaced
+	Path string
+	// Status is the response code, or 0 if the request was not executed
+	Status     int
+	Start      time.Time
+	End        time.Time
+	Passed     bool
+	Mismatches int
+	// Err is the error returned by Test(), nil if it passed
+	Err error
+}
+
+// SpanExporter receives a TraceSpan for each executed TestCase. It is the place to create
+// an OpenTelemetry span from the TraceSpan, using the exporter of your tracing backend.
+// It must support concurrent calls when the testcases run in parallel
+type SpanExporter interface {
+	ExportSpan(span TraceSpan)
+}
+
+// SetTracePropagation enables the W3C Trace Context propagation: each testcase gets a new trace,
+// whose traceparent header is sent with the request, unless the testcase sets it.
+// The trace id is stored in the reserved "trace.id" variable, so a failing testcase
+// can be correlated with the server side traces. Disabled by default
+func (r *Rehapt) SetTracePropagation(enabled bool) {
+	r.tracePropagation = enabled
+}
+
+// SetSpanExporter enables the trace propagation, see SetTracePropagation, and gives a TraceSpan
+// describing each executed testcase to the exporter. The skipped testcases are not exported.
+// A nil exporter stops the export
+//
+// Example:
+//
+//	r.SetSpanExporter(otelExporter{tracer: otel.Tracer("rehapt")})
+func (r *Rehapt) SetSpanExporter(exporter SpanExporter) {
+	r.spanExporter = exporter
+}
+
+// startSpan begins the span of the testcase executed by this call instance
+func (r *Rehapt) startSpan(testcase TestCase) error {
+	traceID, err := randomHex(16)
+	if err != nil {
+		return fmt.Errorf("cannot generate trace id. %v", err)
+	}
+	spanID, err := randomHex(8)
+	if err != nil {
+		return fmt.Errorf("cannot generate span id. %v", err)
+	}
+	r.span = &TraceSpan{
+		TraceID: traceID,
+		SpanID:  spanID,
+		Method:  testcase.Request.Method,
+		Path:    fmt.Sprint(testcase.Request.Path),
+		Start:   time.Now(),
+	}
+	r.storeVar(traceIDVar, traceID)
+	return nil
+}
+
+// endSpan completes the span with the result of the testcase and exports it
+func (r *Rehapt) endSpan(err error) {
+	span := *r.span
+	span.Name = span.Method + " " + span.Path
+	span.End = time.Now()
+	span.Passed = err == nil
+	span.Err = err
+	if mismatchErr, ok := err.(*MismatchError); ok == true {
+		span.Mismatches = len(mismatchErr.Mismatches)
+	}
+	if r.spanExporter != nil {
+		r.spanExporter.ExportSpan(span)
+	}
+}
+
+// traceParent returns the traceparent header value of the span, sampled
+func (span *TraceSpan) traceParent() string {
+	return "00-" + span.TraceID + "-" + span.SpanID + "-01"
+}
+
+// randomHex returns n random bytes hex encoded
+func randomHex(n int) (string, error) {
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
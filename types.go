@@ -11,28 +11,112 @@ type ErrorHandler interface {
 	Errorf(format string, args ...interface{})
 }
 
+// Tester is the interface implemented by *Rehapt to execute the testcases.
+// Helper packages can accept it instead of *Rehapt, so a suite can give them
+// a mock or an instrumented implementation, for example embedding *Rehapt
+// to record the executed testcases
+type Tester interface {
+	Test(testcase TestCase) error
+	TestAssert(testcase TestCase)
+	GetVariable(name string) interface{}
+	GetVariableString(name string) string
+	SetVariable(name string, value interface{}) error
+}
+
+var _ Tester = (*Rehapt)(nil)
+
 // TestCase is the base type supported to describe a test.
 // It is the object taken as parameters in Test() and TestAssert()
 type TestCase struct {
 	Request  TestRequest
 	Response TestResponse
+	// Tags allow to classify the testcase, for example "smoke" or "slow".
+	// They are used to run only a subset of testcases, see Rehapt.SetTagFilter
+	Tags []string
+	// SkipIf allow to skip the testcase, for example depending on a feature flag
+	// or on a value stored by a previous testcase. See SkipUnlessVar
+	SkipIf SkipFn
+	// OnlyIf allow to execute the testcase only when the condition is met, for example
+	// depending on a value stored by a previous testcase. Otherwise it is skipped. See VarEquals
+	OnlyIf ConditionFn
+	// Before is called before executing the request, for example to seed some data.
+	// If it returns an error, the request is not executed
+	Before HookFn
+	// After is called once the response has been checked, even if it did not match.
+	// It is the right place to cleanup what the testcase created
+	After HookFn
+	// PreCheck checks the state before executing the request, like the content of a database.
+	// If a check fails, the request is not executed. See StateCheck
+	PreCheck []StateCheck
+	// PostCheck checks the state once the response has been checked, even if it did not match,
+	// for example to assert the persisted side effects. See StateCheck
+	PostCheck []StateCheck
+	// Events expects messages to be published while handling the request, for example to a message
+	// queue. They are checked once the response has been checked, even if it did not match. See EventCheck
+	Events []EventCheck
+	// Outbound checks the calls made by the application while handling the request,
+	// see Rehapt.CaptureOutbound. They are checked once the response has been checked
+	Outbound []OutboundCheck
+	// Debug logs the request and response bodies of this testcase, see Rehapt.SetDebugBodies
+	Debug bool
 }
 
-// TestRequest describe the request to be executed
+// TestRequest describe the request to be executed.
+// The Body is encoded by the BodyMarshaler, or the default marshaler if nil.
+// A RawBody, string or []byte, is sent as is: it cannot be set together with Body or BodyMarshaler
 type TestRequest struct {
 	Method        string
 	Path          interface{}
 	Headers       H
 	Body          interface{}
 	BodyMarshaler MarshalFn
+	RawBody       interface{}
+	// BodyFile is the file holding the request body, like "testdata/order.json", relative to the test package.
+	// Its content is sent as is, once the variables are replaced, with the Content-Type of its extension
+	// unless the testcase headers define it. It cannot be set together with Body, RawBody or BodyMarshaler
+	BodyFile string
+	// Cookies are sent in the Cookie header, after the cookies of the headers if any.
+	// The variables are replaced in their values, like "_session_"
+	Cookies map[string]string
+	// BasicAuth sets the Authorization header, overriding the default credentials, see Rehapt.SetDefaultBasicAuth
+	BasicAuth *BasicAuth
+	// BearerToken sets the Authorization header, overriding the default credentials, see Rehapt.SetDefaultBearerToken.
+	// The variables are replaced, like "_token_". It cannot be set together with BasicAuth
+	BearerToken string
 }
 
-// TestResponse describe the response expected
+// BasicAuth describes the credentials of the HTTP Basic authentication.
+// The variables are replaced in the User and the Password, like "_password_"
+type BasicAuth struct {
+	User     string
+	Password string
+}
+
+// TestResponse describe the response expected.
+// The actual body is decoded by the BodyUnmarshaler, or the default unmarshaler if nil, then compared with Body.
+// RawBody is compared with the actual body as a string, without decoding it: it cannot be set
+// together with Body or BodyUnmarshaler
 type TestResponse struct {
 	Headers         interface{}
 	Code            interface{}
 	Body            interface{}
 	BodyUnmarshaler UnmarshalFn
+	RawBody         interface{}
+	// Golden is the path of a file holding the expected body, decoded using the body unmarshaler.
+	// When set, Body is optional and overrides the golden values, for example to use
+	// matchers for the volatile fields. See Rehapt.SetUpdateGolden to write the file
+	Golden string
+	// NoShortcuts disables the "$store$" and "_load_" shortcuts in the expected strings of the headers
+	// and the body, so they are compared literally. See Literal() to disable them for a single value
+	NoShortcuts bool
+	// Cookies are the expected cookies set by the response, by name, like M{"session": "$session$"}.
+	// A string is the expected cookie value, a map lists the expected http.Cookie fields among
+	// Name, Value, Path, Domain, Expires, MaxAge, HttpOnly and Secure, like M{"Value": Any(), "HttpOnly": true}.
+	// Only the listed cookies and fields are checked, unless they are an ExactM
+	Cookies interface{}
+	// Proto is the expected protocol of the response, like "HTTP/2.0". An in-process handler always
+	// responds with the request protocol, "HTTP/1.1". See NewRemoteHandler for the negotiated protocol
+	Proto interface{}
 }
 
 // H declare a Headers map.
@@ -47,6 +131,20 @@ type M map[string]interface{}
 // It is used to expect some fields but ignore the un-listed ones instead of reporting missing
 type PartialM map[string]interface{}
 
+// ExactM declare an Exact Map.
+// It is used to expect exactly the listed fields, even if the default map mode is MapModePartial
+type ExactM map[string]interface{}
+
+// MapMode defines how the maps which are neither PartialM nor ExactM are compared, see Rehapt.SetDefaultMapMode
+type MapMode int
+
+const (
+	// MapModeExhaustive compares the maps like ExactM: the actual map must not have other keys
+	MapModeExhaustive MapMode = iota
+	// MapModePartial compares the maps like PartialM: the other keys of the actual map are ignored
+	MapModePartial
+)
+
 // S declare a Slice.
 // It is used to quickly build a slice within your expected response body
 type S []interface{}
@@ -55,10 +153,60 @@ type S []interface{}
 // It allows to expect a list of element but without the constraint of order matching
 type UnsortedS []interface{}
 
+// SortedS declare a Sorted Slice.
+// It is used to expect the elements in order, even if the default slice ordering is SliceUnordered
+type SortedS []interface{}
+
+// SliceOrdering defines how the slices which are neither UnsortedS nor SortedS are compared,
+// see Rehapt.SetDefaultSliceOrdering
+type SliceOrdering int
+
+const (
+	// SliceOrdered compares the slices like SortedS: the elements must be in the same order
+	SliceOrdered SliceOrdering = iota
+	// SliceUnordered compares the slices like UnsortedS: the elements can be in any order
+	SliceUnordered
+)
+
 type CompareFn func(r *Rehapt, ctx compareCtx) error
 
+// Matcher is implemented by the custom expected types, like an amount of money
+// shipped by a domain package. When an expected value implements it, Match is called
+// with the actual value, which can be nil. It returns an error describing the mismatch,
+// or nil if the actual value matches
+type Matcher interface {
+	Match(r *Rehapt, actual interface{}) error
+}
+
 type ReplaceFn func(r *Rehapt) (string, error)
 
+// SkipFn decides if a TestCase must be skipped, and returns the reason why
+type SkipFn func(r *Rehapt) (bool, string)
+
+// ConditionFn returns true if a TestCase must be executed.
+// When it returns false, it also returns the reason why
+type ConditionFn func(r *Rehapt) (bool, string)
+
+// SkipError is the error returned by Test() when the TestCase has been skipped
+// because of its SkipIf function
+type SkipError struct {
+	Reason string
+}
+
+func (e *SkipError) Error() string {
+	return fmt.Sprintf("testcase skipped. %v", e.Reason)
+}
+
+// IsSkipped returns true if the error returned by Test() means the TestCase has been skipped
+func IsSkipped(err error) bool {
+	_, ok := err.(*SkipError)
+	return ok
+}
+
+// HookFn is a function called around the execution of a TestCase or a Suite.
+// It receives the Rehapt instance so it can read or define variables
+type HookFn func(r *Rehapt) error
+
 type MarshalFn func(v interface{}) ([]byte, error)
 
 func RawMarshaler(v interface{}) ([]byte, error) {
@@ -71,6 +219,56 @@ func RawMarshaler(v interface{}) ([]byte, error) {
 	}
 }
 
+// marshalerContentType returns the Content-Type of the bodies encoded by the marshaler,
+// or an empty string if it is not known
+func marshalerContentType(marshaler MarshalFn) string {
+	switch reflect.ValueOf(marshaler).Pointer() {
+	case reflect.ValueOf(MultipartMarshaler).Pointer():
+		return "multipart/form-data; boundary=" + multipartBoundary
+	case reflect.ValueOf(FormMarshaler).Pointer():
+		return "application/x-www-form-urlencoded"
+	default:
+		return ""
+	}
+}
+
+// resolveRawBody returns the request with its RawBody converted into a Body sent using RawMarshaler
+func (request TestRequest) resolveRawBody() (TestRequest, error) {
+	if request.RawBody == nil {
+		return request, nil
+	}
+	if request.Body != nil {
+		return request, fmt.Errorf("invalid testcase. Request Body and RawBody cannot both be set")
+	}
+	if request.BodyFile != "" {
+		return request, fmt.Errorf("invalid testcase. Request RawBody and BodyFile cannot both be set")
+	}
+	if request.BodyMarshaler != nil {
+		return request, fmt.Errorf("invalid testcase. Request RawBody is sent as is, BodyMarshaler cannot be set")
+	}
+	request.Body = request.RawBody
+	request.BodyMarshaler = RawMarshaler
+	request.RawBody = nil
+	return request, nil
+}
+
+// resolveRawBody returns the response with its RawBody converted into a Body decoded using RawUnmarshaler
+func (response TestResponse) resolveRawBody() (TestResponse, error) {
+	if response.RawBody == nil {
+		return response, nil
+	}
+	if response.Body != nil {
+		return response, fmt.Errorf("invalid testcase. Response Body and RawBody cannot both be set")
+	}
+	if response.BodyUnmarshaler != nil {
+		return response, fmt.Errorf("invalid testcase. Response RawBody is compared as is, BodyUnmarshaler cannot be set")
+	}
+	response.Body = response.RawBody
+	response.BodyUnmarshaler = RawUnmarshaler
+	response.RawBody = nil
+	return response, nil
+}
+
 type UnmarshalFn func(data []byte, v interface{}) error
 
 func RawUnmarshaler(data []byte, out interface{}) error {
@@ -102,3 +300,15 @@ type comparator struct {
 	ExpectedType reflect.Type
 	Compare      func(compareCtx) error
 }
+
+// ComparatorFn compares the actual value with an expected value handled by the comparator it replaces,
+// see Rehapt.ReplaceComparator. It returns an error describing the mismatch, or nil if the values match.
+// builtin is the replaced comparator, so the values can be normalized before delegating to it
+type ComparatorFn func(expected interface{}, actual interface{}, builtin func(expected interface{}, actual interface{}) error) error
+
+// comparatorOverride is a comparator replaced by Rehapt.ReplaceComparator
+type comparatorOverride struct {
+	ExpectedKind reflect.Kind
+	ExpectedType reflect.Type
+	Compare      ComparatorFn
+}
@@ -0,0 +1,160 @@
+package rehapt
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// unsortedIndex buckets the actual elements of an unsorted slice by their literal values, so each expected
+// element is only compared with the actual elements which can match it, instead of all of them.
+// The expected maps are looked up by one of their literal fields, like "name": "John", as the actual
+// element cannot match if it has another value for this field.
+// A literal is a string without shortcut, a bool or a positive integer: for them, a successful
+// comparison means the same key. The other expected elements are compared with all the actual elements
+type unsortedIndex struct {
+	r      *Rehapt
+	actual reflect.Value
+	// The actual elements by their own key, built on first use
+	scalars map[string][]int
+	// The actual map elements by the key of one of their fields, built on first use of each field
+	fields map[string]map[string][]int
+}
+
+func newUnsortedIndex(r *Rehapt, actual reflect.Value) *unsortedIndex {
+	return &unsortedIndex{r: r, actual: actual, fields: make(map[string]map[string][]int)}
+}
+
+// candidates returns the indexes of the actual elements which can match the expected element, in increasing order.
+// It returns false if the expected element has no literal to look up, then any actual element can match
+func (index *unsortedIndex) candidates(expected interface{}) ([]int, bool) {
+	// The replaced comparators can match the literals differently
+	if len(index.r.comparatorOverrides) > 0 {
+		return nil, false
+	}
+	expected = unwrapExpected(expected)
+	if key, ok := index.r.literalKey(expected); ok == true {
+		if index.scalars == nil {
+			index.scalars = make(map[string][]int)
+			for i := 0; i < index.actual.Len(); i++ {
+				if key, ok := scalarKey(reflect.ValueOf(index.actual.Index(i).Interface())); ok == true {
+					index.scalars[key] = append(index.scalars[key], i)
+				}
+			}
+		}
+		return index.scalars[key], true
+	}
+
+	m, ok := expected.(map[string]interface{})
+	if ok == false {
+		switch typed := expected.(type) {
+		case M:
+			m = typed
+		case PartialM:
+			m = typed
+		case ExactM:
+			m = typed
+		default:
+			return nil, false
+		}
+	}
+	// The most selective field gives the fewest candidates
+	var best []int
+	found := false
+	for field, value := range m {
+		key, ok := index.r.literalKey(unwrapExpected(value))
+		if ok == false {
+			continue
+		}
+		bucket := index.field(field)[key]
+		if found == false || len(bucket) < len(best) {
+			best = bucket
+			found = true
+		}
+	}
+	return best, found
+}
+
+// field returns the actual map elements by the key of the given field
+func (index *unsortedIndex) field(name string) map[string][]int {
+	buckets, ok := index.fields[name]
+	if ok == true {
+		return buckets
+	}
+	buckets = make(map[string][]int)
+	key := reflect.ValueOf(name)
+	for i := 0; i < index.actual.Len(); i++ {
+		// The map comparators only accept the actual maps with the same key type
+		element := reflect.ValueOf(index.actual.Index(i).Interface())
+		if element.Kind() != reflect.Map || element.Type().Key() != key.Type() {
+			continue
+		}
+		value := element.MapIndex(key)
+		if value.IsValid() == false {
+			continue
+		}
+		if valueKey, ok := scalarKey(reflect.ValueOf(value.Interface())); ok == true {
+			buckets[valueKey] = append(buckets[valueKey], i)
+		}
+	}
+	index.fields[name] = buckets
+	return buckets
+}
+
+// literalKey returns the key of an expected literal, which is the key of any actual value it matches
+func (r *Rehapt) literalKey(expected interface{}) (string, bool) {
+	if _, ok := expected.(Matcher); ok == true {
+		return "", false
+	}
+	v := reflect.ValueOf(expected)
+	switch v.Kind() {
+	case reflect.String:
+		if r.noShortcuts == false {
+			str := v.String()
+			if r.patterns.storeName(r.variableStoreRegexp, str) != "" || r.patterns.loadMatches(r.variableLoadRegexp, str) != nil {
+				return "", false
+			}
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		// A negative integer also matches a huge unsigned integer
+		if v.Int() < 0 {
+			return "", false
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() > math.MaxInt64 {
+			return "", false
+		}
+	case reflect.Bool:
+	default:
+		// The floats are truncated when compared with the integers
+		return "", false
+	}
+	return scalarKey(v)
+}
+
+// scalarKey returns a key identifying a string, bool or number value.
+// The numbers of any type have the same key when they have the same value
+func scalarKey(v reflect.Value) (string, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return "s" + v.String(), true
+	case reflect.Bool:
+		return "b" + strconv.FormatBool(v.Bool()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return numberKey(float64(v.Int())), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return numberKey(float64(v.Uint())), true
+	case reflect.Float32, reflect.Float64:
+		return numberKey(v.Float()), true
+	default:
+		return "", false
+	}
+}
+
+func numberKey(f float64) string {
+	// -0 is equal to 0
+	if f == 0 {
+		f = 0
+	}
+	return "n" + strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,277 @@
+package rehapt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"unicode/utf8"
+)
+
+// VCRMode defines if a VCR records the outgoing calls or replays them
+type VCRMode int
+
+const (
+	// VCRRecordOnce records the calls if the cassette file does not exist yet, and replays them otherwise.
+	// This is the default mode
+	VCRRecordOnce VCRMode = iota
+	// VCRReplay only replays the recorded calls. A call not found in the cassette fails
+	VCRReplay
+	// VCRRecord always executes and records the calls, the cassette file is overwritten
+	VCRRecord
+)
+
+// VCR is an http.RoundTripper recording the outgoing HTTP calls in a cassette file
+// and replaying them on the next runs.
+// Give it to the HTTP client used by your application to call third-party APIs,
+// and your tests will no longer depend on them.
+//
+// Example:
+//
+//	vcr, err := rehapt.NewVCR("testdata/payment.cassette.json", http.DefaultTransport)
+//	defer vcr.Stop()
+//	app := NewApp(&http.Client{Transport: vcr})
+//	r := rehapt.NewRehapt(t, app)
+type VCR struct {
+	mu       sync.Mutex
+	filename string
+	next     http.RoundTripper
+	mode     VCRMode
+	matcher  func(req *http.Request, body []byte, recorded VCRRequest) bool
+	cassette Cassette
+	used     []bool
+}
+
+// Cassette is the content of a cassette file: the recorded calls, in order
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is a recorded call, a request and its response
+type Interaction struct {
+	Request  VCRRequest  `json:"request"`
+	Response VCRResponse `json:"response"`
+}
+
+// VCRRequest is a recorded request
+type VCRRequest struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Headers    http.Header `json:"headers,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 string      `json:"bodyBase64,omitempty"`
+}
+
+// VCRResponse is a recorded response
+type VCRResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Headers    http.Header `json:"headers,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 string      `json:"bodyBase64,omitempty"`
+}
+
+// NewVCR build a new VCR using the given cassette file.
+// `next` is the http.RoundTripper used to execute the calls when recording,
+// if nil http.DefaultTransport is used.
+// If the cassette file exists, it is loaded and its calls are replayed.
+// Call Stop() at the end of the test to save the recorded calls
+func NewVCR(filename string, next http.RoundTripper) (*VCR, error) {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	v := &VCR{
+		filename: filename,
+		next:     next,
+		mode:     VCRRecordOnce,
+		matcher:  defaultVCRMatcher,
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) == false {
+			return nil, err
+		}
+		// No cassette yet, we will record it
+		v.mode = VCRRecord
+		return v, nil
+	}
+	if err := json.Unmarshal(data, &v.cassette); err != nil {
+		return nil, fmt.Errorf("invalid cassette %v. %v", filename, err)
+	}
+	v.used = make([]bool, len(v.cassette.Interactions))
+	return v, nil
+}
+
+// SetMode changes the VCR mode. See VCRMode
+func (v *VCR) SetMode(mode VCRMode) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if mode == VCRRecord {
+		v.cassette = Cassette{}
+		v.used = nil
+	}
+	v.mode = mode
+}
+
+// SetMatcher changes the function used to find the recorded call matching a request.
+// By default the method, URL and body must be equal
+func (v *VCR) SetMatcher(matcher func(req *http.Request, body []byte, recorded VCRRequest) bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.matcher = matcher
+}
+
+// Recording returns true if the VCR is recording the calls, false if it replays them
+func (v *VCR) Recording() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.mode == VCRRecord
+}
+
+// Cassette returns a copy of the recorded calls
+func (v *VCR) Cassette() Cassette {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return Cassette{Interactions: append([]Interaction{}, v.cassette.Interactions...)}
+}
+
+// RoundTrip implements http.RoundTripper.
+// It records or replays the call depending on the mode
+func (v *VCR) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	v.mu.Lock()
+	if v.mode != VCRRecord {
+		defer v.mu.Unlock()
+		return v.replay(req, body)
+	}
+	// Don't keep the lock during the call, the application might do parallel calls
+	v.mu.Unlock()
+
+	// Execute the request with a fresh copy of the body
+	outgoing := new(http.Request)
+	*outgoing = *req
+	if req.Body != nil {
+		outgoing.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	response, err := v.next.RoundTrip(outgoing)
+	if err != nil {
+		return nil, err
+	}
+	responseBody, err := ioutil.ReadAll(response.Body)
+	_ = response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	interaction := Interaction{
+		Request: VCRRequest{
+			Method:  req.Method,
+			URL:     req.URL.String(),
+			Headers: cloneHeader(req.Header),
+		},
+		Response: VCRResponse{
+			StatusCode: response.StatusCode,
+			Headers:    cloneHeader(response.Header),
+		},
+	}
+	interaction.Request.Body, interaction.Request.BodyBase64 = encodeVCRBody(body)
+	interaction.Response.Body, interaction.Response.BodyBase64 = encodeVCRBody(responseBody)
+	v.mu.Lock()
+	v.cassette.Interactions = append(v.cassette.Interactions, interaction)
+	v.used = append(v.used, true)
+	v.mu.Unlock()
+
+	response.Body = ioutil.NopCloser(bytes.NewReader(responseBody))
+	return response, nil
+}
+
+// Stop saves the cassette file if calls have been recorded
+func (v *VCR) Stop() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.mode != VCRRecord {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(v.cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(v.filename); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(v.filename, data, 0644)
+}
+
+// replay returns the response of the first unused recorded call matching the request
+func (v *VCR) replay(req *http.Request, body []byte) (*http.Response, error) {
+	for i, interaction := range v.cassette.Interactions {
+		if v.used[i] == true || v.matcher(req, body, interaction.Request) == false {
+			continue
+		}
+		v.used[i] = true
+
+		responseBody, err := decodeVCRBody(interaction.Response.Body, interaction.Response.BodyBase64)
+		if err != nil {
+			return nil, err
+		}
+		header := cloneHeader(interaction.Response.Headers)
+		if header == nil {
+			header = make(http.Header)
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", interaction.Response.StatusCode, http.StatusText(interaction.Response.StatusCode)),
+			StatusCode:    interaction.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          ioutil.NopCloser(bytes.NewReader(responseBody)),
+			ContentLength: int64(len(responseBody)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("no recorded call found in cassette %v for %v %v", v.filename, req.Method, req.URL)
+}
+
+func defaultVCRMatcher(req *http.Request, body []byte, recorded VCRRequest) bool {
+	if req.Method != recorded.Method || req.URL.String() != recorded.URL {
+		return false
+	}
+	recordedBody, err := decodeVCRBody(recorded.Body, recorded.BodyBase64)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(body, recordedBody)
+}
+
+// encodeVCRBody keeps the text bodies readable in the cassette, and encode the binary ones in base64
+func encodeVCRBody(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return "", base64.StdEncoding.EncodeToString(body)
+}
+
+func decodeVCRBody(text string, encoded string) ([]byte, error) {
+	if encoded != "" {
+		return base64.StdEncoding.DecodeString(encoded)
+	}
+	return []byte(text), nil
+}
@@ -0,0 +1,67 @@
+package rehapt
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// SetHandlerTimeout allow to fail the testcase when the http.Handler does not return within the timeout,
+// with the stack of all the goroutines to find where the handler is blocked. Otherwise a blocked handler
+// blocks the test until the whole test binary panics after the go test -timeout (10 minutes by default).
+// The blocked handler keeps running in the background. A timeout of 0, the default, disables the watchdog
+//
+// Example:
+//
+//	r.SetHandlerTimeout(30 * time.Second)
+func (r *Rehapt) SetHandlerTimeout(timeout time.Duration) {
+	r.handlerTimeout = timeout
+}
+
+// serve executes the request with the http.Handler, watched by the handler timeout if any.
+// A panic of the handler is returned as an error with the stack of the handler,
+// so it fails the testcase instead of crashing the whole test binary
+func (r *Rehapt) serve(w http.ResponseWriter, request *http.Request) error {
+	if r.handlerTimeout <= 0 {
+		return r.serveRecovered(w, request)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.serveRecovered(w, request)
+	}()
+
+	timer := time.NewTimer(r.handlerTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("handler did not return within %v for %v %v. Goroutines:\n%s", r.handlerTimeout, request.Method, request.URL, goroutineDump())
+	}
+}
+
+// serveRecovered executes the request with the http.Handler and recovers its panic
+func (r *Rehapt) serveRecovered(w http.ResponseWriter, request *http.Request) (err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			err = fmt.Errorf("handler panicked for %v %v. %v\n%s", request.Method, request.URL, value, debug.Stack())
+		}
+	}()
+	r.httpHandler.ServeHTTP(w, request)
+	return nil
+}
+
+// goroutineDump returns the stack of all the goroutines
+func goroutineDump() []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
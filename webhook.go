@@ -0,0 +1,163 @@
+package rehapt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebhookCall is a request received by a WebhookCatcher
+type WebhookCall struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// WebhookCatcher is an HTTP server recording the requests sent by the application under test,
+// like its outbound webhooks, see Rehapt.NewWebhookCatcher
+type WebhookCatcher struct {
+	r      *Rehapt
+	server *httptest.Server
+	mutex  sync.Mutex
+	calls  []WebhookCall
+	// matched holds the indexes of the calls already matched by ExpectCall
+	matched map[int]bool
+	notify  chan struct{}
+}
+
+// NewWebhookCatcher starts a local HTTP server recording all the requests it receives,
+// and responding 200 OK. Give its URL() to the application under test as webhook endpoint,
+// then check the received calls with ExpectCall(). Close() must be called to stop the server
+//
+// Example:
+//
+//	hooks := r.NewWebhookCatcher()
+//	defer hooks.Close()
+//	r.TestAssert(TestCase{
+//	    Request:  TestRequest{Method: "POST", Path: "/api/subscriptions", Body: M{"url": hooks.URL() + "/events"}},
+//	    Response: TestResponse{Code: http.StatusCreated},
+//	})
+//	hooks.ExpectCallAssert(PartialM{"event": "subscription.created"}, 5*time.Second)
+func (r *Rehapt) NewWebhookCatcher() *WebhookCatcher {
+	catcher := &WebhookCatcher{
+		r:       r,
+		matched: make(map[int]bool),
+		notify:  make(chan struct{}, 1),
+	}
+	catcher.server = httptest.NewServer(http.HandlerFunc(catcher.record))
+	return catcher
+}
+
+// URL returns the base URL of the server, like "http://127.0.0.1:41234"
+func (h *WebhookCatcher) URL() string {
+	return h.server.URL
+}
+
+// Close stops the server
+func (h *WebhookCatcher) Close() {
+	h.server.Close()
+}
+
+// Messages returns the bodies of all the received calls, so the catcher can be used as an EventSink
+func (h *WebhookCatcher) Messages() ([][]byte, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	messages := make([][]byte, len(h.calls))
+	for i, call := range h.calls {
+		messages[i] = call.Body
+	}
+	return messages, nil
+}
+
+// Calls returns all the received calls, in order
+func (h *WebhookCatcher) Calls() []WebhookCall {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]WebhookCall(nil), h.calls...)
+}
+
+func (h *WebhookCatcher) record(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.mutex.Lock()
+	h.calls = append(h.calls, WebhookCall{Method: req.Method, Path: req.URL.RequestURI(), Header: cloneHeader(req.Header), Body: body})
+	h.mutex.Unlock()
+
+	select {
+	case h.notify <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ExpectCall waits until a received call has a body matching the expected one, or until `within` expires.
+// The body is decoded with the unmarshaler of the Rehapt instance, and compared as a response body,
+// so the variables can be stored. Each call is matched only once: expecting twice the same body
+// requires two calls
+func (h *WebhookCatcher) ExpectCall(expected interface{}, within time.Duration) error {
+	timer := time.NewTimer(within)
+	defer timer.Stop()
+	for {
+		errs, found := h.matchCall(expected)
+		if found == true {
+			return nil
+		}
+
+		select {
+		case <-h.notify:
+		case <-timer.C:
+			if len(errs) == 0 {
+				return fmt.Errorf("no new webhook call received within %v", within)
+			}
+			return fmt.Errorf("no webhook call matching within %v.\n%v", within, strings.Join(errs, "\n"))
+		}
+	}
+}
+
+// ExpectCallAssert works exactly like ExpectCall except it reports the error if not nil
+// using the ErrorHandler Errorf() function
+func (h *WebhookCatcher) ExpectCallAssert(expected interface{}, within time.Duration) {
+	if helper, ok := h.r.errorHandler.(interface{ Helper() }); ok == true {
+		helper.Helper()
+	}
+	if err := h.ExpectCall(expected, within); err != nil {
+		h.r.reportError(err, 1)
+	}
+}
+
+// matchCall marks the first unmatched call having the expected body as matched.
+// Otherwise it returns why each unmatched call does not match
+func (h *WebhookCatcher) matchCall(expected interface{}) ([]string, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	r := h.r.call()
+	var errs []string
+	for i, call := range h.calls {
+		if h.matched[i] == true {
+			continue
+		}
+		var body interface{}
+		if len(call.Body) > 0 {
+			if err := r.unmarshaler(call.Body, &body); err != nil {
+				errs = append(errs, fmt.Sprintf("call %d, %v %v: cannot unmarshal body. %v", i, call.Method, call.Path, err))
+				continue
+			}
+		}
+		if err := r.tryCompare(expected, body); err != nil {
+			errs = append(errs, fmt.Sprintf("call %d, %v %v: %v", i, call.Method, call.Path, err))
+			continue
+		}
+		h.matched[i] = true
+		return nil, true
+	}
+	return errs, false
+}
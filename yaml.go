@@ -0,0 +1,638 @@
+package rehapt
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This is a small YAML parser, supporting only the subset of YAML needed by the scenario files.
+// It allows to keep the library free of third-party dependencies.
+//
+// Supported:
+//   - block mappings and block sequences (including "- key: value" compact mappings)
+//   - flow mappings and flow sequences, like {a: 1, b: [x, y]}
+//   - plain, single-quoted and double-quoted scalars
+//   - literal (|) and folded (>) block scalars, with the "-" and "+" chomping indicators
+//   - comments and a leading "---" document marker
+//   - local tags, like `!regexp '^[0-9]+$'`
+//
+// Not supported: anchors, aliases, multiple documents, complex keys and multi-line plain scalars.
+//
+// Values are decoded as map[string]interface{}, []interface{}, string, int, float64, bool or nil.
+// A tagged value is decoded as a single key map where the key is the tag,
+// for example `!regexp '^[0-9]+$'` gives map[string]interface{}{"!regexp": "^[0-9]+$"}
+// which is also how tags are written in JSON scenario files.
+
+var (
+	yamlIntRegexp   = regexp.MustCompile(`^[-+]?[0-9]+$`)
+	yamlFloatRegexp = regexp.MustCompile(`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+)
+
+type yamlParser struct {
+	lines []string
+	pos   int
+}
+
+// parseYAML decodes a YAML document into generic values
+func parseYAML(data []byte) (interface{}, error) {
+	text := strings.Replace(string(data), "\r\n", "\n", -1)
+	p := &yamlParser{lines: strings.Split(text, "\n")}
+
+	// Skip the optional document marker
+	if p.next() == true && strings.TrimSpace(p.lines[p.pos]) == "---" {
+		p.pos++
+	}
+	if p.next() == false {
+		return nil, nil
+	}
+
+	value, err := p.parseBlock(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.next() == true {
+		return nil, p.errorf("unexpected content %q", strings.TrimSpace(p.lines[p.pos]))
+	}
+	return value, nil
+}
+
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("yaml line %d: %v", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// next moves to the next meaningful line, skipping the empty lines and comments.
+// It returns false at the end of the document
+func (p *yamlParser) next() bool {
+	for ; p.pos < len(p.lines); p.pos++ {
+		content := strings.TrimSpace(p.lines[p.pos])
+		if content != "" && strings.HasPrefix(content, "#") == false {
+			return true
+		}
+	}
+	return false
+}
+
+// indent returns the indentation of the current line
+func (p *yamlParser) indent() int {
+	line := p.lines[p.pos]
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// content returns the current line without its indentation nor its trailing comment
+func (p *yamlParser) content() string {
+	return stripYAMLComment(strings.TrimLeft(p.lines[p.pos], " "))
+}
+
+// parseBlock parses the block node starting at the current line,
+// which must be indented by at least minIndent spaces
+func (p *yamlParser) parseBlock(minIndent int) (interface{}, error) {
+	if p.next() == false || p.indent() < minIndent {
+		return nil, nil
+	}
+	if strings.HasPrefix(strings.TrimLeft(p.lines[p.pos], " "), "\t") {
+		return nil, p.errorf("tabs are not allowed for indentation")
+	}
+
+	indent := p.indent()
+	content := p.content()
+	if isYAMLSequenceEntry(content) {
+		return p.parseSequence(indent)
+	}
+	if _, _, ok := splitYAMLKey(content); ok == true {
+		return p.parseMapping(indent)
+	}
+
+	// A single scalar or flow node
+	p.pos++
+	return p.parseInline(content, indent-1)
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	sequence := []interface{}{}
+	for p.next() == true && p.indent() == indent {
+		content := p.content()
+		if isYAMLSequenceEntry(content) == false {
+			break
+		}
+
+		item := strings.TrimLeft(content[1:], " ")
+		if item == "" {
+			// The item is the block below
+			p.pos++
+			value, err := p.parseBlock(indent + 1)
+			if err != nil {
+				return nil, err
+			}
+			sequence = append(sequence, value)
+			continue
+		}
+
+		if _, _, ok := splitYAMLKey(item); ok == true && isYAMLQuoted(item) == false && strings.HasPrefix(item, "!") == false {
+			// Compact mapping "- key: value", continue as a mapping
+			// indented at the position of its first key
+			column := len(p.lines[p.pos]) - len(strings.TrimLeft(p.lines[p.pos], " ")) + len(content) - len(item)
+			p.lines[p.pos] = strings.Repeat(" ", column) + item
+			value, err := p.parseMapping(column)
+			if err != nil {
+				return nil, err
+			}
+			sequence = append(sequence, value)
+			continue
+		}
+
+		p.pos++
+		value, err := p.parseInline(item, indent)
+		if err != nil {
+			return nil, err
+		}
+		sequence = append(sequence, value)
+	}
+	return sequence, nil
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	mapping := map[string]interface{}{}
+	for p.next() == true && p.indent() == indent {
+		content := p.content()
+		if isYAMLSequenceEntry(content) == true {
+			break
+		}
+		key, rest, ok := splitYAMLKey(content)
+		if ok == false {
+			return nil, p.errorf("expected a mapping key in %q", content)
+		}
+		if _, exists := mapping[key]; exists == true {
+			return nil, p.errorf("duplicated key %v", key)
+		}
+		p.pos++
+
+		var value interface{}
+		var err error
+		if rest == "" {
+			// The value is the block below. A sequence is allowed at the same indentation
+			if p.next() == true && p.indent() == indent && isYAMLSequenceEntry(p.content()) {
+				value, err = p.parseSequence(indent)
+			} else {
+				value, err = p.parseBlock(indent + 1)
+			}
+		} else {
+			value, err = p.parseInline(rest, indent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		mapping[key] = value
+	}
+	return mapping, nil
+}
+
+// parseInline parses a value written after a key or a sequence dash.
+// parentIndent is the indentation of the line owning this value:
+// block content belonging to this value must be indented more.
+func (p *yamlParser) parseInline(text string, parentIndent int) (interface{}, error) {
+	text = strings.TrimSpace(text)
+
+	switch {
+	case strings.HasPrefix(text, "!"):
+		tag := text
+		rest := ""
+		if i := strings.IndexAny(text, " \t"); i != -1 {
+			tag, rest = text[:i], strings.TrimSpace(text[i:])
+		}
+		var value interface{}
+		var err error
+		if rest == "" {
+			value, err = p.parseBlock(parentIndent + 1)
+		} else {
+			value, err = p.parseInline(rest, parentIndent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{tag: value}, nil
+
+	case strings.HasPrefix(text, "|") || strings.HasPrefix(text, ">"):
+		return p.parseBlockScalar(text, parentIndent)
+
+	case strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{"):
+		// A flow collection might continue on the next lines.
+		// Errors are reported on the line where it starts
+		start := p.pos - 1
+		for yamlFlowDepth(text) > 0 && p.pos < len(p.lines) {
+			text += " " + strings.TrimSpace(stripYAMLComment(p.lines[p.pos]))
+			p.pos++
+		}
+		f := &yamlFlowParser{text: text}
+		value, err := f.parseValue()
+		if err == nil {
+			if f.skipSpaces(); f.pos < len(f.text) {
+				err = fmt.Errorf("unexpected %q after flow collection", f.text[f.pos:])
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("yaml line %d: %v", start+1, err)
+		}
+		return value, nil
+
+	case isYAMLQuoted(text):
+		// The line has already been consumed, p.pos is its number
+		value, rest, err := parseYAMLQuoted(text)
+		if err != nil {
+			return nil, fmt.Errorf("yaml line %d: %v", p.pos, err)
+		}
+		if strings.TrimSpace(rest) != "" {
+			return nil, fmt.Errorf("yaml line %d: unexpected %q after quoted string", p.pos, rest)
+		}
+		return value, nil
+
+	default:
+		return resolveYAMLScalar(text), nil
+	}
+}
+
+func (p *yamlParser) parseBlockScalar(header string, parentIndent int) (interface{}, error) {
+	folded := header[0] == '>'
+	chomping := strings.TrimSpace(header[1:])
+	if chomping != "" && chomping != "-" && chomping != "+" {
+		return nil, p.errorf("unsupported block scalar indicator %q", header)
+	}
+
+	// Collect the lines indented more than the parent, empty lines included
+	var lines []string
+	blockIndent := -1
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		if strings.TrimSpace(line) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if indent <= parentIndent {
+			break
+		}
+		if blockIndent == -1 {
+			blockIndent = indent
+		}
+		if indent < blockIndent {
+			break
+		}
+		lines = append(lines, line[blockIndent:])
+	}
+
+	// Trailing empty lines are handled by the chomping
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+	// Those empty lines belonged to the next node
+	p.pos -= trailing
+
+	var value string
+	if folded == true {
+		value = foldYAMLLines(lines)
+	} else {
+		value = strings.Join(lines, "\n")
+	}
+
+	switch chomping {
+	case "-":
+	case "+":
+		value += "\n" + strings.Repeat("\n", trailing)
+	default:
+		if len(lines) > 0 {
+			value += "\n"
+		}
+	}
+	return value, nil
+}
+
+// foldYAMLLines joins the lines with spaces, except around empty lines
+// and more indented lines which keep their line breaks
+func foldYAMLLines(lines []string) string {
+	var result []byte
+	for i, line := range lines {
+		if i > 0 {
+			previous := lines[i-1]
+			if line == "" || previous == "" || strings.HasPrefix(line, " ") || strings.HasPrefix(previous, " ") {
+				result = append(result, '\n')
+			} else {
+				result = append(result, ' ')
+			}
+		}
+		result = append(result, line...)
+	}
+	return string(result)
+}
+
+type yamlFlowParser struct {
+	text string
+	pos  int
+}
+
+func (f *yamlFlowParser) skipSpaces() {
+	for f.pos < len(f.text) && (f.text[f.pos] == ' ' || f.text[f.pos] == '\t') {
+		f.pos++
+	}
+}
+
+func (f *yamlFlowParser) parseValue() (interface{}, error) {
+	f.skipSpaces()
+	if f.pos >= len(f.text) {
+		return nil, fmt.Errorf("unexpected end of flow collection")
+	}
+
+	switch c := f.text[f.pos]; {
+	case c == '[':
+		f.pos++
+		sequence := []interface{}{}
+		for {
+			f.skipSpaces()
+			if f.pos < len(f.text) && f.text[f.pos] == ']' {
+				f.pos++
+				return sequence, nil
+			}
+			value, err := f.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			sequence = append(sequence, value)
+			if err := f.parseSeparator(']'); err != nil {
+				return nil, err
+			}
+		}
+
+	case c == '{':
+		f.pos++
+		mapping := map[string]interface{}{}
+		for {
+			f.skipSpaces()
+			if f.pos < len(f.text) && f.text[f.pos] == '}' {
+				f.pos++
+				return mapping, nil
+			}
+			key, err := f.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			value, err := f.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			mapping[key] = value
+			if err := f.parseSeparator('}'); err != nil {
+				return nil, err
+			}
+		}
+
+	case c == '!':
+		end := f.pos
+		for end < len(f.text) && strings.IndexByte(" \t,]}", f.text[end]) == -1 {
+			end++
+		}
+		tag := f.text[f.pos:end]
+		f.pos = end
+		f.skipSpaces()
+		var value interface{}
+		if f.pos < len(f.text) && strings.IndexByte(",]}", f.text[f.pos]) == -1 {
+			var err error
+			if value, err = f.parseValue(); err != nil {
+				return nil, err
+			}
+		}
+		return map[string]interface{}{tag: value}, nil
+
+	case c == '"' || c == '\'':
+		value, rest, err := parseYAMLQuoted(f.text[f.pos:])
+		if err != nil {
+			return nil, err
+		}
+		f.pos = len(f.text) - len(rest)
+		return value, nil
+
+	default:
+		end := f.pos
+		for end < len(f.text) && strings.IndexByte(",]}", f.text[end]) == -1 {
+			if f.text[end] == ':' && (end+1 == len(f.text) || f.text[end+1] == ' ') {
+				break
+			}
+			end++
+		}
+		value := resolveYAMLScalar(strings.TrimSpace(f.text[f.pos:end]))
+		f.pos = end
+		return value, nil
+	}
+}
+
+func (f *yamlFlowParser) parseKey() (string, error) {
+	if f.pos >= len(f.text) {
+		return "", fmt.Errorf("unexpected end of flow mapping")
+	}
+	var key string
+	if c := f.text[f.pos]; c == '"' || c == '\'' {
+		value, rest, err := parseYAMLQuoted(f.text[f.pos:])
+		if err != nil {
+			return "", err
+		}
+		key = value
+		f.pos = len(f.text) - len(rest)
+	} else {
+		end := strings.IndexByte(f.text[f.pos:], ':')
+		if end == -1 {
+			return "", fmt.Errorf("missing ':' after key in flow mapping")
+		}
+		key = strings.TrimSpace(f.text[f.pos : f.pos+end])
+		f.pos += end
+	}
+	f.skipSpaces()
+	if f.pos >= len(f.text) || f.text[f.pos] != ':' {
+		return "", fmt.Errorf("missing ':' after key %v in flow mapping", key)
+	}
+	f.pos++
+	return key, nil
+}
+
+func (f *yamlFlowParser) parseSeparator(end byte) error {
+	f.skipSpaces()
+	if f.pos >= len(f.text) {
+		return fmt.Errorf("unexpected end of flow collection, missing '%c'", end)
+	}
+	switch f.text[f.pos] {
+	case ',':
+		f.pos++
+		return nil
+	case end:
+		return nil
+	default:
+		return fmt.Errorf("unexpected '%c' in flow collection", f.text[f.pos])
+	}
+}
+
+// yamlFlowDepth returns how many flow collections are still open at the end of the text
+func yamlFlowDepth(text string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		}
+	}
+	return depth
+}
+
+// isYAMLSequenceEntry returns true if the line content is a block sequence entry
+func isYAMLSequenceEntry(content string) bool {
+	return content == "-" || strings.HasPrefix(content, "- ")
+}
+
+func isYAMLQuoted(text string) bool {
+	return strings.HasPrefix(text, `"`) || strings.HasPrefix(text, `'`)
+}
+
+// splitYAMLKey splits a "key: value" line content.
+// It returns false if the content is not a mapping entry
+func splitYAMLKey(content string) (string, string, bool) {
+	if isYAMLQuoted(content) {
+		key, rest, err := parseYAMLQuoted(content)
+		if err != nil {
+			return "", "", false
+		}
+		rest = strings.TrimLeft(rest, " ")
+		if strings.HasPrefix(rest, ":") == false || (len(rest) > 1 && rest[1] != ' ') {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(rest[1:]), true
+	}
+	if strings.HasPrefix(content, "[") || strings.HasPrefix(content, "{") {
+		return "", "", false
+	}
+
+	for i := 0; i < len(content); i++ {
+		if content[i] == ':' && (i+1 == len(content) || content[i+1] == ' ') {
+			return strings.TrimSpace(content[:i]), strings.TrimSpace(content[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// parseYAMLQuoted parses the quoted string at the beginning of the text,
+// and returns its value and the remaining text
+func parseYAMLQuoted(text string) (string, string, error) {
+	quote := text[0]
+	var value []byte
+	for i := 1; i < len(text); i++ {
+		c := text[i]
+		if quote == '\'' {
+			if c == '\'' {
+				// '' is an escaped quote
+				if i+1 < len(text) && text[i+1] == '\'' {
+					value = append(value, '\'')
+					i++
+					continue
+				}
+				return string(value), text[i+1:], nil
+			}
+			value = append(value, c)
+			continue
+		}
+
+		switch c {
+		case '"':
+			return string(value), text[i+1:], nil
+		case '\\':
+			if i+1 >= len(text) {
+				return "", "", fmt.Errorf("invalid escape at end of string")
+			}
+			i++
+			switch e := text[i]; e {
+			case 'n':
+				value = append(value, '\n')
+			case 't':
+				value = append(value, '\t')
+			case 'r':
+				value = append(value, '\r')
+			case '0':
+				value = append(value, 0)
+			case '"', '\\', '/':
+				value = append(value, e)
+			case 'u':
+				if i+4 >= len(text) {
+					return "", "", fmt.Errorf("invalid unicode escape")
+				}
+				code, err := strconv.ParseUint(text[i+1:i+5], 16, 32)
+				if err != nil {
+					return "", "", fmt.Errorf("invalid unicode escape. %v", err)
+				}
+				var buf [utf8.UTFMax]byte
+				n := utf8.EncodeRune(buf[:], rune(code))
+				value = append(value, buf[:n]...)
+				i += 4
+			default:
+				return "", "", fmt.Errorf("unsupported escape \\%c", e)
+			}
+		default:
+			value = append(value, c)
+		}
+	}
+	return "", "", fmt.Errorf("unterminated quoted string %v", text)
+}
+
+// stripYAMLComment removes the trailing comment of a line, if any.
+// A comment starts with a '#' preceded by a space, outside of quotes
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" [{,:-", line[i-1]) != -1):
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return strings.TrimRight(line[:i], " \t")
+		}
+	}
+	return strings.TrimRight(line, " \t")
+}
+
+// resolveYAMLScalar converts a plain scalar to its value: null, bool, int, float or string
+func resolveYAMLScalar(text string) interface{} {
+	switch text {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if yamlIntRegexp.MatchString(text) {
+		if i, err := strconv.Atoi(text); err == nil {
+			return i
+		}
+	}
+	if yamlFloatRegexp.MatchString(text) {
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f
+		}
+	}
+	return text
+}